@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"loadtest/internal/brokermetrics"
+	"loadtest/internal/config"
+)
+
+// BrokerMetricsStats holds the broker counters scraped during the run
+type BrokerMetricsStats struct {
+	mu      sync.Mutex
+	scrapes []brokerScrape
+	failed  int
+	lastErr string
+}
+
+// brokerScrape is one successful scrape, at is the time into the run
+type brokerScrape struct {
+	at     time.Duration
+	values map[string]float64
+}
+
+// runBrokerScraper scrapes the broker's metrics endpoint when the run
+// starts, every cfg.Interval and once more when stop is closed, then
+// closes done
+func runBrokerScraper(cfg config.MQTTBrokerMetrics, start time.Time, stats *BrokerMetricsStats, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	scraper := brokermetrics.NewScraper(cfg.URL, cfg.Metrics, min(cfg.Interval, 10*time.Second))
+	warned := false
+	scrape := func() {
+		values, err := scraper.Scrape(context.Background())
+
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+		if err != nil {
+			stats.failed++
+			stats.lastErr = err.Error()
+			if !warned {
+				fmt.Fprintf(consoleOut, "⚠️  Broker metrics: %v\n", err)
+				warned = true
+			}
+			return
+		}
+		if len(stats.scrapes) == 0 {
+			if missing := missingCounters(cfg.Metrics, values); len(missing) > 0 {
+				fmt.Fprintf(consoleOut, "⚠️  Broker metrics: %s does not expose %s\n", scraper.URL, strings.Join(missing, ", "))
+			}
+		}
+		stats.scrapes = append(stats.scrapes, brokerScrape{at: time.Since(start), values: values})
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	scrape()
+	for {
+		select {
+		case <-stop:
+			scrape()
+			return
+		case <-ticker.C:
+			scrape()
+		}
+	}
+}
+
+// missingCounters lists the names a scrape did not return
+func missingCounters(names []string, values map[string]float64) []string {
+	var missing []string
+	for _, name := range names {
+		if _, ok := values[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// counterDelta is how far a counter moved between two scrapes. A counter
+// that went backwards was reset by a broker restart and counts from zero.
+func counterDelta(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// BrokerCounter is one broker counter's movement over the run
+type BrokerCounter struct {
+	Name      string  `json:"name"`
+	Delta     float64 `json:"delta"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// BrokerMetricsReport summarizes the broker counters for the final report
+type BrokerMetricsReport struct {
+	URL       string          `json:"url"`
+	Interval  float64         `json:"interval_s"`
+	Scrapes   int             `json:"scrapes"`
+	Failed    int             `json:"failed_scrapes"`
+	LastError string          `json:"last_error,omitempty"`
+	Counters  []BrokerCounter `json:"counters"`
+	Missing   []string        `json:"missing,omitempty"` // requested counters the broker does not expose
+
+	// Client-side counts over the same run, to read the counters against
+	ClientPublishes  int64 `json:"client_publishes"`
+	ClientDeliveries int64 `json:"client_deliveries"`
+}
+
+func buildBrokerMetricsReport(cfg config.MQTTBrokerMetrics, stats *BrokerMetricsStats) *BrokerMetricsReport {
+	report := &BrokerMetricsReport{
+		URL:      brokermetrics.Endpoint(cfg.URL),
+		Interval: cfg.Interval.Seconds(),
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	report.Scrapes = len(stats.scrapes)
+	report.Failed = stats.failed
+	report.LastError = stats.lastErr
+	if len(stats.scrapes) == 0 {
+		return report
+	}
+
+	report.Missing = missingCounters(cfg.Metrics, stats.scrapes[0].values)
+	span := (stats.scrapes[len(stats.scrapes)-1].at - stats.scrapes[0].at).Seconds()
+	for _, name := range cfg.Metrics {
+		if _, ok := stats.scrapes[0].values[name]; !ok {
+			continue
+		}
+		counter := BrokerCounter{Name: name}
+		for i := 1; i < len(stats.scrapes); i++ {
+			prev, ok1 := stats.scrapes[i-1].values[name]
+			cur, ok2 := stats.scrapes[i].values[name]
+			if ok1 && ok2 {
+				counter.Delta += counterDelta(prev, cur)
+			}
+		}
+		if span > 0 {
+			counter.PerSecond = counter.Delta / span
+		}
+		report.Counters = append(report.Counters, counter)
+	}
+	return report
+}
+
+// mergeBrokerTimeline adds each scrape's counter deltas to the second of the
+// run the scrape finished in
+func mergeBrokerTimeline(timeline []TimelineSecond, stats *BrokerMetricsStats) []TimelineSecond {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	for i := 1; i < len(stats.scrapes); i++ {
+		prev, cur := stats.scrapes[i-1], stats.scrapes[i]
+		sec := int(cur.at / time.Second)
+		for len(timeline) <= sec {
+			timeline = append(timeline, TimelineSecond{Second: len(timeline)})
+		}
+		for name, v := range cur.values {
+			p, ok := prev.values[name]
+			if !ok {
+				continue
+			}
+			if timeline[sec].Broker == nil {
+				timeline[sec].Broker = make(map[string]float64)
+			}
+			timeline[sec].Broker[name] += counterDelta(p, v)
+		}
+	}
+	return timeline
+}
+
+// display prints the broker metrics section of the final report
+func (r *BrokerMetricsReport) display() {
+	fmt.Fprintln(consoleOut, "\nBroker Metrics:")
+	fmt.Fprintf(consoleOut, "  Endpoint:     %s (every %.0fs)\n", r.URL, r.Interval)
+	if r.Failed > 0 {
+		fmt.Fprintf(consoleOut, "  Scrapes:      %d (⚠️  %d failed, last: %s)\n", r.Scrapes, r.Failed, r.LastError)
+	} else {
+		fmt.Fprintf(consoleOut, "  Scrapes:      %d\n", r.Scrapes)
+	}
+	if r.Scrapes < 2 {
+		fmt.Fprintln(consoleOut, "  ⚠️  Fewer than two successful scrapes, no counter deltas")
+		return
+	}
+
+	counters := append([]BrokerCounter(nil), r.Counters...)
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Name < counters[j].Name })
+	for _, c := range counters {
+		fmt.Fprintf(consoleOut, "  %-28s %-12.0f %.1f/s\n", c.Name, c.Delta, c.PerSecond)
+	}
+	if len(r.Missing) > 0 {
+		fmt.Fprintf(consoleOut, "  Not exposed:  %s\n", strings.Join(r.Missing, ", "))
+	}
+	fmt.Fprintf(consoleOut, "  Client side:  %d publishes, %d deliveries\n", r.ClientPublishes, r.ClientDeliveries)
+}
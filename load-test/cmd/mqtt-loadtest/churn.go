@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// Reconnect phases separating steady churn from a thundering herd
+const (
+	phaseChurn = "churn"
+	phaseStorm = "storm"
+)
+
+// reconnectRequest asks a publisher to drop its connection and reconnect,
+// take over its own client ID, die without DISCONNECT or join a capacity
+// step. It is handled on the publishing goroutine so it never races a
+// publish.
+type reconnectRequest struct {
+	phase    string
+	backoff  config.MQTTBackoff
+	inflight int             // QoS 1 messages in flight at a takeover
+	joined   *sync.WaitGroup // done once a join has connected or given up
+}
+
+// backoffDelay returns the wait before reconnect attempt n (1-based)
+func backoffDelay(b config.MQTTBackoff, attempt int) time.Duration {
+	exp := b.Initial
+	for i := 1; i < attempt && exp < b.Max; i++ {
+		exp *= 2
+	}
+	if exp > b.Max {
+		exp = b.Max
+	}
+
+	switch b.Policy {
+	case config.BackoffImmediate:
+		if attempt == 1 {
+			return 0
+		}
+		return b.Initial
+	case config.BackoffFixed:
+		return b.Initial
+	case config.BackoffJitter:
+		return time.Duration(mathrand.Int63n(int64(exp) + 1))
+	default:
+		return exp
+	}
+}
+
+// ChurnStats tracks disconnects and reconnects caused by churn and herds
+type ChurnStats struct {
+	Disconnects    int64
+	Reconnects     int64
+	FailedAttempts int64
+	StormFailed    int64 // failed attempts during the herd
+
+	ChurnLatency  LatencyRecorder // successful reconnect attempts, steady churn
+	StormLatency  LatencyRecorder // successful reconnect attempts during the herd
+	StormRecovery LatencyRecorder // drop to connected, including backoff
+	stormPending  int64
+	mu            sync.Mutex
+	stormStart    time.Time
+	stormDuration time.Duration
+	stormClients  int
+}
+
+// startStorm marks the beginning of a thundering herd of n clients
+func (s *ChurnStats) startStorm(n int) {
+	s.mu.Lock()
+	s.stormStart = time.Now()
+	s.stormClients = n
+	s.mu.Unlock()
+	atomic.StoreInt64(&s.stormPending, int64(n))
+}
+
+// stormClientDone records one herd client back online (or given up)
+func (s *ChurnStats) stormClientDone() {
+	if atomic.AddInt64(&s.stormPending, -1) == 0 {
+		s.mu.Lock()
+		s.stormDuration = time.Since(s.stormStart)
+		s.mu.Unlock()
+	}
+}
+
+// handleRequest runs a connection control request on the publishing
+// goroutine
+func (c *MQTTLoadClient) handleRequest(req reconnectRequest) {
+	switch req.phase {
+	case phaseTakeover:
+		c.handleTakeover(req.inflight)
+	case phaseKill:
+		c.handleKill()
+	case phaseJoin:
+		c.handleJoin(req.joined)
+	default:
+		c.handleReconnect(req)
+	}
+}
+
+// handleReconnect drops the session and reconnects following the request's
+// backoff policy until it succeeds, the credentials are refused or the run
+// ends. A herd has already dropped the connection.
+func (c *MQTTLoadClient) handleReconnect(req reconnectRequest) {
+	churn := &c.Stats.Churn
+	if req.phase == phaseStorm {
+		defer churn.stormClientDone()
+		// A churn request handled first may have reconnected already
+		if sessionOpen(c.session) {
+			return
+		}
+		c.setSession(nil)
+	}
+
+	if c.session != nil {
+		c.Disconnect()
+		c.setSession(nil)
+		atomic.AddInt64(&churn.Disconnects, 1)
+	}
+
+	dropped := time.Now()
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.Done:
+			return
+		case <-time.After(backoffDelay(req.backoff, attempt)):
+		}
+
+		session, timing, err := connectSession(c.Config, c.ClientID)
+		c.sample(opReconnect, timing.Total, err, 0)
+		if err != nil {
+			c.recordConnectFailure()
+			atomic.AddInt64(&churn.FailedAttempts, 1)
+			if req.phase == phaseStorm {
+				atomic.AddInt64(&churn.StormFailed, 1)
+			}
+			if isAuthFailure(err) {
+				c.Stats.AuthFailures.Record(c.credentialLabel())
+				c.Stats.recordErr("auth", c.ClientID, err)
+				return
+			}
+			continue
+		}
+
+		atomic.AddInt64(&c.Stats.ConnectionsTotal, 1)
+		atomic.AddInt64(&c.Stats.ConnectionsSuccess, 1)
+		atomic.AddInt64(&c.Stats.ActiveClients, 1)
+		atomic.AddInt64(&churn.Reconnects, 1)
+		if req.phase == phaseStorm {
+			churn.StormLatency.Record(timing.Total)
+			churn.StormRecovery.Record(time.Since(dropped))
+		} else {
+			churn.ChurnLatency.Record(timing.Total)
+		}
+		c.setSession(session)
+		return
+	}
+}
+
+// dropForHerd closes the client's connection without DISCONNECT, as a
+// network failure would, and reports whether it had one. The publishing
+// goroutine may be mid-publish, so the session is read under c.mu.
+func (c *MQTTLoadClient) dropForHerd() bool {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if !sessionOpen(session) {
+		return false
+	}
+	// The broker publishes the will of a dropped connection
+	if c.Config.Will != nil {
+		c.Stats.Wills.recordKill(c.Config.Will.Topic)
+	}
+	session.Abort()
+	atomic.AddInt64(&c.Stats.ActiveClients, -1)
+	atomic.AddInt64(&c.Stats.Churn.Disconnects, 1)
+	return true
+}
+
+// sessionOpen reports whether session is connected and hasn't been aborted.
+// paho only notices an aborted connection later, so IsConnected alone
+// isn't enough.
+func sessionOpen(session mqttSession) bool {
+	if session == nil || !session.IsConnected() {
+		return false
+	}
+	select {
+	case <-session.Closed():
+		return false
+	default:
+		return true
+	}
+}
+
+// requestReconnect queues a reconnect unless one is already pending
+func (c *MQTTLoadClient) requestReconnect(req reconnectRequest) bool {
+	select {
+	case c.reconnect <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// runChurn cycles random publishers at cfg.Rate per second and drops all of
+// them at cfg.HerdAt until stop is closed
+func runChurn(cfg config.MQTTChurn, clientList []*MQTTLoadClient, stats *Stats, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var herd <-chan time.Time
+	if cfg.HerdAt > 0 {
+		herd = time.After(cfg.HerdAt)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			c := clientList[mathrand.Intn(len(clientList))]
+			c.requestReconnect(reconnectRequest{phase: phaseChurn, backoff: cfg.Backoff})
+		case <-herd:
+			// Drop every connection at once, then let each publisher
+			// reconnect between publishes
+			var dropped []*MQTTLoadClient
+			for _, c := range clientList {
+				if c.dropForHerd() {
+					dropped = append(dropped, c)
+				}
+			}
+			fmt.Fprintf(consoleOut, "\n🐘 Thundering herd: dropped %d of %d clients\n", len(dropped), len(clientList))
+			stats.Churn.startStorm(len(dropped))
+			for _, c := range dropped {
+				c.herd <- reconnectRequest{phase: phaseStorm, backoff: cfg.Backoff}
+			}
+		}
+	}
+}
+
+// ChurnReport summarizes churn for the final report
+type ChurnReport struct {
+	Rate           float64      `json:"rate"`
+	Backoff        string       `json:"backoff"`
+	Disconnects    int64        `json:"disconnects"`
+	Reconnects     int64        `json:"reconnects"`
+	FailedAttempts int64        `json:"failed_attempts"`
+	Steady         LatencyStats `json:"steady_connect_latency"` // initial connects
+	Churn          LatencyStats `json:"churn_connect_latency"`
+	Storm          *StormReport `json:"storm,omitempty"`
+}
+
+// StormReport describes the thundering herd reconnect
+type StormReport struct {
+	Clients        int          `json:"clients"`
+	Recovered      bool         `json:"recovered"`
+	Duration       float64      `json:"duration_ms"` // herd start to last client back
+	FailedAttempts int64        `json:"failed_attempts"`
+	ConnectLatency LatencyStats `json:"connect_latency"`
+	Recovery       LatencyStats `json:"recovery"` // per client, drop to connected
+}
+
+func buildChurnReport(cfg config.MQTTChurn, stats *Stats) *ChurnReport {
+	churn := &stats.Churn
+	report := &ChurnReport{
+		Rate:           cfg.Rate,
+		Backoff:        fmt.Sprintf("%s %v..%v", cfg.Backoff.Policy, cfg.Backoff.Initial, cfg.Backoff.Max),
+		Disconnects:    atomic.LoadInt64(&churn.Disconnects),
+		Reconnects:     atomic.LoadInt64(&churn.Reconnects),
+		FailedAttempts: atomic.LoadInt64(&churn.FailedAttempts),
+		Steady:         stats.latencySince(0, isConnect),
+		Churn:          churn.ChurnLatency.Summary(),
+	}
+
+	churn.mu.Lock()
+	defer churn.mu.Unlock()
+	if churn.stormClients > 0 {
+		report.Storm = &StormReport{
+			Clients:        churn.stormClients,
+			Recovered:      atomic.LoadInt64(&churn.stormPending) == 0,
+			Duration:       toMs(churn.stormDuration),
+			FailedAttempts: atomic.LoadInt64(&churn.StormFailed),
+			ConnectLatency: churn.StormLatency.Summary(),
+			Recovery:       churn.StormRecovery.Summary(),
+		}
+	}
+	return report
+}
+
+// display prints the churn section of the final report
+func (r *ChurnReport) display() {
+	fmt.Fprintln(consoleOut, "\nConnection Churn:")
+	fmt.Fprintf(consoleOut, "  Backoff:      %s\n", r.Backoff)
+	if r.Rate > 0 {
+		fmt.Fprintf(consoleOut, "  Rate:         %.2f clients/s\n", r.Rate)
+	}
+	fmt.Fprintf(consoleOut, "  Disconnects:  %d\n", r.Disconnects)
+	fmt.Fprintf(consoleOut, "  Reconnects:   %d (%d failed attempts)\n", r.Reconnects, r.FailedAttempts)
+	fmt.Fprintln(consoleOut, "  Connect latency:")
+	fmt.Fprintf(consoleOut, "    Steady:     %s\n", r.Steady)
+	if r.Churn.Count > 0 {
+		fmt.Fprintf(consoleOut, "    Churn:      %s\n", r.Churn)
+	}
+	if r.Storm != nil {
+		fmt.Fprintf(consoleOut, "    Storm:      %s\n", r.Storm.ConnectLatency)
+		fmt.Fprintf(consoleOut, "  Storm:        %d clients dropped, %d failed attempts\n", r.Storm.Clients, r.Storm.FailedAttempts)
+		if r.Storm.Recovered {
+			fmt.Fprintf(consoleOut, "    All back:   %.0fms\n", r.Storm.Duration)
+		} else {
+			fmt.Fprintf(consoleOut, "    ⚠️  Not all clients reconnected before the run ended\n")
+		}
+		fmt.Fprintf(consoleOut, "    Recovery:   %s\n", r.Storm.Recovery)
+	}
+}
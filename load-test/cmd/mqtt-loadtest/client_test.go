@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqttbroker "loadtest/internal/broker"
+	"loadtest/internal/config"
+	"loadtest/internal/metrics"
+)
+
+func startEmbedded(t *testing.T, opts mqttbroker.Options) *mqttbroker.Broker {
+	t.Helper()
+	b := mqttbroker.NewBroker(opts)
+	if err := b.Start(); err != nil {
+		t.Fatalf("embedded broker: %v", err)
+	}
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func newTestStats() *Stats {
+	return &Stats{StartTime: time.Now(), Metrics: metrics.NewCollector()}
+}
+
+func newTestConfig(b *mqttbroker.Broker, qos byte) ClientConfig {
+	return ClientConfig{
+		Broker:          b.URL(),
+		QoS:             qos,
+		Clean:           true,
+		Payload:         rtuGenerator{},
+		Tracking:        true,
+		ProtocolVersion: 4,
+	}
+}
+
+// newTestPublishers connects n publishers on thms/{rtuId}/data
+func newTestPublishers(t *testing.T, cfg ClientConfig, stats *Stats, n int) []*MQTTLoadClient {
+	t.Helper()
+	pubs := make([]*MQTTLoadClient, n)
+	for i := range pubs {
+		rtuID := fmt.Sprintf("rtu%d", i+1)
+		c := &MQTTLoadClient{
+			ID:       i + 1,
+			ClientID: "mqtt_" + rtuID,
+			Config:   cfg,
+			Stats:    stats,
+			Done:     make(chan struct{}),
+		}
+		c.Config.RTUID = rtuID
+		c.Config.PublishTopic = "thms/" + rtuID + "/data"
+		if err := c.Connect(); err != nil {
+			t.Fatalf("%s: connect: %v", c.ClientID, err)
+		}
+		t.Cleanup(c.Disconnect)
+		pubs[i] = c
+	}
+	return pubs
+}
+
+// waitFor polls done until it holds, failing the test after 5s
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForUnique waits until the subscribers saw want unique messages and
+// handled every publish the broker sent them, so extras show up as
+// duplicates
+func waitForUnique(t *testing.T, b *mqttbroker.Broker, delivery *DeliveryStats, want int64) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d unique deliveries", want), func() bool {
+		return atomic.LoadInt64(&delivery.Unique) >= want
+	})
+	waitFor(t, "every broker delivery to be handled", func() bool {
+		handled := atomic.LoadInt64(&delivery.Unique) + atomic.LoadInt64(&delivery.Duplicates) +
+			atomic.LoadInt64(&delivery.Malformed)
+		return handled >= b.Stats().PublishesSent
+	})
+}
+
+func TestClientDeliveryByQoS(t *testing.T) {
+	for _, qos := range []byte{0, 1, 2} {
+		t.Run(fmt.Sprintf("qos%d", qos), func(t *testing.T) {
+			b := startEmbedded(t, mqttbroker.Options{})
+			stats := newTestStats()
+			cfg := newTestConfig(b, qos)
+			pubs := newTestPublishers(t, cfg, stats, 3)
+
+			delivery := &DeliveryStats{}
+			subs := newSubscriberPool(2, SubModeWildcard, cfg, []string{"thms/+/data"}, nil, pubs, stats, delivery)
+			for _, sub := range subs {
+				if err := sub.Connect(pubs); err != nil {
+					t.Fatalf("subscriber: %v", err)
+				}
+				t.Cleanup(sub.Disconnect)
+			}
+
+			for i := 0; i < 10; i++ {
+				for _, pub := range pubs {
+					pub.publish()
+				}
+			}
+			waitForUnique(t, b, delivery, 2*30)
+
+			if got := atomic.LoadInt64(&stats.PublishesSuccess); got != 30 {
+				t.Errorf("PublishesSuccess = %d, want 30", got)
+			}
+			report := buildDeliveryReport(subs, pubs, stats, delivery, SubModeWildcard)
+			if report.Expected != 60 || report.Unique != 60 || report.Lost != 0 || report.Duplicates != 0 {
+				t.Errorf("delivery = expected %d, unique %d, lost %d, duplicates %d; want 60 delivered once",
+					report.Expected, report.Unique, report.Lost, report.Duplicates)
+			}
+			if report.Latency.Count != 60 {
+				t.Errorf("delivery latency covers %d messages, want 60", report.Latency.Count)
+			}
+			for _, v := range report.ByQoS {
+				if len(v.Violations) > 0 {
+					t.Errorf("QoS %d violations: %v", v.QoS, v.Violations)
+				}
+			}
+			if got := b.Stats().PublishesReceived; got != 30 {
+				t.Errorf("broker received %d publishes, want 30", got)
+			}
+		})
+	}
+}
+
+func TestClientDeliveryLossFromDrops(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{DropRate: 0.2, Seed: 1})
+	stats := newTestStats()
+	cfg := newTestConfig(b, 1)
+	pubs := newTestPublishers(t, cfg, stats, 1)
+
+	delivery := &DeliveryStats{}
+	subs := newSubscriberPool(1, SubModePerRTU, cfg, nil, nil, pubs, stats, delivery)
+	if err := subs[0].Connect(pubs); err != nil {
+		t.Fatalf("subscriber: %v", err)
+	}
+	t.Cleanup(subs[0].Disconnect)
+
+	for i := 0; i < 50; i++ {
+		pubs[0].publish()
+	}
+	dropped := b.Stats().Dropped
+	waitForUnique(t, b, delivery, 50-dropped)
+
+	// The broker acknowledged every publish, so each drop is a QoS 1 loss
+	report := buildDeliveryReport(subs, pubs, stats, delivery, SubModePerRTU)
+	if dropped == 0 || report.Lost != dropped {
+		t.Errorf("lost %d with %d dropped by the broker", report.Lost, dropped)
+	}
+	if len(report.ByQoS) != 1 || len(report.ByQoS[0].Violations) == 0 {
+		t.Errorf("verification = %+v, want the QoS 1 loss flagged", report.ByQoS)
+	}
+}
+
+func TestClientAuthFailure(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{Users: map[string]string{"rtu1": "secret"}})
+	stats := newTestStats()
+	cfg := newTestConfig(b, 1)
+	cfg.Username, cfg.Password = "rtu1", "wrong"
+
+	c := &MQTTLoadClient{ClientID: "mqtt_rtu1", Config: cfg, Stats: stats}
+	start := time.Now()
+	err := c.Connect()
+	if err == nil || !isAuthFailure(err) {
+		t.Fatalf("Connect = %v, want an auth failure", err)
+	}
+	if elapsed := time.Since(start); elapsed >= initialRetryDelay {
+		t.Errorf("Connect took %v; bad credentials shouldn't be retried", elapsed)
+	}
+	if got := atomic.LoadInt64(&stats.ConnectionsFailed); got != 1 {
+		t.Errorf("ConnectionsFailed = %d, want 1", got)
+	}
+	if got := stats.AuthFailures.Snapshot()["rtu1"]; got != 1 {
+		t.Errorf("auth failures for rtu1 = %d, want 1", got)
+	}
+
+	c.Config.Password = "secret"
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect with the right password: %v", err)
+	}
+	c.Disconnect()
+}
+
+func TestClientPublishOnDroppedConnection(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{DisconnectRate: 1})
+	stats := newTestStats()
+	pubs := newTestPublishers(t, newTestConfig(b, 1), stats, 1)
+
+	pubs[0].publish()
+
+	if got := atomic.LoadInt64(&stats.PublishesFailed); got != 1 {
+		t.Errorf("PublishesFailed = %d, want 1", got)
+	}
+	// The failed sequence number isn't expected by subscribers
+	if got := pubs[0].ackedFrom(1); got != 0 {
+		t.Errorf("ackedFrom(1) = %d, want 0", got)
+	}
+	select {
+	case <-pubs[0].session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open after the broker closed the connection")
+	}
+	if got := b.Stats().Disconnected; got != 1 {
+		t.Errorf("broker disconnected %d connections, want 1", got)
+	}
+}
+
+func TestClientKillFiresWill(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{})
+	stats := newTestStats()
+	cfg := newTestConfig(b, 1)
+
+	monitor, err := startWillMonitor(cfg, []string{"thms/+/status"}, &stats.Wills)
+	if err != nil {
+		t.Fatalf("will monitor: %v", err)
+	}
+	defer monitor.Disconnect()
+
+	var pubs []*MQTTLoadClient
+	for _, rtuID := range []string{"rtu1", "rtu2"} {
+		c := &MQTTLoadClient{ClientID: "mqtt_" + rtuID, Config: cfg, Stats: stats}
+		c.Config.Will = &willMessage{Topic: "thms/" + rtuID + "/status", Payload: []byte("offline"), QoS: 1}
+		if err := c.Connect(); err != nil {
+			t.Fatalf("%s: connect: %v", c.ClientID, err)
+		}
+		pubs = append(pubs, c)
+	}
+	pubs[0].handleKill()
+
+	// The other client disconnects cleanly, so its will must not fire
+	pubs[1].Disconnect()
+	// The broker reads the DISCONNECT before the connection closes, so the
+	// clean client's will is discarded whenever the broker gets to it
+	var report *WillReport
+	waitFor(t, "the monitor to see every will the broker published", func() bool {
+		report = buildWillReport(&stats.Wills, 0)
+		seen := int64(report.Received) + report.Unexpected + report.Duplicates
+		return report.Received >= 1 && seen >= b.Stats().WillsPublished
+	})
+	if report.Killed != 1 || report.Received != 1 || report.Unexpected != 0 {
+		t.Errorf("wills = killed %d, received %d, unexpected %d; want the one killed client's will",
+			report.Killed, report.Received, report.Unexpected)
+	}
+	if got := b.Stats().WillsPublished; got != 1 {
+		t.Errorf("broker published %d wills, want 1", got)
+	}
+}
+
+func TestTakeoverInflightVerifiedAtQoS1(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{})
+	stats := newTestStats()
+	cfg := newTestConfig(b, 2)
+	pubs := newTestPublishers(t, cfg, stats, 1)
+
+	delivery := &DeliveryStats{}
+	subs := newSubscriberPool(1, SubModePerRTU, cfg, nil, nil, pubs, stats, delivery)
+	if err := subs[0].Connect(pubs); err != nil {
+		t.Fatalf("subscriber: %v", err)
+	}
+	t.Cleanup(subs[0].Disconnect)
+
+	for i := 0; i < 5; i++ {
+		pubs[0].publish()
+	}
+	pubs[0].handleTakeover(3)
+	pubs[0].publish()
+
+	report := buildTakeoverReport(&stats.Takeover, nil)
+	waitForUnique(t, b, delivery, expectedDeliveries(subs, pubs))
+
+	byQoS := make(map[int]QoSVerification)
+	for _, v := range verifyDelivery(subs, pubs) {
+		byQoS[v.QoS] = v
+	}
+	if v := byQoS[1]; v.Expected != int64(report.Acked) || len(v.Violations) > 0 {
+		t.Errorf("QoS 1 = %+v, want the %d acknowledged in-flight messages verified", v, report.Acked)
+	}
+	if v := byQoS[2]; v.Expected != 6 || len(v.Violations) > 0 {
+		t.Errorf("QoS 2 = %+v, want the 6 regular publishes", v)
+	}
+}
+
+func TestHerdDropsConnectionsDirectly(t *testing.T) {
+	b := startEmbedded(t, mqttbroker.Options{})
+	stats := newTestStats()
+	pubs := newTestPublishers(t, newTestConfig(b, 1), stats, 3)
+	for _, c := range pubs {
+		c.reconnect = make(chan reconnectRequest, 1)
+		c.herd = make(chan reconnectRequest, 1)
+	}
+	// A pending churn request must not hold back the drop
+	pubs[0].requestReconnect(reconnectRequest{phase: phaseChurn})
+	// A client without a connection isn't dropped or counted
+	pubs[2].Disconnect()
+	pubs[2].setSession(nil)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runChurn(config.MQTTChurn{HerdAt: time.Millisecond}, pubs, stats, stop)
+		close(done)
+	}()
+	waitFor(t, "the herd reconnects to be queued", func() bool {
+		return len(pubs[0].herd)+len(pubs[1].herd) == 2
+	})
+	close(stop)
+	<-done
+
+	// The broker sees both connections drop before any publisher loop runs
+	for _, c := range pubs[:2] {
+		select {
+		case <-c.session.Closed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection still open after the herd", c.ClientID)
+		}
+	}
+	if got := atomic.LoadInt64(&stats.Churn.Disconnects); got != 2 {
+		t.Errorf("Disconnects = %d, want 2", got)
+	}
+	if got := atomic.LoadInt64(&stats.ActiveClients); got != 0 {
+		t.Errorf("ActiveClients = %d, want 0", got)
+	}
+
+	for _, c := range pubs[:2] {
+		c.handleRequest(<-c.herd)
+	}
+	report := buildChurnReport(config.MQTTChurn{HerdAt: time.Millisecond}, stats)
+	if report.Storm == nil || report.Storm.Clients != 2 || !report.Storm.Recovered {
+		t.Errorf("storm = %+v, want the 2 dropped clients recovered", report.Storm)
+	}
+	if got := atomic.LoadInt64(&stats.Churn.Disconnects); got != 2 {
+		t.Errorf("Disconnects = %d after reconnecting, want 2", got)
+	}
+	if got := atomic.LoadInt64(&stats.ActiveClients); got != 2 {
+		t.Errorf("ActiveClients = %d, want 2", got)
+	}
+}
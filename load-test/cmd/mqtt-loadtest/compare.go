@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerStats tracks one broker listener when --compare-broker splits the
+// clients across two listeners
+type ListenerStats struct {
+	Broker             string
+	Clients            int
+	ConnectionsSuccess int64
+	ConnectionsFailed  int64
+	PublishesSuccess   int64
+	PublishesFailed    int64
+}
+
+// ListenerReport is the per-listener section of the final report
+type ListenerReport struct {
+	Broker         string          `json:"broker"`
+	Clients        int             `json:"clients"`
+	Connections    ConnectionStats `json:"connections"`
+	ConnectLatency LatencyStats    `json:"connect_latency"`
+	Publishes      PublishStats    `json:"publishes"`
+	PublishLatency LatencyStats    `json:"publish_latency"`
+}
+
+func buildListenerReports(stats *Stats, elapsed time.Duration) []ListenerReport {
+	reports := make([]ListenerReport, 0, len(stats.Listeners))
+	for _, l := range stats.Listeners {
+		connSuccess := atomic.LoadInt64(&l.ConnectionsSuccess)
+		connFailed := atomic.LoadInt64(&l.ConnectionsFailed)
+		pubSuccess := atomic.LoadInt64(&l.PublishesSuccess)
+		pubFailed := atomic.LoadInt64(&l.PublishesFailed)
+
+		r := ListenerReport{
+			Broker:  l.Broker,
+			Clients: l.Clients,
+			Connections: ConnectionStats{
+				Total:   connSuccess + connFailed,
+				Success: connSuccess,
+				Failed:  connFailed,
+			},
+			ConnectLatency: stats.latencySince(0, onListener(l, isConnect)),
+			Publishes: PublishStats{
+				Total:   pubSuccess + pubFailed,
+				Success: pubSuccess,
+				Failed:  pubFailed,
+			},
+			PublishLatency: stats.latencySince(0, onListener(l, isPublish)),
+		}
+		if r.Connections.Total > 0 {
+			r.Connections.SuccessRate = float64(connSuccess) / float64(r.Connections.Total) * 100
+		}
+		if r.Publishes.Total > 0 {
+			r.Publishes.SuccessRate = float64(pubSuccess) / float64(r.Publishes.Total) * 100
+		}
+		if elapsed.Seconds() > 0 {
+			r.Publishes.PerSecond = float64(pubSuccess) / elapsed.Seconds()
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// displayListenerComparison prints the listeners side by side
+func displayListenerComparison(reports []ListenerReport) {
+	width := 22
+	for _, r := range reports {
+		if len(r.Broker)+2 > width {
+			width = len(r.Broker) + 2
+		}
+	}
+
+	row := func(label string, value func(r ListenerReport) string) {
+		fmt.Fprintf(consoleOut, "  %-16s", label)
+		for _, r := range reports {
+			fmt.Fprintf(consoleOut, "%-*s", width, value(r))
+		}
+		fmt.Fprintln(consoleOut)
+	}
+
+	fmt.Fprintln(consoleOut, "\nListener Comparison:")
+	row("", func(r ListenerReport) string { return r.Broker })
+	row("", func(r ListenerReport) string { return strings.Repeat("-", len(r.Broker)) })
+	row("Clients", func(r ListenerReport) string { return fmt.Sprintf("%d", r.Clients) })
+	row("Connected", func(r ListenerReport) string {
+		return fmt.Sprintf("%d (%.2f%%)", r.Connections.Success, r.Connections.SuccessRate)
+	})
+	row("Connect avg", func(r ListenerReport) string { return fmt.Sprintf("%.2fms", r.ConnectLatency.AvgMs) })
+	row("Connect p95", func(r ListenerReport) string { return fmt.Sprintf("%.2fms", r.ConnectLatency.P95Ms) })
+	row("Publishes", func(r ListenerReport) string {
+		return fmt.Sprintf("%d (%.2f%%)", r.Publishes.Success, r.Publishes.SuccessRate)
+	})
+	row("Publish rate", func(r ListenerReport) string { return fmt.Sprintf("%.2f msg/s", r.Publishes.PerSecond) })
+	row("Publish avg", func(r ListenerReport) string { return fmt.Sprintf("%.2fms", r.PublishLatency.AvgMs) })
+	row("Publish p95", func(r ListenerReport) string { return fmt.Sprintf("%.2fms", r.PublishLatency.P95Ms) })
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"gopkg.in/yaml.v3"
+
+	"loadtest/internal/mqtt5"
+)
+
+// Credential orders for --credentials-order
+const (
+	CredOrderSequential = "sequential"
+	CredOrderRandom     = "random"
+)
+
+// Credential is one RTU account from a credentials file
+type Credential struct {
+	RTUID    string `yaml:"rtu_id"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// label identifies the credential in reports without exposing the password
+func (c Credential) label() string {
+	if c.RTUID != "" && c.RTUID != c.Username {
+		return fmt.Sprintf("%s (%s)", c.Username, c.RTUID)
+	}
+	return c.Username
+}
+
+// loadCredentials reads a CSV or YAML credentials file, choosing the format
+// from the file extension
+func loadCredentials(path string) ([]Credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	var creds []Credential
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		creds, err = parseCredentialsYAML(f)
+	case ".csv":
+		creds, err = parseCredentialsCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported credentials file %s (use .csv, .yaml or .yml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("credentials file %s has no entries", path)
+	}
+	return creds, nil
+}
+
+// parseCredentialsYAML accepts either a top-level list or a "credentials" key
+func parseCredentialsYAML(r io.Reader) ([]Credential, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Credential
+	if err := yaml.Unmarshal(data, &list); err == nil {
+		return list, nil
+	}
+
+	var doc struct {
+		Credentials []Credential `yaml:"credentials"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Credentials, nil
+}
+
+// parseCredentialsCSV reads rows of rtu_id,client_id,username,password. A
+// header row naming these columns may reorder them.
+func parseCredentialsCSV(r io.Reader) ([]Credential, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{"rtu_id": 0, "client_id": 1, "username": 2, "password": 3}
+	if len(rows) > 0 && isCredentialHeader(rows[0]) {
+		columns = make(map[string]int)
+		for i, name := range rows[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		rows = rows[1:]
+	}
+
+	field := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	creds := make([]Credential, 0, len(rows))
+	for n, row := range rows {
+		cred := Credential{
+			RTUID:    field(row, "rtu_id"),
+			ClientID: field(row, "client_id"),
+			Username: field(row, "username"),
+			Password: field(row, "password"),
+		}
+		if cred.Username == "" {
+			return nil, fmt.Errorf("row %d: missing username", n+1)
+		}
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+func isCredentialHeader(row []string) bool {
+	for _, name := range row {
+		if strings.EqualFold(strings.TrimSpace(name), "username") {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialPicker hands out credentials to clients in the configured order
+type credentialPicker struct {
+	creds []Credential
+	order string
+	next  int
+}
+
+func newCredentialPicker(creds []Credential, order string) (*credentialPicker, error) {
+	if order != CredOrderSequential && order != CredOrderRandom {
+		return nil, fmt.Errorf("invalid --credentials-order %q (use %s or %s)", order, CredOrderSequential, CredOrderRandom)
+	}
+	return &credentialPicker{creds: creds, order: order}, nil
+}
+
+// Next returns the credential for the next client, wrapping around when there
+// are more clients than credentials
+func (p *credentialPicker) Next() Credential {
+	if p.order == CredOrderRandom {
+		return p.creds[mathrand.Intn(len(p.creds))]
+	}
+	cred := p.creds[p.next%len(p.creds)]
+	p.next++
+	return cred
+}
+
+// isAuthFailure reports whether err is the broker refusing the credentials
+func isAuthFailure(err error) bool {
+	if errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) || errors.Is(err, packets.ErrorRefusedNotAuthorised) {
+		return true
+	}
+	var rcErr *mqtt5.ReasonCodeError
+	if errors.As(err, &rcErr) {
+		return rcErr.Code == mqtt5.ReasonBadUsernameOrPassword || rcErr.Code == mqtt5.ReasonNotAuthorized
+	}
+	return false
+}
+
+// AuthFailures counts refused connects per credential
+type AuthFailures struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (a *AuthFailures) Record(label string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.counts == nil {
+		a.counts = make(map[string]int)
+	}
+	a.counts[label]++
+}
+
+// Snapshot returns a copy of the per-credential counts
+func (a *AuthFailures) Snapshot() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := make(map[string]int, len(a.counts))
+	for label, n := range a.counts {
+		counts[label] = n
+	}
+	return counts
+}
+
+// sortedLabels returns the credential labels with the most failures first
+func sortedLabels(counts map[string]int) []string {
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if counts[labels[i]] != counts[labels[j]] {
+			return counts[labels[i]] > counts[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	return labels
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	mqttbroker "loadtest/internal/broker"
+	"loadtest/internal/config"
+)
+
+// startEmbeddedBroker starts the in-process broker for --embedded-broker and
+// points the scenario at it
+func startEmbeddedBroker(sc *config.MQTTScenario) (*mqttbroker.Broker, error) {
+	if sc.ProtocolVersion == 5 {
+		return nil, fmt.Errorf("the embedded broker speaks MQTT 3.1 and 3.1.1; use --protocol-version 3 or 4")
+	}
+	if sc.CompareBroker != "" {
+		return nil, fmt.Errorf("--embedded-broker can't be combined with a compare broker")
+	}
+	for name, rate := range map[string]float64{
+		"--embedded-drop":       embeddedDrop,
+		"--embedded-reject":     embeddedReject,
+		"--embedded-disconnect": embeddedDisconnect,
+	} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+
+	b := mqttbroker.NewBroker(mqttbroker.Options{
+		Addr:           embeddedAddr,
+		Latency:        time.Duration(embeddedLatency) * time.Millisecond,
+		DropRate:       embeddedDrop,
+		RejectRate:     embeddedReject,
+		DisconnectRate: embeddedDisconnect,
+		Seed:           embeddedSeed,
+		// Room for every message an offline subscriber is sent
+		MaxOfflineMessages: max(1000, sc.TotalClients()*sc.OfflineQueue.Messages),
+	})
+	if err := b.Start(); err != nil {
+		return nil, err
+	}
+	sc.Broker = b.URL()
+	return b, nil
+}
+
+// describeEmbedded summarizes the faults the embedded broker injects
+func describeEmbedded() string {
+	var faults []string
+	if embeddedLatency > 0 {
+		faults = append(faults, fmt.Sprintf("%dms latency", embeddedLatency))
+	}
+	if embeddedDrop > 0 {
+		faults = append(faults, fmt.Sprintf("%.1f%% of publishes dropped", embeddedDrop*100))
+	}
+	if embeddedReject > 0 {
+		faults = append(faults, fmt.Sprintf("%.1f%% of connects refused", embeddedReject*100))
+	}
+	if embeddedDisconnect > 0 {
+		faults = append(faults, fmt.Sprintf("%.1f%% of publishes disconnect", embeddedDisconnect*100))
+	}
+	if len(faults) == 0 {
+		return "in-process broker, no faults injected"
+	}
+	return "in-process broker, " + strings.Join(faults, ", ")
+}
+
+// EmbeddedBrokerReport is the broker's side of a --embedded-broker run
+type EmbeddedBrokerReport struct {
+	Addr              string `json:"addr"`
+	Connects          int64  `json:"connects"`
+	Rejected          int64  `json:"rejected"`
+	Disconnected      int64  `json:"disconnected"`
+	PublishesReceived int64  `json:"publishes_received"`
+	PublishesSent     int64  `json:"publishes_sent"`
+	Dropped           int64  `json:"dropped"`
+	WillsPublished    int64  `json:"wills_published"`
+	Takeovers         int64  `json:"takeovers"`
+}
+
+func buildEmbeddedBrokerReport(b *mqttbroker.Broker) *EmbeddedBrokerReport {
+	s := b.Stats()
+	return &EmbeddedBrokerReport{
+		Addr:              b.Addr(),
+		Connects:          s.Connects,
+		Rejected:          s.Rejected,
+		Disconnected:      s.Disconnected,
+		PublishesReceived: s.PublishesReceived,
+		PublishesSent:     s.PublishesSent,
+		Dropped:           s.Dropped,
+		WillsPublished:    s.WillsPublished,
+		Takeovers:         s.Takeovers,
+	}
+}
+
+// display prints the embedded broker section of the final report
+func (r *EmbeddedBrokerReport) display() {
+	fmt.Fprintln(consoleOut, "\nEmbedded Broker:")
+	fmt.Fprintf(consoleOut, "  Address:      %s\n", r.Addr)
+	fmt.Fprintf(consoleOut, "  Connects:     %d (%d refused, %d takeovers)\n", r.Connects, r.Rejected, r.Takeovers)
+	fmt.Fprintf(consoleOut, "  Publishes:    %d received, %d delivered\n", r.PublishesReceived, r.PublishesSent)
+	if r.Dropped > 0 || r.Disconnected > 0 {
+		fmt.Fprintf(consoleOut, "  Injected:     %d dropped, %d disconnects\n", r.Dropped, r.Disconnected)
+	}
+	if r.WillsPublished > 0 {
+		fmt.Fprintf(consoleOut, "  Wills:        %d published\n", r.WillsPublished)
+	}
+}
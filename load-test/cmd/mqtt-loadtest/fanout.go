@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// FanoutStep is the throughput and latency at one subscriber count
+type FanoutStep struct {
+	Subscribers int          `json:"subscribers"`
+	Connected   int          `json:"connected"`
+	Duration    float64      `json:"duration_s"`
+	In          int64        `json:"messages_in"`  // acknowledged publishes
+	Out         int64        `json:"messages_out"` // deliveries to subscribers
+	InRate      float64      `json:"in_per_sec"`
+	OutRate     float64      `json:"out_per_sec"`
+	Ratio       float64      `json:"fanout"` // out per in
+	Latency     LatencyStats `json:"latency"`
+}
+
+// FanoutReport summarizes the fan-out benchmark for the final report
+type FanoutReport struct {
+	Filters []string     `json:"filters"`
+	Steps   []FanoutStep `json:"steps"`
+}
+
+// runFanout adds subscribers at every step and measures messages in and out
+// until the steps are done or stop is closed. subs holds the pool for the
+// last step, with the first step already connected.
+func runFanout(cfg config.MQTTFanout, duration time.Duration, subs []*MQTTSubscriber, publishers []*MQTTLoadClient, filters []string, stats *Stats, delivery *DeliveryStats, verbose bool, stop <-chan struct{}) *FanoutReport {
+	step := cfg.Step
+	if step == 0 {
+		step = duration / time.Duration(len(cfg.Steps))
+	}
+	report := &FanoutReport{Filters: filters}
+
+	prev := cfg.Steps[0]
+	for i, n := range cfg.Steps {
+		if i > 0 {
+			fmt.Fprintf(consoleOut, "\n📈 Fan-out: adding %d subscribers (%d total)\n", n-prev, n)
+			connectSubscribers(subs[prev:n], publishers, false, verbose)
+			prev = n
+		}
+
+		in := atomic.LoadInt64(&stats.PublishesSuccess)
+		out := atomic.LoadInt64(&delivery.Received)
+		mark := stats.Metrics.Count()
+		start := time.Now()
+
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-time.After(step):
+		}
+
+		elapsed := time.Since(start)
+		result := FanoutStep{
+			Subscribers: n,
+			Duration:    elapsed.Seconds(),
+			In:          atomic.LoadInt64(&stats.PublishesSuccess) - in,
+			Out:         atomic.LoadInt64(&delivery.Received) - out,
+			Latency:     stats.latencySince(mark, isDelivery),
+		}
+		for _, sub := range subs[:n] {
+			if sub.session != nil {
+				result.Connected++
+			}
+		}
+		result.InRate = float64(result.In) / elapsed.Seconds()
+		result.OutRate = float64(result.Out) / elapsed.Seconds()
+		if result.In > 0 {
+			result.Ratio = float64(result.Out) / float64(result.In)
+		}
+		report.Steps = append(report.Steps, result)
+
+		if stopped {
+			break
+		}
+	}
+	return report
+}
+
+// display prints the fan-out section of the final report
+func (r *FanoutReport) display() {
+	fmt.Fprintln(consoleOut, "\nFan-out:")
+	fmt.Fprintf(consoleOut, "  Filters:      %s\n", strings.Join(r.Filters, ", "))
+	fmt.Fprintf(consoleOut, "  %-6s %-10s %-11s %-11s %-8s %-10s %-10s %s\n", "Subs", "Connected", "In/s", "Out/s", "Fan-out", "P50", "P95", "P99")
+	for _, s := range r.Steps {
+		fmt.Fprintf(consoleOut, "  %-6d %-10d %-11.1f %-11.1f %-8s %-10s %-10s %.2fms\n",
+			s.Subscribers, s.Connected, s.InRate, s.OutRate, fmt.Sprintf("%.2fx", s.Ratio),
+			fmt.Sprintf("%.2fms", s.Latency.P50Ms), fmt.Sprintf("%.2fms", s.Latency.P95Ms), s.Latency.P99Ms)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"loadtest/internal/metrics"
+)
+
+// LatencyRecorder collects latency observations from many goroutines
+type LatencyRecorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+// Record adds a single observation
+func (r *LatencyRecorder) Record(d time.Duration) {
+	r.mu.Lock()
+	r.samples = append(r.samples, d)
+	r.mu.Unlock()
+}
+
+// Count returns the number of recorded observations
+func (r *LatencyRecorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.samples)
+}
+
+// Summary returns percentile statistics for all recorded observations
+func (r *LatencyRecorder) Summary() LatencyStats {
+	r.mu.Lock()
+	samples := make([]time.Duration, len(r.samples))
+	copy(samples, r.samples)
+	r.mu.Unlock()
+
+	return summarizeLatencies(samples)
+}
+
+// SummarySince returns percentile statistics for the observations recorded
+// after the first mark, as returned by Count
+func (r *LatencyRecorder) SummarySince(mark int) LatencyStats {
+	r.mu.Lock()
+	if mark > len(r.samples) {
+		mark = len(r.samples)
+	}
+	samples := make([]time.Duration, len(r.samples)-mark)
+	copy(samples, r.samples[mark:])
+	r.mu.Unlock()
+
+	return summarizeLatencies(samples)
+}
+
+// LatencyStats is a percentile summary of latency observations (milliseconds)
+type LatencyStats struct {
+	Count int     `json:"count"`
+	MinMs float64 `json:"min_ms"`
+	AvgMs float64 `json:"avg_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P90Ms float64 `json:"p90_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+// summarizeLatencies runs durations kept outside the metrics collector
+// through the collector's statistics
+func summarizeLatencies(durations []time.Duration) LatencyStats {
+	samples := make([]metrics.Sample, len(durations))
+	for i, d := range durations {
+		samples[i] = metrics.Sample{Latency: d, Success: true}
+	}
+	return summarizeSamples(samples)
+}
+
+// summarizeSamples converts the collector's statistics, which are in
+// microseconds, to a LatencyStats
+func summarizeSamples(samples []metrics.Sample) LatencyStats {
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	r := metrics.SummarizeRequests("", samples)
+	return LatencyStats{
+		Count: r.Count,
+		MinMs: r.MinLatency / 1000,
+		AvgMs: r.AvgLatency / 1000,
+		P50Ms: r.Percentiles[50] / 1000,
+		P90Ms: r.Percentiles[90] / 1000,
+		P95Ms: r.Percentiles[95] / 1000,
+		P99Ms: r.Percentiles[99] / 1000,
+		MaxMs: r.MaxLatency / 1000,
+	}
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// String returns a one-line human-readable summary
+func (l LatencyStats) String() string {
+	return fmt.Sprintf("Min: %.2fms | Avg: %.2fms | P50: %.2fms | P90: %.2fms | P95: %.2fms | P99: %.2fms | Max: %.2fms",
+		l.MinMs, l.AvgMs, l.P50Ms, l.P90Ms, l.P95Ms, l.P99Ms, l.MaxMs)
+}
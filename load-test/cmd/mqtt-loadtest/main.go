@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
-	"math"
 	mathrand "math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -15,25 +15,107 @@ import (
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/spf13/cobra"
+
+	mqttbroker "loadtest/internal/broker"
+	"loadtest/internal/brokermetrics"
+	"loadtest/internal/config"
+	"loadtest/internal/metrics"
+	"loadtest/internal/mqtt5"
 )
 
 var (
 	// Flags
-	broker       string
-	clients      int
-	durationSec  int
-	intervalSec  int
-	topic        string
-	rtuPrefix    string // RTU ID prefix
-	username     string
-	password     string
-	qosLevel     int
-	retain       bool
-	clean        bool
-	verbose      bool
-	syncMode     bool   // Synchronized burst mode (all devices at 15-min intervals)
-	jitterSec    int    // Random jitter in seconds (default: ±5s)
-	testMode     bool   // Test mode: generates predictable threshold/peak values
+	broker        string
+	clients       int
+	durationSec   int
+	intervalSec   int
+	topic         string
+	rtuPrefix     string // RTU ID prefix
+	username      string
+	password      string
+	qosLevel      int
+	retain        bool
+	clean         bool
+	verbose       bool
+	syncMode      bool     // Synchronized burst mode (all devices at 15-min intervals)
+	jitterSec     int      // Random jitter in seconds (default: ±5s)
+	testMode      bool     // Test mode: generates predictable threshold/peak values
+	subscribers   int      // Number of subscriber clients measuring end-to-end delivery
+	subMode       string   // Subscription mode: wildcard or per-rtu
+	subFilters    []string // Wildcard-mode filters cycled across subscribers
+	fanoutSteps   []int    // Subscriber counts to step through during the run
+	fanoutStep    int      // Seconds per fan-out step (0 = duration / steps)
+	sharedCount   int      // Consumers in the $share group (0 = none)
+	sharedName    string   // $share group name
+	sharedFilter  string   // Filter shared by the group (default: the publish topic wildcard)
+	sharedDropAt  int      // Seconds into the run to kill one consumer (0 = never)
+	drainSec      int      // Seconds to wait for in-flight deliveries after publishing stops
+	protocolVer   int      // MQTT protocol version: 3 (3.1), 4 (3.1.1) or 5
+	sessionExp    int      // MQTT 5 session expiry interval (seconds)
+	messageExp    int      // MQTT 5 message expiry interval (seconds)
+	userProps     []string // MQTT 5 user properties (key=value)
+	topicAliases  bool     // MQTT 5 topic aliases
+	tlsOpts       TLSOptions
+	wsPath        string   // WebSocket path used when the broker URL has none
+	wsSubprotocol string   // WebSocket subprotocol offered to the broker
+	wsHeaders     []string // extra WebSocket handshake headers
+	compareBroker string   // second listener; clients are split between both
+	credsFile     string   // CSV or YAML file with one account per RTU
+	credsOrder    string   // sequential or random draw from credsFile
+	payloadType   string   // payload generator: rtu, test-mode, random, template or json
+	payloadSize   int      // payload size for the random generator
+	payloadFile   string   // template or sequence file for the template, json and sequence generators
+	groundTruth   string   // alarm manifest output for sequence payloads
+	scenarioFile  string   // YAML scenario with client groups
+	offlineMsgs   int      // messages per publisher queued for offline subscribers (0 = timed run)
+	offlineSec    int      // extra seconds subscribers stay offline after publishing
+	offlineExpiry int      // MQTT 5 subscriber session expiry in offline-queue mode (seconds)
+	drainTimeout  int      // seconds to wait for offline subscribers to drain their queue
+	retainedN     int      // retained topics to populate (0 = timed run)
+	retainedTmpl  string   // retained topic template with {index}
+	retainedSizes []int    // retained payload sizes, cycled across topics
+	retainedWait  int      // seconds each subscriber waits for the retained snapshot
+	retainedKeep  bool     // leave the retained topics in place after the run
+	churnRate     float64  // publishers disconnected and reconnected per second
+	herdAtSec     int      // seconds into the run to drop every publisher at once (0 = off)
+	backoff       string   // reconnect backoff policy for churned clients
+	backoffInitMs int      // initial reconnect delay (milliseconds)
+	backoffMaxMs  int      // maximum reconnect delay (milliseconds)
+	takeoverFrac  float64  // fraction of publishers opening a second connection with their client ID
+	takeoverAtSec int      // seconds into the run for the takeover
+	takeoverMsgs  int      // QoS 1 publishes in flight on the old session at takeover
+	willTopic     string   // Last Will topic template, empty = no will
+	willPayload   string   // Last Will payload template
+	willQoS       int      // Last Will QoS
+	willRetain    bool     // Last Will retain flag
+	willDelay     int      // MQTT 5 will delay interval (seconds)
+	killFrac      float64  // fraction of publishers whose TCP connection is dropped without DISCONNECT
+	killAtSec     int      // seconds into the run for the kill
+	rate          float64  // open-loop messages per second across all publishers (0 = per-client intervals)
+	rateQueue     int      // scheduled sends a publisher may owe before new ones are skipped
+	rateBehindMs  int      // schedule lag counted as falling behind (milliseconds)
+	stepClients   int      // publishers added per capacity step (0 = all at once)
+	stepEverySec  int      // seconds each capacity step is held
+	sloSuccess    float64  // minimum publish success percent per step
+	sloP95Ms      int      // maximum publish p95 per step (milliseconds)
+	sloConnFail   int      // connect failures allowed per step
+	keepAliveSec  int      // MQTT keep-alive sent on CONNECT (seconds)
+	soak          bool     // time keep-alive pings and watch for dropped connections
+	soakWindowSec int      // ping timeline window (seconds)
+	reportFormat  string   // console, json, html, csv or junit
+	reportOutput  string   // structured report file (empty = stdout)
+	timelineFile  string   // per-second timeline CSV (empty = none)
+	brokerMetrics string   // broker Prometheus endpoint to scrape (empty = none)
+	scrapeSec     int      // seconds between broker metric scrapes
+	scrapeNames   []string // broker counters to scrape
+
+	embedded           bool    // run against an in-process broker
+	embeddedAddr       string  // embedded broker listen address
+	embeddedLatency    int     // embedded broker routing delay (milliseconds)
+	embeddedDrop       float64 // fraction of publishes the embedded broker drops
+	embeddedReject     float64 // fraction of connects the embedded broker refuses
+	embeddedDisconnect float64 // fraction of publishes that close the connection
+	embeddedSeed       int64   // fault injection seed (0 = random)
 )
 
 // Statistics tracking
@@ -48,24 +130,162 @@ type Stats struct {
 	ActiveClients      int64
 	mu                 sync.RWMutex
 	errors             []ErrorRecord
+
+	// Connection phase latencies of successful connects; the total is in
+	// Metrics
+	DialLatency    LatencyRecorder
+	TLSLatency     LatencyRecorder
+	UpgradeLatency LatencyRecorder
+	MQTTLatency    LatencyRecorder
+
+	// Per-listener stats, set when --compare-broker is used
+	Listeners []*ListenerStats
+
+	// Connects refused for bad credentials, keyed by credential
+	AuthFailures AuthFailures
+
+	// Disconnects and reconnects caused by --churn-rate and --herd-at
+	Churn ChurnStats
+
+	// Duplicate client ID connections opened by --takeover
+	Takeover TakeoverStats
+
+	// Connections killed by --kill and the wills they fired
+	Wills WillStats
+
+	// Open-loop schedule kept by --rate
+	Schedule ScheduleStats
+
+	// Keep-alive pings and dropped connections seen by --soak
+	Soak SoakStats
+
+	// Broker counters scraped by --broker-metrics
+	Broker BrokerMetricsStats
+
+	// In-process broker started by --embedded-broker
+	Embedded *mqttbroker.Broker
+
+	// Every connect, publish and delivery, for per-operation statistics, the
+	// latency summaries of the report sections and the shared reporters
+	Metrics *metrics.Collector
+}
+
+// MQTT operations recorded in the metrics collector
+const (
+	opConnect   = "connect"
+	opReconnect = "reconnect"
+	opSubscribe = "subscribe"
+	opDeliver   = "deliver"
+)
+
+// publishOps names the publish operation by QoS
+var publishOps = [...]string{"publish_qos0", "publish_qos1", "publish_qos2"}
+
+// sample records one MQTT operation in the metrics collector
+func (s *Stats) sample(op string, latency time.Duration, err error, sent, received int) {
+	s.sampleTarget("", op, latency, err, sent, received)
+}
+
+// sampleTarget records an operation against one of the compared listeners
+func (s *Stats) sampleTarget(target, op string, latency time.Duration, err error, sent, received int) {
+	if s.Metrics == nil {
+		return
+	}
+	sample := metrics.Sample{
+		Latency:       latency,
+		Success:       err == nil,
+		RequestName:   op,
+		BytesSent:     int64(sent),
+		BytesReceived: int64(received),
+		Target:        target,
+	}
+	if err != nil {
+		sample.ErrorMsg = err.Error()
+		if code := reasonCodeOf(err); code != nil {
+			sample.StatusCode = int(*code)
+		}
+	}
+	s.Metrics.Record(sample)
+}
+
+func (s *Stats) recordConnectTiming(t connTiming) {
+	s.DialLatency.Record(t.Dial)
+	if t.TLSHandshake > 0 {
+		s.TLSLatency.Record(t.TLSHandshake)
+	}
+	if t.Upgrade > 0 {
+		s.UpgradeLatency.Record(t.Upgrade)
+	}
+	s.MQTTLatency.Record(t.MQTT())
+}
+
+func (s *Stats) addError(rec ErrorRecord) {
+	rec.Time = time.Now()
+	s.mu.Lock()
+	s.errors = append(s.errors, rec)
+	s.mu.Unlock()
+}
+
+func (s *Stats) recordError(errType, clientID, message string) {
+	s.addError(ErrorRecord{Type: errType, ClientID: clientID, Message: message})
+}
+
+// recordErr records err, keeping the MQTT 5 reason code when the broker sent one
+func (s *Stats) recordErr(errType, clientID string, err error) {
+	s.addError(ErrorRecord{Type: errType, ClientID: clientID, Message: err.Error(), ReasonCode: reasonCodeOf(err)})
+}
+
+// reasonCodeCounts groups recorded errors by MQTT 5 reason code
+func (s *Stats) reasonCodeCounts() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, rec := range s.errors {
+		if rec.ReasonCode != nil {
+			counts[fmt.Sprintf("0x%02X %s", *rec.ReasonCode, mqtt5.ReasonName(*rec.ReasonCode))]++
+		}
+	}
+	return counts
 }
 
 type ErrorRecord struct {
-	Time      time.Time
-	Type      string
-	ClientID  string
-	Message   string
+	Time       time.Time
+	Type       string
+	ClientID   string
+	Message    string
+	ReasonCode *byte `json:"ReasonCode,omitempty"` // MQTT 5 reason code, nil for 3.1.1
 }
 
 type TestReport struct {
-	Duration        time.Duration `json:"duration"`
-	Broker          string        `json:"broker"`
-	Topic           string        `json:"topic"`
-	QoS             byte          `json:"qos"`
-
-	Connections     ConnectionStats `json:"connections"`
-	Publishes       PublishStats   `json:"publishes"`
-	Errors          []ErrorRecord  `json:"errors,omitempty"`
+	StartTime time.Time     `json:"start_time"`
+	Duration  time.Duration `json:"duration"`
+	Scenario  string        `json:"scenario,omitempty"`
+	Broker    string        `json:"broker"`
+	Topic     string        `json:"topic"`
+	QoS       byte          `json:"qos"`
+
+	Connections   ConnectionStats           `json:"connections"`
+	ConnectPhases ConnectPhaseStats         `json:"connect_phases"`
+	Publishes     PublishStats              `json:"publishes"`
+	Operations    map[string]OperationStats `json:"operations,omitempty"`
+	OpenLoop      *OpenLoopReport           `json:"open_loop,omitempty"`
+	Capacity      *CapacityReport           `json:"capacity,omitempty"`
+	Soak          *SoakReport               `json:"soak,omitempty"`
+	Delivery      *DeliveryReport           `json:"delivery,omitempty"`
+	OfflineQueue  *OfflineQueueReport       `json:"offline_queue,omitempty"`
+	Retained      *RetainedReport           `json:"retained,omitempty"`
+	Shared        *SharedReport             `json:"shared,omitempty"`
+	Churn         *ChurnReport              `json:"churn,omitempty"`
+	Takeover      *TakeoverReport           `json:"takeover,omitempty"`
+	Will          *WillReport               `json:"will,omitempty"`
+	ReasonCodes   map[string]int            `json:"reason_codes,omitempty"`
+	Listeners     []ListenerReport          `json:"listeners,omitempty"`
+	AuthFailures  map[string]int            `json:"auth_failures,omitempty"`
+	Errors        []ErrorRecord             `json:"errors,omitempty"`
+	BrokerMetrics *BrokerMetricsReport      `json:"broker_metrics,omitempty"`
+	Embedded      *EmbeddedBrokerReport     `json:"embedded_broker,omitempty"`
+	Timeline      []TimelineSecond          `json:"timeline,omitempty"`
 }
 
 type ConnectionStats struct {
@@ -75,6 +295,15 @@ type ConnectionStats struct {
 	SuccessRate float64 `json:"success_rate"`
 }
 
+// ConnectPhaseStats breaks successful connects down by phase
+type ConnectPhaseStats struct {
+	TCPDial      LatencyStats  `json:"tcp_dial"`
+	TLSHandshake *LatencyStats `json:"tls_handshake,omitempty"`
+	WSUpgrade    *LatencyStats `json:"ws_upgrade,omitempty"`
+	MQTTConnect  LatencyStats  `json:"mqtt_connect"`
+	Total        LatencyStats  `json:"total"`
+}
+
 type PublishStats struct {
 	Total       int64   `json:"total"`
 	Success     int64   `json:"success"`
@@ -85,25 +314,61 @@ type PublishStats struct {
 
 // MQTT Client wrapper
 type MQTTLoadClient struct {
-	ID              int
-	ClientID        string
-	client          mqtt.Client
-	Config          ClientConfig
-	Stats           *Stats
-	Done            chan struct{}
-	PublishCount    int64   // Track number of publishes for test mode
-	mu              sync.Mutex  // Protect PublishCount
+	ID           int
+	ClientID     string
+	session      mqttSession
+	Config       ClientConfig
+	Stats        *Stats
+	Done         chan struct{}
+	Listener     *ListenerStats        // nil unless listeners are compared
+	Credential   string                // credential label for auth failure reporting
+	reconnect    chan reconnectRequest // churn, takeover, kill and join requests, handled between publishes
+	herd         chan reconnectRequest // reconnects after a herd drop, kept apart so a pending request can't hold one back
+	schedule     chan time.Time        // open-loop send times, nil for per-client intervals
+	PublishCount int64                 // Track number of publishes for payload sequence numbers
+	PublishedOK  int64                 // Publishes acknowledged by the broker
+	lastAcked    int64                 // Highest acknowledged sequence number
+	unpublished  map[int64]struct{}    // Sequence numbers that never reached the broker
+	inflight     map[int64]struct{}    // Takeover sequence numbers sent at QoS 1, side by side
+	mu           sync.Mutex            // Protect PublishCount, lastAcked, unpublished, inflight and writes to session
 }
 
 type ClientConfig struct {
-	Broker   string
-	Topic    string
-	RTUID    string // Unique RTU ID for each client
-	Username string
-	Password string
-	QoS      byte
-	Retain   bool
-	Clean    bool
+	Broker       string
+	PublishTopic string // topic template expanded for this client
+	RTUID        string // Unique RTU ID for each client
+	Username     string
+	Password     string
+	QoS          byte
+	Retain       bool
+	Clean        bool
+
+	Group      string        // scenario client group
+	GroupIndex int           // 1-based index within the group
+	Interval   time.Duration // publish interval
+	Schedule   string        // continuous or sync
+	Jitter     time.Duration // ±jitter for the sync schedule
+	Payload    PayloadGenerator
+	Tracking   bool // embed seq/sentAt for subscribers
+
+	TLSConfig *tls.Config // used for ssl://, tls://, mqtts:// and wss:// brokers
+
+	WSPath        string      // WebSocket path when the broker URL has none
+	WSSubprotocol string      // WebSocket subprotocol, defaults to mqtt
+	WSHeader      http.Header // extra WebSocket handshake headers
+
+	ProtocolVersion int                  // 3, 4 (3.1.1) or 5
+	SessionExpiry   uint32               // MQTT 5 session expiry interval (seconds)
+	MessageExpiry   uint32               // MQTT 5 message expiry interval (seconds)
+	UserProperties  []mqtt5.UserProperty // MQTT 5 user properties sent on CONNECT and PUBLISH
+	TopicAliases    bool                 // MQTT 5 topic aliases for repeated topics
+	Will            *willMessage         // Last Will registered on CONNECT, nil for none
+	KeepAlive       time.Duration        // zero uses the default keep-alive
+	Soak            *SoakStats           // watches pings and drops when set
+
+	// OnMessage receives messages that arrive before any Subscribe call
+	// registers a handler, such as a stored session's queue after CONNACK
+	OnMessage messageHandler
 }
 
 const (
@@ -111,44 +376,74 @@ const (
 	initialRetryDelay = 500 * time.Millisecond
 )
 
-func (c *MQTTLoadClient) Connect() error {
+// keepAlive returns the keep-alive interval sent on CONNECT
+func (cfg ClientConfig) keepAlive() time.Duration {
+	if cfg.KeepAlive > 0 {
+		return cfg.KeepAlive
+	}
+	return keepAlive
+}
+
+// newClientOptions builds the paho options shared by publishers and subscribers
+func newClientOptions(cfg ClientConfig, clientID string) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(c.Config.Broker)
-	opts.SetClientID(c.ClientID)
-	opts.SetCleanSession(c.Config.Clean)
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(clientID)
+	opts.SetCleanSession(cfg.Clean)
 	opts.SetAutoReconnect(false)
-	opts.SetConnectTimeout(15 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
+	opts.SetConnectTimeout(connectTimeout)
+	opts.SetKeepAlive(cfg.keepAlive())
+	if cfg.ProtocolVersion == 3 || cfg.ProtocolVersion == 4 {
+		opts.SetProtocolVersion(uint(cfg.ProtocolVersion))
+	}
 
-	if c.Config.Username != "" {
-		opts.SetUsername(c.Config.Username)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+	}
+	if cfg.Password != "" {
+		opts.SetPassword(cfg.Password)
 	}
-	if c.Config.Password != "" {
-		opts.SetPassword(c.Config.Password)
+	if cfg.Will != nil {
+		opts.SetBinaryWill(cfg.Will.Topic, cfg.Will.Payload, cfg.Will.QoS, cfg.Will.Retain)
 	}
 
+	return opts
+}
+
+func (c *MQTTLoadClient) Connect() error {
 	var lastErr error
 	retryDelay := initialRetryDelay
 
 	for attempt := 1; attempt <= maxRetryAttempts; attempt++ {
-		client := mqtt.NewClient(opts)
-		token := client.Connect()
-
-		if token.Wait() && token.Error() != nil {
-			lastErr = token.Error()
+		session, timing, err := connectSession(c.Config, c.ClientID)
+
+		if err != nil {
+			lastErr = err
+
+			// Bad credentials won't improve with retries
+			if isAuthFailure(err) {
+				c.recordConnectFailure()
+				c.sample(opConnect, timing.Total, err, 0)
+				c.Stats.addError(ErrorRecord{
+					Type:       "auth",
+					ClientID:   c.ClientID,
+					Message:    fmt.Sprintf("%s: %s", c.credentialLabel(), err.Error()),
+					ReasonCode: reasonCodeOf(err),
+				})
+				c.Stats.AuthFailures.Record(c.credentialLabel())
+				return err
+			}
 
 			// Don't retry on the last attempt
 			if attempt == maxRetryAttempts {
-				atomic.AddInt64(&c.Stats.ConnectionsTotal, 1)
-				atomic.AddInt64(&c.Stats.ConnectionsFailed, 1)
-				c.Stats.mu.Lock()
-				c.Stats.errors = append(c.Stats.errors, ErrorRecord{
-					Time:     time.Now(),
-					Type:     "connection",
-					ClientID: c.ClientID,
-					Message:  fmt.Sprintf("Attempt %d/%d failed: %s", attempt, maxRetryAttempts, lastErr.Error()),
+				c.recordConnectFailure()
+				c.sample(opConnect, timing.Total, err, 0)
+				c.Stats.addError(ErrorRecord{
+					Type:       "connection",
+					ClientID:   c.ClientID,
+					Message:    fmt.Sprintf("Attempt %d/%d failed: %s", attempt, maxRetryAttempts, lastErr.Error()),
+					ReasonCode: reasonCodeOf(lastErr),
 				})
-				c.Stats.mu.Unlock()
 				return lastErr
 			}
 
@@ -163,14 +458,48 @@ func (c *MQTTLoadClient) Connect() error {
 		atomic.AddInt64(&c.Stats.ConnectionsTotal, 1)
 		atomic.AddInt64(&c.Stats.ConnectionsSuccess, 1)
 		atomic.AddInt64(&c.Stats.ActiveClients, 1)
+		c.Stats.recordConnectTiming(timing)
+		c.sample(opConnect, timing.Total, nil, 0)
+		if c.Listener != nil {
+			atomic.AddInt64(&c.Listener.ConnectionsSuccess, 1)
+		}
 
-		c.client = client
+		c.setSession(session)
 		return nil
 	}
 
 	return lastErr
 }
 
+// sample records one of the client's operations, against its listener when
+// listeners are compared
+func (c *MQTTLoadClient) sample(op string, latency time.Duration, err error, sent int) {
+	target := ""
+	if c.Listener != nil {
+		target = c.Listener.Broker
+	}
+	c.Stats.sampleTarget(target, op, latency, err, sent, 0)
+}
+
+func (c *MQTTLoadClient) recordConnectFailure() {
+	atomic.AddInt64(&c.Stats.ConnectionsTotal, 1)
+	atomic.AddInt64(&c.Stats.ConnectionsFailed, 1)
+	if c.Listener != nil {
+		atomic.AddInt64(&c.Listener.ConnectionsFailed, 1)
+	}
+}
+
+// credentialLabel names the account this client authenticates with
+func (c *MQTTLoadClient) credentialLabel() string {
+	if c.Credential != "" {
+		return c.Credential
+	}
+	if c.Config.Username != "" {
+		return c.Config.Username
+	}
+	return "(anonymous)"
+}
+
 func (c *MQTTLoadClient) StartPublishing(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -179,6 +508,10 @@ func (c *MQTTLoadClient) StartPublishing(interval time.Duration) {
 		select {
 		case <-c.Done:
 			return
+		case req := <-c.reconnect:
+			c.handleRequest(req)
+		case req := <-c.herd:
+			c.handleRequest(req)
 		case <-ticker.C:
 			c.publish()
 		}
@@ -214,11 +547,19 @@ func (c *MQTTLoadClient) StartPublishingSync(interval time.Duration, jitter time
 	}
 
 	// Wait for first interval
-	select {
-	case <-c.Done:
-		return
-	case <-time.After(initialDelay):
-		c.publish()
+	first := time.After(initialDelay)
+	for first != nil {
+		select {
+		case <-c.Done:
+			return
+		case req := <-c.reconnect:
+			c.handleRequest(req)
+		case req := <-c.herd:
+			c.handleRequest(req)
+		case <-first:
+			c.publish()
+			first = nil
+		}
 	}
 
 	// Continue with interval ticker
@@ -229,6 +570,10 @@ func (c *MQTTLoadClient) StartPublishingSync(interval time.Duration, jitter time
 		select {
 		case <-c.Done:
 			return
+		case req := <-c.reconnect:
+			c.handleRequest(req)
+		case req := <-c.herd:
+			c.handleRequest(req)
 		case <-ticker.C:
 			c.publish()
 		}
@@ -236,201 +581,165 @@ func (c *MQTTLoadClient) StartPublishingSync(interval time.Duration, jitter time
 }
 
 func (c *MQTTLoadClient) publish() {
-	if c.client == nil {
+	if c.session == nil {
+		return
+	}
+	c.publishAt(time.Now())
+}
+
+// publishAt publishes the next payload for a send scheduled at at. Open-loop
+// clients measure latency from at rather than from when the publish started.
+func (c *MQTTLoadClient) publishAt(at time.Time) {
+	count, payload, err := c.nextPayload(at)
+	if err != nil {
+		c.Stats.recordError("payload", c.ClientID, err.Error())
+		c.markUnpublished(count)
 		return
 	}
 
-	// Increment publish count for test mode
+	// Each RTU publishes to its own topic, thms/{rtuId}/data by default
+	start := time.Now()
+	if c.schedule != nil {
+		c.Stats.Schedule.sent(at, start)
+	}
+	err = c.session.Publish(c.Config.PublishTopic, c.Config.QoS, c.Config.Retain, payload)
+	elapsed := time.Since(start)
+	atomic.AddInt64(&c.Stats.PublishesTotal, 1)
+	c.sample(publishOps[c.Config.QoS], elapsed, err, len(payload))
+
+	if err != nil {
+		atomic.AddInt64(&c.Stats.PublishesFailed, 1)
+		c.Stats.recordErr("publish", c.ClientID, err)
+		c.markUnpublished(count)
+		if c.Listener != nil {
+			atomic.AddInt64(&c.Listener.PublishesFailed, 1)
+		}
+	} else {
+		atomic.AddInt64(&c.Stats.PublishesSuccess, 1)
+		atomic.AddInt64(&c.PublishedOK, 1)
+		c.markAcked(count)
+		if c.schedule != nil {
+			c.Stats.Schedule.acked(at)
+		}
+		if c.Listener != nil {
+			atomic.AddInt64(&c.Listener.PublishesSuccess, 1)
+		}
+	}
+}
+
+// nextPayload takes the next per-client sequence number and generates its
+// payload, stamped with the send time at
+func (c *MQTTLoadClient) nextPayload(at time.Time) (int64, []byte, error) {
 	c.mu.Lock()
 	c.PublishCount++
 	count := c.PublishCount
 	c.mu.Unlock()
 
-	var vr, vs, vt, ir, is_, it, in, pf1, pf2, pf3, tk1, tk2, i1f1, i2f1, i3f1, inf1, i1f2, i2f2, i3f2, inf2 float64
-	var payload string
-	var now time.Time
-	var ts int64
-
-	if testMode {
-		// ============================================
-		// TEST MODE: Predictable threshold/peak values
-		// ============================================
-		// Pattern cycles every 10 messages:
-		// 1-3: Normal values
-		// 4: Voltage High (threshold trigger)
-		// 5: Voltage Low (threshold trigger)
-		// 6: Current High (threshold trigger)
-		// 7: Temperature High (threshold trigger)
-		// 8: Power Factor Low (threshold trigger)
-		// 9-10: Normal values with increasing STot (for peak detection)
-
-		cycle := (count % 10)
-
-		switch cycle {
-		case 1, 2, 3, 9, 10:
-			// Normal values
-			vr, vs, vt = 230.0, 230.0, 230.0
-			ir, is_, it = 150.0, 150.0, 150.0
-			pf1, pf2, pf3 = 0.95, 0.95, 0.95
-			tk1, tk2 = 35.0, 37.0
-		case 4:
-			// Voltage High: 260V (exceeds typical 250V threshold)
-			vr, vs, vt = 260.0, 260.0, 260.0
-			ir, is_, it = 150.0, 150.0, 150.0
-			pf1, pf2, pf3 = 0.95, 0.95, 0.95
-			tk1, tk2 = 35.0, 37.0
-		case 5:
-			// Voltage Low: 200V (below typical 210V threshold)
-			vr, vs, vt = 200.0, 200.0, 200.0
-			ir, is_, it = 150.0, 150.0, 150.0
-			pf1, pf2, pf3 = 0.95, 0.95, 0.95
-			tk1, tk2 = 35.0, 37.0
-		case 6:
-			// Current High: 250A (exceeds typical 200A threshold)
-			vr, vs, vt = 230.0, 230.0, 230.0
-			ir, is_, it = 250.0, 250.0, 250.0
-			pf1, pf2, pf3 = 0.95, 0.95, 0.95
-			tk1, tk2 = 35.0, 37.0
-		case 7:
-			// Temperature High: 70°C (exceeds typical 50°C threshold)
-			vr, vs, vt = 230.0, 230.0, 230.0
-			ir, is_, it = 150.0, 150.0, 150.0
-			pf1, pf2, pf3 = 0.95, 0.95, 0.95
-			tk1, tk2 = 70.0, 72.0
-		case 8:
-			// Power Factor Low: 0.75 (below typical 0.85 threshold)
-			vr, vs, vt = 230.0, 230.0, 230.0
-			ir, is_, it = 150.0, 150.0, 150.0
-			pf1, pf2, pf3 = 0.75, 0.75, 0.75
-			tk1, tk2 = 35.0, 37.0
-		}
-
-		in = (ir + is_ + it) * 0.02
-		i1f1, i2f1, i3f1 = ir*0.8, is_*0.8, it*0.8
-		inf1 = in * 0.4
-		i1f2, i2f2, i3f2 = ir*0.7, is_*0.7, it*0.7
-		inf2 = in * 0.3
-
-		// Calculate power values
-		pr, ps, pt := vr*ir*pf1, vs*is_*pf2, vt*it*pf3
-		qr, qs, qt := vr*ir*math.Sqrt(1-pf1*pf1), vs*is_*math.Sqrt(1-pf2*pf2), vt*it*math.Sqrt(1-pf3*pf3)
-		sr, ss, st := vr*ir, vs*is_, vt*it
-		stot := sr + ss + st
-
-		// For cycles 9-10, increase STot to trigger peak updates
-		if cycle == 9 {
-			stot = 100000.0 + float64(count%100)*5000.0 // 100-600 kVA in watts
-			sr, ss, st = stot/3.0, stot/3.0, stot/3.0
-		} else if cycle == 10 {
-			stot = 500000.0 + float64(count%100)*10000.0 // 500-1500 kVA in watts
-			sr, ss, st = stot/3.0, stot/3.0, stot/3.0
-		}
-
-		// Timestamp
-		now = time.Now()
-		ts = now.Unix()
-
-		// Build JSON payload
-		payload = fmt.Sprintf(`{
-			"rtuId": "%s",
-			"TS": %d,
-			"VR": %.2f, "VS": %.2f, "VT": %.2f,
-			"IR": %.2f, "IS": %.2f, "IT": %.2f, "IN": %.2f,
-			"PF1": %.3f, "PF2": %.3f, "PF3": %.3f,
-			"PR": %.2f, "PS": %.2f, "PT": %.2f,
-			"QR": %.2f, "QS": %.2f, "QT": %.2f,
-			"SR": %.2f, "SS": %.2f, "ST": %.2f, "STot": %.2f,
-			"ITot": %.2f,
-			"I1F1": %.2f, "I2F1": %.2f, "I3F1": %.2f, "INF1": %.2f,
-			"I1F2": %.2f, "I2F2": %.2f, "I3F2": %.2f, "INF2": %.2f,
-			"TK1": %.1f, "TK2": %.1f
-		}`, c.Config.RTUID, ts,
-			vr, vs, vt,
-			ir, is_, it, in,
-			pf1, pf2, pf3,
-			pr, ps, pt,
-			qr, qs, qt,
-			sr, ss, st, stot,
-			ir+is_+it,
-			i1f1, i2f1, i3f1, inf1,
-			i1f2, i2f2, i3f2, inf2,
-			tk1, tk2)
+	payload, err := c.Config.Payload.Generate(PayloadContext{
+		RTUID:    c.Config.RTUID,
+		ClientID: c.ClientID,
+		Group:    c.Config.Group,
+		Index:    c.Config.GroupIndex,
+		Seq:      count,
+		Time:     at,
+		Tracking: c.Config.Tracking,
+	})
+	return count, payload, err
+}
 
-	} else {
-		// ============================================
-		// NORMAL MODE: Random realistic values
-		// ============================================
-		vr = 220.0 + mathrand.Float64()*20
-		vs = 220.0 + mathrand.Float64()*20
-		vt = 220.0 + mathrand.Float64()*20
-
-		ir = 80.0 + mathrand.Float64()*120
-		is_ = 80.0 + mathrand.Float64()*120
-		it = 80.0 + mathrand.Float64()*120
-		in = (ir + is_ + it) * 0.02 + mathrand.Float64()*5
-
-		pf1 = 0.90 + mathrand.Float64()*0.09
-		pf2 = 0.90 + mathrand.Float64()*0.09
-		pf3 = 0.90 + mathrand.Float64()*0.09
-
-		i1f1 = ir*0.8 + mathrand.Float64()*20
-		i2f1 = is_*0.8 + mathrand.Float64()*20
-		i3f1 = it*0.8 + mathrand.Float64()*20
-		inf1 = in * 0.4
-
-		i1f2 = ir*0.7 + mathrand.Float64()*20
-		i2f2 = is_*0.7 + mathrand.Float64()*20
-		i3f2 = it*0.7 + mathrand.Float64()*20
-		inf2 = in * 0.3
-
-		tk1 = 25.0 + mathrand.Float64()*20
-		tk2 = tk1 + mathrand.Float64()*5 + 1
-
-		now = time.Now()
-		ts = now.Unix()
-
-		payload = fmt.Sprintf(`{
-			"rtuId": "%s",
-			"TS": %d,
-			"VR": %.2f, "VS": %.2f, "VT": %.2f,
-			"IR": %.2f, "IS": %.2f, "IT": %.2f, "IN": %.2f,
-			"PF1": %.3f, "PF2": %.3f, "PF3": %.3f,
-			"I1F1": %.2f, "I2F1": %.2f, "I3F1": %.2f, "INF1": %.2f,
-			"I1F2": %.2f, "I2F2": %.2f, "I3F2": %.2f, "INF2": %.2f,
-			"TK1": %.1f, "TK2": %.1f
-		}`, c.Config.RTUID, ts,
-			vr, vs, vt,
-			ir, is_, it, in,
-			pf1, pf2, pf3,
-			i1f1, i2f1, i3f1, inf1,
-			i1f2, i2f2, i3f2, inf2,
-			tk1, tk2)
-	}
-
-	// Each RTU publishes to its own topic: thms/{rtuId}/data
-	topic := fmt.Sprintf("%s/%s/data", c.Config.Topic, c.Config.RTUID)
-
-	token := c.client.Publish(topic, c.Config.QoS, c.Config.Retain, payload)
-	atomic.AddInt64(&c.Stats.PublishesTotal, 1)
+// markAcked records a sequence number the broker acknowledged
+func (c *MQTTLoadClient) markAcked(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq > c.lastAcked {
+		c.lastAcked = seq
+	}
+}
 
-	if token.Wait() && token.Error() != nil {
-		atomic.AddInt64(&c.Stats.PublishesFailed, 1)
-		c.Stats.mu.Lock()
-		c.Stats.errors = append(c.Stats.errors, ErrorRecord{
-			Time:     time.Now(),
-			Type:     "publish",
-			ClientID: c.ClientID,
-			Message:  token.Error().Error(),
-		})
-		c.Stats.mu.Unlock()
-	} else {
-		atomic.AddInt64(&c.Stats.PublishesSuccess, 1)
+// markUnpublished excludes a sequence number from delivery verification
+func (c *MQTTLoadClient) markUnpublished(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unpublished == nil {
+		c.unpublished = make(map[int64]struct{})
 	}
+	c.unpublished[seq] = struct{}{}
+}
+
+// setSession replaces the session. Only the publishing goroutine writes it,
+// so reads there need no lock; other goroutines read it under c.mu.
+func (c *MQTTLoadClient) setSession(session mqttSession) {
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+}
+
+// markInflight records that seq went out at QoS 1 alongside other
+// takeover messages rather than in order at Config.QoS
+func (c *MQTTLoadClient) markInflight(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight == nil {
+		c.inflight = make(map[int64]struct{})
+	}
+	c.inflight[seq] = struct{}{}
+}
+
+// sentAs returns a function giving the QoS each sequence number was
+// published at and whether it was published in order
+func (c *MQTTLoadClient) sentAs() func(seq int64) (qos int, ordered bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inflight := make(map[int64]struct{}, len(c.inflight))
+	for seq := range c.inflight {
+		inflight[seq] = struct{}{}
+	}
+	return func(seq int64) (int, bool) {
+		if _, ok := inflight[seq]; ok {
+			return 1, false
+		}
+		return int(c.Config.QoS), true
+	}
+}
+
+// handedOut returns the number of sequence numbers taken so far
+func (c *MQTTLoadClient) handedOut() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PublishCount
+}
+
+// ackedFrom counts the acknowledged sequence numbers from seq on
+func (c *MQTTLoadClient) ackedFrom(seq int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastAcked < seq {
+		return 0
+	}
+	n := c.lastAcked - seq + 1
+	for unpublished := range c.unpublished {
+		if unpublished >= seq && unpublished <= c.lastAcked {
+			n--
+		}
+	}
+	return n
+}
+
+// acknowledged returns the highest acknowledged sequence number and the
+// sequence numbers below it that were never published
+func (c *MQTTLoadClient) acknowledged() (int64, map[int64]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unpublished := make(map[int64]struct{}, len(c.unpublished))
+	for seq := range c.unpublished {
+		unpublished[seq] = struct{}{}
+	}
+	return c.lastAcked, unpublished
 }
 
 func (c *MQTTLoadClient) Disconnect() {
-	if c.client != nil && c.client.IsConnected() {
-		c.client.Disconnect(250)
+	if c.session != nil && c.session.IsConnected() {
+		c.session.Disconnect()
 		atomic.AddInt64(&c.Stats.ActiveClients, -1)
 	}
 }
@@ -444,14 +753,13 @@ Tests MQTT broker capacity with multiple concurrent clients and publish rates.`,
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&broker, "broker", "b", "tcp://localhost:1883", "MQTT broker address")
+	rootCmd.Flags().StringVar(&scenarioFile, "scenario", "", "YAML scenario file with client groups (see configs/mqtt); run-wide flags set explicitly override it")
+	addConnectionFlags(rootCmd)
 	rootCmd.Flags().IntVarP(&clients, "clients", "c", 10, "Number of concurrent clients (RTUs)")
 	rootCmd.Flags().IntVarP(&intervalSec, "interval", "i", 5, "Publish interval per client (seconds)")
 	rootCmd.Flags().IntVarP(&durationSec, "duration", "d", 60, "Test duration (seconds)")
 	rootCmd.Flags().StringVarP(&topic, "topic", "t", "thms", "Base topic for RTU data (format: {topic}/{rtuId}/data)")
-	rootCmd.Flags().StringVar(&rtuPrefix, "rtu-prefix", "25090100000", "RTU ID prefix (will append sequential number)")
-	rootCmd.Flags().StringVarP(&username, "username", "u", "", "Username for authentication")
-	rootCmd.Flags().StringVarP(&password, "password", "P", "", "Password for authentication")
+	rootCmd.Flags().StringVar(&rtuPrefix, "rtu-prefix", "25090100", "RTU ID prefix (a 4-digit sequential number is appended)")
 	rootCmd.Flags().IntVar(&qosLevel, "qos", 0, "QoS level (0, 1, or 2)")
 	rootCmd.Flags().BoolVar(&retain, "retain", false, "Set retain flag")
 	rootCmd.Flags().BoolVar(&clean, "clean", true, "Use clean session")
@@ -459,42 +767,272 @@ func init() {
 	rootCmd.Flags().BoolVar(&syncMode, "sync", false, "Synchronized mode (all devices publish at same interval mark)")
 	rootCmd.Flags().IntVar(&jitterSec, "jitter", 5, "Random jitter in seconds for sync mode (±jitter)")
 	rootCmd.Flags().BoolVar(&testMode, "test-mode", false, "Test mode: generates predictable threshold/peak values for validation")
+	rootCmd.Flags().StringVar(&payloadType, "payload", config.PayloadRTU, "Payload generator: rtu, test-mode, random, template, json or sequence")
+	rootCmd.Flags().IntVar(&payloadSize, "payload-size", 256, "Payload size in bytes for --payload random")
+	rootCmd.Flags().StringVar(&payloadFile, "payload-file", "", "Go text/template file for --payload template or json (see configs/mqtt/payloads), or sequence file for --payload sequence (see configs/mqtt/sequences)")
+	rootCmd.Flags().StringVar(&groundTruth, "ground-truth", "", "Write the alarms sequence payloads should trigger to this JSON file")
+	rootCmd.Flags().IntVar(&subscribers, "subscribers", 0, "Number of subscriber clients measuring end-to-end delivery latency (0 = publish only)")
+	rootCmd.Flags().StringVar(&subMode, "sub-mode", SubModeWildcard, "Subscription mode: wildcard ({topic}/+/data per subscriber) or per-rtu (RTU topics split across subscribers)")
+	rootCmd.Flags().StringArrayVar(&subFilters, "sub-filter", nil, "Wildcard-mode filter, repeatable and cycled across subscribers (e.g. thms/+/data, thms/#); placeholders like thms/{rtuId}/data subscribe to every RTU's exact topic")
+	rootCmd.Flags().IntVar(&sharedCount, "shared-consumers", 0, "Consumers sharing a $share/<group>/<filter> subscription alongside the publishers (0 = none)")
+	rootCmd.Flags().StringVar(&sharedName, "shared-group", "ingest", "Shared subscription group name")
+	rootCmd.Flags().StringVar(&sharedFilter, "shared-filter", "", "Filter the consumers share (default: the publish topic wildcard, e.g. thms/+/data)")
+	rootCmd.Flags().IntVar(&sharedDropAt, "shared-drop-at", 0, "Seconds into the run to kill one consumer and measure load redistribution (0 = never)")
+	rootCmd.Flags().IntSliceVar(&fanoutSteps, "fanout-steps", nil, "Fan-out benchmark: subscriber counts to step through during the run (e.g. 1,10,50,100)")
+	rootCmd.Flags().IntVar(&fanoutStep, "fanout-step", 0, "Seconds per fan-out step (default: duration divided by the number of steps)")
+	rootCmd.Flags().Float64Var(&rate, "rate", 0, "Open-loop mode: publish this many messages per second across all clients on a fixed schedule, measuring latency from the scheduled send time (0 = per-client --interval)")
+	rootCmd.Flags().IntVar(&rateQueue, "rate-queue", 1000, "Scheduled sends a client may fall behind by before further ones are skipped in --rate mode")
+	rootCmd.Flags().IntVar(&rateBehindMs, "rate-behind", 100, "Schedule lag in milliseconds reported as falling behind in --rate mode")
+	rootCmd.Flags().IntVar(&stepClients, "step-clients", 0, "Capacity search: start with this many clients and add as many again every --step-every seconds until a step breaks the SLO (0 = connect all at once)")
+	rootCmd.Flags().IntVar(&stepEverySec, "step-every", 30, "Seconds each capacity step is held and measured")
+	rootCmd.Flags().Float64Var(&sloSuccess, "slo-success", 99, "Minimum publish success percent per capacity step (0 = not checked)")
+	rootCmd.Flags().IntVar(&sloP95Ms, "slo-p95", 500, "Maximum publish acknowledgement p95 per capacity step in milliseconds (0 = not checked)")
+	rootCmd.Flags().IntVar(&sloConnFail, "slo-connect-failures", 0, "Failed connects allowed per capacity step")
+	rootCmd.Flags().IntVar(&keepAliveSec, "keep-alive", 60, "MQTT keep-alive interval in seconds")
+	rootCmd.Flags().BoolVar(&soak, "soak", false, "Idle soak: time every keep-alive PINGREQ/PINGRESP and report connections dropped without DISCONNECT (pair with a long --interval)")
+	rootCmd.Flags().IntVar(&soakWindowSec, "soak-window", 60, "Seconds per window of the --soak ping latency timeline")
+	rootCmd.Flags().IntVar(&drainSec, "drain", 2, "Seconds to wait for in-flight deliveries after publishing stops")
+	rootCmd.Flags().IntVar(&sessionExp, "session-expiry", 0, "MQTT 5 session expiry interval in seconds")
+	rootCmd.Flags().IntVar(&messageExp, "message-expiry", 0, "MQTT 5 message expiry interval in seconds (0 = never)")
+	rootCmd.Flags().StringArrayVar(&userProps, "user-property", nil, "MQTT 5 user property key=value (repeatable)")
+	rootCmd.Flags().BoolVar(&topicAliases, "topic-alias", false, "Use MQTT 5 topic aliases when the broker allows them")
+	rootCmd.Flags().StringVar(&credsFile, "credentials-file", "", "CSV or YAML file mapping RTU ID to client ID, username and password (overrides --username/--password)")
+	rootCmd.Flags().StringVar(&credsOrder, "credentials-order", CredOrderSequential, "How clients draw from --credentials-file: sequential or random (random may reuse entries)")
+	rootCmd.Flags().IntVar(&offlineMsgs, "offline-queue", 0, "Persistent-session test: subscribers subscribe with clean session off and disconnect, each publisher sends this many messages, then subscribers reconnect and drain (0 = timed run)")
+	rootCmd.Flags().IntVar(&offlineSec, "offline-wait", 0, "Extra seconds subscribers stay offline after publishing in --offline-queue mode")
+	rootCmd.Flags().IntVar(&offlineExpiry, "offline-session-expiry", 3600, "MQTT 5 subscriber session expiry in seconds for --offline-queue")
+	rootCmd.Flags().IntVar(&drainTimeout, "drain-timeout", 60, "Seconds to wait for subscribers to drain their queue in --offline-queue mode")
+	rootCmd.Flags().IntVar(&retainedN, "retained-topics", 0, "Retained store test: publishers populate this many retained topics, fresh wildcard subscribers (--subscribers, at least 1) time the snapshot, then the topics are cleared (0 = timed run)")
+	rootCmd.Flags().StringVar(&retainedTmpl, "retained-topic", "loadtest/retained/{index}", "Retained topic template, {index} is the topic number")
+	rootCmd.Flags().IntSliceVar(&retainedSizes, "retained-size", []int{256}, "Retained payload sizes in bytes, cycled across topics (e.g. 64,1024,16384)")
+	rootCmd.Flags().IntVar(&retainedWait, "retained-timeout", 60, "Seconds each subscriber waits for the full retained snapshot")
+	rootCmd.Flags().BoolVar(&retainedKeep, "retained-keep", false, "Leave the retained topics in place instead of clearing them")
+	rootCmd.Flags().Float64Var(&churnRate, "churn-rate", 0, "Publishers disconnected and reconnected per second during the run")
+	rootCmd.Flags().IntVar(&herdAtSec, "herd-at", 0, "Seconds into the run to drop every publisher at once and let them reconnect (thundering herd, 0 = off)")
+	rootCmd.Flags().StringVar(&backoff, "backoff", config.BackoffExponential, "Reconnect backoff for churn and herd: immediate, fixed, exponential or jitter")
+	rootCmd.Flags().IntVar(&backoffInitMs, "backoff-initial", 500, "Initial reconnect delay in milliseconds")
+	rootCmd.Flags().IntVar(&backoffMaxMs, "backoff-max", 30000, "Maximum reconnect delay in milliseconds")
+	rootCmd.Flags().Float64Var(&takeoverFrac, "takeover", 0, "Fraction of publishers (0-1) that open a second connection with the same client ID")
+	rootCmd.Flags().IntVar(&takeoverAtSec, "takeover-at", 0, "Seconds into the run for the client-ID takeover (0 = half the run)")
+	rootCmd.Flags().IntVar(&takeoverMsgs, "takeover-inflight", 10, "QoS 1 messages in flight on the old session when the takeover connects")
+	rootCmd.Flags().StringVar(&willTopic, "will-topic", "", "Last Will topic, supports {rtuId}, {clientId}, {group} and {index} (e.g. thms/{rtuId}/status)")
+	rootCmd.Flags().StringVar(&willPayload, "will-payload", "", "Last Will payload, same placeholders as --will-topic (default {\"rtuId\":\"{rtuId}\",\"status\":\"offline\"})")
+	rootCmd.Flags().IntVar(&willQoS, "will-qos", 1, "Last Will QoS")
+	rootCmd.Flags().BoolVar(&willRetain, "will-retain", false, "Set the retain flag on the Last Will")
+	rootCmd.Flags().IntVar(&willDelay, "will-delay", 0, "MQTT 5 will delay interval in seconds")
+	rootCmd.Flags().Float64Var(&killFrac, "kill", 0, "Fraction of publishers (0-1) whose TCP connection is closed without DISCONNECT so their wills fire")
+	rootCmd.Flags().IntVar(&killAtSec, "kill-at", 0, "Seconds into the run to kill connections (0 = half the run)")
+	rootCmd.Flags().StringVar(&compareBroker, "compare-broker", "", "Second listener (e.g. ws://localhost:8080/mqtt); clients alternate between --broker and this one for a side-by-side report")
+	rootCmd.Flags().StringVar(&reportFormat, "report-format", reportConsole, "Final report format: console, json, html, csv (per operation) or junit; anything but console goes to stdout alone, with progress on stderr, unless --report-output is set")
+	rootCmd.Flags().StringVar(&reportOutput, "report-output", "", "Write the --report-format report to this file instead of stdout")
+	rootCmd.Flags().StringVar(&timelineFile, "timeline-output", "", "Write a per-second CSV timeline of connects, publishes, deliveries and errors to this file")
+	rootCmd.Flags().StringVar(&brokerMetrics, "broker-metrics", "", "Broker Prometheus endpoint to scrape during the run (e.g. localhost:8888 for VerneMQ's listener.http.metrics); counter deltas join the report and timeline")
+	rootCmd.Flags().IntVar(&scrapeSec, "broker-metrics-interval", 5, "Seconds between --broker-metrics scrapes")
+	rootCmd.Flags().StringArrayVar(&scrapeNames, "broker-metric", config.DefaultBrokerMetrics, "Broker counter to scrape, summed across labels (repeatable, replaces the defaults)")
+	rootCmd.Flags().BoolVar(&embedded, "embedded-broker", false, "Run against an in-process MQTT 3.1.1 broker instead of --broker, for self-tests and offline demos")
+	rootCmd.Flags().StringVar(&embeddedAddr, "embedded-addr", "127.0.0.1:0", "Listen address of the --embedded-broker (port 0 picks a free one)")
+	rootCmd.Flags().IntVar(&embeddedLatency, "embedded-latency", 0, "Milliseconds the embedded broker waits before routing each publish")
+	rootCmd.Flags().Float64Var(&embeddedDrop, "embedded-drop", 0, "Fraction of publishes (0-1) the embedded broker acknowledges but never routes")
+	rootCmd.Flags().Float64Var(&embeddedReject, "embedded-reject", 0, "Fraction of connects (0-1) the embedded broker refuses with server unavailable")
+	rootCmd.Flags().Float64Var(&embeddedDisconnect, "embedded-disconnect", 0, "Fraction of publishes (0-1) the embedded broker answers by closing the connection")
+	rootCmd.Flags().Int64Var(&embeddedSeed, "embedded-seed", 0, "Seed for the embedded broker's fault injection, to reproduce a run (0 = random)")
+}
+
+// addConnectionFlags registers the flags describing how to reach the broker,
+// shared by the load test and the probe command
+func addConnectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&broker, "broker", "b", "tcp://localhost:1883", "MQTT broker address")
+	cmd.Flags().StringVarP(&username, "username", "u", "", "Username for authentication")
+	cmd.Flags().StringVarP(&password, "password", "P", "", "Password for authentication")
+	cmd.Flags().IntVar(&protocolVer, "protocol-version", 4, "MQTT protocol version: 3 (3.1), 4 (3.1.1) or 5")
+	cmd.Flags().StringVar(&tlsOpts.CAFile, "ca-file", "", "CA bundle (PEM) for verifying ssl:// and tls:// brokers")
+	cmd.Flags().StringVar(&tlsOpts.CertFile, "cert-file", "", "Client certificate (PEM) for mutual TLS")
+	cmd.Flags().StringVar(&tlsOpts.KeyFile, "key-file", "", "Client private key (PEM) for mutual TLS")
+	cmd.Flags().StringVar(&tlsOpts.ClientCertDir, "client-cert-dir", "", "Directory with per-RTU certificates named {rtuId}.crt and {rtuId}.key")
+	cmd.Flags().StringVar(&tlsOpts.ServerName, "server-name", "", "TLS server name (SNI), defaults to the broker host")
+	cmd.Flags().BoolVar(&tlsOpts.Insecure, "insecure", false, "Skip broker certificate verification")
+	cmd.Flags().StringVar(&wsPath, "ws-path", "/mqtt", "WebSocket path for ws:// and wss:// brokers without one in the URL")
+	cmd.Flags().StringVar(&wsSubprotocol, "ws-subprotocol", "mqtt", "WebSocket subprotocol offered to the broker")
+	cmd.Flags().StringArrayVar(&wsHeaders, "ws-header", nil, "Extra WebSocket handshake header \"Key: Value\" (repeatable)")
 }
 
 func runLoadTest(cmd *cobra.Command, args []string) {
-	duration := time.Duration(durationSec) * time.Second
-	interval := time.Duration(intervalSec) * time.Second
-	jitter := time.Duration(jitterSec) * time.Second
-	qos := byte(qosLevel)
-
-	fmt.Printf("\n🚀 Starting MQTT Load Test\n")
-	fmt.Printf("   Broker:   %s\n", broker)
-	fmt.Printf("   Clients:  %d\n", clients)
-	fmt.Printf("   Duration: %v\n", duration)
-	fmt.Printf("   Interval: %v\n", interval)
-	if testMode {
-		fmt.Printf("   Mode:     🧪 TEST MODE (predictable threshold/peak values)\n")
-		fmt.Printf("   Pattern:  10-msg cycle: normal x3, V-high, V-low, I-high, Temp-high, PF-low, peak x2\n")
-	} else if syncMode {
-		fmt.Printf("   Mode:     🔄 SYNCHRONIZED BURST (at :00, :15, :30, :45)\n")
-		fmt.Printf("   Jitter:   ±%v\n", jitter)
+	if err := setupReportOutput(reportFormats); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if scenarioFile == "" && subscribers > 0 && subMode != SubModeWildcard && subMode != SubModePerRTU {
+		fmt.Fprintf(os.Stderr, "Error: invalid --sub-mode %q (use %s or %s)\n", subMode, SubModeWildcard, SubModePerRTU)
+		os.Exit(1)
+	}
+
+	if scenarioFile == "" && (protocolVer < 3 || protocolVer > 5) {
+		fmt.Fprintf(os.Stderr, "Error: invalid --protocol-version %d (use 3, 4 or 5)\n", protocolVer)
+		os.Exit(1)
+	}
+
+	sc, err := resolveScenario(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var embeddedBroker *mqttbroker.Broker
+	if embedded {
+		embeddedBroker, err = startEmbeddedBroker(sc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: embedded broker: %v\n", err)
+			os.Exit(1)
+		}
+		defer embeddedBroker.Stop()
+	}
+
+	groups := make([]*clientGroup, len(sc.Groups))
+	for i, g := range sc.Groups {
+		groups[i], err = newClientGroup(g)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	tlsOpts = TLSOptions(sc.TLS)
+	baseTLS, err := buildTLSConfig(tlsOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	wsHeader, err := parseWSHeaders(sc.WebSocket.Headers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	clients := sc.TotalClients()
+	duration := sc.Duration
+	verbose := sc.Verbose
+	offlineQueue := sc.OfflineQueue.Messages > 0
+	retainedStorm := sc.Retained.Topics > 0
+	timed := !offlineQueue && !retainedStorm
+	stepLoad := timed && sc.StepLoad.Clients > 0
+	fanoutSteps := sc.Subscribers.Fanout.Steps
+	subCount := sc.Subscribers.Count
+	if len(fanoutSteps) > 0 {
+		subCount = fanoutSteps[len(fanoutSteps)-1]
+	}
+
+	fmt.Fprintf(consoleOut, "\n🚀 Starting MQTT Load Test\n")
+	if sc.Name != "" {
+		fmt.Fprintf(consoleOut, "   Scenario: %s\n", sc.Name)
+	}
+	fmt.Fprintf(consoleOut, "   Broker:   %s\n", sc.Broker)
+	if embeddedBroker != nil {
+		fmt.Fprintf(consoleOut, "   Embedded: 🧪 %s\n", describeEmbedded())
+	}
+	if sc.CompareBroker != "" {
+		fmt.Fprintf(consoleOut, "   Compare:  %s (clients split evenly)\n", sc.CompareBroker)
+	}
+	fmt.Fprintf(consoleOut, "   Protocol: %s\n", protocolName(sc.ProtocolVersion))
+	fmt.Fprintf(consoleOut, "   Clients:  %d\n", clients)
+	if offlineQueue {
+		fmt.Fprintf(consoleOut, "   Offline:  📴 %d messages per client queued for offline subscribers (session expiry %v)\n",
+			sc.OfflineQueue.Messages, sc.OfflineQueue.SessionExpiry)
+	} else if retainedStorm {
+		fmt.Fprintf(consoleOut, "   Retained: 📌 %d topics (%s, sizes %v bytes), snapshot by %d fresh subscribers\n",
+			sc.Retained.Topics, sc.Retained.Topic, sc.Retained.Sizes, max(sc.Subscribers.Count, 1))
+	} else if stepLoad {
+		fmt.Fprintf(consoleOut, "   Steps:    📶 +%d clients every %v up to %d, until a step breaks the SLO\n",
+			sc.StepLoad.Clients, sc.StepLoad.Every, clients)
+	} else {
+		fmt.Fprintf(consoleOut, "   Duration: %v\n", duration)
+	}
+	if timed && (sc.Churn.Rate > 0 || sc.Churn.HerdAt > 0) {
+		churn := fmt.Sprintf("%.2f clients/s", sc.Churn.Rate)
+		if sc.Churn.HerdAt > 0 {
+			churn += fmt.Sprintf(", herd at %v", sc.Churn.HerdAt)
+		}
+		fmt.Fprintf(consoleOut, "   Churn:    🔁 %s, %s backoff\n", churn, sc.Churn.Backoff.Policy)
+	}
+	if timed && sc.Takeover.Fraction > 0 {
+		fmt.Fprintf(consoleOut, "   Takeover: 👯 %.0f%% of clients at %v, %d QoS 1 in flight\n",
+			sc.Takeover.Fraction*100, sc.Takeover.At, sc.Takeover.InFlight)
+	}
+	if timed && sc.Shared.Consumers > 0 {
+		drop := ""
+		if sc.Shared.DropAt > 0 {
+			drop = fmt.Sprintf(", one killed at %v", sc.Shared.DropAt)
+		}
+		fmt.Fprintf(consoleOut, "   Shared:   🤝 %d consumers in $share/%s%s\n", sc.Shared.Consumers, sc.Shared.Group, drop)
+	}
+	if timed && sc.OpenLoop.Rate > 0 {
+		fmt.Fprintf(consoleOut, "   Rate:     🎯 %.1f msg/s open loop across all clients, behind past %v\n", sc.OpenLoop.Rate, sc.OpenLoop.Behind)
+	}
+	if sc.BrokerMetrics.URL != "" {
+		fmt.Fprintf(consoleOut, "   Metrics:  📈 %s every %v\n", brokermetrics.Endpoint(sc.BrokerMetrics.URL), sc.BrokerMetrics.Interval)
+	}
+	if timed && sc.Soak.Enabled {
+		fmt.Fprintf(consoleOut, "   Soak:     💤 keep-alive pings timed per %v window, drops without DISCONNECT tracked\n", sc.Soak.Window)
+	}
+	if timed && sc.Kill.Fraction > 0 {
+		fmt.Fprintf(consoleOut, "   Kill:     💀 %.0f%% of clients with a will at %v\n", sc.Kill.Fraction*100, sc.Kill.At)
+	}
+	if len(groups) == 1 {
+		printGroupSettings(groups[0])
 	} else {
-		fmt.Printf("   Mode:     ⏱ Continuous stream\n")
+		for _, g := range groups {
+			fmt.Fprintf(consoleOut, "   Group:    %s: %s\n", g.Name, g.describe())
+		}
+	}
+	if subCount > 0 {
+		if len(fanoutSteps) > 0 {
+			fmt.Fprintf(consoleOut, "   Fan-out:  📈 %v subscribers (%s)\n", fanoutSteps, sc.Subscribers.Mode)
+		} else {
+			fmt.Fprintf(consoleOut, "   Subs:     %d (%s)\n", sc.Subscribers.Count, sc.Subscribers.Mode)
+		}
+		for _, g := range groups {
+			if g.Payload.Type == config.PayloadRandom {
+				fmt.Fprintf(consoleOut, "   ⚠️  %s: random payloads carry no tracking fields; subscribers will count them as malformed\n", g.Name)
+			}
+		}
 	}
-	fmt.Printf("   Topic:    %s\n", topic)
-	if username != "" {
-		fmt.Printf("   Auth:     %s:***\n", username)
+	for _, g := range groups {
+		prefix := ""
+		if len(groups) > 1 {
+			prefix = g.Name + ": "
+		}
+		if g.picker != nil {
+			fmt.Fprintf(consoleOut, "   Auth:     %s%d credentials from %s (%s)\n", prefix, g.credCount, g.Credentials.File, g.Credentials.Order)
+			if g.Clients > g.credCount {
+				fmt.Fprintf(consoleOut, "   ⚠️  %d clients share %d credentials; entries with a client_id will take over each other's sessions\n", g.Clients, g.credCount)
+			}
+		} else if g.Credentials.Username != "" {
+			fmt.Fprintf(consoleOut, "   Auth:     %s%s:***\n", prefix, g.Credentials.Username)
+		}
 	}
-	fmt.Printf("   Press Ctrl+C to stop early\n\n")
+	fmt.Fprintf(consoleOut, "   Press Ctrl+C to stop early\n\n")
 
 	stats := &Stats{
 		StartTime: time.Now(),
 		errors:    make([]ErrorRecord, 0),
+		Metrics:   metrics.NewCollector(),
+		Embedded:  embeddedBroker,
+	}
+	stats.Metrics.Start()
+
+	var scrapeStop, scrapeDone chan struct{}
+	if sc.BrokerMetrics.URL != "" {
+		scrapeStop, scrapeDone = make(chan struct{}), make(chan struct{})
+		go runBrokerScraper(sc.BrokerMetrics, stats.StartTime, &stats.Broker, scrapeStop, scrapeDone)
+	}
+	if sc.CompareBroker != "" {
+		stats.Listeners = []*ListenerStats{{Broker: sc.Broker}, {Broker: sc.CompareBroker}}
 	}
 
 	// Create clients
-	fmt.Println("📡 Connecting clients...")
-	clientList := make([]*MQTTLoadClient, clients)
+	fmt.Fprintln(consoleOut, "📡 Connecting clients...")
+	failedBefore := atomic.LoadInt64(&stats.ConnectionsFailed)
+	clientList := make([]*MQTTLoadClient, 0, clients)
 	var wg sync.WaitGroup
 
 	// Dynamic connection rate based on client count
@@ -514,47 +1052,123 @@ func runLoadTest(cmd *cobra.Command, args []string) {
 		staggerDelay = 15 * time.Millisecond
 	}
 
-	fmt.Printf("🔧 Connection settings: %d concurrent, %v stagger\n", maxConcurrentConns, staggerDelay)
+	fmt.Fprintf(consoleOut, "🔧 Connection settings: %d concurrent, %v stagger\n", maxConcurrentConns, staggerDelay)
 
 	semaphore := make(chan struct{}, maxConcurrentConns)
 
-	for i := 0; i < clients; i++ {
-		num := i + 1
-		rtuID := fmt.Sprintf("25090100%04d", num)
-		clientID := fmt.Sprintf("mqtt_client_%d", i+1)
-
-		clientList[i] = &MQTTLoadClient{
-			ID:       i + 1,
-			ClientID: clientID,
-			Config: ClientConfig{
-				Broker:   broker,
-				Topic:    topic,
-				RTUID:    rtuID,
-				Username: username,
-				Password: password,
-				QoS:      qos,
-				Retain:   retain,
-				Clean:    clean,
-			},
-			Stats: stats,
-			Done:  make(chan struct{}),
-		}
-
-		// Stagger connections to reduce auth service load
-		time.Sleep(staggerDelay)
+	for _, g := range groups {
+		for n := 0; n < g.Clients; n++ {
+			i := len(clientList)
+			rtuID := g.rtuID(n)
+			clientID := fmt.Sprintf("%s%d", g.ClientIDPrefix, i+1)
+			clientUser, clientPass := g.Credentials.Username, g.Credentials.Password
+
+			var credLabel string
+			if g.picker != nil {
+				cred := g.picker.Next()
+				if cred.RTUID != "" {
+					rtuID = cred.RTUID
+				}
+				if cred.ClientID != "" {
+					clientID = cred.ClientID
+				}
+				clientUser, clientPass = cred.Username, cred.Password
+				credLabel = cred.label()
+			}
 
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
+			clientBroker := sc.Broker
+			var listener *ListenerStats
+			if len(stats.Listeners) > 0 {
+				listener = stats.Listeners[i%len(stats.Listeners)]
+				listener.Clients++
+				clientBroker = listener.Broker
+			}
 
-			// Acquire semaphore slot (blocks if max concurrent connections reached)
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }() // Release slot when done
+			clientTLS, err := clientTLSConfig(baseTLS, sc.TLS.ClientCertDir, rtuID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
 
-			if err := clientList[idx].Connect(); err != nil && verbose {
-				fmt.Printf("⚠️  Client %d failed to connect: %v\n", idx+1, err)
+			client := &MQTTLoadClient{
+				ID:       i + 1,
+				ClientID: clientID,
+				Config: ClientConfig{
+					Broker:       clientBroker,
+					PublishTopic: g.topicFor(rtuID, clientID, n+1),
+					RTUID:        rtuID,
+					Username:     clientUser,
+					Password:     clientPass,
+					QoS:          byte(g.QoS),
+					Retain:       g.Retain,
+					Clean:        g.CleanSession(),
+
+					Group:      g.Name,
+					GroupIndex: n + 1,
+					Interval:   g.Interval,
+					Schedule:   g.Schedule,
+					Jitter:     g.Jitter,
+					Payload:    g.payload,
+					Tracking:   subCount > 0 || sc.Shared.Consumers > 0,
+
+					TLSConfig: clientTLS,
+
+					WSPath:        sc.WebSocket.Path,
+					WSSubprotocol: sc.WebSocket.Subprotocol,
+					WSHeader:      wsHeader,
+
+					ProtocolVersion: sc.ProtocolVersion,
+					SessionExpiry:   uint32(g.SessionExpiry / time.Second),
+					MessageExpiry:   uint32(g.MessageExpiry / time.Second),
+					UserProperties:  g.properties,
+					TopicAliases:    g.TopicAliases,
+					KeepAlive:       g.KeepAlive,
+				},
+				Stats:      stats,
+				Done:       make(chan struct{}),
+				Listener:   listener,
+				Credential: credLabel,
+				reconnect:  make(chan reconnectRequest, 1),
+				herd:       make(chan reconnectRequest, 1),
+			}
+			if sc.OpenLoop.Rate > 0 {
+				client.schedule = make(chan time.Time, sc.OpenLoop.Queue)
 			}
-		}(i)
+			if timed && sc.Soak.Enabled {
+				client.Config.Soak = &stats.Soak
+			}
+			if g.Will.Topic != "" {
+				client.Config.Will = &willMessage{
+					Topic:   g.expand(g.Will.Topic, rtuID, clientID, n+1),
+					Payload: []byte(g.expand(g.Will.Payload, rtuID, clientID, n+1)),
+					QoS:     byte(g.Will.QoS),
+					Retain:  g.Will.Retain,
+					Delay:   uint32(g.Will.Delay / time.Second),
+				}
+			}
+			clientList = append(clientList, client)
+
+			// Later capacity steps connect the rest during the run
+			if stepLoad && i >= sc.StepLoad.Clients {
+				continue
+			}
+
+			// Stagger connections to reduce auth service load
+			time.Sleep(staggerDelay)
+
+			wg.Add(1)
+			go func(c *MQTTLoadClient) {
+				defer wg.Done()
+
+				// Acquire semaphore slot (blocks if max concurrent connections reached)
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }() // Release slot when done
+
+				if err := c.Connect(); err != nil && verbose {
+					fmt.Fprintf(consoleOut, "⚠️  Client %d failed to connect: %v\n", c.ID, err)
+				}
+			}(client)
+		}
 	}
 
 	wg.Wait()
@@ -562,13 +1176,182 @@ func runLoadTest(cmd *cobra.Command, args []string) {
 	connSuccess := atomic.LoadInt64(&stats.ConnectionsSuccess)
 	connFailed := atomic.LoadInt64(&stats.ConnectionsFailed)
 
-	fmt.Printf("\n✅ Connected: %d/%d\n", connSuccess, clients)
+	initial := clients
+	if stepLoad {
+		initial = min(clients, sc.StepLoad.Clients)
+	}
+	fmt.Fprintf(consoleOut, "\n✅ Connected: %d/%d\n", connSuccess, initial)
 	if connFailed > 0 {
-		fmt.Printf("⚠️  Failed: %d\n", connFailed)
+		fmt.Fprintf(consoleOut, "⚠️  Failed: %d\n", connFailed)
+	}
+
+	// Connect subscribers before publishing so no message is missed
+	var subList []*MQTTSubscriber
+	delivery := &DeliveryStats{}
+	subBase := subscriberConfig(sc, baseTLS, wsHeader)
+	if subCount > 0 && !retainedStorm {
+		initial := subCount
+		if len(fanoutSteps) > 0 {
+			initial = fanoutSteps[0]
+		}
+		fmt.Fprintf(consoleOut, "\n📥 Connecting %d subscribers (%s)...\n", initial, sc.Subscribers.Mode)
+		subCfg := subBase
+		subCfg.QoS = maxGroupQoS(groups)
+		subCfg.Clean = !offlineQueue
+		if offlineQueue {
+			subCfg.SessionExpiry = uint32(sc.OfflineQueue.SessionExpiry / time.Second)
+		}
+		var filters []string
+		for _, g := range groups {
+			filters = appendUnique(filters, g.wildcardFilter())
+		}
+		subList = newSubscriberPool(subCount, sc.Subscribers.Mode, subCfg, filters, sc.Subscribers.Filters, clientList, stats, delivery)
+		connectSubscribers(subList[:initial], clientList, offlineQueue, verbose)
+	}
+
+	var shared *sharedGroup
+	if sc.Shared.Consumers > 0 && timed {
+		var filters []string
+		for _, g := range groups {
+			filters = appendUnique(filters, g.wildcardFilter())
+		}
+		shared = newSharedGroup(sc.Shared, filters, stats)
+		fmt.Fprintf(consoleOut, "\n🤝 Connecting %d shared consumers (%s)...\n", sc.Shared.Consumers, strings.Join(shared.Filters, ", "))
+		sharedCfg := subBase
+		sharedCfg.QoS = maxGroupQoS(groups)
+		shared.connect(sharedCfg, clientList)
+	}
+
+	// Watch the will topics before any connection can be killed
+	var willMonitor mqttSession
+	willFilters, willQoS, willDelay := willTopics(groups)
+	if len(willFilters) > 0 {
+		monitorCfg := subBase
+		monitorCfg.QoS = willQoS
+		willMonitor, err = startWillMonitor(monitorCfg, willFilters, &stats.Wills)
+		if err != nil {
+			fmt.Fprintf(consoleOut, "⚠️  Will monitor failed to connect: %v\n", err)
+		}
+	}
+
+	var offlineReport *OfflineQueueReport
+	var retainedReport *RetainedReport
+	var fanoutReport *FanoutReport
+	var capacityReport *CapacityReport
+	if offlineQueue {
+		offlineReport = runOfflineQueue(sc.OfflineQueue, clientList, subList, stats, delivery)
+	} else if retainedStorm {
+		retainedReport = runRetainedStorm(sc.Retained, clientList, subBase, sc.Subscribers.Count, stats)
+	} else {
+		var fanout chan *FanoutReport
+		phaseDone := make(chan struct{})
+		if shared != nil && sc.Shared.DropAt > 0 {
+			go shared.runDrop(sc.Shared.DropAt, phaseDone)
+		}
+		if len(fanoutSteps) > 0 && len(subList) > 0 {
+			fanout = make(chan *FanoutReport, 1)
+			patterns := sc.Subscribers.Filters
+			if len(patterns) == 0 {
+				patterns = subList[0].Filters
+			}
+			go func() {
+				fanout <- runFanout(sc.Subscribers.Fanout, duration, subList, clientList, patterns, stats, delivery, verbose, phaseDone)
+			}()
+		}
+		// A capacity search runs until a step breaks the SLO, not for a duration
+		var capacity chan *CapacityReport
+		var stepEnd chan struct{}
+		publishFor := duration
+		if stepLoad {
+			capacity = make(chan *CapacityReport, 1)
+			stepEnd = make(chan struct{})
+			publishFor = 0
+			go func() {
+				capacity <- runStepLoad(sc.StepLoad, clientList, stats, failedBefore, phaseDone, stepEnd)
+			}()
+		}
+		runPublishPhase(clientList, stats, publishFor, sc, stepEnd)
+		close(phaseDone)
+		if fanout != nil {
+			fanoutReport = <-fanout
+		}
+		if capacity != nil {
+			capacityReport = <-capacity
+		}
+	}
+
+	fmt.Fprintln(consoleOut, "\n🛑 Stopping clients...")
+
+	if willMonitor != nil {
+		waitForWills(&stats.Wills, willDelay)
 	}
 
+	// Give subscribers time to receive messages still in flight
+	if timed && len(subList) > 0 && sc.Drain > 0 {
+		fmt.Fprintf(consoleOut, "⏳ Draining deliveries for %v...\n", sc.Drain)
+		time.Sleep(sc.Drain)
+	}
+
+	for _, client := range clientList {
+		client.Disconnect()
+	}
+	for _, sub := range subList {
+		sub.Disconnect()
+	}
+	if shared != nil {
+		shared.disconnect()
+	}
+	var willReport *WillReport
+	if willMonitor != nil {
+		willMonitor.Disconnect()
+		willReport = buildWillReport(&stats.Wills, willDelay)
+	}
+
+	// Wait a bit for graceful disconnect
+	time.Sleep(500 * time.Millisecond)
+
+	var deliveryReport *DeliveryReport
+	if len(subList) > 0 {
+		deliveryReport = buildDeliveryReport(subList, clientList, stats, delivery, sc.Subscribers.Mode)
+		deliveryReport.Fanout = fanoutReport
+	}
+
+	var sharedReport *SharedReport
+	if shared != nil {
+		sharedReport = shared.buildReport(clientList)
+	}
+
+	var takeoverReport *TakeoverReport
+	if timed && sc.Takeover.Fraction > 0 {
+		takeoverReport = buildTakeoverReport(&stats.Takeover, subList)
+	}
+
+	if sc.GroundTruth != "" {
+		n, err := writeGroundTruth(sc.GroundTruth, sc.Broker, groups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Fprintf(consoleOut, "🎯 Ground truth: %d alarm transitions written to %s\n", n, sc.GroundTruth)
+		}
+	}
+
+	if scrapeStop != nil {
+		close(scrapeStop)
+		<-scrapeDone
+	}
+
+	// Display final report
+	displayFinalReport(sc, stats, deliveryReport, offlineReport, sharedReport, takeoverReport, willReport, retainedReport, capacityReport)
+}
+
+// runPublishPhase publishes on every client's schedule until the duration
+// elapses, end is closed or the run is interrupted. A zero duration never
+// elapses.
+func runPublishPhase(clientList []*MQTTLoadClient, stats *Stats, duration time.Duration, sc *config.MQTTScenario, end <-chan struct{}) {
+	var wg sync.WaitGroup
+
 	// Start publishing
-	fmt.Println("\n📤 Starting publish phase...\n")
+	fmt.Fprint(consoleOut, "\n📤 Starting publish phase...\n\n")
 
 	// Progress reporter
 	stopProgress := make(chan struct{})
@@ -591,14 +1374,34 @@ func runLoadTest(cmd *cobra.Command, args []string) {
 		wg.Add(1)
 		go func(c *MQTTLoadClient) {
 			defer wg.Done()
-			if syncMode {
-				c.StartPublishingSync(interval, jitter)
+			if c.schedule != nil {
+				c.StartPublishingScheduled()
+			} else if c.Config.Schedule == config.ScheduleSync {
+				c.StartPublishingSync(c.Config.Interval, c.Config.Jitter)
 			} else {
-				c.StartPublishing(interval)
+				c.StartPublishing(c.Config.Interval)
 			}
 		}(client)
 	}
 
+	if sc.Soak.Enabled {
+		stats.Soak.begin(sc.Soak.Window, atomic.LoadInt64(&stats.ActiveClients))
+	}
+
+	stopChurn := make(chan struct{})
+	if sc.OpenLoop.Rate > 0 {
+		go runScheduler(sc.OpenLoop, clientList, &stats.Schedule, stopChurn)
+	}
+	if sc.Churn.Rate > 0 || sc.Churn.HerdAt > 0 {
+		go runChurn(sc.Churn, clientList, stats, stopChurn)
+	}
+	if sc.Takeover.Fraction > 0 {
+		go runTakeover(sc.Takeover, clientList, stopChurn)
+	}
+	if sc.Kill.Fraction > 0 {
+		go runKill(sc.Kill, clientList, stopChurn)
+	}
+
 	// Wait for duration or interrupt
 	done := make(chan struct{})
 	go func() {
@@ -610,28 +1413,33 @@ func runLoadTest(cmd *cobra.Command, args []string) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+
 	select {
-	case <-time.After(duration):
-		fmt.Println("\n\n⏰ Test duration completed")
+	case <-timeout:
+		fmt.Fprintln(consoleOut, "\n\n⏰ Test duration completed")
+	case <-end:
+		fmt.Fprintln(consoleOut, "\n\n📶 Capacity search completed")
 	case <-sigChan:
-		fmt.Println("\n\n⚠️  Test interrupted by user")
+		fmt.Fprintln(consoleOut, "\n\n⚠️  Test interrupted by user")
 	case <-done:
 	}
 
 	// Stop all clients
 	close(stopProgress)
-	fmt.Println("\n🛑 Stopping clients...")
-
+	close(stopChurn)
 	for _, client := range clientList {
 		close(client.Done)
-		client.Disconnect()
 	}
-
-	// Wait a bit for graceful disconnect
-	time.Sleep(500 * time.Millisecond)
-
-	// Display final report
-	displayFinalReport(stats)
+	if sc.OpenLoop.Rate > 0 {
+		stats.Schedule.finish(clientList)
+	}
+	if sc.Soak.Enabled {
+		stats.Soak.finish()
+	}
 }
 
 func displayProgress(stats *Stats) {
@@ -646,11 +1454,11 @@ func displayProgress(stats *Stats) {
 		perSec = float64(pubSuccess) / elapsed
 	}
 
-	fmt.Printf("\r⏱ %.1fs | 🔗 %d/%d | 👥 %d active | 📤 %d pubs (%.1f/s)    ",
+	fmt.Fprintf(consoleOut, "\r⏱ %.1fs | 🔗 %d/%d | 👥 %d active | 📤 %d pubs (%.1f/s)    ",
 		elapsed, connSuccess, connSuccess+connFailed, active, pubSuccess, perSec)
 }
 
-func displayFinalReport(stats *Stats) {
+func displayFinalReport(sc *config.MQTTScenario, stats *Stats, delivery *DeliveryReport, offline *OfflineQueueReport, shared *SharedReport, takeover *TakeoverReport, will *WillReport, retained *RetainedReport, capacity *CapacityReport) {
 	elapsed := time.Since(stats.StartTime)
 
 	connTotal := atomic.LoadInt64(&stats.ConnectionsTotal)
@@ -675,79 +1483,344 @@ func displayFinalReport(stats *Stats) {
 		perSec = float64(pubSuccess) / elapsed.Seconds()
 	}
 
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println("           MQTT LOAD TEST RESULTS")
-	fmt.Println(strings.Repeat("=", 60))
+	fmt.Fprintln(consoleOut, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(consoleOut, "           MQTT LOAD TEST RESULTS")
+	fmt.Fprintln(consoleOut, strings.Repeat("=", 60))
+
+	fmt.Fprintln(consoleOut, "\nTest Configuration:")
+	fmt.Fprintf(consoleOut, "  Duration:     %.1fs\n", elapsed.Seconds())
+	if sc.Name != "" {
+		fmt.Fprintf(consoleOut, "  Scenario:     %s\n", sc.Name)
+	}
+	fmt.Fprintf(consoleOut, "  Target:       %s\n", sc.Broker)
+	fmt.Fprintf(consoleOut, "  Protocol:     %s\n", protocolName(sc.ProtocolVersion))
+	if len(sc.Groups) == 1 {
+		fmt.Fprintf(consoleOut, "  Topic:        %s\n", sc.Groups[0].Topic)
+		fmt.Fprintf(consoleOut, "  QoS:          %d\n", sc.Groups[0].QoS)
+	} else {
+		for _, g := range sc.Groups {
+			fmt.Fprintf(consoleOut, "  Group:        %s (%d clients, %s, QoS %d)\n", g.Name, g.Clients, g.Topic, g.QoS)
+		}
+	}
+
+	fmt.Fprintln(consoleOut, "\nConnection Statistics:")
+	fmt.Fprintf(consoleOut, "  Total:        %d\n", connTotal)
+	fmt.Fprintf(consoleOut, "  Successful:   %d (%.2f%%)\n", connSuccess, connRate)
+	fmt.Fprintf(consoleOut, "  Failed:       %d\n", connFailed)
+
+	phases := ConnectPhaseStats{
+		TCPDial:     stats.DialLatency.Summary(),
+		MQTTConnect: stats.MQTTLatency.Summary(),
+		Total:       stats.latencySince(0, isConnect),
+	}
+	if stats.TLSLatency.Count() > 0 {
+		tlsPhase := stats.TLSLatency.Summary()
+		phases.TLSHandshake = &tlsPhase
+	}
 
-	fmt.Println("\nTest Configuration:")
-	fmt.Printf("  Duration:     %.1fs\n", elapsed.Seconds())
-	fmt.Printf("  Target:       %s\n", broker)
-	fmt.Printf("  Topic:        %s\n", topic)
-	fmt.Printf("  QoS:          %d\n", qosLevel)
+	if stats.UpgradeLatency.Count() > 0 {
+		upgrade := stats.UpgradeLatency.Summary()
+		phases.WSUpgrade = &upgrade
+	}
 
-	fmt.Println("\nConnection Statistics:")
-	fmt.Printf("  Total:        %d\n", connTotal)
-	fmt.Printf("  Successful:   %d (%.2f%%)\n", connSuccess, connRate)
-	fmt.Printf("  Failed:       %d\n", connFailed)
+	if phases.Total.Count > 0 {
+		fmt.Fprintln(consoleOut, "\nConnection Phases:")
+		fmt.Fprintf(consoleOut, "  TCP dial:     %s\n", phases.TCPDial)
+		if phases.TLSHandshake != nil {
+			fmt.Fprintf(consoleOut, "  TLS:          %s\n", phases.TLSHandshake)
+		}
+		if phases.WSUpgrade != nil {
+			fmt.Fprintf(consoleOut, "  WS upgrade:   %s\n", phases.WSUpgrade)
+		}
+		fmt.Fprintf(consoleOut, "  MQTT:         %s\n", phases.MQTTConnect)
+		fmt.Fprintf(consoleOut, "  Total:        %s\n", phases.Total)
+	}
+
+	fmt.Fprintln(consoleOut, "\nPublish Statistics:")
+	fmt.Fprintf(consoleOut, "  Total:        %d\n", pubTotal)
+	fmt.Fprintf(consoleOut, "  Successful:   %d (%.2f%%)\n", pubSuccess, pubRate)
+	fmt.Fprintf(consoleOut, "  Failed:       %d\n", pubFailed)
+	fmt.Fprintf(consoleOut, "  Rate:         %.2f msg/s\n", perSec)
+
+	var openLoop *OpenLoopReport
+	if sc.OpenLoop.Rate > 0 {
+		openLoop = buildOpenLoopReport(sc.OpenLoop, &stats.Schedule, stats.latencySince(0, isPublish))
+		openLoop.display()
+	}
+	if capacity != nil {
+		capacity.display()
+	}
+
+	var soakReport *SoakReport
+	if sc.Soak.Enabled && sc.OfflineQueue.Messages == 0 && sc.Retained.Topics == 0 {
+		soakReport = buildSoakReport(sc.Groups, &stats.Soak)
+		soakReport.display()
+	}
+
+	var listeners []ListenerReport
+	if len(stats.Listeners) > 0 {
+		listeners = buildListenerReports(stats, elapsed)
+		displayListenerComparison(listeners)
+	}
 
-	fmt.Println("\nPublish Statistics:")
-	fmt.Printf("  Total:        %d\n", pubTotal)
-	fmt.Printf("  Successful:   %d (%.2f%%)\n", pubSuccess, pubRate)
-	fmt.Printf("  Failed:       %d\n", pubFailed)
-	fmt.Printf("  Rate:         %.2f msg/s\n", perSec)
+	if delivery != nil {
+		fmt.Fprintln(consoleOut, "\nDelivery Statistics:")
+		fmt.Fprintf(consoleOut, "  Subscribers:  %d (%s)\n", delivery.Subscribers, delivery.Mode)
+		fmt.Fprintf(consoleOut, "  Expected:     %d\n", delivery.Expected)
+		fmt.Fprintf(consoleOut, "  Received:     %d (%d unique)\n", delivery.Received, delivery.Unique)
+		fmt.Fprintf(consoleOut, "  Lost:         %d (%.2f%%)\n", delivery.Lost, delivery.LossRate)
+		fmt.Fprintf(consoleOut, "  Duplicates:   %d\n", delivery.Duplicates)
+		if delivery.Malformed > 0 {
+			fmt.Fprintf(consoleOut, "  Malformed:    %d\n", delivery.Malformed)
+		}
+		fmt.Fprintf(consoleOut, "  Latency:      %s\n", delivery.Latency)
+		if len(delivery.ByQoS) > 0 {
+			fmt.Fprintln(consoleOut, "  Verification:")
+			for _, v := range delivery.ByQoS {
+				fmt.Fprintf(consoleOut, "    %s\n", v)
+			}
+		}
+		if delivery.Fanout != nil {
+			delivery.Fanout.display()
+		}
+	}
+
+	if shared != nil {
+		shared.display()
+	}
+
+	if offline != nil {
+		offline.display()
+	}
+
+	if retained != nil {
+		retained.display()
+	}
+
+	var churn *ChurnReport
+	if sc.Churn.Rate > 0 || sc.Churn.HerdAt > 0 {
+		churn = buildChurnReport(sc.Churn, stats)
+		churn.display()
+	}
+
+	if takeover != nil {
+		takeover.display()
+	}
+
+	if will != nil {
+		will.display()
+	}
+
+	stats.Metrics.Stop()
+	samples := stats.Metrics.GetSamples()
+	opStats := collectStatistics(stats, elapsed, samples)
+	operations := operationStats(opStats)
+	if len(operations) > 0 {
+		displayOperations(operations)
+	}
+
+	timeline := buildTimeline(samples)
+	var brokerReport *BrokerMetricsReport
+	if sc.BrokerMetrics.URL != "" {
+		brokerReport = buildBrokerMetricsReport(sc.BrokerMetrics, &stats.Broker)
+		brokerReport.ClientPublishes = pubTotal
+		if delivery != nil {
+			brokerReport.ClientDeliveries = delivery.Received
+		}
+		brokerReport.display()
+		timeline = mergeBrokerTimeline(timeline, &stats.Broker)
+	}
+
+	var embeddedReport *EmbeddedBrokerReport
+	if stats.Embedded != nil {
+		embeddedReport = buildEmbeddedBrokerReport(stats.Embedded)
+		embeddedReport.display()
+	}
+
+	authFailures := stats.AuthFailures.Snapshot()
+	if len(authFailures) > 0 {
+		fmt.Fprintf(consoleOut, "\nAuth Failures (%d credentials):\n", len(authFailures))
+		labels := sortedLabels(authFailures)
+		if len(labels) > 10 {
+			labels = labels[:10]
+		}
+		for _, label := range labels {
+			fmt.Fprintf(consoleOut, "  %-30s %d\n", label, authFailures[label])
+		}
+	}
+
+	reasonCodes := stats.reasonCodeCounts()
+	if len(reasonCodes) > 0 {
+		fmt.Fprintln(consoleOut, "\nReason Codes:")
+		for reason, count := range reasonCodes {
+			fmt.Fprintf(consoleOut, "  %-30s %d\n", reason, count)
+		}
+	}
 
 	stats.mu.RLock()
 	errorCount := len(stats.errors)
 	stats.mu.RUnlock()
 
 	if errorCount > 0 {
-		fmt.Printf("\n⚠️  Errors:      %d\n", errorCount)
+		fmt.Fprintf(consoleOut, "\n⚠️  Errors:      %d\n", errorCount)
 		stats.mu.RLock()
 		recentErrors := stats.errors
 		if len(recentErrors) > 10 {
 			recentErrors = recentErrors[len(recentErrors)-10:]
 		}
-		fmt.Println("\nRecent Errors:")
+		fmt.Fprintln(consoleOut, "\nRecent Errors:")
 		for _, err := range recentErrors {
-			fmt.Printf("  [%s] %s: %s\n", err.Type, err.ClientID, err.Message)
+			fmt.Fprintf(consoleOut, "  [%s] %s: %s\n", err.Type, err.ClientID, err.Message)
 		}
 		stats.mu.RUnlock()
 	}
 
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Printf("Test completed at %s\n", time.Now().Format(time.RFC3339))
-	fmt.Println(strings.Repeat("=", 60) + "\n")
-
-	// Output JSON report if needed
-	if os.Getenv("MQTT_LOADTEST_JSON") != "" {
-		report := TestReport{
-			Duration: elapsed,
-			Broker:   broker,
-			Topic:    topic,
-			QoS:      byte(qosLevel),
-			Connections: ConnectionStats{
-				Total:       connTotal,
-				Success:     connSuccess,
-				Failed:      connFailed,
-				SuccessRate: connRate,
-			},
-			Publishes: PublishStats{
-				Total:       pubTotal,
-				Success:     pubSuccess,
-				Failed:      pubFailed,
-				SuccessRate: pubRate,
-				PerSecond:   perSec,
-			},
+	fmt.Fprintln(consoleOut, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintf(consoleOut, "Test completed at %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintln(consoleOut, strings.Repeat("=", 60)+"\n")
+
+	report := TestReport{
+		StartTime: stats.StartTime,
+		Duration:  elapsed,
+		Scenario:  sc.Name,
+		Broker:    sc.Broker,
+		Topic:     sc.Groups[0].Topic,
+		QoS:       byte(sc.Groups[0].QoS),
+		Connections: ConnectionStats{
+			Total:       connTotal,
+			Success:     connSuccess,
+			Failed:      connFailed,
+			SuccessRate: connRate,
+		},
+		ConnectPhases: phases,
+		Publishes: PublishStats{
+			Total:       pubTotal,
+			Success:     pubSuccess,
+			Failed:      pubFailed,
+			SuccessRate: pubRate,
+			PerSecond:   perSec,
+		},
+		Operations:    operations,
+		OpenLoop:      openLoop,
+		Capacity:      capacity,
+		Soak:          soakReport,
+		Delivery:      delivery,
+		OfflineQueue:  offline,
+		Retained:      retained,
+		Shared:        shared,
+		Churn:         churn,
+		Takeover:      takeover,
+		Will:          will,
+		ReasonCodes:   reasonCodes,
+		Listeners:     listeners,
+		AuthFailures:  authFailures,
+		BrokerMetrics: brokerReport,
+		Embedded:      embeddedReport,
+		Timeline:      timeline,
+	}
+
+	stats.mu.RLock()
+	report.Errors = stats.errors
+	stats.mu.RUnlock()
+
+	if err := writeReport(&report, opStats); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing %s report: %v\n", reportFormat, err)
+	}
+	if timelineFile != "" {
+		var counters []string
+		if brokerReport != nil {
+			for _, c := range brokerReport.Counters {
+				counters = append(counters, c.Name)
+			}
+		}
+		if err := writeTimeline(timelineFile, report.Timeline, counters); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing timeline: %v\n", err)
 		}
+	}
+}
 
-		stats.mu.RLock()
-		report.Errors = stats.errors
-		stats.mu.RUnlock()
+// printGroupSettings prints the banner lines of a single-group run
+func printGroupSettings(g *clientGroup) {
+	fmt.Fprintf(consoleOut, "   Interval: %v\n", g.Interval)
+	if g.Payload.Type == config.PayloadTestMode {
+		fmt.Fprintf(consoleOut, "   Mode:     🧪 TEST MODE (predictable threshold/peak values)\n")
+		fmt.Fprintf(consoleOut, "   Pattern:  10-msg cycle: normal x3, V-high, V-low, I-high, Temp-high, PF-low, peak x2\n")
+	} else if g.Schedule == config.ScheduleSync {
+		fmt.Fprintf(consoleOut, "   Mode:     🔄 SYNCHRONIZED BURST (at :00, :15, :30, :45)\n")
+		fmt.Fprintf(consoleOut, "   Jitter:   ±%v\n", g.Jitter)
+	} else {
+		fmt.Fprintf(consoleOut, "   Mode:     ⏱ Continuous stream\n")
+	}
+	fmt.Fprintf(consoleOut, "   Topic:    %s\n", g.Topic)
+	if g.KeepAlive != keepAlive {
+		fmt.Fprintf(consoleOut, "   Keep-alive: %v\n", g.KeepAlive)
+	}
+	if g.Will.Topic != "" {
+		fmt.Fprintf(consoleOut, "   Will:     %s (QoS %d)\n", g.Will.Topic, g.Will.QoS)
+	}
+}
+
+// subscriberConfig returns the connection settings shared by every
+// subscriber-side client: delivery subscribers and monitors
+func subscriberConfig(sc *config.MQTTScenario, tlsCfg *tls.Config, wsHeader http.Header) ClientConfig {
+	return ClientConfig{
+		Broker:   sc.Broker,
+		Username: sc.Subscribers.Username,
+		Password: sc.Subscribers.Password,
+
+		TLSConfig: tlsCfg,
+
+		WSPath:        sc.WebSocket.Path,
+		WSSubprotocol: sc.WebSocket.Subprotocol,
+		WSHeader:      wsHeader,
+
+		ProtocolVersion: sc.ProtocolVersion,
+	}
+}
+
+// maxGroupQoS returns the highest QoS any group publishes with
+func maxGroupQoS(groups []*clientGroup) byte {
+	var qos byte
+	for _, g := range groups {
+		if byte(g.QoS) > qos {
+			qos = byte(g.QoS)
+		}
+	}
+	return qos
+}
 
-		jsonData, _ := json.MarshalIndent(report, "", "  ")
-		fmt.Println("\nJSON Report:")
-		fmt.Println(string(jsonData))
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// protocolName returns the MQTT version name for a protocol level
+func protocolName(version int) string {
+	switch version {
+	case 3:
+		return "MQTT 3.1"
+	case 5:
+		return "MQTT 5.0"
+	default:
+		return "MQTT 3.1.1"
+	}
+}
+
+// parseUserProperties parses key=value pairs from --user-property
+func parseUserProperties(pairs []string) ([]mqtt5.UserProperty, error) {
+	var props []mqtt5.UserProperty
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --user-property %q (expected key=value)", pair)
+		}
+		props = append(props, mqtt5.UserProperty{Key: key, Value: value})
 	}
+	return props, nil
 }
 
 // Helper function to repeat strings
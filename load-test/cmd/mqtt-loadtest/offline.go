@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// offlineDrainIdle ends the drain early once no queued message has arrived
+// for this long
+const offlineDrainIdle = 5 * time.Second
+
+// OfflineQueueReport summarizes what happened to messages queued for
+// subscribers while they were disconnected
+type OfflineQueueReport struct {
+	Subscribers     int           `json:"subscribers"`
+	SessionsResumed int           `json:"sessions_resumed"` // reconnects with session present
+	Queued          int64         `json:"queued"`           // acknowledged publishes owed to the subscribers
+	Retained        int64         `json:"retained"`         // queued messages delivered after reconnect
+	Dropped         int64         `json:"dropped"`
+	Expired         int64         `json:"expired"` // missing and past their MQTT 5 message expiry at reconnect
+	Offline         time.Duration `json:"offline"`
+	DrainTime       time.Duration `json:"drain_time"` // reconnect to last queued message
+	DrainRate       float64       `json:"drain_rate"` // messages per second
+}
+
+// runOfflineQueue disconnects the subscribers, has every publisher send
+// cfg.Messages messages, reconnects the subscribers to their stored sessions
+// and waits for the queue to drain
+func runOfflineQueue(cfg config.MQTTOfflineQueue, publishers []*MQTTLoadClient, subs []*MQTTSubscriber, stats *Stats, delivery *DeliveryStats) *OfflineQueueReport {
+	var active []*MQTTSubscriber
+	for _, sub := range subs {
+		if sub.session != nil {
+			sub.Disconnect()
+			active = append(active, sub)
+		}
+	}
+	if len(active) == 0 {
+		fmt.Fprintln(consoleOut, "\n⚠️  No subscriber connected, skipping the offline queue test")
+		return nil
+	}
+	offlineAt := time.Now()
+	fmt.Fprintf(consoleOut, "\n📴 %d subscribers disconnected, sessions kept on the broker\n", len(active))
+
+	fmt.Fprintf(consoleOut, "📤 Publishing %d messages per client while subscribers are offline...\n\n", cfg.Messages)
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopProgress:
+				return
+			case <-ticker.C:
+				displayProgress(stats)
+			}
+		}
+	}()
+
+	// sentAt[i][seq-1] is when publisher i finished publishing seq
+	sentAt := make([][]time.Time, len(publishers))
+	var wg sync.WaitGroup
+	for i, pub := range publishers {
+		if pub.session == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *MQTTLoadClient) {
+			defer wg.Done()
+			times := make([]time.Time, 0, cfg.Messages)
+			for n := 0; n < cfg.Messages; n++ {
+				c.publish()
+				times = append(times, time.Now())
+			}
+			sentAt[i] = times
+		}(i, pub)
+	}
+	wg.Wait()
+	close(stopProgress)
+	fmt.Fprintf(consoleOut, "\n✅ Published in %v\n", time.Since(offlineAt).Truncate(time.Millisecond))
+
+	if cfg.Offline > 0 {
+		fmt.Fprintf(consoleOut, "⏸  Subscribers staying offline for %v...\n", cfg.Offline)
+		time.Sleep(cfg.Offline)
+	}
+
+	fmt.Fprintf(consoleOut, "🔌 Reconnecting %d subscribers to drain their sessions...\n", len(active))
+	reconnectAt := time.Now()
+	report := &OfflineQueueReport{
+		Subscribers: len(active),
+		Offline:     reconnectAt.Sub(offlineAt),
+	}
+
+	var resumed int64
+	var subWg sync.WaitGroup
+	for _, sub := range active {
+		atomic.StoreInt64(&sub.lastReceived, 0)
+		subWg.Add(1)
+		go func(s *MQTTSubscriber) {
+			defer subWg.Done()
+			present, err := s.Reconnect()
+			if err != nil {
+				return
+			}
+			if present {
+				atomic.AddInt64(&resumed, 1)
+			} else {
+				stats.recordError("session", s.ClientID, "broker did not resume the stored session")
+			}
+		}(sub)
+	}
+	subWg.Wait()
+	report.SessionsResumed = int(resumed)
+
+	expected := expectedDeliveries(active, publishers)
+	deadline := reconnectAt.Add(cfg.DrainTimeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&delivery.Unique) >= expected {
+			break
+		}
+		last := reconnectAt
+		for _, sub := range active {
+			if t := atomic.LoadInt64(&sub.lastReceived); t > last.UnixNano() {
+				last = time.Unix(0, t)
+			}
+		}
+		if time.Since(last) > offlineDrainIdle {
+			break
+		}
+		fmt.Fprintf(consoleOut, "\r⏳ Draining: %d/%d", atomic.LoadInt64(&delivery.Unique), expected)
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Fprintln(consoleOut)
+
+	for _, sub := range active {
+		if t := atomic.LoadInt64(&sub.lastReceived); t > 0 {
+			if d := time.Unix(0, t).Sub(reconnectAt); d > report.DrainTime {
+				report.DrainTime = d
+			}
+		}
+	}
+
+	classifyQueued(report, active, publishers, sentAt, reconnectAt)
+	if report.DrainTime > 0 {
+		report.DrainRate = float64(report.Retained) / report.DrainTime.Seconds()
+	}
+	return report
+}
+
+// classifyQueued sorts every message owed to a subscriber into retained,
+// expired or dropped
+func classifyQueued(report *OfflineQueueReport, subs []*MQTTSubscriber, publishers []*MQTTLoadClient, sentAt [][]time.Time, reconnectAt time.Time) {
+	for _, sub := range subs {
+		for i, pub := range publishers {
+			if !sub.covers(pub) {
+				continue
+			}
+			from := sub.expectedFrom(pub)
+			sub.mu.Lock()
+			stream := sub.streams[streamKey(pub.Config.PublishTopic, pub.ClientID)]
+			if stream == nil {
+				stream = newTopicStream()
+			}
+			expiry := time.Duration(pub.Config.MessageExpiry) * time.Second
+			if pub.Config.ProtocolVersion != 5 {
+				expiry = 0
+			}
+
+			lastAcked, unpublished := pub.acknowledged()
+			for seq := from; seq <= lastAcked; seq++ {
+				if _, skip := unpublished[seq]; skip {
+					continue
+				}
+				report.Queued++
+				if _, ok := stream.received[seq]; ok {
+					report.Retained++
+					continue
+				}
+				if expiry > 0 && int(seq) <= len(sentAt[i]) && sentAt[i][seq-1].Add(expiry).Before(reconnectAt) {
+					report.Expired++
+				} else {
+					report.Dropped++
+				}
+			}
+			sub.mu.Unlock()
+		}
+	}
+}
+
+// display prints the offline queue section of the final report
+func (r *OfflineQueueReport) display() {
+	pct := func(n int64) float64 {
+		if r.Queued == 0 {
+			return 0
+		}
+		return float64(n) / float64(r.Queued) * 100
+	}
+
+	fmt.Fprintln(consoleOut, "\nOffline Queue:")
+	fmt.Fprintf(consoleOut, "  Sessions:     %d/%d resumed\n", r.SessionsResumed, r.Subscribers)
+	fmt.Fprintf(consoleOut, "  Offline for:  %v\n", r.Offline.Truncate(time.Millisecond))
+	fmt.Fprintf(consoleOut, "  Queued:       %d\n", r.Queued)
+	fmt.Fprintf(consoleOut, "  Retained:     %d (%.2f%%)\n", r.Retained, pct(r.Retained))
+	fmt.Fprintf(consoleOut, "  Dropped:      %d (%.2f%%)\n", r.Dropped, pct(r.Dropped))
+	fmt.Fprintf(consoleOut, "  Expired:      %d (%.2f%%)\n", r.Expired, pct(r.Expired))
+	fmt.Fprintf(consoleOut, "  Drain time:   %v (%.1f msg/s)\n", r.DrainTime.Truncate(time.Millisecond), r.DrainRate)
+}
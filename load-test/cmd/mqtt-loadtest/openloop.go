@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// ScheduleStats tracks the open-loop schedule against what the publishers
+// managed. Send times are bucketed by the second of the run they were
+// scheduled for.
+type ScheduleStats struct {
+	Scheduled int64 // sends handed out by the scheduler
+	Skipped   int64 // sends dropped because the client's queue was full or it was offline
+	Pending   int64 // sends still queued when the run ended
+
+	Lag     LatencyRecorder // scheduled time to actual send
+	Latency LatencyRecorder // scheduled time to acknowledgement
+
+	mu      sync.Mutex
+	start   time.Time
+	end     time.Time
+	behind  time.Duration
+	seconds []scheduleSecond
+}
+
+// scheduleSecond is one second of the open-loop schedule
+type scheduleSecond struct {
+	late    int64 // sends that started more than the behind threshold late
+	skipped int64
+	maxLag  time.Duration
+}
+
+// bucket returns the second at, creating it if needed. Callers hold s.mu.
+func (s *ScheduleStats) bucket(at time.Time) *scheduleSecond {
+	i := int(at.Sub(s.start) / time.Second)
+	if i < 0 {
+		i = 0
+	}
+	for len(s.seconds) <= i {
+		s.seconds = append(s.seconds, scheduleSecond{})
+	}
+	return &s.seconds[i]
+}
+
+// sent records a publish scheduled for at starting at start
+func (s *ScheduleStats) sent(at, start time.Time) {
+	lag := start.Sub(at)
+	s.Lag.Record(lag)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bucket(at)
+	if lag > s.behind {
+		b.late++
+	}
+	if lag > b.maxLag {
+		b.maxLag = lag
+	}
+}
+
+// acked records the acknowledgement of a publish scheduled for at
+func (s *ScheduleStats) acked(at time.Time) {
+	s.Latency.Record(time.Since(at))
+}
+
+// skip records a scheduled send that was never attempted
+func (s *ScheduleStats) skip(at time.Time) {
+	atomic.AddInt64(&s.Skipped, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bucket(at).skipped++
+}
+
+// finish stops the schedule clock and counts the sends still queued
+func (s *ScheduleStats) finish(clientList []*MQTTLoadClient) {
+	for _, c := range clientList {
+		atomic.AddInt64(&s.Pending, int64(len(c.schedule)))
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+}
+
+// StartPublishingScheduled publishes at every send time the open-loop
+// scheduler hands the client, as soon as the previous publish completes
+func (c *MQTTLoadClient) StartPublishingScheduled() {
+	for {
+		select {
+		case <-c.Done:
+			return
+		case req := <-c.reconnect:
+			c.handleRequest(req)
+		case req := <-c.herd:
+			c.handleRequest(req)
+		case at := <-c.schedule:
+			if c.session == nil {
+				c.Stats.Schedule.skip(at)
+				continue
+			}
+			c.publishAt(at)
+		}
+	}
+}
+
+// runScheduler hands out send times at cfg.Rate messages per second, round
+// robin across the clients, until stop is closed. The schedule never waits
+// for the broker: a client whose queue is full loses the send.
+func runScheduler(cfg config.MQTTOpenLoop, clientList []*MQTTLoadClient, stats *ScheduleStats, stop <-chan struct{}) {
+	stats.mu.Lock()
+	stats.start = time.Now()
+	stats.behind = cfg.Behind
+	start := stats.start
+	stats.mu.Unlock()
+
+	tick := time.Duration(float64(time.Second) / cfg.Rate)
+	ticker := time.NewTicker(max(tick, time.Millisecond))
+	defer ticker.Stop()
+
+	var issued int64
+	next := 0
+	for {
+		// Send k is due at k/rate seconds into the run
+		due := int64(time.Since(start).Seconds()*cfg.Rate) + 1
+		for ; issued < due; issued++ {
+			at := start.Add(time.Duration(float64(issued) / cfg.Rate * float64(time.Second)))
+			c := clientList[next]
+			next = (next + 1) % len(clientList)
+
+			atomic.AddInt64(&stats.Scheduled, 1)
+			select {
+			case c.schedule <- at:
+			default:
+				stats.skip(at)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// BehindWindow is a stretch of the run where the publishers fell behind
+// the open-loop schedule
+type BehindWindow struct {
+	From    int     `json:"from_s"` // seconds into the run, inclusive
+	To      int     `json:"to_s"`   // exclusive
+	Late    int64   `json:"late"`   // sends started later than the threshold
+	Skipped int64   `json:"skipped"`
+	MaxLag  float64 `json:"max_lag_ms"`
+}
+
+// OpenLoopReport summarizes an open-loop run for the final report
+type OpenLoopReport struct {
+	TargetRate   float64        `json:"target_rate"`
+	AchievedRate float64        `json:"achieved_rate"` // acknowledged publishes per second
+	Scheduled    int64          `json:"scheduled"`
+	Sent         int64          `json:"sent"`
+	Skipped      int64          `json:"skipped"`
+	Pending      int64          `json:"pending"` // queued when the run ended
+	Lag          LatencyStats   `json:"schedule_lag"`
+	Latency      LatencyStats   `json:"latency"`      // scheduled time to acknowledgement
+	Service      LatencyStats   `json:"service_time"` // actual send to acknowledgement, what a closed loop reports
+	Threshold    float64        `json:"behind_threshold_ms"`
+	Behind       []BehindWindow `json:"behind,omitempty"`
+}
+
+// buildOpenLoopReport reports the schedule against service, the publish
+// latency a closed loop would report
+func buildOpenLoopReport(cfg config.MQTTOpenLoop, stats *ScheduleStats, service LatencyStats) *OpenLoopReport {
+	report := &OpenLoopReport{
+		TargetRate: cfg.Rate,
+		Scheduled:  atomic.LoadInt64(&stats.Scheduled),
+		Skipped:    atomic.LoadInt64(&stats.Skipped),
+		Pending:    atomic.LoadInt64(&stats.Pending),
+		Lag:        stats.Lag.Summary(),
+		Latency:    stats.Latency.Summary(),
+		Service:    service,
+		Threshold:  toMs(cfg.Behind),
+	}
+	report.Sent = int64(report.Lag.Count)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if elapsed := stats.end.Sub(stats.start); elapsed > 0 {
+		report.AchievedRate = float64(report.Latency.Count) / elapsed.Seconds()
+	}
+
+	var window *BehindWindow
+	for i, sec := range stats.seconds {
+		if sec.late == 0 && sec.skipped == 0 {
+			window = nil
+			continue
+		}
+		if window == nil {
+			report.Behind = append(report.Behind, BehindWindow{From: i})
+			window = &report.Behind[len(report.Behind)-1]
+		}
+		window.To = i + 1
+		window.Late += sec.late
+		window.Skipped += sec.skipped
+		if lag := toMs(sec.maxLag); lag > window.MaxLag {
+			window.MaxLag = lag
+		}
+	}
+	return report
+}
+
+// display prints the open-loop section of the final report
+func (r *OpenLoopReport) display() {
+	fmt.Fprintln(consoleOut, "\nOpen Loop:")
+	fmt.Fprintf(consoleOut, "  Target:       %.1f msg/s\n", r.TargetRate)
+	fmt.Fprintf(consoleOut, "  Achieved:     %.1f msg/s acknowledged\n", r.AchievedRate)
+	fmt.Fprintf(consoleOut, "  Scheduled:    %d (%d sent, %d skipped, %d pending at the end)\n", r.Scheduled, r.Sent, r.Skipped, r.Pending)
+	if r.Sent > 0 {
+		fmt.Fprintf(consoleOut, "  Lag:          %s\n", r.Lag)
+	}
+	if r.Latency.Count > 0 {
+		fmt.Fprintf(consoleOut, "  Latency:      %s\n", r.Latency)
+		fmt.Fprintf(consoleOut, "  Service:      %s\n", r.Service)
+	}
+	if len(r.Behind) == 0 {
+		fmt.Fprintf(consoleOut, "  Schedule:     ✅ kept within %.0fms\n", r.Threshold)
+		return
+	}
+	fmt.Fprintf(consoleOut, "  Behind:       ⚠️  lagged more than %.0fms in %d windows\n", r.Threshold, len(r.Behind))
+	for _, w := range r.Behind {
+		fmt.Fprintf(consoleOut, "    %-12s %d late, %d skipped, max lag %.0fms\n", fmt.Sprintf("%ds-%ds", w.From, w.To), w.Late, w.Skipped, w.MaxLag)
+	}
+}
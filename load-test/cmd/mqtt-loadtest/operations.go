@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"loadtest/internal/metrics"
+)
+
+// OperationStats is one MQTT operation's row of the per-operation breakdown
+type OperationStats struct {
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	AvgMs     float64 `json:"avg_ms"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// collectStatistics aggregates the collector the way HTTP runs do, with
+// the per-operation breakdown filled in
+func collectStatistics(stats *Stats, elapsed time.Duration, samples []metrics.Sample) *metrics.Statistics {
+	result := stats.Metrics.GetStatistics()
+	result.Duration = elapsed
+	result.CalculateRequestStats(samples)
+	return result
+}
+
+// latencySince summarizes the successful samples recorded after mark, as
+// returned by Metrics.Count, that match selects
+func (s *Stats) latencySince(mark int, match func(metrics.Sample) bool) LatencyStats {
+	return summarizeSamples(s.Metrics.GetSamplesSince(mark, func(m metrics.Sample) bool {
+		return m.Success && match(m)
+	}))
+}
+
+func isConnect(s metrics.Sample) bool { return s.RequestName == opConnect }
+
+func isPublish(s metrics.Sample) bool { return strings.HasPrefix(s.RequestName, "publish_") }
+
+func isDelivery(s metrics.Sample) bool { return s.RequestName == opDeliver }
+
+// onListener narrows match to the samples of one compared listener
+func onListener(l *ListenerStats, match func(metrics.Sample) bool) func(metrics.Sample) bool {
+	return func(s metrics.Sample) bool { return s.Target == l.Broker && match(s) }
+}
+
+// operationStats converts the collector's per-request statistics, which are
+// in microseconds, for the MQTT report
+func operationStats(s *metrics.Statistics) map[string]OperationStats {
+	ops := make(map[string]OperationStats, len(s.RequestStats))
+	for name, r := range s.RequestStats {
+		ops[name] = OperationStats{
+			Count:     r.Count,
+			Errors:    r.ErrorCount,
+			ErrorRate: r.ErrorRate,
+			AvgMs:     s.ToLatencyMs(r.AvgLatency),
+			P50Ms:     s.ToLatencyMs(r.Percentiles[50]),
+			P90Ms:     s.ToLatencyMs(r.Percentiles[90]),
+			P95Ms:     s.ToLatencyMs(r.Percentiles[95]),
+			P99Ms:     s.ToLatencyMs(r.Percentiles[99]),
+			MaxMs:     s.ToLatencyMs(r.MaxLatency),
+		}
+	}
+	return ops
+}
+
+// displayOperations prints the per-operation section of the final report
+func displayOperations(ops map[string]OperationStats) {
+	fmt.Fprintln(consoleOut, "\nOperations:")
+	fmt.Fprintf(consoleOut, "  %-14s %-9s %-8s %-10s %-10s %-10s %-10s %s\n", "Operation", "Count", "Errors", "Avg", "P50", "P95", "P99", "Max")
+	for _, name := range sortedOperations(ops) {
+		op := ops[name]
+		fmt.Fprintf(consoleOut, "  %-14s %-9d %-8d %-10s %-10s %-10s %-10s %.2fms\n",
+			name, op.Count, op.Errors,
+			fmt.Sprintf("%.2fms", op.AvgMs), fmt.Sprintf("%.2fms", op.P50Ms),
+			fmt.Sprintf("%.2fms", op.P95Ms), fmt.Sprintf("%.2fms", op.P99Ms), op.MaxMs)
+	}
+}
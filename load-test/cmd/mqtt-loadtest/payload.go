@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// PayloadContext carries the per-message values available to generators
+type PayloadContext struct {
+	RTUID    string
+	ClientID string
+	Group    string
+	Index    int       // 1-based client index within the group
+	Seq      int64     // per-client publish counter, starting at 1
+	Time     time.Time // generation time
+	Tracking bool      // embed seq/sentAt for subscribers
+}
+
+// PayloadGenerator builds the payload of each publish. Generators are shared
+// by every client of a group and must be safe for concurrent use.
+type PayloadGenerator interface {
+	Generate(pc PayloadContext) ([]byte, error)
+}
+
+// newPayloadGenerator creates the generator configured for a client group
+func newPayloadGenerator(cfg config.MQTTPayloadConfig) (PayloadGenerator, error) {
+	switch cfg.Type {
+	case config.PayloadRTU:
+		return rtuGenerator{}, nil
+	case config.PayloadTestMode:
+		return testModeGenerator{}, nil
+	case config.PayloadRandom:
+		return randomGenerator{size: cfg.Size}, nil
+	case config.PayloadTemplate, config.PayloadJSON:
+		return newTemplateGenerator(cfg.File, cfg.Type == config.PayloadJSON)
+	case config.PayloadSequence:
+		return newSequenceGenerator(cfg.File)
+	}
+	return nil, fmt.Errorf("unknown payload type %q", cfg.Type)
+}
+
+// trackingFields returns the JSON fields subscribers use to measure delivery
+// latency, loss, ordering and duplicates, or "" when tracking is off
+func trackingFields(pc PayloadContext) string {
+	if !pc.Tracking {
+		return ""
+	}
+	return fmt.Sprintf(`"pub": %q, "seq": %d, "sentAt": %d,`, pc.ClientID, pc.Seq, pc.Time.UnixNano())
+}
+
+// rtuGenerator produces the RTU telemetry schema with random realistic values
+type rtuGenerator struct{}
+
+func (rtuGenerator) Generate(pc PayloadContext) ([]byte, error) {
+	var vr, vs, vt, ir, is_, it, in, pf1, pf2, pf3, tk1, tk2, i1f1, i2f1, i3f1, inf1, i1f2, i2f2, i3f2, inf2 float64
+	tracking := trackingFields(pc)
+
+	// ============================================
+	// NORMAL MODE: Random realistic values
+	// ============================================
+	vr = 220.0 + mathrand.Float64()*20
+	vs = 220.0 + mathrand.Float64()*20
+	vt = 220.0 + mathrand.Float64()*20
+
+	ir = 80.0 + mathrand.Float64()*120
+	is_ = 80.0 + mathrand.Float64()*120
+	it = 80.0 + mathrand.Float64()*120
+	in = (ir+is_+it)*0.02 + mathrand.Float64()*5
+
+	pf1 = 0.90 + mathrand.Float64()*0.09
+	pf2 = 0.90 + mathrand.Float64()*0.09
+	pf3 = 0.90 + mathrand.Float64()*0.09
+
+	i1f1 = ir*0.8 + mathrand.Float64()*20
+	i2f1 = is_*0.8 + mathrand.Float64()*20
+	i3f1 = it*0.8 + mathrand.Float64()*20
+	inf1 = in * 0.4
+
+	i1f2 = ir*0.7 + mathrand.Float64()*20
+	i2f2 = is_*0.7 + mathrand.Float64()*20
+	i3f2 = it*0.7 + mathrand.Float64()*20
+	inf2 = in * 0.3
+
+	tk1 = 25.0 + mathrand.Float64()*20
+	tk2 = tk1 + mathrand.Float64()*5 + 1
+
+	ts := pc.Time.Unix()
+
+	return []byte(fmt.Sprintf(`{
+		"rtuId": "%s",
+		"TS": %d, %s
+		"VR": %.2f, "VS": %.2f, "VT": %.2f,
+		"IR": %.2f, "IS": %.2f, "IT": %.2f, "IN": %.2f,
+		"PF1": %.3f, "PF2": %.3f, "PF3": %.3f,
+		"I1F1": %.2f, "I2F1": %.2f, "I3F1": %.2f, "INF1": %.2f,
+		"I1F2": %.2f, "I2F2": %.2f, "I3F2": %.2f, "INF2": %.2f,
+		"TK1": %.1f, "TK2": %.1f
+	}`, pc.RTUID, ts, tracking,
+		vr, vs, vt,
+		ir, is_, it, in,
+		pf1, pf2, pf3,
+		i1f1, i2f1, i3f1, inf1,
+		i1f2, i2f2, i3f2, inf2,
+		tk1, tk2)), nil
+}
+
+// testModeGenerator produces the RTU schema with predictable threshold/peak values
+type testModeGenerator struct{}
+
+func (testModeGenerator) Generate(pc PayloadContext) ([]byte, error) {
+	var vr, vs, vt, ir, is_, it, in, pf1, pf2, pf3, tk1, tk2, i1f1, i2f1, i3f1, inf1, i1f2, i2f2, i3f2, inf2 float64
+	tracking := trackingFields(pc)
+
+	// ============================================
+	// TEST MODE: Predictable threshold/peak values
+	// ============================================
+	// Pattern cycles every 10 messages:
+	// 1-3: Normal values
+	// 4: Voltage High (threshold trigger)
+	// 5: Voltage Low (threshold trigger)
+	// 6: Current High (threshold trigger)
+	// 7: Temperature High (threshold trigger)
+	// 8: Power Factor Low (threshold trigger)
+	// 9-10: Normal values with increasing STot (for peak detection)
+
+	cycle := (pc.Seq % 10)
+
+	switch cycle {
+	case 1, 2, 3, 9, 10:
+		// Normal values
+		vr, vs, vt = 230.0, 230.0, 230.0
+		ir, is_, it = 150.0, 150.0, 150.0
+		pf1, pf2, pf3 = 0.95, 0.95, 0.95
+		tk1, tk2 = 35.0, 37.0
+	case 4:
+		// Voltage High: 260V (exceeds typical 250V threshold)
+		vr, vs, vt = 260.0, 260.0, 260.0
+		ir, is_, it = 150.0, 150.0, 150.0
+		pf1, pf2, pf3 = 0.95, 0.95, 0.95
+		tk1, tk2 = 35.0, 37.0
+	case 5:
+		// Voltage Low: 200V (below typical 210V threshold)
+		vr, vs, vt = 200.0, 200.0, 200.0
+		ir, is_, it = 150.0, 150.0, 150.0
+		pf1, pf2, pf3 = 0.95, 0.95, 0.95
+		tk1, tk2 = 35.0, 37.0
+	case 6:
+		// Current High: 250A (exceeds typical 200A threshold)
+		vr, vs, vt = 230.0, 230.0, 230.0
+		ir, is_, it = 250.0, 250.0, 250.0
+		pf1, pf2, pf3 = 0.95, 0.95, 0.95
+		tk1, tk2 = 35.0, 37.0
+	case 7:
+		// Temperature High: 70°C (exceeds typical 50°C threshold)
+		vr, vs, vt = 230.0, 230.0, 230.0
+		ir, is_, it = 150.0, 150.0, 150.0
+		pf1, pf2, pf3 = 0.95, 0.95, 0.95
+		tk1, tk2 = 70.0, 72.0
+	case 8:
+		// Power Factor Low: 0.75 (below typical 0.85 threshold)
+		vr, vs, vt = 230.0, 230.0, 230.0
+		ir, is_, it = 150.0, 150.0, 150.0
+		pf1, pf2, pf3 = 0.75, 0.75, 0.75
+		tk1, tk2 = 35.0, 37.0
+	}
+
+	in = (ir + is_ + it) * 0.02
+	i1f1, i2f1, i3f1 = ir*0.8, is_*0.8, it*0.8
+	inf1 = in * 0.4
+	i1f2, i2f2, i3f2 = ir*0.7, is_*0.7, it*0.7
+	inf2 = in * 0.3
+
+	// Calculate power values
+	pr, ps, pt := vr*ir*pf1, vs*is_*pf2, vt*it*pf3
+	qr, qs, qt := vr*ir*math.Sqrt(1-pf1*pf1), vs*is_*math.Sqrt(1-pf2*pf2), vt*it*math.Sqrt(1-pf3*pf3)
+	sr, ss, st := vr*ir, vs*is_, vt*it
+	stot := sr + ss + st
+
+	// For cycles 9-10, increase STot to trigger peak updates
+	if cycle == 9 {
+		stot = 100000.0 + float64(pc.Seq%100)*5000.0 // 100-600 kVA in watts
+		sr, ss, st = stot/3.0, stot/3.0, stot/3.0
+	} else if cycle == 10 {
+		stot = 500000.0 + float64(pc.Seq%100)*10000.0 // 500-1500 kVA in watts
+		sr, ss, st = stot/3.0, stot/3.0, stot/3.0
+	}
+
+	// Timestamp
+	ts := pc.Time.Unix()
+
+	// Build JSON payload
+	return []byte(fmt.Sprintf(`{
+		"rtuId": "%s",
+		"TS": %d, %s
+		"VR": %.2f, "VS": %.2f, "VT": %.2f,
+		"IR": %.2f, "IS": %.2f, "IT": %.2f, "IN": %.2f,
+		"PF1": %.3f, "PF2": %.3f, "PF3": %.3f,
+		"PR": %.2f, "PS": %.2f, "PT": %.2f,
+		"QR": %.2f, "QS": %.2f, "QT": %.2f,
+		"SR": %.2f, "SS": %.2f, "ST": %.2f, "STot": %.2f,
+		"ITot": %.2f,
+		"I1F1": %.2f, "I2F1": %.2f, "I3F1": %.2f, "INF1": %.2f,
+		"I1F2": %.2f, "I2F2": %.2f, "I3F2": %.2f, "INF2": %.2f,
+		"TK1": %.1f, "TK2": %.1f
+	}`, pc.RTUID, ts, tracking,
+		vr, vs, vt,
+		ir, is_, it, in,
+		pf1, pf2, pf3,
+		pr, ps, pt,
+		qr, qs, qt,
+		sr, ss, st, stot,
+		ir+is_+it,
+		i1f1, i2f1, i3f1, inf1,
+		i1f2, i2f2, i3f2, inf2,
+		tk1, tk2)), nil
+}
+
+// randomGenerator produces random bytes of a fixed size
+type randomGenerator struct {
+	size int
+}
+
+func (g randomGenerator) Generate(pc PayloadContext) ([]byte, error) {
+	buf := make([]byte, g.size)
+	mathrand.Read(buf)
+	return buf, nil
+}
+
+// templateGenerator renders a user-supplied text/template. In JSON mode the
+// output must be a JSON object; it is compacted and the tracking fields are
+// added automatically.
+type templateGenerator struct {
+	tmpl *template.Template
+	json bool
+}
+
+func newTemplateGenerator(path string, jsonMode bool) (*templateGenerator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payload template: %w", err)
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(payloadFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse payload template %s: %w", path, err)
+	}
+
+	g := &templateGenerator{tmpl: tmpl, json: jsonMode}
+
+	// Render once up front so template errors fail the run instead of every publish
+	if _, err := g.Generate(PayloadContext{RTUID: "000000000000", ClientID: "check", Index: 1, Seq: 1, Time: time.Now()}); err != nil {
+		return nil, fmt.Errorf("payload template %s: %w", path, err)
+	}
+	return g, nil
+}
+
+// templateData is the dot value of payload templates
+type templateData struct {
+	PayloadContext
+	TrackingFields string // tracking JSON fields with a trailing comma, or ""
+}
+
+func (g *templateGenerator) Generate(pc PayloadContext) ([]byte, error) {
+	data := templateData{PayloadContext: pc}
+	if !g.json {
+		data.TrackingFields = trackingFields(pc)
+	}
+
+	var buf bytes.Buffer
+	if err := g.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if !g.json {
+		return buf.Bytes(), nil
+	}
+
+	var out bytes.Buffer
+	if err := json.Compact(&out, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("template output is not valid JSON: %w", err)
+	}
+	payload := out.Bytes()
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil, fmt.Errorf("template output is not a JSON object")
+	}
+
+	if pc.Tracking {
+		fields := fmt.Sprintf(`"pub":%q,"seq":%d,"sentAt":%d`, pc.ClientID, pc.Seq, pc.Time.UnixNano())
+		if len(payload) > 2 {
+			fields += ","
+		}
+		payload = append([]byte("{"+fields), payload[1:]...)
+	}
+	return payload, nil
+}
+
+// payloadFuncs are the functions available to payload templates
+var payloadFuncs = template.FuncMap{
+	// randFloat returns a random float in [min, max)
+	"randFloat": func(min, max float64) float64 {
+		return min + mathrand.Float64()*(max-min)
+	},
+	// randInt returns a random integer in [min, max]
+	"randInt": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		return min + mathrand.Intn(max-min+1)
+	},
+	// choice returns one of its arguments at random
+	"choice": func(values ...interface{}) interface{} {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[mathrand.Intn(len(values))]
+	},
+	// cycle returns the value for seq from a repeating list
+	"cycle": func(seq int64, values ...interface{}) interface{} {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[int((seq-1)%int64(len(values)))]
+	},
+	// round rounds to the given number of decimals
+	"round": func(v interface{}, decimals int) float64 {
+		p := math.Pow(10, float64(decimals))
+		return math.Round(toFloat(v)*p) / p
+	},
+	"add":       func(a, b interface{}) float64 { return toFloat(a) + toFloat(b) },
+	"mul":       func(a, b interface{}) float64 { return toFloat(a) * toFloat(b) },
+	"unix":      func(t time.Time) int64 { return t.Unix() },
+	"unixMilli": func(t time.Time) int64 { return t.UnixMilli() },
+	"rfc3339":   func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"quote": func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	},
+}
+
+// toFloat converts the numeric values templates pass around, such as .Seq
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return 0
+}
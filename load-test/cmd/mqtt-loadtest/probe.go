@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/spf13/cobra"
+
+	"loadtest/internal/mqtt5"
+)
+
+// Limits the probe command walks
+const (
+	limitMessageSize   = "message-size"
+	limitClientID      = "client-id"
+	limitTopicLevels   = "topic-levels"
+	limitSubscriptions = "subscriptions"
+	limitConnections   = "connections"
+)
+
+// How the broker enforced a limit
+const (
+	enforcedDisconnect = "disconnect"
+	enforcedReasonCode = "reason code"
+	enforcedSilentDrop = "silent drop"
+)
+
+const (
+	probePublisherID  = "mqtt_probe_pub"
+	probeSubscriberID = "mqtt_probe_sub"
+	probeConnPrefix   = "mqtt_probe_conn_"
+	// probeConnBatch is how many connections the connection probe opens at once
+	probeConnBatch = 50
+)
+
+var probeLimits = []string{limitMessageSize, limitClientID, limitTopicLevels, limitSubscriptions, limitConnections}
+
+var (
+	probeOnly      []string // limits to probe
+	probeTopic     string   // base topic for probe traffic
+	probeTimeout   int      // seconds to wait for an answer or a delivery
+	probeMaxSize   int      // largest payload tried (bytes)
+	probeMaxID     int      // longest client ID tried
+	probeMaxLevels int      // deepest topic tried
+	probeMaxSubs   int      // most subscriptions tried on one session
+	probeMaxConns  int      // most connections opened
+)
+
+// errProbeTimeout is returned when the broker doesn't answer in time
+var errProbeTimeout = errors.New("no response from broker")
+
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Find the broker's message size, client ID, topic depth, subscription and connection limits",
+	Long: `Walk each broker limit in turn, growing payload size, client ID length,
+topic depth, subscription count and connection count until the broker rejects,
+and report the observed limit and how it was enforced: disconnect, reason code
+or silent drop. Use it to check a deployed vernemq.conf (max_message_size,
+max_client_id_size, max_topic_levels, max_subscriptions, max_connections)
+against what was intended.`,
+	Run: runProbe,
+}
+
+func init() {
+	addConnectionFlags(probeCmd)
+	probeCmd.Flags().StringSliceVar(&probeOnly, "limits", probeLimits, "Limits to probe, in order: "+strings.Join(probeLimits, ", "))
+	probeCmd.Flags().StringVarP(&probeTopic, "topic", "t", "loadtest/probe", "Base topic for probe publishes and subscriptions")
+	probeCmd.Flags().IntVar(&probeTimeout, "timeout", 5, "Seconds to wait for the broker to answer or deliver before calling it a silent drop")
+	probeCmd.Flags().IntVar(&probeMaxSize, "max-size", 16<<20, "Largest payload to try in bytes")
+	probeCmd.Flags().IntVar(&probeMaxID, "max-client-id", 65535, "Longest client ID to try")
+	probeCmd.Flags().IntVar(&probeMaxLevels, "max-topic-levels", 1024, "Deepest topic to try")
+	probeCmd.Flags().IntVar(&probeMaxSubs, "max-subscriptions", 10000, "Most subscriptions to try on one session")
+	probeCmd.Flags().IntVar(&probeMaxConns, "max-connections", 10000, "Most connections to open (mind ulimit -n)")
+	probeCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Print every attempt")
+	probeCmd.Flags().StringVar(&reportFormat, "report-format", reportConsole, "Final report format: console or json; json goes to stdout alone, with progress on stderr, unless --report-output is set")
+	probeCmd.Flags().StringVar(&reportOutput, "report-output", "", "Write the json report to this file instead of stdout")
+	rootCmd.AddCommand(probeCmd)
+}
+
+// ProbeResult is the outcome of walking one limit
+type ProbeResult struct {
+	Limit       string `json:"limit"`
+	Accepted    int    `json:"accepted"`           // largest value the broker accepted
+	Rejected    int    `json:"rejected,omitempty"` // smallest value it refused, 0 when none up to Max
+	Max         int    `json:"max"`
+	Enforcement string `json:"enforcement,omitempty"` // disconnect, reason code or silent drop
+	Detail      string `json:"detail,omitempty"`      // reason code or error behind the enforcement
+	Attempts    int    `json:"attempts"`
+	Error       string `json:"error,omitempty"` // the probe itself failed
+}
+
+// ProbeReport is the JSON form of the probe results
+type ProbeReport struct {
+	Broker   string        `json:"broker"`
+	Protocol string        `json:"protocol"`
+	Results  []ProbeResult `json:"results"`
+}
+
+// probeOutcome is how the broker answered one attempt, zero when it accepted
+type probeOutcome struct {
+	enforcement string
+	detail      string
+}
+
+func (o probeOutcome) rejected() bool {
+	return o.enforcement != ""
+}
+
+// classify maps a failed connect, publish or subscribe to how the broker
+// enforced the limit
+func classify(err error) probeOutcome {
+	if reasonCodeOf(err) != nil {
+		return probeOutcome{enforcedReasonCode, err.Error()}
+	}
+	for code, connErr := range packets.ConnErrors {
+		if connErr != nil && code != packets.ErrNetworkError && errors.Is(err, connErr) {
+			return probeOutcome{enforcedReasonCode, fmt.Sprintf("CONNACK 0x%02X (%s)", code, err)}
+		}
+	}
+	if errors.Is(err, errProbeTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return probeOutcome{enforcedSilentDrop, err.Error()}
+	}
+	return probeOutcome{enforcedDisconnect, err.Error()}
+}
+
+// refusedConnect reports whether the broker refused a connection for a
+// reason no limit explains, such as bad credentials
+func refusedConnect(err error) bool {
+	if isAuthFailure(err) || errors.Is(err, packets.ErrorRefusedBadProtocolVersion) {
+		return true
+	}
+	var rcErr *mqtt5.ReasonCodeError
+	return errors.As(err, &rcErr) && rcErr.Code == mqtt5.ReasonUnsupportedProtocolVersion
+}
+
+// within runs fn and gives up after timeout; fn keeps running in the
+// background, so callers abort the session it uses
+func within(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errProbeTimeout
+	}
+}
+
+// attempt runs try for n and records a rejection
+func (r *ProbeResult) attempt(n int, try func(n int) (probeOutcome, error)) (bool, error) {
+	out, err := try(n)
+	if err != nil {
+		return false, err
+	}
+	r.Attempts++
+	if verbose {
+		if out.rejected() {
+			fmt.Fprintf(consoleOut, "   %s %d: %s (%s)\n", r.Limit, n, out.enforcement, out.detail)
+		} else {
+			fmt.Fprintf(consoleOut, "   %s %d: accepted\n", r.Limit, n)
+		}
+	}
+	if out.rejected() {
+		r.Rejected = n
+		r.Enforcement = out.enforcement
+		r.Detail = out.detail
+	}
+	return out.rejected(), nil
+}
+
+// search doubles n from start until the broker rejects it or r.Max is
+// reached, then bisects between the largest accepted and smallest rejected
+// value. Values below start are never tried.
+func (r *ProbeResult) search(start int, try func(n int) (probeOutcome, error)) error {
+	lo := start - 1
+	n := start
+	for {
+		rejected, err := r.attempt(n, try)
+		if err != nil {
+			return err
+		}
+		if rejected {
+			break
+		}
+		lo = n
+		if n >= r.Max {
+			r.Accepted = n
+			return nil
+		}
+		n = min(n*2, r.Max)
+	}
+
+	hi := n
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		rejected, err := r.attempt(mid, try)
+		if err != nil {
+			return err
+		}
+		if rejected {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	if lo >= start {
+		r.Accepted = lo
+	}
+	return nil
+}
+
+// prober holds the connections the limit probes share
+type prober struct {
+	cfg      ClientConfig
+	base     string
+	timeout  time.Duration
+	pub      mqttSession
+	sub      mqttSession
+	filter   string      // what sub is subscribed to
+	received chan string // topics delivered to any probe subscriber
+}
+
+func (p *prober) onMessage(msg receivedMessage) {
+	select {
+	case p.received <- msg.Topic:
+	default:
+	}
+}
+
+// listen (re)connects the shared subscriber to filter
+func (p *prober) listen(filter string) error {
+	if p.sub != nil && p.sub.IsConnected() && p.filter == filter {
+		return nil
+	}
+	if p.sub != nil {
+		p.sub.Disconnect()
+		p.sub = nil
+	}
+	sub, err := p.subscriber(probeSubscriberID, filter)
+	if err != nil {
+		return err
+	}
+	p.sub = sub
+	p.filter = filter
+	return nil
+}
+
+// subscriber connects clientID and subscribes it to filter
+func (p *prober) subscriber(clientID, filter string) (mqttSession, error) {
+	session, _, err := connectSession(p.cfg, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s: %w", clientID, err)
+	}
+	if err := within(p.timeout, func() error { return session.Subscribe(filter, 1, p.onMessage) }); err != nil {
+		session.Abort()
+		return nil, fmt.Errorf("subscribe %s: %w", filter, err)
+	}
+	return session, nil
+}
+
+// deliver publishes payload to topic at QoS 1 and waits for sub to receive
+// it. A publisher the broker dropped is reconnected on the next call.
+func (p *prober) deliver(sub mqttSession, topic string, payload []byte) (probeOutcome, error) {
+	if p.pub == nil || !p.pub.IsConnected() {
+		pub, _, err := connectSession(p.cfg, probePublisherID)
+		if err != nil {
+			return probeOutcome{}, fmt.Errorf("connect %s: %w", probePublisherID, err)
+		}
+		p.pub = pub
+	}
+	for len(p.received) > 0 {
+		<-p.received
+	}
+
+	err := within(p.timeout, func() error { return p.pub.Publish(topic, 1, false, payload) })
+	if err != nil {
+		p.pub.Abort()
+		p.pub = nil
+		return classify(err), nil
+	}
+
+	deadline := time.After(p.timeout)
+	for {
+		select {
+		case got := <-p.received:
+			if got == topic {
+				return probeOutcome{}, nil
+			}
+		case <-sub.Closed():
+			return probeOutcome{enforcedDisconnect, "broker closed the subscriber connection"}, nil
+		case <-deadline:
+			return probeOutcome{enforcedSilentDrop, fmt.Sprintf("acknowledged but not delivered within %v", p.timeout)}, nil
+		}
+	}
+}
+
+func (p *prober) close() {
+	if p.pub != nil {
+		p.pub.Disconnect()
+		p.pub = nil
+	}
+	if p.sub != nil {
+		p.sub.Disconnect()
+		p.sub = nil
+	}
+}
+
+// probeMessageSize grows the payload of a QoS 1 publish
+func (p *prober) probeMessageSize(r *ProbeResult) error {
+	filter := p.base + "/size/+"
+	return r.search(1024, func(n int) (probeOutcome, error) {
+		if err := p.listen(filter); err != nil {
+			return probeOutcome{}, err
+		}
+		return p.deliver(p.sub, fmt.Sprintf("%s/size/%d", p.base, n), make([]byte, n))
+	})
+}
+
+// probeClientID grows the client ID of a fresh connection, starting at the
+// 23 characters every broker must accept
+func (p *prober) probeClientID(r *ProbeResult) error {
+	return r.search(23, func(n int) (probeOutcome, error) {
+		id := probePublisherID + "_"
+		if n < len(id) {
+			id = id[:n]
+		}
+		id += strings.Repeat("x", n-len(id))
+
+		session, _, err := connectSession(p.cfg, id)
+		if err != nil {
+			if refusedConnect(err) {
+				return probeOutcome{}, err
+			}
+			return classify(err), nil
+		}
+		session.Disconnect()
+		return probeOutcome{}, nil
+	})
+}
+
+// probeTopicLevels grows the depth of the published topic, starting at the
+// depth of the probe topic itself
+func (p *prober) probeTopicLevels(r *ProbeResult) error {
+	filter := p.base + "/levels/#"
+	start := strings.Count(p.base, "/") + 3
+	return r.search(start, func(n int) (probeOutcome, error) {
+		if err := p.listen(filter); err != nil {
+			return probeOutcome{}, err
+		}
+		topic := fmt.Sprintf("%s/levels/%d", p.base, n) + strings.Repeat("/l", n-start)
+		return p.deliver(p.sub, topic, []byte("probe"))
+	})
+}
+
+// probeSubscriptions adds subscriptions to one session until the broker
+// refuses one, then checks the granted ones actually deliver
+func (p *prober) probeSubscriptions(r *ProbeResult) error {
+	p.close()
+	clientID := probeSubscriberID + "_subs"
+	sub, _, err := connectSession(p.cfg, clientID)
+	if err != nil {
+		return fmt.Errorf("connect %s: %w", clientID, err)
+	}
+	defer sub.Disconnect()
+
+	topicFor := func(i int) string { return fmt.Sprintf("%s/subs/%d", p.base, i) }
+	for i := 1; i <= r.Max; i++ {
+		err := within(p.timeout, func() error { return sub.Subscribe(topicFor(i), 1, p.onMessage) })
+		r.Attempts++
+		if err != nil {
+			out := classify(err)
+			r.Rejected, r.Enforcement, r.Detail = i, out.enforcement, out.detail
+			break
+		}
+		r.Accepted = i
+		if verbose && i%1000 == 0 {
+			fmt.Fprintf(consoleOut, "   %s %d: accepted\n", r.Limit, i)
+		}
+	}
+	if r.Accepted == 0 || !sub.IsConnected() {
+		return nil
+	}
+
+	// A broker may grant subscriptions it never delivers on
+	delivered := func(i int) (bool, error) {
+		out, err := p.deliver(sub, topicFor(i), []byte("probe"))
+		r.Attempts++
+		return !out.rejected(), err
+	}
+	ok, err := delivered(r.Accepted)
+	if err != nil || ok {
+		return err
+	}
+	lo, hi := 0, r.Accepted
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := delivered(mid)
+		if err != nil {
+			return err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	r.Accepted, r.Rejected = lo, hi
+	r.Enforcement = enforcedSilentDrop
+	r.Detail = fmt.Sprintf("SUBACK granted but subscription %d never delivered", hi)
+	return nil
+}
+
+// probeConnections opens connections in batches until the broker refuses
+// one, then counts how many it kept open
+func (p *prober) probeConnections(r *ProbeResult) error {
+	p.close()
+	var (
+		mu       sync.Mutex
+		sessions []mqttSession
+		failed   error
+	)
+	defer func() {
+		var wg sync.WaitGroup
+		for _, s := range sessions {
+			wg.Add(1)
+			go func(s mqttSession) {
+				defer wg.Done()
+				s.Disconnect()
+			}(s)
+		}
+		wg.Wait()
+	}()
+
+	for next := 1; next <= r.Max && failed == nil; next += probeConnBatch {
+		var wg sync.WaitGroup
+		for i := next; i < next+probeConnBatch && i <= r.Max; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s, _, err := connectSession(p.cfg, fmt.Sprintf("%s%d", probeConnPrefix, i))
+				mu.Lock()
+				defer mu.Unlock()
+				r.Attempts++
+				if err != nil {
+					if failed == nil {
+						failed = err
+					}
+					return
+				}
+				sessions = append(sessions, s)
+			}(i)
+		}
+		wg.Wait()
+		if verbose {
+			fmt.Fprintf(consoleOut, "   %s %d: %d open\n", r.Limit, min(next+probeConnBatch-1, r.Max), len(sessions))
+		}
+	}
+
+	live := 0
+	for _, s := range sessions {
+		if s.IsConnected() {
+			live++
+		}
+	}
+	r.Accepted = live
+	switch {
+	case failed != nil && refusedConnect(failed):
+		r.Error = failed.Error()
+	case failed != nil && strings.Contains(failed.Error(), "too many open files"):
+		r.Error = fmt.Sprintf("out of file descriptors after %d connections, raise ulimit -n", len(sessions))
+	case failed != nil:
+		out := classify(failed)
+		r.Rejected, r.Enforcement, r.Detail = len(sessions)+1, out.enforcement, out.detail
+	case live < len(sessions):
+		r.Rejected = live + 1
+		r.Enforcement = enforcedDisconnect
+		r.Detail = fmt.Sprintf("broker accepted %d connections but closed %d of them", len(sessions), len(sessions)-live)
+	}
+	return nil
+}
+
+func runProbe(cmd *cobra.Command, args []string) {
+	if err := setupReportOutput([]string{reportConsole, reportJSON}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if protocolVer < 3 || protocolVer > 5 {
+		fmt.Fprintf(os.Stderr, "Error: invalid --protocol-version %d (use 3, 4 or 5)\n", protocolVer)
+		os.Exit(1)
+	}
+	if strings.ContainsAny(probeTopic, "+#") {
+		fmt.Fprintf(os.Stderr, "Error: --topic %q can't contain wildcards\n", probeTopic)
+		os.Exit(1)
+	}
+	maxes := map[string]int{
+		limitMessageSize:   probeMaxSize,
+		limitClientID:      probeMaxID,
+		limitTopicLevels:   probeMaxLevels,
+		limitSubscriptions: probeMaxSubs,
+		limitConnections:   probeMaxConns,
+	}
+	for _, limit := range probeOnly {
+		if _, ok := maxes[limit]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown limit %q (use %s)\n", limit, strings.Join(probeLimits, ", "))
+			os.Exit(1)
+		}
+	}
+
+	tlsCfg, err := buildTLSConfig(tlsOpts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	wsHeader, err := parseWSHeaders(wsHeaders)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := &prober{
+		cfg: ClientConfig{
+			Broker:   broker,
+			Username: username,
+			Password: password,
+			QoS:      1,
+			Clean:    true,
+
+			TLSConfig: tlsCfg,
+
+			WSPath:        wsPath,
+			WSSubprotocol: wsSubprotocol,
+			WSHeader:      wsHeader,
+
+			ProtocolVersion: protocolVer,
+		},
+		base:     probeTopic,
+		timeout:  time.Duration(probeTimeout) * time.Second,
+		received: make(chan string, 64),
+	}
+	defer p.close()
+
+	fmt.Fprintf(consoleOut, "\n🔎 Probing broker limits\n")
+	fmt.Fprintf(consoleOut, "   Broker:   %s\n", broker)
+	fmt.Fprintf(consoleOut, "   Protocol: %s\n", protocolName(protocolVer))
+	fmt.Fprintf(consoleOut, "   Limits:   %s\n", strings.Join(probeOnly, ", "))
+
+	probes := map[string]func(*ProbeResult) error{
+		limitMessageSize:   p.probeMessageSize,
+		limitClientID:      p.probeClientID,
+		limitTopicLevels:   p.probeTopicLevels,
+		limitSubscriptions: p.probeSubscriptions,
+		limitConnections:   p.probeConnections,
+	}
+	report := ProbeReport{Broker: broker, Protocol: protocolName(protocolVer)}
+	for _, limit := range probeOnly {
+		fmt.Fprintf(consoleOut, "\n📏 %s (up to %d)...\n", limit, maxes[limit])
+		r := ProbeResult{Limit: limit, Max: maxes[limit]}
+		start := time.Now()
+		if err := probes[limit](&r); err != nil {
+			r.Error = err.Error()
+		}
+		icon := "✅"
+		if r.Error != "" {
+			icon = "❌"
+		}
+		fmt.Fprintf(consoleOut, "%s %s after %d attempts in %v\n", icon, r.summary(), r.Attempts, time.Since(start).Truncate(time.Millisecond))
+		report.Results = append(report.Results, r)
+	}
+
+	report.display()
+
+	if reportFormat == reportJSON {
+		if err := writeReportTo(func(w io.Writer) error { return encodeJSON(w, report) }); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing json report: %v\n", err)
+		}
+	}
+}
+
+// summary describes the observed limit in one line
+func (r *ProbeResult) summary() string {
+	switch {
+	case r.Error != "":
+		return fmt.Sprintf("failed: %s", r.Error)
+	case r.Rejected == 0:
+		return fmt.Sprintf("no limit up to %d", r.Max)
+	default:
+		return fmt.Sprintf("limit %d (%s at %d)", r.Accepted, r.Enforcement, r.Rejected)
+	}
+}
+
+// display prints the probe results table
+func (r *ProbeReport) display() {
+	fmt.Fprintln(consoleOut, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(consoleOut, "           MQTT BROKER LIMITS")
+	fmt.Fprintln(consoleOut, strings.Repeat("=", 60))
+	fmt.Fprintf(consoleOut, "\n  Target:       %s\n", r.Broker)
+	fmt.Fprintf(consoleOut, "  Protocol:     %s\n\n", r.Protocol)
+	fmt.Fprintf(consoleOut, "  %-14s %-10s %-10s %-12s %s\n", "Limit", "Accepted", "Rejected", "Enforced by", "Detail")
+	for _, res := range r.Results {
+		rejected, enforcement, detail := "-", "not reached", fmt.Sprintf("accepted everything up to %d", res.Max)
+		if res.Rejected > 0 {
+			rejected, enforcement, detail = fmt.Sprint(res.Rejected), res.Enforcement, res.Detail
+		}
+		if res.Error != "" {
+			enforcement, detail = "❌ error", res.Error
+		}
+		fmt.Fprintf(consoleOut, "  %-14s %-10d %-10s %-12s %s\n", res.Limit, res.Accepted, rejected, enforcement, detail)
+	}
+	fmt.Fprintln(consoleOut, "\n  message-size is payload bytes; brokers count the whole packet")
+	fmt.Fprintln(consoleOut, strings.Repeat("=", 60)+"\n")
+}
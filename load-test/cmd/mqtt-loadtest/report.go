@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadtest/internal/metrics"
+	"loadtest/internal/reporter"
+)
+
+// Report formats for --report-format
+const (
+	reportConsole = "console"
+	reportJSON    = "json"
+	reportHTML    = "html"
+	reportCSV     = "csv"
+	reportJUnit   = "junit"
+)
+
+// reportFormats lists the formats of a load test run; probe only has
+// console and json
+var reportFormats = []string{reportConsole, reportJSON, reportHTML, reportCSV, reportJUnit}
+
+// reportOut receives the structured report when --report-output is not set.
+// Progress and the console report move to stderr in that case so stdout
+// carries nothing else.
+var reportOut io.Writer = os.Stdout
+
+// consoleOut receives progress and the console report
+var consoleOut io.Writer = os.Stdout
+
+// setupReportOutput checks the report flags against formats and, when a
+// structured report goes to stdout, sends everything else to stderr
+func setupReportOutput(formats []string) error {
+	valid := false
+	for _, f := range formats {
+		valid = valid || reportFormat == f
+	}
+	if !valid {
+		return fmt.Errorf("invalid --report-format %q (use %s)", reportFormat, strings.Join(formats, ", "))
+	}
+	if reportFormat == reportConsole {
+		if reportOutput != "" {
+			return fmt.Errorf("--report-output needs a --report-format other than %s", reportConsole)
+		}
+		return nil
+	}
+	if reportOutput == "" {
+		consoleOut = os.Stderr
+	}
+	return nil
+}
+
+// writeReport writes the structured report in reportFormat to
+// --report-output, or to stdout
+func writeReport(report *TestReport, s *metrics.Statistics) error {
+	switch reportFormat {
+	case reportConsole:
+		return nil
+	case reportJSON:
+		return writeReportTo(func(w io.Writer) error { return encodeJSON(w, report) })
+	case reportHTML:
+		return writeHTML(report, s)
+	case reportCSV:
+		return writeReportTo(func(w io.Writer) error { return writeOperationsCSV(w, report.Operations) })
+	default:
+		return writeReportTo(func(w io.Writer) error { return writeJUnit(w, report) })
+	}
+}
+
+// writeReportTo runs write against --report-output, or stdout
+func writeReportTo(write func(w io.Writer) error) error {
+	if reportOutput == "" {
+		return write(reportOut)
+	}
+	f, err := os.Create(reportOutput)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func encodeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeHTML renders the run through the shared HTML reporter. Individual samples are left out: an MQTT
+// run records one per publish and delivery, far more than the HTTP reports
+// were built for.
+func writeHTML(report *TestReport, s *metrics.Statistics) error {
+	result := &reporter.Result{
+		Statistics:    s,
+		TotalRequests: int64(s.TotalRequests),
+		TotalErrors:   int64(s.ErrorCount),
+		Duration:      report.Duration,
+		StartTime:     report.StartTime,
+		EndTime:       report.StartTime.Add(report.Duration),
+	}
+	if reportOutput != "" {
+		return reporter.NewHTMLReporter(reportOutput).Generate(result)
+	}
+	return (&reporter.HTMLReporter{Writer: reportOut}).Generate(result)
+}
+
+// writeOperationsCSV writes one row per MQTT operation
+func writeOperationsCSV(w io.Writer, ops map[string]OperationStats) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"operation", "count", "errors", "error_rate", "avg_ms", "p50_ms", "p90_ms", "p95_ms", "p99_ms", "max_ms"})
+	for _, name := range sortedOperations(ops) {
+		op := ops[name]
+		out.Write([]string{
+			name, strconv.Itoa(op.Count), strconv.Itoa(op.Errors), formatFloat(op.ErrorRate),
+			formatFloat(op.AvgMs), formatFloat(op.P50Ms), formatFloat(op.P90Ms),
+			formatFloat(op.P95Ms), formatFloat(op.P99Ms), formatFloat(op.MaxMs),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// JUnit XML, as read by CI systems
+type junitSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Class   string        `xml:"classname,attr"`
+	Name    string        `xml:"name,attr"`
+	Time    float64       `xml:"time,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+	Output  string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// addCase appends a check, failed when failure is not empty
+func (s *junitSuite) addCase(class, name string, seconds float64, failure, output string) {
+	c := junitCase{Class: "mqtt-loadtest." + class, Name: name, Time: seconds, Output: output}
+	if failure != "" {
+		c.Failure = &junitFailure{Message: failure}
+		s.Failures++
+	}
+	s.Cases = append(s.Cases, c)
+	s.Tests++
+}
+
+// writeJUnit reports the run as one test suite: every operation passes
+// when none of its samples failed, and each verification section the run
+// enabled passes when it found nothing wrong
+func writeJUnit(w io.Writer, report *TestReport) error {
+	suite := &junitSuite{
+		Name:      "mqtt-loadtest",
+		Time:      report.Duration.Seconds(),
+		Timestamp: report.StartTime.Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{Name: "broker", Value: report.Broker},
+			{Name: "topic", Value: report.Topic},
+			{Name: "qos", Value: strconv.Itoa(int(report.QoS))},
+		},
+	}
+	if report.Scenario != "" {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "scenario", Value: report.Scenario})
+	}
+
+	for _, name := range sortedOperations(report.Operations) {
+		op := report.Operations[name]
+		failure := ""
+		if op.Errors > 0 {
+			failure = fmt.Sprintf("%d of %d failed (%.2f%%)", op.Errors, op.Count, op.ErrorRate)
+		}
+		output := fmt.Sprintf("avg %.2fms, p95 %.2fms, p99 %.2fms, max %.2fms", op.AvgMs, op.P95Ms, op.P99Ms, op.MaxMs)
+		suite.addCase("operations", name, math.Round(float64(op.Count)*op.AvgMs)/1000, failure, output)
+	}
+
+	if d := report.Delivery; d != nil {
+		failure := ""
+		if d.Lost > 0 {
+			failure = fmt.Sprintf("%d of %d messages lost (%.2f%%)", d.Lost, d.Expected, d.LossRate)
+		}
+		suite.addCase("delivery", "no message loss", 0, failure, fmt.Sprintf("%d received, %d duplicates", d.Received, d.Duplicates))
+	}
+	if o := report.OpenLoop; o != nil {
+		failure := ""
+		if len(o.Behind) > 0 {
+			failure = fmt.Sprintf("lagged more than %.0fms in %d windows", o.Threshold, len(o.Behind))
+		}
+		suite.addCase("open_loop", "kept schedule", 0, failure, fmt.Sprintf("%.1f of %.1f msg/s", o.AchievedRate, o.TargetRate))
+	}
+	if c := report.Capacity; c != nil {
+		failure := ""
+		if c.Broken() && c.Capacity == 0 {
+			failure = fmt.Sprintf("the first step of %d clients broke the SLO", c.StepClients)
+		}
+		suite.addCase("capacity", "first step within SLO", 0, failure, fmt.Sprintf("capacity %d clients", c.Capacity))
+	}
+	if s := report.Soak; s != nil {
+		failure := ""
+		if s.Drops > 0 {
+			failure = fmt.Sprintf("%d connections lost without DISCONNECT", s.Drops)
+		}
+		suite.addCase("soak", "no dropped connections", 0, failure, fmt.Sprintf("%d pings", s.Pings.Count))
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func sortedOperations(ops map[string]OperationStats) []string {
+	names := make([]string, 0, len(ops))
+	for name := range ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TimelineSecond is one second of the run
+type TimelineSecond struct {
+	Second          int `json:"second"`
+	Connects        int `json:"connects"` // including reconnects
+	ConnectFailures int `json:"connect_failures"`
+	Publishes       int `json:"publishes"`
+	PublishFailures int `json:"publish_failures"`
+	Deliveries      int `json:"deliveries"`
+	Errors          int `json:"errors"` // failed samples of any operation
+
+	// Broker counter deltas from the scrapes that finished this second
+	Broker map[string]float64 `json:"broker,omitempty"`
+}
+
+// buildTimeline buckets the recorded samples by second of the run
+func buildTimeline(samples []metrics.Sample) []TimelineSecond {
+	var timeline []TimelineSecond
+	for _, s := range samples {
+		i := int(s.Timestamp / time.Second)
+		for len(timeline) <= i {
+			timeline = append(timeline, TimelineSecond{Second: len(timeline)})
+		}
+		sec := &timeline[i]
+
+		switch {
+		case s.RequestName == opConnect || s.RequestName == opReconnect:
+			sec.Connects++
+			if !s.Success {
+				sec.ConnectFailures++
+			}
+		case isPublish(s):
+			sec.Publishes++
+			if !s.Success {
+				sec.PublishFailures++
+			}
+		case s.RequestName == opDeliver:
+			sec.Deliveries++
+		}
+		if !s.Success {
+			sec.Errors++
+		}
+	}
+	return timeline
+}
+
+// writeTimeline writes the per-second timeline as CSV to path, with a
+// column for each scraped broker counter
+func writeTimeline(path string, timeline []TimelineSecond, brokerCounters []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	out := csv.NewWriter(f)
+	header := []string{"second", "connects", "connect_failures", "publishes", "publish_failures", "deliveries", "errors"}
+	for _, name := range brokerCounters {
+		header = append(header, "broker_"+name)
+	}
+	out.Write(header)
+	for _, s := range timeline {
+		row := []string{
+			strconv.Itoa(s.Second), strconv.Itoa(s.Connects), strconv.Itoa(s.ConnectFailures),
+			strconv.Itoa(s.Publishes), strconv.Itoa(s.PublishFailures), strconv.Itoa(s.Deliveries), strconv.Itoa(s.Errors),
+		}
+		for _, name := range brokerCounters {
+			row = append(row, strconv.FormatFloat(s.Broker[name], 'f', -1, 64))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
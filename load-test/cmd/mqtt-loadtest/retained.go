@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+const (
+	// retainedSubscriberPrefix names the fresh snapshot subscribers
+	retainedSubscriberPrefix = "mqtt_retained_sub_"
+	// retainedClearCheck is how long a subscriber listens for retained
+	// messages that survived clearing
+	retainedClearCheck = 2 * time.Second
+)
+
+// RetainedReport summarizes the retained store test for the final report
+type RetainedReport struct {
+	Topics       int          `json:"topics"`
+	Stored       int          `json:"stored"` // retained publishes the broker acknowledged
+	Bytes        int64        `json:"bytes"`  // payload bytes stored
+	PopulateTime float64      `json:"populate_time_ms"`
+	PopulateRate float64      `json:"populate_rate"` // messages per second
+	Subscribers  int          `json:"subscribers"`
+	Complete     int          `json:"complete"`      // subscribers that received the whole snapshot
+	MinReceived  int          `json:"min_received"`  // smallest snapshot a subscriber received
+	FirstMessage LatencyStats `json:"first_message"` // SUBSCRIBE to first retained message
+	Snapshot     LatencyStats `json:"snapshot"`      // SUBSCRIBE to last retained message, complete subscribers
+	SnapshotRate float64      `json:"snapshot_rate"` // messages per second per subscriber
+	Cleared      int          `json:"cleared"`
+	Remaining    int          `json:"remaining"` // still retained after clearing
+	Kept         bool         `json:"kept"`
+}
+
+// retainedSnapshot collects the retained messages one subscriber receives
+type retainedSnapshot struct {
+	mu       sync.Mutex
+	expected map[string]bool
+	seen     map[string]bool
+	first    time.Time
+	last     time.Time
+	done     chan struct{}
+}
+
+func newRetainedSnapshot(expected map[string]bool) *retainedSnapshot {
+	return &retainedSnapshot{
+		expected: expected,
+		seen:     make(map[string]bool, len(expected)),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *retainedSnapshot) onMessage(msg receivedMessage) {
+	if !msg.Retained || len(msg.Payload) == 0 {
+		return
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.expected[msg.Topic] || s.seen[msg.Topic] {
+		return
+	}
+	if len(s.seen) == 0 {
+		s.first = now
+	}
+	s.seen[msg.Topic] = true
+	s.last = now
+	if len(s.seen) == len(s.expected) {
+		close(s.done)
+	}
+}
+
+// retainedTopic expands the retained topic template for topic index (1-based)
+func retainedTopic(tmpl string, index int) string {
+	return strings.ReplaceAll(tmpl, "{index}", strconv.Itoa(index))
+}
+
+// retainedPayload returns size bytes starting with the topic index so
+// payloads differ between topics
+func retainedPayload(index, size int) []byte {
+	payload := []byte(strconv.Itoa(index) + ":")
+	for len(payload) < size {
+		payload = append(payload, 'x')
+	}
+	return payload[:size]
+}
+
+// runRetainedStorm populates the retained topics, times how long fresh
+// wildcard subscribers take to receive them and clears them again
+func runRetainedStorm(cfg config.MQTTRetainedStorm, publishers []*MQTTLoadClient, subCfg ClientConfig, subscribers int, stats *Stats) *RetainedReport {
+	var active []*MQTTLoadClient
+	for _, pub := range publishers {
+		if pub.session != nil {
+			active = append(active, pub)
+		}
+	}
+	if len(active) == 0 {
+		fmt.Fprintln(consoleOut, "\n⚠️  No publisher connected, skipping the retained store test")
+		return nil
+	}
+	if subscribers < 1 {
+		subscribers = 1
+	}
+	report := &RetainedReport{Topics: cfg.Topics, Subscribers: subscribers, Kept: cfg.Keep}
+
+	fmt.Fprintf(consoleOut, "\n📌 Populating %d retained topics from %d publishers...\n", cfg.Topics, len(active))
+	start := time.Now()
+	var mu sync.Mutex
+	stored := make(map[string]bool, cfg.Topics)
+	eachRetained(cfg, active, func(c *MQTTLoadClient, topic string, index int) {
+		payload := retainedPayload(index, cfg.Sizes[(index-1)%len(cfg.Sizes)])
+		if c.publishRetained(topic, payload) {
+			mu.Lock()
+			stored[topic] = true
+			report.Bytes += int64(len(payload))
+			mu.Unlock()
+		}
+	})
+	elapsed := time.Since(start)
+	report.Stored = len(stored)
+	report.PopulateTime = toMs(elapsed)
+	report.PopulateRate = float64(report.Stored) / elapsed.Seconds()
+	fmt.Fprintf(consoleOut, "✅ %d/%d stored in %v (%.0f msg/s)\n", report.Stored, cfg.Topics, elapsed.Truncate(time.Millisecond), report.PopulateRate)
+	if report.Stored == 0 {
+		return report
+	}
+
+	filter := templateFilter(cfg.Topic)
+	fmt.Fprintf(consoleOut, "📥 %d fresh subscribers fetching the snapshot on %s...\n", subscribers, filter)
+	subCfg.Clean = true
+	subCfg.QoS = 1
+	var firsts, snapshots []time.Duration
+	report.MinReceived = report.Stored
+	var wg sync.WaitGroup
+	for i := 1; i <= subscribers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			snap := newRetainedSnapshot(stored)
+			subscribed, ok := fetchRetained(subCfg, fmt.Sprintf("%s%d", retainedSubscriberPrefix, id), filter, snap, cfg.Timeout, stats)
+			if !ok {
+				return
+			}
+
+			snap.mu.Lock()
+			defer snap.mu.Unlock()
+			mu.Lock()
+			defer mu.Unlock()
+			if len(snap.seen) < report.MinReceived {
+				report.MinReceived = len(snap.seen)
+			}
+			if len(snap.seen) > 0 {
+				firsts = append(firsts, snap.first.Sub(subscribed))
+			}
+			if len(snap.seen) == len(stored) {
+				report.Complete++
+				snapshots = append(snapshots, snap.last.Sub(subscribed))
+			}
+		}(i)
+	}
+	wg.Wait()
+	report.FirstMessage = summarizeLatencies(firsts)
+	report.Snapshot = summarizeLatencies(snapshots)
+	if report.Snapshot.AvgMs > 0 {
+		report.SnapshotRate = float64(report.Stored) / (report.Snapshot.AvgMs / 1000)
+	}
+
+	if cfg.Keep {
+		fmt.Fprintln(consoleOut, "📌 Keeping the retained topics")
+		return report
+	}
+
+	fmt.Fprintf(consoleOut, "🧹 Clearing %d retained topics...\n", cfg.Topics)
+	var cleared int64
+	eachRetained(cfg, active, func(c *MQTTLoadClient, topic string, _ int) {
+		if c.publishRetained(topic, nil) {
+			atomic.AddInt64(&cleared, 1)
+		}
+	})
+	report.Cleared = int(cleared)
+
+	snap := newRetainedSnapshot(stored)
+	if _, ok := fetchRetained(subCfg, retainedSubscriberPrefix+"check", filter, snap, retainedClearCheck, stats); ok {
+		snap.mu.Lock()
+		report.Remaining = len(snap.seen)
+		snap.mu.Unlock()
+	}
+	return report
+}
+
+// eachRetained calls fn for every retained topic, spreading the topics over
+// the publishers, each publishing its share in order
+func eachRetained(cfg config.MQTTRetainedStorm, publishers []*MQTTLoadClient, fn func(c *MQTTLoadClient, topic string, index int)) {
+	var wg sync.WaitGroup
+	for p, pub := range publishers {
+		wg.Add(1)
+		go func(p int, c *MQTTLoadClient) {
+			defer wg.Done()
+			for index := p + 1; index <= cfg.Topics; index += len(publishers) {
+				fn(c, retainedTopic(cfg.Topic, index), index)
+			}
+		}(p, pub)
+	}
+	wg.Wait()
+}
+
+// publishRetained publishes a retained QoS 1 message, an empty payload
+// clearing the topic
+func (c *MQTTLoadClient) publishRetained(topic string, payload []byte) bool {
+	err := c.session.Publish(topic, 1, true, payload)
+	atomic.AddInt64(&c.Stats.PublishesTotal, 1)
+	if err != nil {
+		atomic.AddInt64(&c.Stats.PublishesFailed, 1)
+		c.Stats.recordErr("retained", c.ClientID, err)
+		return false
+	}
+	atomic.AddInt64(&c.Stats.PublishesSuccess, 1)
+	return true
+}
+
+// fetchRetained connects a fresh subscriber and collects retained messages
+// until snap is complete or timeout passes. It returns when it subscribed.
+func fetchRetained(cfg ClientConfig, clientID, filter string, snap *retainedSnapshot, timeout time.Duration, stats *Stats) (time.Time, bool) {
+	session, _, err := connectSession(cfg, clientID)
+	if err != nil {
+		stats.recordErr("subscribe", clientID, err)
+		return time.Time{}, false
+	}
+	defer session.Disconnect()
+
+	subscribed := time.Now()
+	if err := session.Subscribe(filter, cfg.QoS, snap.onMessage); err != nil {
+		stats.recordErr("subscribe", clientID, err)
+		return time.Time{}, false
+	}
+	select {
+	case <-snap.done:
+	case <-time.After(timeout):
+	}
+	return subscribed, true
+}
+
+// display prints the retained store section of the final report
+func (r *RetainedReport) display() {
+	fmt.Fprintln(consoleOut, "\nRetained Store:")
+	fmt.Fprintf(consoleOut, "  Topics:       %d (%d stored, %.1f KB)\n", r.Topics, r.Stored, float64(r.Bytes)/1024)
+	fmt.Fprintf(consoleOut, "  Populate:     %.0fms (%.0f msg/s)\n", r.PopulateTime, r.PopulateRate)
+	fmt.Fprintf(consoleOut, "  Subscribers:  %d (%d got the full snapshot", r.Subscribers, r.Complete)
+	if r.Complete < r.Subscribers {
+		fmt.Fprintf(consoleOut, ", ⚠️  smallest %d/%d", r.MinReceived, r.Stored)
+	}
+	fmt.Fprintln(consoleOut, ")")
+	if r.FirstMessage.Count > 0 {
+		fmt.Fprintf(consoleOut, "  First msg:    %s\n", r.FirstMessage)
+	}
+	if r.Complete > 0 {
+		fmt.Fprintf(consoleOut, "  Snapshot:     %s\n", r.Snapshot)
+		fmt.Fprintf(consoleOut, "  Rate:         %.0f msg/s per subscriber\n", r.SnapshotRate)
+	}
+	if r.Kept {
+		fmt.Fprintln(consoleOut, "  Cleared:      no, topics kept")
+		return
+	}
+	fmt.Fprintf(consoleOut, "  Cleared:      %d\n", r.Cleared)
+	if r.Remaining > 0 {
+		fmt.Fprintf(consoleOut, "  Remaining:    ❌ %d still retained after clearing\n", r.Remaining)
+	}
+}
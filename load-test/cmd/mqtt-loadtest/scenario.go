@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"loadtest/internal/config"
+	"loadtest/internal/mqtt5"
+)
+
+// groupFlags configure a single client group and can't be combined with a
+// scenario file, which defines its own groups
+var groupFlags = []string{
+	"clients", "interval", "topic", "rtu-prefix", "qos", "retain", "clean",
+	"sync", "jitter", "test-mode", "payload", "payload-size", "payload-file",
+	"session-expiry", "message-expiry", "user-property", "topic-alias", "keep-alive",
+	"credentials-file", "credentials-order",
+	"will-topic", "will-payload", "will-qos", "will-retain", "will-delay",
+}
+
+// resolveScenario returns the scenario to run: the --scenario file with any
+// explicitly set run-wide flags applied on top, or a single-group scenario
+// built from the flags
+func resolveScenario(cmd *cobra.Command) (*config.MQTTScenario, error) {
+	if scenarioFile == "" {
+		sc := scenarioFromFlags()
+		return sc, sc.Validate()
+	}
+
+	sc, err := config.LoadMQTTScenario(scenarioFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range groupFlags {
+		if cmd.Flags().Changed(name) {
+			return nil, fmt.Errorf("--%s can't be combined with --scenario; set it on the groups in %s", name, scenarioFile)
+		}
+	}
+
+	applyFlagOverrides(cmd, sc)
+	return sc, sc.Validate()
+}
+
+// atOrHalfRun returns sec seconds, or half the run when sec is 0 as in
+// scenario files
+func atOrHalfRun(sec int, run time.Duration) time.Duration {
+	if sec == 0 {
+		return run / 2
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// scenarioFromFlags builds the scenario equivalent of the command-line flags
+func scenarioFromFlags() *config.MQTTScenario {
+	schedule := config.ScheduleContinuous
+	if syncMode {
+		schedule = config.ScheduleSync
+	}
+	payload := config.MQTTPayloadConfig{Type: payloadType, Size: payloadSize, File: payloadFile}
+	will := config.MQTTWill{
+		Topic:   willTopic,
+		Payload: willPayload,
+		QoS:     willQoS,
+		Retain:  willRetain,
+		Delay:   time.Duration(willDelay) * time.Second,
+	}
+	if testMode {
+		payload.Type = config.PayloadTestMode
+	}
+
+	return &config.MQTTScenario{
+		Broker:          broker,
+		CompareBroker:   compareBroker,
+		ProtocolVersion: protocolVer,
+		Duration:        time.Duration(durationSec) * time.Second,
+		Drain:           time.Duration(drainSec) * time.Second,
+		Verbose:         verbose,
+		GroundTruth:     groundTruth,
+		TLS:             tlsFromFlags(),
+		WebSocket: config.MQTTWebSocketConfig{
+			Path:        wsPath,
+			Subprotocol: wsSubprotocol,
+			Headers:     wsHeaders,
+		},
+		Subscribers: config.MQTTSubscriberGroup{
+			Count:    subscribers,
+			Mode:     subMode,
+			Filters:  subFilters,
+			Username: username,
+			Password: password,
+			Fanout: config.MQTTFanout{
+				Steps: fanoutSteps,
+				Step:  time.Duration(fanoutStep) * time.Second,
+			},
+		},
+		Shared: config.MQTTSharedGroup{
+			Consumers: sharedCount,
+			Group:     sharedName,
+			Filter:    sharedFilter,
+			DropAt:    time.Duration(sharedDropAt) * time.Second,
+		},
+		OfflineQueue: config.MQTTOfflineQueue{
+			Messages:      offlineMsgs,
+			Offline:       time.Duration(offlineSec) * time.Second,
+			SessionExpiry: time.Duration(offlineExpiry) * time.Second,
+			DrainTimeout:  time.Duration(drainTimeout) * time.Second,
+		},
+		Retained: config.MQTTRetainedStorm{
+			Topics:  retainedN,
+			Topic:   retainedTmpl,
+			Sizes:   retainedSizes,
+			Timeout: time.Duration(retainedWait) * time.Second,
+			Keep:    retainedKeep,
+		},
+		Churn: config.MQTTChurn{
+			Rate:   churnRate,
+			HerdAt: time.Duration(herdAtSec) * time.Second,
+			Backoff: config.MQTTBackoff{
+				Policy:  backoff,
+				Initial: time.Duration(backoffInitMs) * time.Millisecond,
+				Max:     time.Duration(backoffMaxMs) * time.Millisecond,
+			},
+		},
+		Kill: config.MQTTKill{
+			Fraction: killFrac,
+			At:       atOrHalfRun(killAtSec, time.Duration(durationSec)*time.Second),
+		},
+		OpenLoop: config.MQTTOpenLoop{
+			Rate:   rate,
+			Queue:  rateQueue,
+			Behind: time.Duration(rateBehindMs) * time.Millisecond,
+		},
+		StepLoad: config.MQTTStepLoad{
+			Clients: stepClients,
+			Every:   time.Duration(stepEverySec) * time.Second,
+			SLO: config.MQTTStepSLO{
+				SuccessRate:     sloSuccess,
+				LatencyP95:      time.Duration(sloP95Ms) * time.Millisecond,
+				ConnectFailures: sloConnFail,
+			},
+		},
+		Soak: config.MQTTSoak{
+			Enabled: soak,
+			Window:  time.Duration(soakWindowSec) * time.Second,
+		},
+		BrokerMetrics: config.MQTTBrokerMetrics{
+			URL:      brokerMetrics,
+			Interval: time.Duration(scrapeSec) * time.Second,
+			Metrics:  scrapeNames,
+		},
+		Takeover: config.MQTTTakeover{
+			Fraction: takeoverFrac,
+			At:       atOrHalfRun(takeoverAtSec, time.Duration(durationSec)*time.Second),
+			InFlight: takeoverMsgs,
+		},
+		Groups: []config.MQTTClientGroup{{
+			Name:           "default",
+			Clients:        clients,
+			RTUPrefix:      rtuPrefix,
+			RTUStart:       1,
+			ClientIDPrefix: "mqtt_client_",
+			Topic:          topic + "/{rtuId}/data",
+			QoS:            qosLevel,
+			Retain:         retain,
+			Clean:          &clean,
+			Interval:       time.Duration(intervalSec) * time.Second,
+			Schedule:       schedule,
+			Jitter:         time.Duration(jitterSec) * time.Second,
+			Payload:        payload,
+			Credentials: config.MQTTCredentialsConfig{
+				Username: username,
+				Password: password,
+				File:     credsFile,
+				Order:    credsOrder,
+			},
+			SessionExpiry:  time.Duration(sessionExp) * time.Second,
+			MessageExpiry:  time.Duration(messageExp) * time.Second,
+			UserProperties: userProps,
+			TopicAliases:   topicAliases,
+			KeepAlive:      time.Duration(keepAliveSec) * time.Second,
+			Will:           will,
+		}},
+	}
+}
+
+func tlsFromFlags() config.MQTTTLSConfig {
+	return config.MQTTTLSConfig{
+		CAFile:        tlsOpts.CAFile,
+		CertFile:      tlsOpts.CertFile,
+		KeyFile:       tlsOpts.KeyFile,
+		ClientCertDir: tlsOpts.ClientCertDir,
+		ServerName:    tlsOpts.ServerName,
+		Insecure:      tlsOpts.Insecure,
+	}
+}
+
+// applyFlagOverrides applies run-wide flags set on the command line to a
+// scenario loaded from file
+func applyFlagOverrides(cmd *cobra.Command, sc *config.MQTTScenario) {
+	changed := cmd.Flags().Changed
+
+	if changed("broker") {
+		sc.Broker = broker
+	}
+	if changed("compare-broker") {
+		sc.CompareBroker = compareBroker
+	}
+	if changed("protocol-version") {
+		sc.ProtocolVersion = protocolVer
+	}
+	if changed("duration") {
+		sc.Duration = time.Duration(durationSec) * time.Second
+	}
+	if changed("drain") {
+		sc.Drain = time.Duration(drainSec) * time.Second
+	}
+	if changed("verbose") {
+		sc.Verbose = verbose
+	}
+	if changed("ground-truth") {
+		sc.GroundTruth = groundTruth
+	}
+	if changed("subscribers") {
+		sc.Subscribers.Count = subscribers
+	}
+	if changed("sub-mode") {
+		sc.Subscribers.Mode = subMode
+	}
+	if changed("sub-filter") {
+		sc.Subscribers.Filters = subFilters
+	}
+	if changed("shared-consumers") {
+		sc.Shared.Consumers = sharedCount
+	}
+	if changed("shared-group") {
+		sc.Shared.Group = sharedName
+	}
+	if changed("shared-filter") {
+		sc.Shared.Filter = sharedFilter
+	}
+	if changed("shared-drop-at") {
+		sc.Shared.DropAt = time.Duration(sharedDropAt) * time.Second
+	}
+	if changed("fanout-steps") {
+		sc.Subscribers.Fanout.Steps = fanoutSteps
+	}
+	if changed("fanout-step") {
+		sc.Subscribers.Fanout.Step = time.Duration(fanoutStep) * time.Second
+	}
+	if changed("offline-queue") {
+		sc.OfflineQueue.Messages = offlineMsgs
+	}
+	if changed("offline-wait") {
+		sc.OfflineQueue.Offline = time.Duration(offlineSec) * time.Second
+	}
+	if changed("offline-session-expiry") {
+		sc.OfflineQueue.SessionExpiry = time.Duration(offlineExpiry) * time.Second
+	}
+	if changed("drain-timeout") {
+		sc.OfflineQueue.DrainTimeout = time.Duration(drainTimeout) * time.Second
+	}
+	if changed("retained-topics") {
+		sc.Retained.Topics = retainedN
+	}
+	if changed("retained-topic") {
+		sc.Retained.Topic = retainedTmpl
+	}
+	if changed("retained-size") {
+		sc.Retained.Sizes = retainedSizes
+	}
+	if changed("retained-timeout") {
+		sc.Retained.Timeout = time.Duration(retainedWait) * time.Second
+	}
+	if changed("retained-keep") {
+		sc.Retained.Keep = retainedKeep
+	}
+	if changed("churn-rate") {
+		sc.Churn.Rate = churnRate
+	}
+	if changed("herd-at") {
+		sc.Churn.HerdAt = time.Duration(herdAtSec) * time.Second
+	}
+	if changed("backoff") {
+		sc.Churn.Backoff.Policy = backoff
+	}
+	if changed("backoff-initial") {
+		sc.Churn.Backoff.Initial = time.Duration(backoffInitMs) * time.Millisecond
+	}
+	if changed("backoff-max") {
+		sc.Churn.Backoff.Max = time.Duration(backoffMaxMs) * time.Millisecond
+	}
+	if changed("kill") {
+		sc.Kill.Fraction = killFrac
+	}
+	if changed("kill-at") {
+		sc.Kill.At = atOrHalfRun(killAtSec, sc.Duration)
+	}
+	if changed("rate") {
+		sc.OpenLoop.Rate = rate
+	}
+	if changed("rate-queue") {
+		sc.OpenLoop.Queue = rateQueue
+	}
+	if changed("rate-behind") {
+		sc.OpenLoop.Behind = time.Duration(rateBehindMs) * time.Millisecond
+	}
+	if changed("step-clients") {
+		sc.StepLoad.Clients = stepClients
+	}
+	if changed("step-every") {
+		sc.StepLoad.Every = time.Duration(stepEverySec) * time.Second
+	}
+	if changed("slo-success") {
+		sc.StepLoad.SLO.SuccessRate = sloSuccess
+	}
+	if changed("slo-p95") {
+		sc.StepLoad.SLO.LatencyP95 = time.Duration(sloP95Ms) * time.Millisecond
+	}
+	if changed("slo-connect-failures") {
+		sc.StepLoad.SLO.ConnectFailures = sloConnFail
+	}
+	if changed("soak") {
+		sc.Soak.Enabled = soak
+	}
+	if changed("soak-window") {
+		sc.Soak.Window = time.Duration(soakWindowSec) * time.Second
+	}
+	if changed("broker-metrics") {
+		sc.BrokerMetrics.URL = brokerMetrics
+	}
+	if changed("broker-metrics-interval") {
+		sc.BrokerMetrics.Interval = time.Duration(scrapeSec) * time.Second
+	}
+	if changed("broker-metric") {
+		sc.BrokerMetrics.Metrics = scrapeNames
+	}
+	if changed("takeover") {
+		sc.Takeover.Fraction = takeoverFrac
+	}
+	if changed("takeover-at") {
+		sc.Takeover.At = atOrHalfRun(takeoverAtSec, sc.Duration)
+	}
+	if changed("takeover-inflight") {
+		sc.Takeover.InFlight = takeoverMsgs
+	}
+
+	flagTLS := tlsFromFlags()
+	if changed("ca-file") {
+		sc.TLS.CAFile = flagTLS.CAFile
+	}
+	if changed("cert-file") {
+		sc.TLS.CertFile = flagTLS.CertFile
+	}
+	if changed("key-file") {
+		sc.TLS.KeyFile = flagTLS.KeyFile
+	}
+	if changed("client-cert-dir") {
+		sc.TLS.ClientCertDir = flagTLS.ClientCertDir
+	}
+	if changed("server-name") {
+		sc.TLS.ServerName = flagTLS.ServerName
+	}
+	if changed("insecure") {
+		sc.TLS.Insecure = flagTLS.Insecure
+	}
+
+	if changed("ws-path") {
+		sc.WebSocket.Path = wsPath
+	}
+	if changed("ws-subprotocol") {
+		sc.WebSocket.Subprotocol = wsSubprotocol
+	}
+	if changed("ws-header") {
+		sc.WebSocket.Headers = wsHeaders
+	}
+
+	// --username/--password fill in groups that don't define credentials
+	if changed("username") || changed("password") {
+		for i := range sc.Groups {
+			creds := &sc.Groups[i].Credentials
+			if creds.Username == "" && creds.File == "" {
+				creds.Username, creds.Password = username, password
+			}
+		}
+		if sc.Subscribers.Username == "" {
+			sc.Subscribers.Username, sc.Subscribers.Password = username, password
+		}
+	}
+}
+
+// clientGroup is a scenario client group ready to create clients from
+type clientGroup struct {
+	config.MQTTClientGroup
+	picker     *credentialPicker
+	credCount  int
+	properties []mqtt5.UserProperty
+	payload    PayloadGenerator
+}
+
+func newClientGroup(g config.MQTTClientGroup) (*clientGroup, error) {
+	group := &clientGroup{MQTTClientGroup: g}
+
+	properties, err := parseUserProperties(g.UserProperties)
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %w", g.Name, err)
+	}
+	group.properties = properties
+
+	group.payload, err = newPayloadGenerator(g.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %w", g.Name, err)
+	}
+
+	if g.Credentials.File != "" {
+		creds, err := loadCredentials(g.Credentials.File)
+		if err == nil {
+			group.picker, err = newCredentialPicker(creds, g.Credentials.Order)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", g.Name, err)
+		}
+		group.credCount = len(creds)
+	}
+
+	return group, nil
+}
+
+// rtuID returns the RTU ID of the n-th client in the group
+func (g *clientGroup) rtuID(n int) string {
+	return fmt.Sprintf("%s%04d", g.RTUPrefix, g.RTUStart+n)
+}
+
+// topicFor expands the group's topic template for one client
+func (g *clientGroup) topicFor(rtuID, clientID string, index int) string {
+	return g.expand(g.Topic, rtuID, clientID, index)
+}
+
+// expand fills the topic placeholders of tmpl for one client
+func (g *clientGroup) expand(tmpl, rtuID, clientID string, index int) string {
+	return strings.NewReplacer(
+		"{rtuId}", rtuID,
+		"{clientId}", clientID,
+		"{group}", g.Name,
+		"{index}", strconv.Itoa(index),
+	).Replace(tmpl)
+}
+
+// wildcardFilter returns a filter matching every topic the group publishes,
+// replacing each per-client topic level with +
+func (g *clientGroup) wildcardFilter() string {
+	return g.filterFor(g.Topic)
+}
+
+// filterFor turns a topic template into a filter matching it for every client
+func (g *clientGroup) filterFor(tmpl string) string {
+	return templateFilter(strings.ReplaceAll(tmpl, "{group}", g.Name))
+}
+
+// templateFilter replaces every topic level holding a placeholder with +
+func templateFilter(tmpl string) string {
+	levels := strings.Split(tmpl, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "{") {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// describe summarizes the group for the start-up banner
+func (g *clientGroup) describe() string {
+	schedule := fmt.Sprintf("every %v", g.Interval)
+	if g.Schedule == config.ScheduleSync {
+		schedule = fmt.Sprintf("synchronized every %v ±%v", g.Interval, g.Jitter)
+	}
+	desc := fmt.Sprintf("%d clients, %s, QoS %d, %s payload, %s", g.Clients, schedule, g.QoS, g.Payload.Type, g.Topic)
+	if g.KeepAlive != keepAlive {
+		desc += fmt.Sprintf(", keep-alive %v", g.KeepAlive)
+	}
+	return desc
+}
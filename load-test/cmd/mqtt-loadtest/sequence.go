@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SequenceFile scripts per-RTU telemetry timelines for validating alarm
+// detection rules
+type SequenceFile struct {
+	// Baseline values published while no event drives a field
+	Baseline map[string]float64 `yaml:"baseline"`
+	// Alarm limits used to derive the ground-truth manifest
+	Thresholds map[string]Threshold `yaml:"thresholds"`
+	Timelines  []Timeline           `yaml:"timelines"`
+}
+
+// Threshold holds the alarm limits of one field; nil limits are not checked
+type Threshold struct {
+	High *float64 `yaml:"high"`
+	Low  *float64 `yaml:"low"`
+}
+
+// Timeline is the list of events applied to the matching RTUs
+type Timeline struct {
+	RTU    string          `yaml:"rtu"`   // RTU ID
+	Index  int             `yaml:"index"` // 1-based client index within the group
+	All    bool            `yaml:"all"`   // every RTU of the group
+	Events []SequenceEvent `yaml:"events"`
+}
+
+// SequenceEvent drives one or more fields from At (relative to the first
+// publish) either to a fixed value or along a linear ramp. Without For the
+// final value is held until the end of the run.
+type SequenceEvent struct {
+	Field  string        `yaml:"field"`
+	Fields []string      `yaml:"fields"`
+	At     time.Duration `yaml:"at"`
+	For    time.Duration `yaml:"for"`
+	Set    *float64      `yaml:"set"`
+	Ramp   *Ramp         `yaml:"ramp"`
+}
+
+// Ramp moves a field linearly from From to To over Over
+type Ramp struct {
+	From float64       `yaml:"from"`
+	To   float64       `yaml:"to"`
+	Over time.Duration `yaml:"over"`
+}
+
+func (t Timeline) matches(rtuID string, index int) bool {
+	return t.All || (t.RTU != "" && t.RTU == rtuID) || (t.Index > 0 && t.Index == index)
+}
+
+func (e SequenceEvent) fields() []string {
+	if e.Field != "" {
+		return append([]string{e.Field}, e.Fields...)
+	}
+	return e.Fields
+}
+
+// valueAt returns the event value at elapsed time, or false when the event
+// is not active
+func (e SequenceEvent) valueAt(elapsed time.Duration) (float64, bool) {
+	if elapsed < e.At || (e.For > 0 && elapsed >= e.At+e.For) {
+		return 0, false
+	}
+	if e.Set != nil {
+		return *e.Set, true
+	}
+
+	progress := 1.0
+	if e.Ramp.Over > 0 {
+		progress = math.Min(float64(elapsed-e.At)/float64(e.Ramp.Over), 1)
+	}
+	return e.Ramp.From + (e.Ramp.To-e.Ramp.From)*progress, true
+}
+
+// defaultBaseline matches the normal values of the test-mode cycle
+var defaultBaseline = map[string]float64{
+	"VR": 230, "VS": 230, "VT": 230,
+	"IR": 150, "IS": 150, "IT": 150,
+	"PF1": 0.95, "PF2": 0.95, "PF3": 0.95,
+	"TK1": 35, "TK2": 37,
+}
+
+func float(v float64) *float64 { return &v }
+
+// defaultThresholds are the typical detection limits the test-mode cycle targets
+var defaultThresholds = map[string]Threshold{
+	"VR": {High: float(250), Low: float(210)}, "VS": {High: float(250), Low: float(210)}, "VT": {High: float(250), Low: float(210)},
+	"IR": {High: float(200)}, "IS": {High: float(200)}, "IT": {High: float(200)},
+	"PF1": {Low: float(0.85)}, "PF2": {Low: float(0.85)}, "PF3": {Low: float(0.85)},
+	"TK1": {High: float(50)}, "TK2": {High: float(50)},
+}
+
+// loadSequenceFile reads and validates a sequence file
+func loadSequenceFile(path string) (*SequenceFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sequence file: %w", err)
+	}
+
+	var seq SequenceFile
+	if err := yaml.Unmarshal(data, &seq); err != nil {
+		return nil, fmt.Errorf("failed to parse sequence file %s: %w", path, err)
+	}
+
+	baseline := make(map[string]float64, len(defaultBaseline))
+	for field, v := range defaultBaseline {
+		baseline[field] = v
+	}
+	for field, v := range seq.Baseline {
+		baseline[field] = v
+	}
+	seq.Baseline = baseline
+
+	if seq.Thresholds == nil {
+		seq.Thresholds = defaultThresholds
+	}
+
+	for i, tl := range seq.Timelines {
+		if !tl.All && tl.RTU == "" && tl.Index <= 0 {
+			return nil, fmt.Errorf("sequence file %s: timeline %d needs rtu, index or all", path, i+1)
+		}
+		for j, ev := range tl.Events {
+			if len(ev.fields()) == 0 {
+				return nil, fmt.Errorf("sequence file %s: timeline %d event %d has no field", path, i+1, j+1)
+			}
+			if (ev.Set == nil) == (ev.Ramp == nil) {
+				return nil, fmt.Errorf("sequence file %s: timeline %d event %d needs exactly one of set or ramp", path, i+1, j+1)
+			}
+		}
+	}
+
+	return &seq, nil
+}
+
+// AlarmEvent is one entry of the ground-truth manifest
+type AlarmEvent struct {
+	RTUID     string    `json:"rtuId"`
+	Alarm     string    `json:"alarm"` // e.g. TK1_HIGH
+	State     string    `json:"state"` // raised or cleared
+	Field     string    `json:"field"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+	TS        int64     `json:"ts"`  // TS field of the triggering message
+	Seq       int64     `json:"seq"` // per-RTU publish sequence number
+	Offset    string    `json:"offset"`
+}
+
+// sequenceGenerator produces the RTU schema from scripted timelines and
+// records which alarms each message should raise or clear
+type sequenceGenerator struct {
+	seq *SequenceFile
+
+	startOnce sync.Once
+	start     time.Time
+
+	mu     sync.Mutex
+	active map[string]map[string]bool // rtuId -> alarm -> raised
+	events []AlarmEvent
+}
+
+func newSequenceGenerator(path string) (*sequenceGenerator, error) {
+	seq, err := loadSequenceFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sequenceGenerator{seq: seq, active: make(map[string]map[string]bool)}, nil
+}
+
+func (g *sequenceGenerator) Generate(pc PayloadContext) ([]byte, error) {
+	g.startOnce.Do(func() { g.start = pc.Time })
+	elapsed := pc.Time.Sub(g.start)
+
+	values := make(map[string]float64, len(g.seq.Baseline)+8)
+	for field, v := range g.seq.Baseline {
+		values[field] = v
+	}
+	driven := make(map[string]bool)
+	for _, tl := range g.seq.Timelines {
+		if !tl.matches(pc.RTUID, pc.Index) {
+			continue
+		}
+		for _, ev := range tl.Events {
+			v, ok := ev.valueAt(elapsed)
+			if !ok {
+				continue
+			}
+			for _, field := range ev.fields() {
+				values[field] = v
+				driven[field] = true
+			}
+		}
+	}
+
+	deriveRTUFields(values, driven)
+	g.checkThresholds(pc, elapsed, values)
+
+	fields := make(map[string]interface{}, len(values)+4)
+	for field, v := range values {
+		fields[field] = math.Round(v*1000) / 1000
+	}
+	fields["rtuId"] = pc.RTUID
+	fields["TS"] = pc.Time.Unix()
+	if pc.Tracking {
+		fields["pub"] = pc.ClientID
+		fields["seq"] = pc.Seq
+		fields["sentAt"] = pc.Time.UnixNano()
+	}
+	return json.Marshal(fields)
+}
+
+// deriveRTUFields fills in the power, neutral and harmonic fields of the RTU
+// schema from voltage, current and power factor, keeping scripted values
+func deriveRTUFields(v map[string]float64, driven map[string]bool) {
+	set := func(field string, value float64) {
+		if !driven[field] {
+			v[field] = value
+		}
+	}
+
+	phases := []struct{ v, i, pf, p, q, s string }{
+		{"VR", "IR", "PF1", "PR", "QR", "SR"},
+		{"VS", "IS", "PF2", "PS", "QS", "SS"},
+		{"VT", "IT", "PF3", "PT", "QT", "ST"},
+	}
+	for _, ph := range phases {
+		pf := v[ph.pf]
+		set(ph.p, v[ph.v]*v[ph.i]*pf)
+		set(ph.q, v[ph.v]*v[ph.i]*math.Sqrt(math.Max(0, 1-pf*pf)))
+		set(ph.s, v[ph.v]*v[ph.i])
+	}
+	set("STot", v["SR"]+v["SS"]+v["ST"])
+	set("ITot", v["IR"]+v["IS"]+v["IT"])
+	set("IN", v["ITot"]*0.02)
+	set("I1F1", v["IR"]*0.8)
+	set("I2F1", v["IS"]*0.8)
+	set("I3F1", v["IT"]*0.8)
+	set("INF1", v["IN"]*0.4)
+	set("I1F2", v["IR"]*0.7)
+	set("I2F2", v["IS"]*0.7)
+	set("I3F2", v["IT"]*0.7)
+	set("INF2", v["IN"]*0.3)
+}
+
+// checkThresholds records alarm transitions caused by this message
+func (g *sequenceGenerator) checkThresholds(pc PayloadContext, elapsed time.Duration, values map[string]float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	active, ok := g.active[pc.RTUID]
+	if !ok {
+		active = make(map[string]bool)
+		g.active[pc.RTUID] = active
+	}
+
+	record := func(alarm, field string, value, threshold float64, raised bool) {
+		if active[alarm] == raised {
+			return
+		}
+		active[alarm] = raised
+		state := "cleared"
+		if raised {
+			state = "raised"
+		}
+		g.events = append(g.events, AlarmEvent{
+			RTUID:     pc.RTUID,
+			Alarm:     alarm,
+			State:     state,
+			Field:     field,
+			Value:     math.Round(value*1000) / 1000,
+			Threshold: threshold,
+			Time:      pc.Time,
+			TS:        pc.Time.Unix(),
+			Seq:       pc.Seq,
+			Offset:    elapsed.Truncate(time.Millisecond).String(),
+		})
+	}
+
+	for field, th := range g.seq.Thresholds {
+		value, ok := values[field]
+		if !ok {
+			continue
+		}
+		if th.High != nil {
+			record(field+"_HIGH", field, value, *th.High, value > *th.High)
+		}
+		if th.Low != nil {
+			record(field+"_LOW", field, value, *th.Low, value < *th.Low)
+		}
+	}
+}
+
+// GroundTruth returns the alarm transitions generated so far in time order
+func (g *sequenceGenerator) GroundTruth() []AlarmEvent {
+	g.mu.Lock()
+	events := make([]AlarmEvent, len(g.events))
+	copy(events, g.events)
+	g.mu.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// groundTruthSource is implemented by generators that know which alarms
+// their payloads should trigger
+type groundTruthSource interface {
+	GroundTruth() []AlarmEvent
+}
+
+// GroundTruthManifest is written by --ground-truth for downstream checks
+type GroundTruthManifest struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Broker      string       `json:"broker"`
+	Alarms      []AlarmEvent `json:"alarms"`
+}
+
+// writeGroundTruth writes the alarm transitions of all groups to path
+func writeGroundTruth(path, broker string, groups []*clientGroup) (int, error) {
+	manifest := GroundTruthManifest{
+		GeneratedAt: time.Now(),
+		Broker:      broker,
+		Alarms:      []AlarmEvent{},
+	}
+	for _, g := range groups {
+		if src, ok := g.payload.(groundTruthSource); ok {
+			manifest.Alarms = append(manifest.Alarms, src.GroundTruth()...)
+		}
+	}
+	sort.SliceStable(manifest.Alarms, func(i, j int) bool { return manifest.Alarms[i].Time.Before(manifest.Alarms[j].Time) })
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write ground truth: %w", err)
+	}
+	return len(manifest.Alarms), nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"loadtest/internal/mqtt5"
+)
+
+const (
+	connectTimeout = 15 * time.Second
+	publishTimeout = 30 * time.Second
+	keepAlive      = 60 * time.Second
+)
+
+// receivedMessage is an inbound message independent of protocol version
+type receivedMessage struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Retained  bool
+	Duplicate bool
+}
+
+type messageHandler func(msg receivedMessage)
+
+// willMessage is the Last Will a client registers on CONNECT
+type willMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Delay   uint32 // MQTT 5 will delay interval (seconds)
+}
+
+// mqttSession is the protocol-specific connection behind a load client
+type mqttSession interface {
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	Subscribe(filter string, qos byte, handler messageHandler) error
+	Disconnect()
+	Abort() // close the network connection without DISCONNECT, firing the will
+	IsConnected() bool
+	SessionPresent() bool    // broker resumed a stored session on connect
+	Closed() <-chan struct{} // closed once the connection is gone
+}
+
+// connTiming breaks a successful connect down into its phases
+type connTiming struct {
+	Dial         time.Duration // TCP connect
+	TLSHandshake time.Duration // zero for plain TCP
+	Upgrade      time.Duration // WebSocket upgrade, zero for TCP listeners
+	Total        time.Duration // dial through CONNACK
+}
+
+// MQTT returns the time spent in the CONNECT/CONNACK exchange
+func (t connTiming) MQTT() time.Duration {
+	return t.Total - t.Dial - t.TLSHandshake - t.Upgrade
+}
+
+// connectSession opens a session using the protocol version from cfg
+func connectSession(cfg ClientConfig, clientID string) (mqttSession, connTiming, error) {
+	var timing connTiming
+	start := time.Now()
+
+	var session mqttSession
+	var err error
+	if cfg.ProtocolVersion == 5 {
+		session, err = connectV5(cfg, clientID, &timing)
+	} else {
+		session, err = connectV3(cfg, clientID, &timing)
+	}
+
+	timing.Total = time.Since(start)
+	return session, timing, err
+}
+
+// reasonCodeOf extracts the MQTT 5 reason code carried by err, if any
+func reasonCodeOf(err error) *byte {
+	var rcErr *mqtt5.ReasonCodeError
+	if errors.As(err, &rcErr) {
+		code := rcErr.Code
+		return &code
+	}
+	return nil
+}
+
+// v3Session wraps paho.mqtt.golang for MQTT 3.1 and 3.1.1
+type v3Session struct {
+	client         mqtt.Client
+	conn           net.Conn
+	sessionPresent bool
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+func connectV3(cfg ClientConfig, clientID string, timing *connTiming) (mqttSession, error) {
+	session := &v3Session{closed: make(chan struct{})}
+	opts := newClientOptions(cfg, clientID)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, _ error) {
+		session.markClosed()
+	})
+	if cfg.OnMessage != nil {
+		opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+			cfg.OnMessage(receivedMessage{
+				Topic:     msg.Topic(),
+				Payload:   msg.Payload(),
+				QoS:       msg.Qos(),
+				Retained:  msg.Retained(),
+				Duplicate: msg.Duplicate(),
+			})
+		})
+	}
+	opts.SetCustomOpenConnectionFn(func(_ *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		conn, err := dialBroker(ctx, cfg, timing)
+		conn = watchConn(cfg, conn)
+		session.conn = conn
+		return conn, err
+	})
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	session.client = client
+	if ct, ok := token.(*mqtt.ConnectToken); ok {
+		session.sessionPresent = ct.SessionPresent()
+	}
+	return session, nil
+}
+
+func (s *v3Session) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	token := s.client.Publish(topic, qos, retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (s *v3Session) Subscribe(filter string, qos byte, handler messageHandler) error {
+	token := s.client.Subscribe(filter, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(receivedMessage{
+			Topic:     msg.Topic(),
+			Payload:   msg.Payload(),
+			QoS:       msg.Qos(),
+			Retained:  msg.Retained(),
+			Duplicate: msg.Duplicate(),
+		})
+	})
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+	// MQTT 3.1.1 reports a refused filter as return code 0x80
+	if code, ok := token.(*mqtt.SubscribeToken).Result()[filter]; ok && code == 0x80 {
+		return &mqtt5.ReasonCodeError{Packet: "SUBACK", Code: code}
+	}
+	return nil
+}
+
+func (s *v3Session) Disconnect() {
+	s.client.Disconnect(250)
+	s.markClosed()
+}
+
+// Abort closes the socket under paho, which sees it as a lost connection
+func (s *v3Session) Abort() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.markClosed()
+}
+
+func (s *v3Session) markClosed() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func (s *v3Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *v3Session) IsConnected() bool {
+	return s.client.IsConnected()
+}
+
+func (s *v3Session) SessionPresent() bool {
+	return s.sessionPresent
+}
+
+// v5Session wraps the internal MQTT 5 client
+type v5Session struct {
+	client         *mqtt5.Client
+	messageExpiry  uint32
+	userProps      []mqtt5.UserProperty
+	sessionPresent bool
+
+	// Messages go to every handler whose filter matches, as paho routes
+	// them for MQTT 3.1.1, and to the default handler when none does
+	mu             sync.RWMutex
+	routes         map[string]messageHandler // by filter, $share prefix stripped
+	defaultHandler messageHandler
+}
+
+func connectV5(cfg ClientConfig, clientID string, timing *connTiming) (mqttSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	conn, err := dialBroker(ctx, cfg, timing)
+	if err != nil {
+		return nil, err
+	}
+	conn = watchConn(cfg, conn)
+
+	s := &v5Session{
+		messageExpiry:  cfg.MessageExpiry,
+		userProps:      cfg.UserProperties,
+		routes:         make(map[string]messageHandler),
+		defaultHandler: cfg.OnMessage,
+	}
+
+	client, connack, err := mqtt5.Connect(ctx, conn, mqtt5.ClientOptions{
+		ClientID:        clientID,
+		Username:        cfg.Username,
+		Password:        cfg.Password,
+		CleanStart:      cfg.Clean,
+		KeepAlive:       cfg.keepAlive(),
+		SessionExpiry:   cfg.SessionExpiry,
+		UserProps:       cfg.UserProperties,
+		UseTopicAliases: cfg.TopicAliases,
+		Will:            v5Will(cfg.Will),
+		OnMessage:       s.onMessage,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.client = client
+	s.sessionPresent = connack.SessionPresent
+	return s, nil
+}
+
+func v5Will(w *willMessage) *mqtt5.Message {
+	if w == nil {
+		return nil
+	}
+	msg := &mqtt5.Message{Topic: w.Topic, Payload: w.Payload, QoS: w.QoS, Retain: w.Retain}
+	if w.Delay > 0 {
+		msg.Properties.WillDelay = mqtt5.Uint32(w.Delay)
+	}
+	return msg
+}
+
+func (s *v5Session) onMessage(msg *mqtt5.Message) {
+	var handlers []messageHandler
+	s.mu.RLock()
+	for filter, handler := range s.routes {
+		if topicMatches(filter, msg.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	if len(handlers) == 0 && s.defaultHandler != nil {
+		handlers = append(handlers, s.defaultHandler)
+	}
+	s.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(receivedMessage{
+			Topic:     msg.Topic,
+			Payload:   msg.Payload,
+			QoS:       msg.QoS,
+			Retained:  msg.Retain,
+			Duplicate: msg.Duplicate,
+		})
+	}
+}
+
+func (s *v5Session) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	msg := &mqtt5.Message{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+		Retain:  retain,
+		Properties: mqtt5.Properties{
+			User: s.userProps,
+		},
+	}
+	if s.messageExpiry > 0 {
+		msg.Properties.MessageExpiry = mqtt5.Uint32(s.messageExpiry)
+	}
+
+	_, err := s.client.Publish(ctx, msg)
+	return err
+}
+
+func (s *v5Session) Subscribe(filter string, qos byte, handler messageHandler) error {
+	s.mu.Lock()
+	s.routes[routeFilter(filter)] = handler
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	_, err := s.client.Subscribe(ctx, mqtt5.Subscription{Filter: filter, QoS: qos})
+	return err
+}
+
+// routeFilter strips the $share/<group>/ prefix, since messages arrive on
+// the topics the underlying filter matches
+func routeFilter(filter string) string {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			return rest[i+1:]
+		}
+	}
+	return filter
+}
+
+func (s *v5Session) Disconnect() {
+	s.client.Disconnect(mqtt5.ReasonSuccess)
+}
+
+func (s *v5Session) Abort() {
+	s.client.Close()
+}
+
+func (s *v5Session) IsConnected() bool {
+	return s.client.IsConnected()
+}
+
+func (s *v5Session) SessionPresent() bool {
+	return s.sessionPresent
+}
+
+func (s *v5Session) Closed() <-chan struct{} {
+	return s.client.Done()
+}
+
+// dialBroker opens the network connection to the broker, recording the
+// TCP, TLS and WebSocket phases in timing
+func dialBroker(ctx context.Context, cfg ClientConfig, timing *connTiming) (net.Conn, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL %q: %w", cfg.Broker, err)
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return dialWebsocket(ctx, u, cfg, timing)
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps":
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+
+	secure := isTLSScheme(u.Scheme)
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := dialTCP(ctx, host, timing)
+	if err != nil || !secure {
+		return conn, err
+	}
+	return handshakeTLS(ctx, conn, cfg.TLSConfig, u.Hostname(), timing)
+}
+
+// dialTCP connects to addr and records the dial time
+func dialTCP(ctx context.Context, addr string, timing *connTiming) (net.Conn, error) {
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	timing.Dial = time.Since(start)
+	return conn, nil
+}
+
+// handshakeTLS runs the TLS client handshake over conn and records its duration
+func handshakeTLS(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, hostname string, timing *connTiming) (net.Conn, error) {
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = hostname
+	}
+
+	start := time.Now()
+	tlsConn := tls.Client(conn, tlsCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	timing.TLSHandshake = time.Since(start)
+
+	return tlsConn, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"loadtest/internal/mqtt5"
+)
+
+func TestV5SessionRoutesByFilter(t *testing.T) {
+	got := make(map[string][]string)
+	route := func(name string) messageHandler {
+		return func(msg receivedMessage) { got[name] = append(got[name], msg.Topic) }
+	}
+
+	s := &v5Session{routes: make(map[string]messageHandler), defaultHandler: route("default")}
+	s.routes[routeFilter("thms/+/data")] = route("data")
+	s.routes[routeFilter("$share/g/thms/#")] = route("shared")
+	s.routes[routeFilter("thms/+/status")] = route("status")
+
+	for _, topic := range []string{"thms/rtu1/data", "thms/rtu1/status", "other"} {
+		s.onMessage(&mqtt5.Message{Topic: topic})
+	}
+
+	want := map[string][]string{
+		"data":    {"thms/rtu1/data"},
+		"shared":  {"thms/rtu1/data", "thms/rtu1/status"},
+		"status":  {"thms/rtu1/status"},
+		"default": {"other"},
+	}
+	for name, topics := range want {
+		if len(got[name]) != len(topics) {
+			t.Errorf("%s handler got %v, want %v", name, got[name], topics)
+			continue
+		}
+		for i := range topics {
+			if got[name][i] != topics[i] {
+				t.Errorf("%s handler got %v, want %v", name, got[name], topics)
+			}
+		}
+	}
+}
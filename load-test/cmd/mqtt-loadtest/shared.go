@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+const (
+	// sharedBucket is the resolution of the group delivery timeline
+	sharedBucket = 100 * time.Millisecond
+	// sharedRateWindow is the window the group delivery rate is measured over
+	sharedRateWindow = time.Second
+	// sharedBaseline is how long before the drop the steady group rate is
+	// measured
+	sharedBaseline = 5 * time.Second
+	// sharedRecovered is the fraction of the steady rate that counts as
+	// redistributed
+	sharedRecovered = 0.9
+)
+
+// sharedConsumer is one member of the $share group
+type sharedConsumer struct {
+	ID         int
+	ClientID   string
+	session    mqttSession
+	received   int64
+	beforeDrop int64 // received when the drop happened
+	dropped    bool
+}
+
+// sharedGroup tracks what the consumers of one $share subscription received.
+// Every acknowledged message should reach exactly one consumer.
+type sharedGroup struct {
+	Filters   []string // $share/<group>/<filter>
+	consumers []*sharedConsumer
+	stats     *Stats
+	latency   LatencyRecorder
+
+	mu         sync.Mutex
+	streams    map[string]*topicStream
+	since      map[*MQTTLoadClient]int64
+	start      time.Time
+	buckets    []int64 // deliveries per sharedBucket since start
+	dropAt     time.Time
+	duplicates int64
+	malformed  int64
+}
+
+func newSharedGroup(cfg config.MQTTSharedGroup, filters []string, stats *Stats) *sharedGroup {
+	g := &sharedGroup{
+		stats:   stats,
+		streams: make(map[string]*topicStream),
+	}
+	if cfg.Filter != "" {
+		filters = []string{cfg.Filter}
+	}
+	for _, filter := range filters {
+		g.Filters = append(g.Filters, "$share/"+cfg.Group+"/"+filter)
+	}
+	for i := 1; i <= cfg.Consumers; i++ {
+		g.consumers = append(g.consumers, &sharedConsumer{ID: i, ClientID: fmt.Sprintf("mqtt_%s_%d", cfg.Group, i)})
+	}
+	return g
+}
+
+// connect subscribes every consumer to the shared filters. Messages numbered
+// before the last consumer subscribed aren't expected.
+func (g *sharedGroup) connect(cfg ClientConfig, publishers []*MQTTLoadClient) {
+	cfg.Clean = true
+	var wg sync.WaitGroup
+	for _, c := range g.consumers {
+		wg.Add(1)
+		go func(c *sharedConsumer) {
+			defer wg.Done()
+			session, _, err := connectSession(cfg, c.ClientID)
+			if err != nil {
+				g.stats.recordErr("shared", c.ClientID, err)
+				return
+			}
+			handler := func(msg receivedMessage) { g.handleMessage(c, msg) }
+			for _, filter := range g.Filters {
+				if err := session.Subscribe(filter, cfg.QoS, handler); err != nil {
+					g.stats.recordErr("shared", c.ClientID, fmt.Errorf("%s: %w", filter, err))
+					session.Disconnect()
+					return
+				}
+			}
+			c.session = session
+		}(c)
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.start = time.Now()
+	g.since = make(map[*MQTTLoadClient]int64, len(publishers))
+	for _, pub := range publishers {
+		if n := pub.handedOut(); n > 0 {
+			g.since[pub] = n
+		}
+	}
+}
+
+func (g *sharedGroup) handleMessage(c *sharedConsumer, msg receivedMessage) {
+	receivedAt := time.Now()
+	atomic.AddInt64(&c.received, 1)
+
+	var p trackedPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil || p.SentAt == 0 {
+		atomic.AddInt64(&g.malformed, 1)
+		return
+	}
+
+	g.mu.Lock()
+	if bucket := int(receivedAt.Sub(g.start) / sharedBucket); bucket >= 0 {
+		for len(g.buckets) <= bucket {
+			g.buckets = append(g.buckets, 0)
+		}
+		g.buckets[bucket]++
+	}
+	key := streamKey(msg.Topic, p.Pub)
+	stream, ok := g.streams[key]
+	if !ok {
+		stream = newTopicStream()
+		g.streams[key] = stream
+	}
+	dup := stream.observe(p.Seq)
+	g.mu.Unlock()
+
+	if dup {
+		atomic.AddInt64(&g.duplicates, 1)
+		return
+	}
+	g.latency.Record(receivedAt.Sub(time.Unix(0, p.SentAt)))
+}
+
+// connected returns the consumers still online
+func (g *sharedGroup) connected() []*sharedConsumer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var online []*sharedConsumer
+	for _, c := range g.consumers {
+		if c.session != nil && !c.dropped {
+			online = append(online, c)
+		}
+	}
+	return online
+}
+
+// runDrop kills one consumer without DISCONNECT at at, as a crashing
+// ingestion worker would
+func (g *sharedGroup) runDrop(at time.Duration, stop <-chan struct{}) {
+	select {
+	case <-stop:
+		return
+	case <-time.After(at):
+	}
+
+	online := g.connected()
+	if len(online) < 2 {
+		return
+	}
+	victim := online[len(online)-1]
+	fmt.Fprintf(consoleOut, "\n🔻 Shared group: killing consumer %s\n", victim.ClientID)
+
+	g.mu.Lock()
+	g.dropAt = time.Now()
+	for _, c := range g.consumers {
+		c.beforeDrop = atomic.LoadInt64(&c.received)
+	}
+	victim.dropped = true
+	g.mu.Unlock()
+	victim.session.Abort()
+}
+
+// disconnect disconnects the consumers still online
+func (g *sharedGroup) disconnect() {
+	for _, c := range g.connected() {
+		c.session.Disconnect()
+	}
+}
+
+// ConsumerShare is one consumer's part of the group's deliveries
+type ConsumerShare struct {
+	ClientID  string  `json:"client_id"`
+	Received  int64   `json:"received"`
+	Share     float64 `json:"share"`                // percent of the group's deliveries
+	AfterDrop float64 `json:"after_drop,omitempty"` // percent of deliveries after the drop
+	Dropped   bool    `json:"dropped,omitempty"`
+}
+
+// SharedReport summarizes the shared subscription group for the final report
+type SharedReport struct {
+	Filters    []string        `json:"filters"`
+	Consumers  int             `json:"consumers"`
+	Connected  int             `json:"connected"`
+	Expected   int64           `json:"expected"`
+	Received   int64           `json:"received"`
+	Unique     int64           `json:"unique"`
+	Missing    int64           `json:"missing"`
+	Duplicates int64           `json:"duplicates"`
+	Malformed  int64           `json:"malformed"`
+	Latency    LatencyStats    `json:"latency"`
+	Shares     []ConsumerShare `json:"shares"`
+	Skew       float64         `json:"skew"` // busiest consumer above the mean, percent
+	CV         float64         `json:"cv"`   // coefficient of variation of the shares
+
+	// Set when a consumer was killed mid-test
+	Dropped        string  `json:"dropped,omitempty"`
+	SteadyRate     float64 `json:"steady_rate,omitempty"` // group deliveries/s before the drop
+	Redistributed  bool    `json:"redistributed,omitempty"`
+	Redistribution float64 `json:"redistribution_ms,omitempty"` // drop to the group rate recovering
+}
+
+func (g *sharedGroup) buildReport(publishers []*MQTTLoadClient) *SharedReport {
+	report := &SharedReport{
+		Filters:    g.Filters,
+		Consumers:  len(g.consumers),
+		Duplicates: atomic.LoadInt64(&g.duplicates),
+		Malformed:  atomic.LoadInt64(&g.malformed),
+		Latency:    g.latency.Summary(),
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Balance is measured while every consumer was online
+	var counts []float64
+	var total, afterTotal int64
+	for _, c := range g.consumers {
+		if c.session == nil {
+			continue
+		}
+		report.Connected++
+		received := atomic.LoadInt64(&c.received)
+		report.Received += received
+		steady := received
+		if !g.dropAt.IsZero() {
+			steady = c.beforeDrop
+			afterTotal += received - c.beforeDrop
+		}
+		total += steady
+		counts = append(counts, float64(steady))
+	}
+	for _, c := range g.consumers {
+		if c.session == nil {
+			continue
+		}
+		share := ConsumerShare{ClientID: c.ClientID, Received: atomic.LoadInt64(&c.received), Dropped: c.dropped}
+		steady := share.Received
+		if !g.dropAt.IsZero() {
+			steady = c.beforeDrop
+			if afterTotal > 0 {
+				share.AfterDrop = float64(share.Received-c.beforeDrop) / float64(afterTotal) * 100
+			}
+		}
+		if total > 0 {
+			share.Share = float64(steady) / float64(total) * 100
+		}
+		report.Shares = append(report.Shares, share)
+	}
+	report.Skew, report.CV = balance(counts)
+
+	for _, pub := range publishers {
+		if !g.covers(pub) {
+			continue
+		}
+		from := g.since[pub] + 1
+		report.Expected += pub.ackedFrom(from)
+
+		stream := g.streams[streamKey(pub.Config.PublishTopic, pub.ClientID)]
+		if stream == nil {
+			continue
+		}
+		lastAcked, unpublished := pub.acknowledged()
+		for seq := from; seq <= lastAcked; seq++ {
+			if _, skip := unpublished[seq]; skip {
+				continue
+			}
+			if _, ok := stream.received[seq]; ok {
+				report.Unique++
+			}
+		}
+	}
+	report.Missing = report.Expected - report.Unique
+
+	if !g.dropAt.IsZero() {
+		for _, c := range g.consumers {
+			if c.dropped {
+				report.Dropped = c.ClientID
+			}
+		}
+		g.redistribution(report)
+	}
+	return report
+}
+
+// covers reports whether the shared filters match the publisher's topic
+func (g *sharedGroup) covers(pub *MQTTLoadClient) bool {
+	for _, filter := range g.Filters {
+		// $share/<group>/<filter>
+		shared := strings.SplitN(filter, "/", 3)[2]
+		if topicMatches(shared, pub.Config.PublishTopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// redistribution finds how long after the drop the surviving consumers got
+// back to sharedRecovered of the group's steady delivery rate, sustained
+// for sharedRateWindow
+func (g *sharedGroup) redistribution(report *SharedReport) {
+	window := int(sharedRateWindow / sharedBucket)
+	drop := int(g.dropAt.Sub(g.start) / sharedBucket)
+	from := drop - int(sharedBaseline/sharedBucket)
+	if from < 0 {
+		from = 0
+	}
+	if drop <= from {
+		return
+	}
+
+	var steady int64
+	for i := from; i < drop && i < len(g.buckets); i++ {
+		steady += g.buckets[i]
+	}
+	report.SteadyRate = float64(steady) / (float64(drop-from) * sharedBucket.Seconds())
+	if report.SteadyRate == 0 {
+		return
+	}
+
+	for i := drop; i+window <= len(g.buckets); i++ {
+		var n int64
+		for _, count := range g.buckets[i : i+window] {
+			n += count
+		}
+		if float64(n)/sharedRateWindow.Seconds() >= sharedRecovered*report.SteadyRate {
+			report.Redistributed = true
+			// The rate is back from the start of the first window holding it
+			if back := g.start.Add(time.Duration(i) * sharedBucket); back.After(g.dropAt) {
+				report.Redistribution = toMs(back.Sub(g.dropAt))
+			}
+			return
+		}
+	}
+}
+
+// balance returns how far the busiest consumer is above the mean (percent)
+// and the coefficient of variation of counts
+func balance(counts []float64) (float64, float64) {
+	if len(counts) == 0 {
+		return 0, 0
+	}
+	sorted := append([]float64(nil), counts...)
+	sort.Float64s(sorted)
+	var sum float64
+	for _, n := range sorted {
+		sum += n
+	}
+	mean := sum / float64(len(sorted))
+	if mean == 0 {
+		return 0, 0
+	}
+	var variance float64
+	for _, n := range sorted {
+		variance += (n - mean) * (n - mean)
+	}
+	variance /= float64(len(sorted))
+	return (sorted[len(sorted)-1]/mean - 1) * 100, math.Sqrt(variance) / mean
+}
+
+// display prints the shared subscription section of the final report
+func (r *SharedReport) display() {
+	fmt.Fprintln(consoleOut, "\nShared Subscription:")
+	fmt.Fprintf(consoleOut, "  Filters:      %s\n", strings.Join(r.Filters, ", "))
+	fmt.Fprintf(consoleOut, "  Consumers:    %d/%d connected\n", r.Connected, r.Consumers)
+	fmt.Fprintf(consoleOut, "  Expected:     %d\n", r.Expected)
+	fmt.Fprintf(consoleOut, "  Received:     %d (%d unique)\n", r.Received, r.Unique)
+	if r.Missing > 0 {
+		fmt.Fprintf(consoleOut, "  Missing:      ❌ %d\n", r.Missing)
+	} else {
+		fmt.Fprintf(consoleOut, "  Missing:      0\n")
+	}
+	fmt.Fprintf(consoleOut, "  Duplicates:   %d\n", r.Duplicates)
+	if r.Malformed > 0 {
+		fmt.Fprintf(consoleOut, "  Malformed:    %d\n", r.Malformed)
+	}
+	fmt.Fprintf(consoleOut, "  Latency:      %s\n", r.Latency)
+	fmt.Fprintf(consoleOut, "  Balance:      busiest +%.1f%% over the mean, CV %.3f\n", r.Skew, r.CV)
+	for _, s := range r.Shares {
+		line := fmt.Sprintf("    %-24s %8d  %6.2f%%", s.ClientID, s.Received, s.Share)
+		if r.Dropped != "" {
+			if s.Dropped {
+				line += "  killed"
+			} else {
+				line += fmt.Sprintf("  → %6.2f%% after the drop", s.AfterDrop)
+			}
+		}
+		fmt.Fprintln(consoleOut, line)
+	}
+	if r.Dropped == "" {
+		return
+	}
+	fmt.Fprintf(consoleOut, "  Dropped:      %s at %.1f deliveries/s\n", r.Dropped, r.SteadyRate)
+	if r.Redistributed {
+		fmt.Fprintf(consoleOut, "  Recovered:    %.0fms to %.0f%% of the steady rate\n", r.Redistribution, sharedRecovered*100)
+	} else {
+		fmt.Fprintf(consoleOut, "  Recovered:    ⚠️  group rate never got back to %.0f%%\n", sharedRecovered*100)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// Ways a soak connection can end without the client closing it
+const (
+	dropKeepAlive = "keep-alive timeout"        // PINGREQ never answered, typical of a half-open connection
+	dropClosed    = "closed without DISCONNECT" // broker or a middlebox closed the socket
+	dropReset     = "connection reset"
+	dropNetwork   = "network error"
+)
+
+// SoakStats tracks keep-alive pings and unexpected connection drops across
+// the soak. Pings and drops before the hold starts only count in the totals.
+type SoakStats struct {
+	Pings LatencyRecorder // PINGREQ to PINGRESP
+	Drops int64
+
+	mu        sync.Mutex
+	start     time.Time
+	window    time.Duration
+	connected int64 // clients online when the hold started
+	windows   []*soakWindow
+	causes    map[string]int64
+}
+
+// soakWindow is one window of the soak timeline
+type soakWindow struct {
+	pings LatencyRecorder
+	drops int64
+}
+
+// begin starts the timeline with connected clients online
+func (s *SoakStats) begin(window time.Duration, connected int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+	s.window = window
+	s.connected = connected
+}
+
+// at returns the timeline window for t, nil before the hold. Callers hold s.mu.
+func (s *SoakStats) at(t time.Time) *soakWindow {
+	if s.start.IsZero() || t.Before(s.start) {
+		return nil
+	}
+	i := int(t.Sub(s.start) / s.window)
+	for len(s.windows) <= i {
+		s.windows = append(s.windows, &soakWindow{})
+	}
+	return s.windows[i]
+}
+
+// finish extends the timeline to the end of the hold, so quiet windows
+// still show up
+func (s *SoakStats) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.at(time.Now())
+}
+
+// ping records one keep-alive round trip
+func (s *SoakStats) ping(rtt time.Duration) {
+	s.Pings.Record(rtt)
+
+	s.mu.Lock()
+	w := s.at(time.Now())
+	s.mu.Unlock()
+	if w != nil {
+		w.pings.Record(rtt)
+	}
+}
+
+// drop records a connection that ended without the client closing it
+func (s *SoakStats) drop(cause string) {
+	atomic.AddInt64(&s.Drops, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.causes == nil {
+		s.causes = make(map[string]int64)
+	}
+	s.causes[cause]++
+	if w := s.at(time.Now()); w != nil {
+		w.drops++
+	}
+}
+
+// soakConn follows the MQTT packets on a connection to time keep-alive pings
+// and to tell why the connection ended. It sees the plain MQTT stream under
+// any TLS or WebSocket framing, for every protocol version.
+type soakConn struct {
+	net.Conn
+	stats *SoakStats
+	in    packetScanner // read side only
+	out   packetScanner // write side, guarded by outMu
+	outMu sync.Mutex    // paho writes PINGREQ from its own goroutine
+
+	mu           sync.Mutex
+	established  bool      // CONNACK accepted the connection
+	pingSent     time.Time // zero when no PINGREQ is outstanding
+	disconnected bool      // client sent DISCONNECT
+	brokerReason *byte     // reason code of a broker DISCONNECT (MQTT 5)
+	ended        bool
+}
+
+// watchConn wraps conn for the soak when cfg asks for it
+func watchConn(cfg ClientConfig, conn net.Conn) net.Conn {
+	if cfg.Soak == nil || conn == nil {
+		return conn
+	}
+	return &soakConn{Conn: conn, stats: cfg.Soak}
+}
+
+func (c *soakConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.feed(p[:n], c.received)
+	if err != nil {
+		c.end(err)
+	}
+	return n, err
+}
+
+func (c *soakConn) Write(p []byte) (int, error) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	n, err := c.Conn.Write(p)
+	c.out.feed(p[:n], c.sent)
+	return n, err
+}
+
+func (c *soakConn) Close() error {
+	c.end(nil)
+	return c.Conn.Close()
+}
+
+// sent notes the outbound packets the soak cares about
+func (c *soakConn) sent(header byte, _ []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch header >> 4 {
+	case packetTypePingreq:
+		c.pingSent = time.Now()
+	case packetTypeDisconnect:
+		c.disconnected = true
+	}
+}
+
+// received notes the inbound packets the soak cares about
+func (c *soakConn) received(header byte, head []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch header >> 4 {
+	case packetTypeConnack:
+		// Both versions put the return or reason code in the second byte
+		c.established = len(head) == 2 && head[1] == 0
+	case packetTypePingresp:
+		if !c.pingSent.IsZero() {
+			c.stats.ping(time.Since(c.pingSent))
+			c.pingSent = time.Time{}
+		}
+	case packetTypeDisconnect:
+		code := byte(0)
+		if len(head) > 0 {
+			code = head[0]
+		}
+		c.brokerReason = &code
+	}
+}
+
+// end records how the connection finished, once. readErr is nil when the
+// client closed the socket itself.
+func (c *soakConn) end(readErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return
+	}
+	c.ended = true
+	if !c.established || c.disconnected {
+		return
+	}
+
+	switch {
+	case c.brokerReason != nil:
+		c.stats.drop(fmt.Sprintf("broker DISCONNECT 0x%02X", *c.brokerReason))
+	case readErr == nil && !c.pingSent.IsZero():
+		// The client gave up waiting for PINGRESP
+		c.stats.drop(dropKeepAlive)
+	case readErr == nil:
+		// Closed on purpose without DISCONNECT
+	case errors.Is(readErr, io.EOF):
+		c.stats.drop(dropClosed)
+	case errors.Is(readErr, syscall.ECONNRESET):
+		c.stats.drop(dropReset)
+	default:
+		c.stats.drop(dropNetwork)
+	}
+}
+
+// MQTT control packet types seen by the soak
+const (
+	packetTypeConnack    = 2
+	packetTypePingreq    = 12
+	packetTypePingresp   = 13
+	packetTypeDisconnect = 14
+)
+
+// packetScanner splits a byte stream into MQTT control packets, keeping the
+// fixed header and the first two bytes of each body
+type packetScanner struct {
+	state     int // 0 fixed header, 1 remaining length, 2 body
+	header    byte
+	remaining int
+	shift     uint
+	head      []byte
+}
+
+// feed consumes p and calls emit for every packet it completes
+func (s *packetScanner) feed(p []byte, emit func(header byte, head []byte)) {
+	for len(p) > 0 {
+		switch s.state {
+		case 0:
+			s.header = p[0]
+			s.remaining, s.shift, s.head = 0, 0, s.head[:0]
+			s.state = 1
+			p = p[1:]
+		case 1:
+			b := p[0]
+			p = p[1:]
+			s.remaining |= int(b&0x7F) << s.shift
+			s.shift += 7
+			if b&0x80 != 0 {
+				continue
+			}
+			if s.remaining == 0 {
+				emit(s.header, nil)
+				s.state = 0
+			} else {
+				s.state = 2
+			}
+		case 2:
+			n := min(len(p), s.remaining)
+			if keep := 2 - len(s.head); keep > 0 {
+				s.head = append(s.head, p[:min(n, keep)]...)
+			}
+			s.remaining -= n
+			p = p[n:]
+			if s.remaining == 0 {
+				emit(s.header, s.head)
+				s.state = 0
+			}
+		}
+	}
+}
+
+// SoakWindow is one window of the soak timeline
+type SoakWindow struct {
+	From      float64      `json:"from_s"`
+	Pings     LatencyStats `json:"pings"`
+	Drops     int64        `json:"drops"`
+	Connected int64        `json:"connected"` // at the end of the window
+}
+
+// SoakReport summarizes the idle-connection soak for the final report
+type SoakReport struct {
+	KeepAlive []string         `json:"keep_alive"` // per group
+	Window    float64          `json:"window_s"`
+	Pings     LatencyStats     `json:"pings"`
+	Drops     int64            `json:"drops"`
+	Causes    map[string]int64 `json:"drop_causes,omitempty"`
+	Timeline  []SoakWindow     `json:"timeline"`
+}
+
+func buildSoakReport(groups []config.MQTTClientGroup, stats *SoakStats) *SoakReport {
+	report := &SoakReport{
+		Pings: stats.Pings.Summary(),
+		Drops: atomic.LoadInt64(&stats.Drops),
+	}
+	for _, g := range groups {
+		report.KeepAlive = append(report.KeepAlive, fmt.Sprintf("%s: %v", g.Name, g.KeepAlive))
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	report.Window = stats.window.Seconds()
+	if len(stats.causes) > 0 {
+		report.Causes = make(map[string]int64, len(stats.causes))
+		for cause, n := range stats.causes {
+			report.Causes[cause] = n
+		}
+	}
+	connected := stats.connected
+	for i, w := range stats.windows {
+		connected -= w.drops
+		report.Timeline = append(report.Timeline, SoakWindow{
+			From:      float64(i) * stats.window.Seconds(),
+			Pings:     w.pings.Summary(),
+			Drops:     w.drops,
+			Connected: connected,
+		})
+	}
+	return report
+}
+
+// display prints the soak section of the final report
+func (r *SoakReport) display() {
+	fmt.Fprintln(consoleOut, "\nIdle Soak:")
+	for _, k := range r.KeepAlive {
+		fmt.Fprintf(consoleOut, "  Keep-alive:   %s\n", k)
+	}
+	if r.Pings.Count > 0 {
+		fmt.Fprintf(consoleOut, "  Ping RTT:     %s\n", r.Pings)
+	} else {
+		fmt.Fprintf(consoleOut, "  Ping RTT:     ⚠️  no PINGRESP seen; the run may be shorter than the keep-alive\n")
+	}
+	fmt.Fprintf(consoleOut, "  Pings:        %d\n", r.Pings.Count)
+	if r.Drops == 0 {
+		fmt.Fprintf(consoleOut, "  Drops:        ✅ none\n")
+	} else {
+		fmt.Fprintf(consoleOut, "  Drops:        ❌ %d connections lost without DISCONNECT\n", r.Drops)
+		causes := make([]string, 0, len(r.Causes))
+		for cause := range r.Causes {
+			causes = append(causes, cause)
+		}
+		sort.Strings(causes)
+		for _, cause := range causes {
+			fmt.Fprintf(consoleOut, "    %-28s %d\n", cause, r.Causes[cause])
+		}
+	}
+
+	if len(r.Timeline) == 0 {
+		return
+	}
+	fmt.Fprintf(consoleOut, "  %-10s %-8s %-10s %-10s %-10s %-10s %-7s %s\n", "Window", "Pings", "P50", "P95", "P99", "Max", "Drops", "Connected")
+	for _, w := range r.Timeline {
+		fmt.Fprintf(consoleOut, "  %-10s %-8d %-10s %-10s %-10s %-10s %-7d %d\n",
+			fmt.Sprintf("+%.0fs", w.From), w.Pings.Count,
+			fmt.Sprintf("%.2fms", w.Pings.P50Ms), fmt.Sprintf("%.2fms", w.Pings.P95Ms),
+			fmt.Sprintf("%.2fms", w.Pings.P99Ms), fmt.Sprintf("%.2fms", w.Pings.MaxMs), w.Drops, w.Connected)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+// phaseJoin asks an idle publisher to connect when its capacity step starts
+const phaseJoin = "join"
+
+// handleJoin connects a publisher that sat out the earlier steps
+func (c *MQTTLoadClient) handleJoin(joined *sync.WaitGroup) {
+	defer joined.Done()
+	if c.session != nil {
+		return
+	}
+	// Connect records its failures for the step's SLO check
+	c.Connect()
+}
+
+// CapacityStep is what one step of the capacity search measured
+type CapacityStep struct {
+	Step            int          `json:"step"`
+	Clients         int          `json:"clients"` // publishers the step asked for
+	Connected       int64        `json:"connected"`
+	ConnectFailures int64        `json:"connect_failures"`
+	Duration        float64      `json:"duration_s"`
+	Publishes       int64        `json:"publishes"`
+	SuccessRate     float64      `json:"success_rate"`
+	Rate            float64      `json:"acked_per_sec"`
+	Latency         LatencyStats `json:"latency"`
+	Breaches        []string     `json:"breaches,omitempty"`
+}
+
+// CapacityReport is the outcome of a step-load capacity search
+type CapacityReport struct {
+	StepClients int            `json:"step_clients"`
+	Every       float64        `json:"every_s"`
+	SLO         CapacitySLO    `json:"slo"`
+	Steps       []CapacityStep `json:"steps"`
+	Capacity    int            `json:"capacity"`  // clients at the last step that met the SLO
+	Exhausted   bool           `json:"exhausted"` // every client was added without a breach
+	Interrupted bool           `json:"interrupted,omitempty"`
+}
+
+// CapacitySLO mirrors config.MQTTStepSLO in report units
+type CapacitySLO struct {
+	SuccessRate     float64 `json:"success_rate,omitempty"`
+	LatencyP95      float64 `json:"latency_p95_ms,omitempty"`
+	ConnectFailures int     `json:"connect_failures"`
+}
+
+// Broken reports whether the search ended on an SLO breach
+func (r *CapacityReport) Broken() bool {
+	return len(r.Steps) > 0 && len(r.Steps[len(r.Steps)-1].Breaches) > 0
+}
+
+// runStepLoad adds cfg.Clients publishers every cfg.Every and checks each
+// step against the SLO. It closes end at the first breach or once every
+// client has joined, and returns early when stop is closed. The first step's
+// clients are already connected; failedBefore is the connect failure count
+// from before they were, so their failures count against the first step.
+func runStepLoad(cfg config.MQTTStepLoad, clientList []*MQTTLoadClient, stats *Stats, failedBefore int64, stop <-chan struct{}, end chan<- struct{}) *CapacityReport {
+	defer close(end)
+
+	report := &CapacityReport{
+		StepClients: cfg.Clients,
+		Every:       cfg.Every.Seconds(),
+		SLO: CapacitySLO{
+			SuccessRate:     cfg.SLO.SuccessRate,
+			LatencyP95:      toMs(cfg.SLO.LatencyP95),
+			ConnectFailures: cfg.SLO.ConnectFailures,
+		},
+	}
+
+	prev := 0
+	failed := failedBefore
+	for step := 1; prev < len(clientList); step++ {
+		n := min(step*cfg.Clients, len(clientList))
+		if step > 1 {
+			failed = atomic.LoadInt64(&stats.ConnectionsFailed)
+			fmt.Fprintf(consoleOut, "\n📶 Step %d: adding %d clients (%d total)\n", step, n-prev, n)
+			var joined sync.WaitGroup
+			for _, c := range clientList[prev:n] {
+				joined.Add(1)
+				if !c.requestReconnect(reconnectRequest{phase: phaseJoin, joined: &joined}) {
+					joined.Done()
+				}
+			}
+			if !waitOrStop(&joined, stop) {
+				report.Interrupted = true
+				return report
+			}
+		}
+		prev = n
+
+		total := atomic.LoadInt64(&stats.PublishesTotal)
+		ok := atomic.LoadInt64(&stats.PublishesSuccess)
+		mark := stats.Metrics.Count()
+		start := time.Now()
+
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-time.After(cfg.Every):
+		}
+
+		elapsed := time.Since(start)
+		result := CapacityStep{
+			Step:            step,
+			Clients:         n,
+			Connected:       atomic.LoadInt64(&stats.ActiveClients),
+			ConnectFailures: atomic.LoadInt64(&stats.ConnectionsFailed) - failed,
+			Duration:        elapsed.Seconds(),
+			Publishes:       atomic.LoadInt64(&stats.PublishesTotal) - total,
+			Latency:         stats.latencySince(mark, isPublish),
+		}
+		acked := atomic.LoadInt64(&stats.PublishesSuccess) - ok
+		result.Rate = float64(acked) / elapsed.Seconds()
+		if result.Publishes > 0 {
+			result.SuccessRate = float64(acked) / float64(result.Publishes) * 100
+		}
+		if stopped {
+			report.Steps = append(report.Steps, result)
+			report.Interrupted = true
+			return report
+		}
+
+		result.Breaches = checkSLO(cfg.SLO, result)
+		report.Steps = append(report.Steps, result)
+		if len(result.Breaches) > 0 {
+			fmt.Fprintf(consoleOut, "\n🚧 Step %d broke the SLO: %v\n", step, result.Breaches)
+			return report
+		}
+		report.Capacity = n
+		fmt.Fprintf(consoleOut, "\n✅ Step %d held at %d clients (%.1f%% success, p95 %.2fms)\n",
+			step, n, result.SuccessRate, result.Latency.P95Ms)
+	}
+	report.Exhausted = true
+	return report
+}
+
+// checkSLO lists the ways a step missed the SLO
+func checkSLO(slo config.MQTTStepSLO, s CapacityStep) []string {
+	var breaches []string
+	if s.ConnectFailures > int64(slo.ConnectFailures) {
+		breaches = append(breaches, fmt.Sprintf("%d connect failures > %d", s.ConnectFailures, slo.ConnectFailures))
+	}
+	if slo.SuccessRate > 0 {
+		if s.Publishes == 0 {
+			breaches = append(breaches, "no publishes completed")
+		} else if s.SuccessRate < slo.SuccessRate {
+			breaches = append(breaches, fmt.Sprintf("success %.2f%% < %.2f%%", s.SuccessRate, slo.SuccessRate))
+		}
+	}
+	if slo.LatencyP95 > 0 && s.Latency.Count > 0 && s.Latency.P95Ms > toMs(slo.LatencyP95) {
+		breaches = append(breaches, fmt.Sprintf("p95 %.2fms > %.2fms", s.Latency.P95Ms, toMs(slo.LatencyP95)))
+	}
+	return breaches
+}
+
+// waitOrStop waits for wg and reports false if stop closed first
+func waitOrStop(wg *sync.WaitGroup, stop <-chan struct{}) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// display prints the capacity section of the final report
+func (r *CapacityReport) display() {
+	fmt.Fprintln(consoleOut, "\nCapacity Search:")
+	slo := fmt.Sprintf("connect failures <= %d", r.SLO.ConnectFailures)
+	if r.SLO.SuccessRate > 0 {
+		slo += fmt.Sprintf(", success >= %.2f%%", r.SLO.SuccessRate)
+	}
+	if r.SLO.LatencyP95 > 0 {
+		slo += fmt.Sprintf(", p95 <= %.2fms", r.SLO.LatencyP95)
+	}
+	fmt.Fprintf(consoleOut, "  Steps:        +%d clients every %.0fs\n", r.StepClients, r.Every)
+	fmt.Fprintf(consoleOut, "  SLO:          %s\n", slo)
+	fmt.Fprintf(consoleOut, "  %-5s %-8s %-10s %-9s %-10s %-10s %-10s %s\n", "Step", "Clients", "Connected", "Success", "Acked/s", "P50", "P95", "Result")
+	for _, s := range r.Steps {
+		result := "✅"
+		if len(s.Breaches) > 0 {
+			result = fmt.Sprintf("❌ %v", s.Breaches)
+		} else if r.Interrupted && s.Step == len(r.Steps) {
+			result = "⚠️  interrupted"
+		}
+		fmt.Fprintf(consoleOut, "  %-5d %-8d %-10d %-9s %-10.1f %-10s %-10s %s\n",
+			s.Step, s.Clients, s.Connected, fmt.Sprintf("%.2f%%", s.SuccessRate), s.Rate,
+			fmt.Sprintf("%.2fms", s.Latency.P50Ms), fmt.Sprintf("%.2fms", s.Latency.P95Ms), result)
+	}
+
+	switch {
+	case r.Broken() && r.Capacity == 0:
+		fmt.Fprintf(consoleOut, "  Capacity:     ❌ the first step of %d clients already broke the SLO\n", r.StepClients)
+	case r.Broken():
+		fmt.Fprintf(consoleOut, "  Capacity:     📶 %d clients (last step within the SLO)\n", r.Capacity)
+	case r.Exhausted:
+		fmt.Fprintf(consoleOut, "  Capacity:     ✅ at least %d clients, every step held; add clients to the groups to push further\n", r.Capacity)
+	default:
+		fmt.Fprintf(consoleOut, "  Capacity:     ⚠️  at least %d clients, search interrupted before a breach\n", r.Capacity)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subscription modes for the subscriber pool
+const (
+	SubModeWildcard = "wildcard" // every subscriber receives every group's topics
+	SubModePerRTU   = "per-rtu"  // RTU topics are split across subscribers
+)
+
+// trackedPayload holds the tracking fields embedded by publishers
+type trackedPayload struct {
+	Pub    string `json:"pub"` // publishing client ID
+	Seq    int64  `json:"seq"`
+	SentAt int64  `json:"sentAt"`
+}
+
+// DeliveryStats aggregates end-to-end delivery across all subscribers
+type DeliveryStats struct {
+	Received   int64
+	Unique     int64
+	Duplicates int64
+	Malformed  int64
+}
+
+// MQTTSubscriber consumes telemetry published by the load clients
+type MQTTSubscriber struct {
+	ID       int
+	ClientID string
+	session  mqttSession
+	Config   ClientConfig
+	Filters  []string
+	Stats    *Stats
+	Delivery *DeliveryStats
+	streams  map[string]*topicStream // per-publisher, per-topic received sequence numbers
+	mu       sync.Mutex
+
+	exact     map[string]bool // filters without wildcards
+	wildcards []string
+	since     map[*MQTTLoadClient]int64 // sequence numbers handed out before the subscription took effect
+
+	lastReceived int64 // UnixNano of the latest delivery
+}
+
+// Connect connects the subscriber and subscribes to its filters. Messages
+// publishers numbered before the last SUBACK aren't expected.
+func (s *MQTTSubscriber) Connect(publishers []*MQTTLoadClient) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	for _, filter := range s.Filters {
+		start := time.Now()
+		err := s.session.Subscribe(filter, s.Config.QoS, s.handleMessage)
+		s.Stats.sample(opSubscribe, time.Since(start), err, 0, 0)
+		if err != nil {
+			s.Stats.addError(ErrorRecord{
+				Type:       "subscribe",
+				ClientID:   s.ClientID,
+				Message:    fmt.Sprintf("%s: %s", filter, err.Error()),
+				ReasonCode: reasonCodeOf(err),
+			})
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.since = make(map[*MQTTLoadClient]int64, len(publishers))
+	for _, pub := range publishers {
+		if n := pub.handedOut(); n > 0 {
+			s.since[pub] = n
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// covers reports whether one of the subscriber's filters matches the
+// publisher's topic
+func (s *MQTTSubscriber) covers(pub *MQTTLoadClient) bool {
+	if s.exact[pub.Config.PublishTopic] {
+		return true
+	}
+	for _, filter := range s.wildcards {
+		if topicMatches(filter, pub.Config.PublishTopic) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedFrom returns the first sequence number of pub the subscriber was
+// subscribed for
+func (s *MQTTSubscriber) expectedFrom(pub *MQTTLoadClient) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.since[pub] + 1
+}
+
+// indexFilters splits the filters into exact topics and wildcards for covers
+func (s *MQTTSubscriber) indexFilters() {
+	s.exact = make(map[string]bool, len(s.Filters))
+	s.wildcards = nil
+	for _, filter := range s.Filters {
+		if strings.ContainsAny(filter, "+#") {
+			s.wildcards = append(s.wildcards, filter)
+		} else {
+			s.exact[filter] = true
+		}
+	}
+}
+
+// topicMatches reports whether topic matches an MQTT topic filter
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Reconnect connects without subscribing, relying on the stored session, and
+// reports whether the broker resumed it
+func (s *MQTTSubscriber) Reconnect() (bool, error) {
+	if err := s.connect(); err != nil {
+		return false, err
+	}
+	return s.session.SessionPresent(), nil
+}
+
+// discardSession removes any session left on the broker under this client ID
+// by a previous run, so a persistent session starts empty
+func (s *MQTTSubscriber) discardSession() error {
+	cfg := s.Config
+	cfg.Clean = true
+	cfg.SessionExpiry = 0
+	session, _, err := connectSession(cfg, s.ClientID)
+	if err != nil {
+		return err
+	}
+	session.Disconnect()
+	return nil
+}
+
+// connect opens the subscriber session with retries. Messages delivered
+// before a subscription handler exists go to handleMessage as well.
+func (s *MQTTSubscriber) connect() error {
+	s.mu.Lock()
+	if s.streams == nil {
+		s.streams = make(map[string]*topicStream)
+	}
+	s.mu.Unlock()
+
+	cfg := s.Config
+	cfg.OnMessage = s.handleMessage
+
+	var lastErr error
+	retryDelay := initialRetryDelay
+
+	for attempt := 1; attempt <= maxRetryAttempts; attempt++ {
+		session, _, err := connectSession(cfg, s.ClientID)
+		if err != nil {
+			lastErr = err
+			jitter := time.Duration(mathrand.Float64() * float64(retryDelay) * 0.5)
+			time.Sleep(retryDelay + jitter)
+			retryDelay *= 2
+			continue
+		}
+
+		s.session = session
+		lastErr = nil
+		break
+	}
+
+	if lastErr != nil {
+		s.Stats.addError(ErrorRecord{
+			Type:       "subscriber",
+			ClientID:   s.ClientID,
+			Message:    fmt.Sprintf("connect failed: %s", lastErr.Error()),
+			ReasonCode: reasonCodeOf(lastErr),
+		})
+		return lastErr
+	}
+
+	return nil
+}
+
+func (s *MQTTSubscriber) handleMessage(msg receivedMessage) {
+	receivedAt := time.Now()
+	atomic.AddInt64(&s.Delivery.Received, 1)
+	atomic.StoreInt64(&s.lastReceived, receivedAt.UnixNano())
+
+	var p trackedPayload
+	if err := json.Unmarshal(msg.Payload, &p); err != nil || p.SentAt == 0 {
+		atomic.AddInt64(&s.Delivery.Malformed, 1)
+		return
+	}
+
+	s.mu.Lock()
+	key := streamKey(msg.Topic, p.Pub)
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = newTopicStream()
+		s.streams[key] = stream
+	}
+	dup := stream.observe(p.Seq)
+	s.mu.Unlock()
+
+	if dup {
+		atomic.AddInt64(&s.Delivery.Duplicates, 1)
+		return
+	}
+
+	latency := receivedAt.Sub(time.Unix(0, p.SentAt))
+	s.Stats.sample(opDeliver, latency, nil, 0, len(msg.Payload))
+	atomic.AddInt64(&s.Delivery.Unique, 1)
+}
+
+// Disconnect disconnects the subscriber
+func (s *MQTTSubscriber) Disconnect() {
+	if s.session != nil && s.session.IsConnected() {
+		s.session.Disconnect()
+	}
+}
+
+// connectSubscribers connects and subscribes subs concurrently, first
+// discarding any stored session when discard is set
+func connectSubscribers(subs []*MQTTSubscriber, publishers []*MQTTLoadClient, discard, verbose bool) {
+	var wg sync.WaitGroup
+	for _, sub := range subs {
+		if len(sub.Filters) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(s *MQTTSubscriber) {
+			defer wg.Done()
+			if discard {
+				if err := s.discardSession(); err != nil && verbose {
+					fmt.Fprintf(consoleOut, "⚠️  Subscriber %d failed to discard its old session: %v\n", s.ID, err)
+				}
+			}
+			if err := s.Connect(publishers); err != nil && verbose {
+				fmt.Fprintf(consoleOut, "⚠️  Subscriber %d failed: %v\n", s.ID, err)
+			}
+		}(sub)
+	}
+	wg.Wait()
+}
+
+// newSubscriberPool creates count subscribers covering the given publishers.
+// In wildcard mode every subscriber subscribes to all of filters, unless
+// custom filters are given: those are cycled across subscribers.
+func newSubscriberPool(count int, mode string, cfg ClientConfig, filters, custom []string, publishers []*MQTTLoadClient, stats *Stats, delivery *DeliveryStats) []*MQTTSubscriber {
+	subs := make([]*MQTTSubscriber, count)
+	for i := range subs {
+		subs[i] = &MQTTSubscriber{
+			ID:       i + 1,
+			ClientID: fmt.Sprintf("mqtt_sub_%d", i+1),
+			Config:   cfg,
+			Stats:    stats,
+			Delivery: delivery,
+		}
+		if mode == SubModeWildcard {
+			subs[i].Filters = filters
+			if len(custom) > 0 {
+				subs[i].Filters = expandFilter(custom[i%len(custom)], publishers)
+			}
+		}
+	}
+
+	if mode == SubModePerRTU {
+		for i, pub := range publishers {
+			sub := subs[i%count]
+			sub.Filters = appendUnique(sub.Filters, pub.Config.PublishTopic)
+		}
+	}
+
+	for _, sub := range subs {
+		sub.indexFilters()
+	}
+	return subs
+}
+
+// expandFilter returns filter itself, or for a filter with topic
+// placeholders the exact topic of every publisher
+func expandFilter(filter string, publishers []*MQTTLoadClient) []string {
+	if !strings.Contains(filter, "{") {
+		return []string{filter}
+	}
+	seen := make(map[string]bool, len(publishers))
+	var topics []string
+	for _, pub := range publishers {
+		topic := strings.NewReplacer(
+			"{rtuId}", pub.Config.RTUID,
+			"{clientId}", pub.ClientID,
+			"{group}", pub.Config.Group,
+			"{index}", strconv.Itoa(pub.Config.GroupIndex),
+		).Replace(filter)
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// expectedDeliveries returns how many unique messages the pool should have
+// received given the publishes acknowledged by the broker
+func expectedDeliveries(subs []*MQTTSubscriber, publishers []*MQTTLoadClient) int64 {
+	var expected int64
+	for _, sub := range subs {
+		if sub.session == nil {
+			continue
+		}
+		for _, pub := range publishers {
+			if sub.covers(pub) {
+				expected += pub.ackedFrom(sub.expectedFrom(pub))
+			}
+		}
+	}
+	return expected
+}
+
+// DeliveryReport summarizes end-to-end delivery for the final report
+type DeliveryReport struct {
+	Subscribers int          `json:"subscribers"`
+	Mode        string       `json:"mode"`
+	Expected    int64        `json:"expected"`
+	Received    int64        `json:"received"`
+	Unique      int64        `json:"unique"`
+	Duplicates  int64        `json:"duplicates"`
+	Lost        int64        `json:"lost"`
+	LossRate    float64      `json:"loss_rate"`
+	Malformed   int64        `json:"malformed"`
+	Latency     LatencyStats `json:"latency"`
+
+	ByQoS  []QoSVerification `json:"by_qos"`
+	Fanout *FanoutReport     `json:"fanout,omitempty"`
+}
+
+func buildDeliveryReport(subs []*MQTTSubscriber, publishers []*MQTTLoadClient, stats *Stats, delivery *DeliveryStats, mode string) *DeliveryReport {
+	report := &DeliveryReport{
+		Subscribers: len(subs),
+		Mode:        mode,
+		Expected:    expectedDeliveries(subs, publishers),
+		Received:    atomic.LoadInt64(&delivery.Received),
+		Unique:      atomic.LoadInt64(&delivery.Unique),
+		Duplicates:  atomic.LoadInt64(&delivery.Duplicates),
+		Malformed:   atomic.LoadInt64(&delivery.Malformed),
+		Latency:     stats.latencySince(0, isDelivery),
+	}
+	report.ByQoS = verifyDelivery(subs, publishers)
+
+	if report.Expected > report.Unique {
+		report.Lost = report.Expected - report.Unique
+	}
+	if report.Expected > 0 {
+		report.LossRate = float64(report.Lost) / float64(report.Expected) * 100
+	}
+
+	return report
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+const (
+	phaseTakeover = "takeover"
+
+	// takeoverKickTimeout is how long the old connection may survive the
+	// new one before it counts as not kicked
+	takeoverKickTimeout = 10 * time.Second
+	// takeoverAckTimeout bounds the wait for acknowledgements of messages
+	// in flight on the old connection once it is gone
+	takeoverAckTimeout = 5 * time.Second
+)
+
+// takeoverRecord is the outcome of one duplicate client ID connection
+type takeoverRecord struct {
+	client  *MQTTLoadClient
+	kicked  bool
+	kick    time.Duration // new CONNECT to old connection closed
+	acked   []int64       // in-flight sequence numbers the old connection got PUBACK for
+	unacked []int64
+	failed  bool // the new connection was refused
+}
+
+// TakeoverStats collects takeover records from the publishing goroutines
+type TakeoverStats struct {
+	mu      sync.Mutex
+	records []takeoverRecord
+	connect LatencyRecorder // new connections
+}
+
+func (t *TakeoverStats) add(rec takeoverRecord) {
+	t.mu.Lock()
+	t.records = append(t.records, rec)
+	t.mu.Unlock()
+}
+
+// handleTakeover opens a second connection with this client's ID while QoS 1
+// messages are in flight on the current one, then continues on the new
+// connection
+func (c *MQTTLoadClient) handleTakeover(inflight int) {
+	old := c.session
+	if old == nil {
+		return
+	}
+
+	type result struct {
+		seq int64
+		err error
+	}
+	results := make(chan result, inflight)
+	pending := make(map[int64]bool, inflight)
+	for i := 0; i < inflight; i++ {
+		seq, payload, err := c.nextPayload(time.Now())
+		if err != nil {
+			c.markUnpublished(seq)
+			continue
+		}
+		pending[seq] = true
+		c.markInflight(seq)
+		go func() {
+			results <- result{seq, old.Publish(c.Config.PublishTopic, 1, false, payload)}
+		}()
+	}
+
+	rec := takeoverRecord{client: c}
+	start := time.Now()
+	session, timing, err := connectSession(c.Config, c.ClientID)
+	if err != nil {
+		rec.failed = true
+		c.recordConnectFailure()
+		c.Stats.recordErr("takeover", c.ClientID, err)
+	} else {
+		atomic.AddInt64(&c.Stats.ConnectionsTotal, 1)
+		atomic.AddInt64(&c.Stats.ConnectionsSuccess, 1)
+		c.Stats.Takeover.connect.Record(timing.Total)
+
+		select {
+		case <-old.Closed():
+			rec.kicked = true
+			rec.kick = time.Since(start)
+		case <-time.After(takeoverKickTimeout):
+		}
+	}
+
+	deadline := time.After(takeoverAckTimeout)
+collect:
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.seq)
+			if r.err == nil {
+				rec.acked = append(rec.acked, r.seq)
+				atomic.AddInt64(&c.PublishedOK, 1)
+				c.markAcked(r.seq)
+			} else {
+				rec.unacked = append(rec.unacked, r.seq)
+				c.markUnpublished(r.seq)
+			}
+		case <-deadline:
+			break collect
+		}
+	}
+	// Messages still waiting were never acknowledged
+	for seq := range pending {
+		rec.unacked = append(rec.unacked, seq)
+		c.markUnpublished(seq)
+	}
+
+	c.Stats.Takeover.add(rec)
+	if session == nil {
+		return
+	}
+	// The new connection replaces the old one in the active count
+	old.Disconnect()
+	c.setSession(session)
+}
+
+// runTakeover asks a random fraction of publishers to take over their own
+// client ID at cfg.At
+func runTakeover(cfg config.MQTTTakeover, clientList []*MQTTLoadClient, stop <-chan struct{}) {
+	select {
+	case <-stop:
+		return
+	case <-time.After(cfg.At):
+	}
+
+	n := int(math.Ceil(cfg.Fraction * float64(len(clientList))))
+	fmt.Fprintf(consoleOut, "\n👯 Client-ID takeover: %d clients reconnecting with their own ID\n", n)
+	for _, i := range mathrand.Perm(len(clientList))[:n] {
+		clientList[i].requestReconnect(reconnectRequest{phase: phaseTakeover, inflight: cfg.InFlight})
+	}
+}
+
+// TakeoverReport summarizes client-ID takeovers for the final report
+type TakeoverReport struct {
+	Clients        int          `json:"clients"`
+	Refused        int          `json:"refused"`    // new connection failed
+	Kicked         int          `json:"kicked"`     // old connection closed by the broker
+	NotKicked      int          `json:"not_kicked"` // old connection still open after the timeout
+	KickLatency    LatencyStats `json:"kick_latency"`
+	ConnectLatency LatencyStats `json:"connect_latency"` // of the new connection
+	InFlight       int          `json:"inflight"`
+	Acked          int          `json:"acked"`
+	Unacked        int          `json:"unacked"`
+	Delivered      int          `json:"delivered,omitempty"`   // in-flight messages a subscriber received
+	Lost           int          `json:"lost,omitempty"`        // in-flight messages no subscriber received
+	AckedLost      int          `json:"acked_lost,omitempty"`  // acknowledged but never delivered
+	Redelivered    int          `json:"redelivered,omitempty"` // in-flight messages delivered more than once
+	Verified       bool         `json:"verified"`              // subscribers were running
+}
+
+// buildTakeoverReport combines the takeover records with what the
+// subscribers received
+func buildTakeoverReport(t *TakeoverStats, subs []*MQTTSubscriber) *TakeoverReport {
+	t.mu.Lock()
+	records := append([]takeoverRecord(nil), t.records...)
+	t.mu.Unlock()
+
+	report := &TakeoverReport{
+		Clients:        len(records),
+		ConnectLatency: t.connect.Summary(),
+	}
+	var kicks []time.Duration
+	for _, rec := range records {
+		if rec.failed {
+			report.Refused++
+		} else if rec.kicked {
+			report.Kicked++
+			kicks = append(kicks, rec.kick)
+		} else {
+			report.NotKicked++
+		}
+		report.Acked += len(rec.acked)
+		report.Unacked += len(rec.unacked)
+	}
+	report.InFlight = report.Acked + report.Unacked
+	report.KickLatency = summarizeLatencies(kicks)
+
+	var connected []*MQTTSubscriber
+	for _, sub := range subs {
+		if sub.session != nil {
+			connected = append(connected, sub)
+		}
+	}
+	if len(connected) == 0 {
+		return report
+	}
+	report.Verified = true
+
+	for _, rec := range records {
+		key := streamKey(rec.client.Config.PublishTopic, rec.client.ClientID)
+		deliveries := func(seq int64) int {
+			max := 0
+			for _, sub := range connected {
+				sub.mu.Lock()
+				if stream := sub.streams[key]; stream != nil && stream.received[seq] > max {
+					max = stream.received[seq]
+				}
+				sub.mu.Unlock()
+			}
+			return max
+		}
+
+		for _, seq := range rec.acked {
+			n := deliveries(seq)
+			if n == 0 {
+				report.AckedLost++
+				report.Lost++
+				continue
+			}
+			report.Delivered++
+			if n > 1 {
+				report.Redelivered++
+			}
+		}
+		for _, seq := range rec.unacked {
+			n := deliveries(seq)
+			if n == 0 {
+				report.Lost++
+				continue
+			}
+			report.Delivered++
+			if n > 1 {
+				report.Redelivered++
+			}
+		}
+	}
+	return report
+}
+
+// display prints the takeover section of the final report
+func (r *TakeoverReport) display() {
+	fmt.Fprintln(consoleOut, "\nClient-ID Takeover:")
+	fmt.Fprintf(consoleOut, "  Clients:      %d (%d old sessions kicked, %d not kicked, %d refused)\n", r.Clients, r.Kicked, r.NotKicked, r.Refused)
+	if r.Kicked > 0 {
+		fmt.Fprintf(consoleOut, "  Kick time:    %s\n", r.KickLatency)
+	}
+	fmt.Fprintf(consoleOut, "  New connect:  %s\n", r.ConnectLatency)
+	fmt.Fprintf(consoleOut, "  In flight:    %d QoS 1 on the old sessions (%d acked, %d unacked)\n", r.InFlight, r.Acked, r.Unacked)
+	if !r.Verified {
+		fmt.Fprintln(consoleOut, "  ⚠️  Run with --subscribers to check whether in-flight messages were lost or redelivered")
+		return
+	}
+	fmt.Fprintf(consoleOut, "  Delivered:    %d\n", r.Delivered)
+	fmt.Fprintf(consoleOut, "  Lost:         %d", r.Lost)
+	if r.AckedLost > 0 {
+		fmt.Fprintf(consoleOut, " (❌ %d acknowledged)", r.AckedLost)
+	}
+	fmt.Fprintln(consoleOut)
+	fmt.Fprintf(consoleOut, "  Redelivered:  %d\n", r.Redelivered)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TLSOptions holds the TLS flags shared by every client
+type TLSOptions struct {
+	CAFile        string // PEM bundle used to verify the broker
+	CertFile      string // client certificate for mutual TLS
+	KeyFile       string // client private key for mutual TLS
+	ClientCertDir string // directory holding {rtuId}.crt / {rtuId}.key per client
+	ServerName    string // SNI and verification name override
+	Insecure      bool   // skip broker certificate verification
+}
+
+// isTLSScheme reports whether a broker URL scheme requires TLS
+func isTLSScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// buildTLSConfig creates the base TLS configuration from the shared options
+func buildTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// clientTLSConfig returns the TLS configuration for one RTU, loading its own
+// certificate from the client certificate directory when one is configured
+func clientTLSConfig(base *tls.Config, certDir, rtuID string) (*tls.Config, error) {
+	if base == nil || certDir == "" {
+		return base, nil
+	}
+
+	certFile := filepath.Join(certDir, rtuID+".crt")
+	keyFile := filepath.Join(certDir, rtuID+".key")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate for RTU %s: %w", rtuID, err)
+	}
+
+	cfg := base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// topicStream tracks the sequence numbers one subscriber received from one
+// publisher on a topic
+type topicStream struct {
+	received  map[int64]int // deliveries per sequence number
+	maxSeq    int64
+	reordered []int64 // sequence numbers that arrived after a higher one
+}
+
+// streamKey identifies a publisher's stream on a topic. Payloads without a
+// publisher ID fall back to one stream per topic.
+func streamKey(topic, pub string) string {
+	if pub == "" {
+		return topic
+	}
+	return topic + "\x00" + pub
+}
+
+func newTopicStream() *topicStream {
+	return &topicStream{received: make(map[int64]int)}
+}
+
+// observe records a delivery and reports whether it was a duplicate. A new
+// sequence number lower than one already received counts as reordered.
+func (t *topicStream) observe(seq int64) bool {
+	t.received[seq]++
+	if t.received[seq] > 1 {
+		return true
+	}
+	if seq < t.maxSeq {
+		t.reordered = append(t.reordered, seq)
+	} else {
+		t.maxSeq = seq
+	}
+	return false
+}
+
+// QoSVerification checks delivery against the guarantees of one QoS level
+type QoSVerification struct {
+	QoS        int      `json:"qos"`
+	Topics     int      `json:"topics"`
+	Expected   int64    `json:"expected"`
+	Received   int64    `json:"received"` // unique sequence numbers
+	Missing    int64    `json:"missing"`
+	Gaps       int64    `json:"gaps"` // runs of consecutive missing sequence numbers
+	Reordered  int64    `json:"reordered"`
+	Duplicates int64    `json:"duplicates"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// check lists the ways delivery broke the QoS guarantee. QoS 0 may lose
+// messages and QoS 1 may duplicate them; ordering per topic holds for all.
+func (v *QoSVerification) check() {
+	if v.QoS > 0 && v.Missing > 0 {
+		v.Violations = append(v.Violations, fmt.Sprintf("%d lost", v.Missing))
+	}
+	if v.QoS == 2 && v.Duplicates > 0 {
+		v.Violations = append(v.Violations, fmt.Sprintf("%d duplicated", v.Duplicates))
+	}
+	if v.Reordered > 0 {
+		v.Violations = append(v.Violations, fmt.Sprintf("%d out of order", v.Reordered))
+	}
+}
+
+func (v QoSVerification) String() string {
+	verdict := "✅ guarantee held"
+	if len(v.Violations) > 0 {
+		verdict = "❌ " + strings.Join(v.Violations, ", ")
+	}
+	return fmt.Sprintf("QoS %d: %d topics | expected %d | received %d | missing %d (%d gaps) | reordered %d | duplicates %d | %s",
+		v.QoS, v.Topics, v.Expected, v.Received, v.Missing, v.Gaps, v.Reordered, v.Duplicates, verdict)
+}
+
+// verifyDelivery compares the sequence numbers every subscriber received
+// against the ones each publisher got acknowledged, grouped by the QoS each
+// message was published at. Takeover messages, sent side by side across two
+// connections, are exempt from the ordering check.
+func verifyDelivery(subs []*MQTTSubscriber, publishers []*MQTTLoadClient) []QoSVerification {
+	results := make(map[int]*QoSVerification)
+	topics := make(map[int]map[string]bool)
+	for _, sub := range subs {
+		if sub.session == nil {
+			continue
+		}
+		for _, pub := range publishers {
+			if !sub.covers(pub) {
+				continue
+			}
+			from := sub.expectedFrom(pub)
+			sentAs := pub.sentAs()
+			verification := func(qos int) *QoSVerification {
+				v, ok := results[qos]
+				if !ok {
+					v = &QoSVerification{QoS: qos}
+					results[qos] = v
+					topics[qos] = make(map[string]bool)
+				}
+				topics[qos][pub.Config.PublishTopic] = true
+				return v
+			}
+			verification(int(pub.Config.QoS))
+
+			sub.mu.Lock()
+			stream := sub.streams[streamKey(pub.Config.PublishTopic, pub.ClientID)]
+			if stream == nil {
+				stream = newTopicStream()
+			}
+			for seq, n := range stream.received {
+				qos, _ := sentAs(seq)
+				v := verification(qos)
+				v.Received++
+				v.Duplicates += int64(n - 1)
+			}
+			for _, seq := range stream.reordered {
+				if qos, ordered := sentAs(seq); ordered {
+					verification(qos).Reordered++
+				}
+			}
+
+			lastAcked, unpublished := pub.acknowledged()
+			inGap := make(map[int]bool)
+			for seq := from; seq <= lastAcked; seq++ {
+				if _, skip := unpublished[seq]; skip {
+					continue
+				}
+				qos, _ := sentAs(seq)
+				v := verification(qos)
+				v.Expected++
+				if _, ok := stream.received[seq]; ok {
+					inGap[qos] = false
+					continue
+				}
+				v.Missing++
+				if !inGap[qos] {
+					v.Gaps++
+					inGap[qos] = true
+				}
+			}
+			sub.mu.Unlock()
+		}
+	}
+
+	verification := make([]QoSVerification, 0, len(results))
+	for qos, v := range results {
+		v.Topics = len(topics[qos])
+		v.check()
+		verification = append(verification, *v)
+	}
+	sort.Slice(verification, func(i, j int) bool { return verification[i].QoS < verification[j].QoS })
+	return verification
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadtest/internal/config"
+)
+
+const (
+	phaseKill = "kill"
+
+	// willMonitorID is the client ID of the subscriber watching will topics
+	willMonitorID = "mqtt_will_monitor"
+	// willWaitTimeout is how long after the will delay the monitor waits for
+	// wills still missing once the publish phase ends
+	willWaitTimeout = 10 * time.Second
+)
+
+// WillStats matches wills seen by the monitor against the connections killed
+// to fire them. Will topics are expected to be unique per client.
+type WillStats struct {
+	mu         sync.Mutex
+	killed     map[string]time.Time // will topic to kill time
+	received   map[string]time.Time // will topic to first delivery
+	latencies  []time.Duration
+	lastKill   time.Time
+	unexpected int64 // wills for connections that weren't killed
+	duplicates int64
+}
+
+func (w *WillStats) recordKill(topic string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.killed == nil {
+		w.killed = make(map[string]time.Time)
+	}
+	w.lastKill = time.Now()
+	w.killed[topic] = w.lastKill
+}
+
+// onMessage is the monitor's message handler
+func (w *WillStats) onMessage(msg receivedMessage) {
+	// Retained wills are left over from earlier runs
+	if msg.Retained {
+		return
+	}
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	killedAt, ok := w.killed[msg.Topic]
+	if !ok {
+		w.unexpected++
+		return
+	}
+	if w.received == nil {
+		w.received = make(map[string]time.Time)
+	}
+	if _, dup := w.received[msg.Topic]; dup {
+		w.duplicates++
+		return
+	}
+	w.received[msg.Topic] = now
+	w.latencies = append(w.latencies, now.Sub(killedAt))
+}
+
+// progress returns the wills received so far, the connections killed and
+// the time of the last kill
+func (w *WillStats) progress() (int, int, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.received), len(w.killed), w.lastKill
+}
+
+// handleKill closes the connection without DISCONNECT so the broker
+// publishes the will. The client stays offline for the rest of the run.
+func (c *MQTTLoadClient) handleKill() {
+	if c.session == nil || c.Config.Will == nil {
+		return
+	}
+	c.Stats.Wills.recordKill(c.Config.Will.Topic)
+	c.session.Abort()
+	c.setSession(nil)
+	atomic.AddInt64(&c.Stats.ActiveClients, -1)
+}
+
+// willTopics returns the filters matching every group's will topic, the
+// highest will QoS and the longest will delay
+func willTopics(groups []*clientGroup) ([]string, byte, time.Duration) {
+	var filters []string
+	var qos byte
+	var delay time.Duration
+	for _, g := range groups {
+		if g.Will.Topic == "" {
+			continue
+		}
+		filters = appendUnique(filters, g.filterFor(g.Will.Topic))
+		if byte(g.Will.QoS) > qos {
+			qos = byte(g.Will.QoS)
+		}
+		if g.Will.Delay > delay {
+			delay = g.Will.Delay
+		}
+	}
+	return filters, qos, delay
+}
+
+// startWillMonitor connects a subscriber to every will topic filter before
+// the publish phase
+func startWillMonitor(cfg ClientConfig, filters []string, stats *WillStats) (mqttSession, error) {
+	cfg.Clean = true
+	session, _, err := connectSession(cfg, willMonitorID)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range filters {
+		if err := session.Subscribe(filter, cfg.QoS, stats.onMessage); err != nil {
+			session.Disconnect()
+			return nil, fmt.Errorf("subscribe %s: %w", filter, err)
+		}
+	}
+	return session, nil
+}
+
+// waitForWills blocks until every killed connection's will arrived or delay
+// plus willWaitTimeout has passed since the last kill
+func waitForWills(stats *WillStats, delay time.Duration) {
+	for {
+		received, killed, lastKill := stats.progress()
+		if received >= killed || time.Since(lastKill) > delay+willWaitTimeout {
+			if killed > 0 {
+				fmt.Fprintln(consoleOut)
+			}
+			return
+		}
+		fmt.Fprintf(consoleOut, "\r⏳ Waiting for wills: %d/%d", received, killed)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// runKill drops a random fraction of the publishers that registered a will
+// at cfg.At
+func runKill(cfg config.MQTTKill, clientList []*MQTTLoadClient, stop <-chan struct{}) {
+	select {
+	case <-stop:
+		return
+	case <-time.After(cfg.At):
+	}
+
+	var withWill []*MQTTLoadClient
+	for _, c := range clientList {
+		if c.Config.Will != nil {
+			withWill = append(withWill, c)
+		}
+	}
+	n := int(math.Ceil(cfg.Fraction * float64(len(withWill))))
+	fmt.Fprintf(consoleOut, "\n💀 Killing %d connections without DISCONNECT\n", n)
+	for _, i := range mathrand.Perm(len(withWill))[:n] {
+		withWill[i].requestReconnect(reconnectRequest{phase: phaseKill})
+	}
+}
+
+// WillReport summarizes will delivery for the final report
+type WillReport struct {
+	Killed       int          `json:"killed"`
+	Received     int          `json:"received"`
+	Missing      int          `json:"missing"`
+	Unexpected   int64        `json:"unexpected"` // wills from connections the test didn't kill
+	Duplicates   int64        `json:"duplicates"`
+	Completeness float64      `json:"completeness"` // percent of killed connections whose will arrived
+	Delay        float64      `json:"delay_ms"`     // configured MQTT 5 will delay
+	Latency      LatencyStats `json:"latency"`      // kill to will delivery
+}
+
+func buildWillReport(stats *WillStats, delay time.Duration) *WillReport {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	report := &WillReport{
+		Killed:     len(stats.killed),
+		Received:   len(stats.received),
+		Unexpected: stats.unexpected,
+		Duplicates: stats.duplicates,
+		Delay:      toMs(delay),
+		Latency:    summarizeLatencies(stats.latencies),
+	}
+	report.Missing = report.Killed - report.Received
+	if report.Killed > 0 {
+		report.Completeness = float64(report.Received) / float64(report.Killed) * 100
+	}
+	return report
+}
+
+// display prints the will section of the final report
+func (r *WillReport) display() {
+	fmt.Fprintln(consoleOut, "\nLast Will:")
+	fmt.Fprintf(consoleOut, "  Killed:       %d connections\n", r.Killed)
+	fmt.Fprintf(consoleOut, "  Received:     %d (%.2f%% complete)\n", r.Received, r.Completeness)
+	if r.Missing > 0 {
+		fmt.Fprintf(consoleOut, "  Missing:      ❌ %d\n", r.Missing)
+	}
+	if r.Unexpected > 0 {
+		fmt.Fprintf(consoleOut, "  Unexpected:   %d wills from connections that weren't killed\n", r.Unexpected)
+	}
+	if r.Duplicates > 0 {
+		fmt.Fprintf(consoleOut, "  Duplicates:   %d\n", r.Duplicates)
+	}
+	if r.Delay > 0 {
+		fmt.Fprintf(consoleOut, "  Will delay:   %.0fms\n", r.Delay)
+	}
+	if r.Received > 0 {
+		fmt.Fprintf(consoleOut, "  Latency:      %s\n", r.Latency)
+	}
+}
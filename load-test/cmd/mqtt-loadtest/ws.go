@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// isWSScheme reports whether a broker URL scheme uses WebSockets
+func isWSScheme(scheme string) bool {
+	return scheme == "ws" || scheme == "wss"
+}
+
+// parseWSHeaders parses --ws-header values into an http.Header
+func parseWSHeaders(values []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid WebSocket header %q (want Key: Value)", v)
+		}
+		header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// dialWebsocket opens an MQTT-over-WebSocket connection, recording the TCP,
+// TLS and upgrade phases in timing
+func dialWebsocket(ctx context.Context, u *url.URL, cfg ClientConfig, timing *connTiming) (net.Conn, error) {
+	target := *u
+	if target.Path == "" {
+		target.Path = cfg.WSPath
+	}
+
+	subprotocol := cfg.WSSubprotocol
+	if subprotocol == "" {
+		subprotocol = "mqtt"
+	}
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: connectTimeout,
+		Subprotocols:     []string{subprotocol},
+		NetDialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialTCP(ctx, addr, timing)
+		},
+		NetDialTLSContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialTCP(ctx, addr, timing)
+			if err != nil {
+				return nil, err
+			}
+			return handshakeTLS(ctx, conn, cfg.TLSConfig, u.Hostname(), timing)
+		},
+	}
+
+	start := time.Now()
+	ws, resp, err := dialer.DialContext(ctx, target.String(), cfg.WSHeader)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("WebSocket upgrade failed: %s: %w", resp.Status, err)
+		}
+		return nil, err
+	}
+	timing.Upgrade = time.Since(start) - timing.Dial - timing.TLSHandshake
+
+	if ws.Subprotocol() != subprotocol {
+		ws.Close()
+		return nil, fmt.Errorf("broker did not accept WebSocket subprotocol %q", subprotocol)
+	}
+
+	return &wsConn{Conn: ws}, nil
+}
+
+// wsConn adapts a WebSocket to net.Conn, carrying MQTT packets in binary frames
+type wsConn struct {
+	*websocket.Conn
+	r   io.Reader
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
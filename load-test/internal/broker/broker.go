@@ -0,0 +1,639 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Options controls the embedded broker and the faults it injects
+type Options struct {
+	Addr  string            // TCP listen address, defaults to 127.0.0.1:0 (a free port)
+	Users map[string]string // username -> password, nil accepts anyone
+
+	Latency        time.Duration // delay before routing each publish
+	DropRate       float64       // fraction of publishes acknowledged but never routed
+	RejectRate     float64       // fraction of CONNECTs refused with server unavailable
+	DisconnectRate float64       // fraction of publishes answered by closing the connection
+	Seed           int64         // seeds the fault injection, zero picks a random seed
+
+	MaxOfflineMessages int // queued QoS 1/2 messages per offline session, defaults to 1000
+	MaxMessageSize     int // larger payloads close the connection, zero is unlimited
+	MaxClientID        int // longer client IDs are refused, zero is unlimited
+	MaxTopicLevels     int // deeper publishes are acknowledged and dropped, zero is unlimited
+	MaxSubscriptions   int // per session, SUBACK 0x80 beyond, zero is unlimited
+	MaxConnections     int // CONNACK server unavailable beyond, zero is unlimited
+}
+
+// Stats counts broker-side events
+type Stats struct {
+	Connects          int64
+	Rejected          int64
+	Disconnected      int64 // connections closed by DisconnectRate
+	PublishesReceived int64
+	PublishesSent     int64
+	Dropped           int64
+	WillsPublished    int64
+	Takeovers         int64
+}
+
+// Broker is a lightweight in-process MQTT 3.1 and 3.1.1 broker with QoS
+// 0/1/2, retained messages, wills, persistent sessions and $share groups
+type Broker struct {
+	opts     Options
+	listener net.Listener
+	stats    Stats
+	live     int64
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	retained map[string]*packets.PublishPacket
+	shared   map[string]int // $share group/filter -> round-robin cursor
+	netConns map[net.Conn]struct{}
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+type session struct {
+	clientID string
+	clean    bool
+	subs     map[string]byte // filter -> granted QoS
+	conn     *conn
+	queue    []*packets.PublishPacket
+}
+
+type conn struct {
+	broker  *Broker
+	netConn net.Conn
+	session *session
+	will    *packets.PublishPacket // guarded by broker.mu
+
+	writeMu sync.Mutex
+	nextID  uint16
+
+	inflight  map[uint16]*packets.PublishPacket // incoming QoS 2 awaiting PUBREL
+	closeOnce sync.Once
+}
+
+// NewBroker creates a new embedded broker
+func NewBroker(opts Options) *Broker {
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:0"
+	}
+	if opts.MaxOfflineMessages == 0 {
+		opts.MaxOfflineMessages = 1000
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Broker{
+		opts:     opts,
+		sessions: make(map[string]*session),
+		retained: make(map[string]*packets.PublishPacket),
+		shared:   make(map[string]int),
+		netConns: make(map[net.Conn]struct{}),
+		rng:      rand.New(rand.NewSource(seed)),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start starts listening for MQTT connections
+func (b *Broker) Start() error {
+	listener, err := net.Listen("tcp", b.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", b.opts.Addr, err)
+	}
+	b.listener = listener
+
+	b.wg.Add(1)
+	go b.acceptConnections()
+
+	return nil
+}
+
+// Addr returns the address the broker listens on
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// URL returns the broker URL suitable for MQTT clients
+func (b *Broker) URL() string {
+	return "tcp://" + b.Addr()
+}
+
+// Stats returns a snapshot of broker-side counters
+func (b *Broker) Stats() Stats {
+	return Stats{
+		Connects:          atomic.LoadInt64(&b.stats.Connects),
+		Rejected:          atomic.LoadInt64(&b.stats.Rejected),
+		Disconnected:      atomic.LoadInt64(&b.stats.Disconnected),
+		PublishesReceived: atomic.LoadInt64(&b.stats.PublishesReceived),
+		PublishesSent:     atomic.LoadInt64(&b.stats.PublishesSent),
+		Dropped:           atomic.LoadInt64(&b.stats.Dropped),
+		WillsPublished:    atomic.LoadInt64(&b.stats.WillsPublished),
+		Takeovers:         atomic.LoadInt64(&b.stats.Takeovers),
+	}
+}
+
+// Retained returns the payload retained on topic, or nil
+func (b *Broker) Retained(topic string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if msg, ok := b.retained[topic]; ok {
+		return msg.Payload
+	}
+	return nil
+}
+
+// Stop closes the listener and every client connection, then waits for
+// the connection handlers to finish
+func (b *Broker) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopChan)
+		if b.listener != nil {
+			b.listener.Close()
+		}
+
+		b.mu.Lock()
+		for netConn := range b.netConns {
+			netConn.Close()
+		}
+		b.mu.Unlock()
+
+		b.wg.Wait()
+	})
+}
+
+func (b *Broker) acceptConnections() {
+	defer b.wg.Done()
+	for {
+		netConn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.stopChan:
+				return
+			default:
+				continue
+			}
+		}
+
+		b.mu.Lock()
+		b.netConns[netConn] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handleConnection(netConn)
+
+			b.mu.Lock()
+			delete(b.netConns, netConn)
+			b.mu.Unlock()
+		}()
+	}
+}
+
+// chance draws from the seeded source, so a fixed Seed with a single
+// publisher reproduces the same faults run after run
+func (b *Broker) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	b.rngMu.Lock()
+	defer b.rngMu.Unlock()
+	return b.rng.Float64() < rate
+}
+
+// refuse answers a CONNECT with a failure return code and closes the connection
+func (c *conn) refuse(rc byte) {
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = rc
+	c.write(connack)
+	c.netConn.Close()
+	atomic.AddInt64(&c.broker.stats.Rejected, 1)
+}
+
+func (b *Broker) handleConnection(netConn net.Conn) {
+	netConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	cp, err := packets.ReadPacket(netConn)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		netConn.Close()
+		return
+	}
+
+	c := &conn{
+		broker:   b,
+		netConn:  netConn,
+		inflight: make(map[uint16]*packets.PublishPacket),
+	}
+
+	if rc := connect.Validate(); rc != packets.Accepted {
+		c.refuse(rc)
+		return
+	}
+	if b.opts.Users != nil {
+		if pw, ok := b.opts.Users[connect.Username]; !ok || pw != string(connect.Password) {
+			c.refuse(packets.ErrRefusedBadUsernameOrPassword)
+			return
+		}
+	}
+	if b.opts.MaxClientID > 0 && len(connect.ClientIdentifier) > b.opts.MaxClientID {
+		c.refuse(packets.ErrRefusedIDRejected)
+		return
+	}
+	if b.opts.MaxConnections > 0 {
+		if atomic.AddInt64(&b.live, 1) > int64(b.opts.MaxConnections) {
+			atomic.AddInt64(&b.live, -1)
+			c.refuse(packets.ErrRefusedServerUnavailable)
+			return
+		}
+		defer atomic.AddInt64(&b.live, -1)
+	}
+	if b.chance(b.opts.RejectRate) {
+		c.refuse(packets.ErrRefusedServerUnavailable)
+		return
+	}
+
+	if connect.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = connect.WillTopic
+		will.Payload = connect.WillMessage
+		will.Qos = connect.WillQos
+		will.Retain = connect.WillRetain
+		c.will = will
+	}
+
+	clientID := connect.ClientIdentifier
+	if clientID == "" {
+		clientID = fmt.Sprintf("auto-%p", c)
+	}
+
+	// A second connection with the same client ID takes the session over;
+	// the old connection goes away without publishing its will
+	b.mu.Lock()
+	sess, exists := b.sessions[clientID]
+	var old *conn
+	if exists && sess.conn != nil {
+		old = sess.conn
+		old.will = nil
+		atomic.AddInt64(&b.stats.Takeovers, 1)
+	}
+	if !exists || connect.CleanSession || sess.clean {
+		sess = &session{clientID: clientID, subs: make(map[string]byte)}
+		b.sessions[clientID] = sess
+		exists = false
+	}
+	sess.clean = connect.CleanSession
+	sess.conn = c
+	c.session = sess
+	queued := sess.queue
+	sess.queue = nil
+	b.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	atomic.AddInt64(&b.stats.Connects, 1)
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.SessionPresent = exists
+	if err := c.write(connack); err != nil {
+		c.close()
+		return
+	}
+
+	for _, p := range queued {
+		c.deliver(p, p.Qos, false)
+	}
+
+	c.readLoop(time.Duration(connect.Keepalive) * time.Second)
+}
+
+func (c *conn) readLoop(keepAlive time.Duration) {
+	defer c.close()
+	b := c.broker
+
+	for {
+		if keepAlive > 0 {
+			c.netConn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.netConn.SetReadDeadline(time.Time{})
+		}
+
+		cp, err := packets.ReadPacket(c.netConn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			if b.opts.MaxMessageSize > 0 && len(p.Payload) > b.opts.MaxMessageSize {
+				return
+			}
+			atomic.AddInt64(&b.stats.PublishesReceived, 1)
+			if b.chance(b.opts.DisconnectRate) {
+				atomic.AddInt64(&b.stats.Disconnected, 1)
+				return
+			}
+			if b.opts.MaxTopicLevels > 0 && strings.Count(p.TopicName, "/")+1 > b.opts.MaxTopicLevels {
+				atomic.AddInt64(&b.stats.Dropped, 1)
+				if p.Qos > 0 {
+					c.ack(p)
+				}
+				continue
+			}
+			switch p.Qos {
+			case 0:
+				b.publish(p)
+			case 1:
+				b.publish(p)
+				c.ack(p)
+			case 2:
+				// Routed on PUBREL, so a retransmitted PUBLISH is delivered once
+				c.inflight[p.MessageID] = p
+				c.ack(p)
+			}
+		case *packets.PubrelPacket:
+			if pub, ok := c.inflight[p.MessageID]; ok {
+				delete(c.inflight, p.MessageID)
+				b.publish(pub)
+			}
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.write(comp)
+		case *packets.PubrecPacket:
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.MessageID = p.MessageID
+			c.write(rel)
+		case *packets.SubscribePacket:
+			c.subscribe(p)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, t := range p.Topics {
+				delete(c.session.subs, t)
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.write(ack)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			b.mu.Lock()
+			c.will = nil
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ack sends PUBACK for a QoS 1 publish or PUBREC for a QoS 2 one
+func (c *conn) ack(p *packets.PublishPacket) {
+	if p.Qos == 2 {
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		c.write(rec)
+		return
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = p.MessageID
+	c.write(ack)
+}
+
+func (c *conn) subscribe(p *packets.SubscribePacket) {
+	b := c.broker
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	b.mu.Lock()
+	for i, filter := range p.Topics {
+		qos := min(p.Qoss[i], 2)
+		if _, ok := c.session.subs[filter]; !ok && b.opts.MaxSubscriptions > 0 && len(c.session.subs) >= b.opts.MaxSubscriptions {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		c.session.subs[filter] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+	}
+
+	// Retained messages go out once per topic at the best matching QoS
+	retained := make(map[string]target)
+	for _, filter := range p.Topics {
+		granted, ok := c.session.subs[filter]
+		if !ok || strings.HasPrefix(filter, "$share/") {
+			continue
+		}
+		for topic, msg := range b.retained {
+			if !TopicMatches(filter, topic) {
+				continue
+			}
+			if t, seen := retained[topic]; !seen || granted > t.qos {
+				retained[topic] = target{qos: granted, msg: msg}
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	c.write(ack)
+	for _, t := range retained {
+		c.deliver(t.msg, min(t.msg.Qos, t.qos), true)
+	}
+}
+
+type target struct {
+	conn    *conn
+	session *session
+	qos     byte
+	msg     *packets.PublishPacket
+}
+
+// publish routes a message to every matching subscriber
+func (b *Broker) publish(p *packets.PublishPacket) {
+	if b.opts.Latency > 0 {
+		time.Sleep(b.opts.Latency)
+	}
+	if b.chance(b.opts.DropRate) {
+		atomic.AddInt64(&b.stats.Dropped, 1)
+		return
+	}
+
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			stored := *p
+			b.retained[p.TopicName] = &stored
+		}
+	}
+
+	var targets []target
+	groups := make(map[string][]target)
+	for _, sess := range b.sessions {
+		matched := false
+		var best byte
+		for filter, qos := range sess.subs {
+			if group, shareFilter, ok := parseShared(filter); ok {
+				if TopicMatches(shareFilter, p.TopicName) {
+					key := group + "/" + shareFilter
+					groups[key] = append(groups[key], target{conn: sess.conn, session: sess, qos: min(p.Qos, qos)})
+				}
+				continue
+			}
+			if TopicMatches(filter, p.TopicName) {
+				best = max(best, qos)
+				matched = true
+			}
+		}
+		if matched {
+			targets = append(targets, target{conn: sess.conn, session: sess, qos: min(p.Qos, best)})
+		}
+	}
+
+	// Each $share group gets one copy, round-robin over its online members
+	for key, members := range groups {
+		var online []target
+		for _, m := range members {
+			if m.conn != nil {
+				online = append(online, m)
+			}
+		}
+		if len(online) == 0 {
+			online = members
+		}
+		cursor := b.shared[key]
+		b.shared[key] = cursor + 1
+		targets = append(targets, online[cursor%len(online)])
+	}
+
+	var deliveries []target
+	for _, t := range targets {
+		if t.conn != nil {
+			deliveries = append(deliveries, t)
+			continue
+		}
+		if t.session.clean || t.qos == 0 {
+			continue
+		}
+		if len(t.session.queue) >= b.opts.MaxOfflineMessages {
+			atomic.AddInt64(&b.stats.Dropped, 1)
+			continue
+		}
+		queued := *p
+		queued.Qos = t.qos
+		t.session.queue = append(t.session.queue, &queued)
+	}
+	b.mu.Unlock()
+
+	for _, t := range deliveries {
+		t.conn.deliver(p, t.qos, false)
+	}
+}
+
+// deliver sends a message to the client. retain is only set for retained
+// messages sent on SUBSCRIBE, never for live ones.
+func (c *conn) deliver(p *packets.PublishPacket, qos byte, retain bool) {
+	out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	out.TopicName = p.TopicName
+	out.Payload = p.Payload
+	out.Qos = qos
+	out.Retain = retain
+
+	c.writeMu.Lock()
+	if qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		out.MessageID = c.nextID
+	}
+	err := out.Write(c.netConn)
+	c.writeMu.Unlock()
+
+	if err == nil {
+		atomic.AddInt64(&c.broker.stats.PublishesSent, 1)
+	}
+}
+
+func (c *conn) write(cp packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return cp.Write(c.netConn)
+}
+
+// close drops the connection, ends a clean session and publishes the will
+// unless the client sent DISCONNECT or was taken over
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.netConn.Close()
+
+		b := c.broker
+		b.mu.Lock()
+		sess := c.session
+		if sess != nil && sess.conn == c {
+			sess.conn = nil
+			if sess.clean {
+				delete(b.sessions, sess.clientID)
+			}
+		}
+		will := c.will
+		c.will = nil
+		b.mu.Unlock()
+
+		if will != nil {
+			atomic.AddInt64(&b.stats.WillsPublished, 1)
+			b.publish(will)
+		}
+	})
+}
+
+func parseShared(filter string) (group, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, "$share/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// TopicMatches reports whether topic matches the MQTT subscription filter
+func TopicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fParts := strings.Split(filter, "/")
+	tParts := strings.Split(topic, "/")
+
+	for i, f := range fParts {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tParts) {
+			return false
+		}
+		if f != "+" && f != tParts[i] {
+			return false
+		}
+	}
+	return len(fParts) == len(tParts)
+}
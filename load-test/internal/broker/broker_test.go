@@ -0,0 +1,287 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func startBroker(t *testing.T, opts Options) *Broker {
+	t.Helper()
+	b := NewBroker(opts)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func connect(t *testing.T, b *Broker, id string, configure func(*mqtt.ClientOptions)) mqtt.Client {
+	t.Helper()
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.URL()).
+		SetClientID(id).
+		SetProtocolVersion(4).
+		SetAutoReconnect(false).
+		SetConnectRetry(false)
+	if configure != nil {
+		configure(opts)
+	}
+	c := mqtt.NewClient(opts)
+	tok := c.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		t.Fatalf("%s: connect timed out", id)
+	}
+	if err := tok.Error(); err != nil {
+		t.Fatalf("%s: connect: %v", id, err)
+	}
+	t.Cleanup(func() { c.Disconnect(0) })
+	return c
+}
+
+func subscribe(t *testing.T, c mqtt.Client, filter string, qos byte) <-chan mqtt.Message {
+	t.Helper()
+	msgs := make(chan mqtt.Message, 100)
+	tok := c.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) { msgs <- m })
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe %s: %v", filter, tok.Error())
+	}
+	return msgs
+}
+
+func publish(t *testing.T, c mqtt.Client, topic string, qos byte, retain bool, payload string) {
+	t.Helper()
+	tok := c.Publish(topic, qos, retain, payload)
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish %s: %v", topic, tok.Error())
+	}
+}
+
+func receive(t *testing.T, msgs <-chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, msgs <-chan mqtt.Message) {
+	t.Helper()
+	select {
+	case m := <-msgs:
+		t.Fatalf("unexpected message on %s: %s", m.Topic(), m.Payload())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestQoSRoundTrip(t *testing.T) {
+	b := startBroker(t, Options{})
+	sub := connect(t, b, "sub", nil)
+	pub := connect(t, b, "pub", nil)
+
+	for _, tc := range []struct {
+		pubQoS, subQoS, want byte
+	}{
+		{0, 2, 0},
+		{1, 2, 1},
+		{2, 2, 2},
+		{2, 1, 1},
+	} {
+		msgs := subscribe(t, sub, "qos/test", tc.subQoS)
+		publish(t, pub, "qos/test", tc.pubQoS, false, "hello")
+
+		m := receive(t, msgs)
+		if string(m.Payload()) != "hello" || m.Qos() != tc.want || m.Retained() {
+			t.Errorf("publish QoS %d to subscription QoS %d: got %q at QoS %d retained=%v, want QoS %d",
+				tc.pubQoS, tc.subQoS, m.Payload(), m.Qos(), m.Retained(), tc.want)
+		}
+		sub.Unsubscribe("qos/test").Wait()
+	}
+
+	if s := b.Stats(); s.PublishesReceived != 4 || s.PublishesSent != 4 {
+		t.Errorf("stats = %+v, want 4 publishes received and sent", s)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"thms/+/data", "thms/rtu1/data", true},
+		{"thms/+/data", "thms/rtu1/cmd", false},
+		{"thms/#", "thms", true},
+		{"thms/#", "thms/rtu1/data", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"thms/rtu1", "thms/rtu1/data", false},
+	} {
+		if got := TopicMatches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestRetained(t *testing.T) {
+	b := startBroker(t, Options{})
+	pub := connect(t, b, "pub", nil)
+	publish(t, pub, "thms/rtu1/status", 1, true, "online")
+
+	if got := string(b.Retained("thms/rtu1/status")); got != "online" {
+		t.Fatalf("Retained = %q, want online", got)
+	}
+
+	sub := connect(t, b, "sub", nil)
+	m := receive(t, subscribe(t, sub, "thms/+/status", 1))
+	if string(m.Payload()) != "online" || !m.Retained() {
+		t.Errorf("got %q retained=%v, want the retained online", m.Payload(), m.Retained())
+	}
+
+	// An empty retained payload clears the topic
+	publish(t, pub, "thms/rtu1/status", 1, true, "")
+	late := connect(t, b, "late", nil)
+	expectNone(t, subscribe(t, late, "thms/#", 1))
+}
+
+func TestWill(t *testing.T) {
+	b := startBroker(t, Options{})
+	watcher := subscribe(t, connect(t, b, "watcher", nil), "thms/+/lwt", 1)
+
+	withWill := func(o *mqtt.ClientOptions) { o.SetWill("thms/rtu1/lwt", "offline", 1, false) }
+
+	// DISCONNECT discards the will
+	connect(t, b, "rtu1", withWill).Disconnect(100)
+	expectNone(t, watcher)
+
+	// Stopping the broker's side of the connection without a DISCONNECT
+	// publishes it
+	connect(t, b, "rtu1", withWill)
+	b.mu.Lock()
+	c := b.sessions["rtu1"].conn
+	b.mu.Unlock()
+	c.close()
+
+	if m := receive(t, watcher); string(m.Payload()) != "offline" {
+		t.Errorf("will payload = %q, want offline", m.Payload())
+	}
+	if s := b.Stats(); s.WillsPublished != 1 {
+		t.Errorf("WillsPublished = %d, want 1", s.WillsPublished)
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	b := startBroker(t, Options{})
+	persistent := func(o *mqtt.ClientOptions) { o.SetCleanSession(false) }
+
+	sub := connect(t, b, "offline-sub", persistent)
+	subscribe(t, sub, "thms/cmd", 1)
+	sub.Disconnect(100)
+
+	publish(t, connect(t, b, "pub", nil), "thms/cmd", 1, false, "queued")
+
+	msgs := make(chan mqtt.Message, 10)
+	connect(t, b, "offline-sub", func(o *mqtt.ClientOptions) {
+		persistent(o)
+		o.SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) { msgs <- m })
+	})
+	if m := receive(t, msgs); string(m.Payload()) != "queued" {
+		t.Errorf("queued payload = %q, want queued", m.Payload())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	b := startBroker(t, Options{Latency: 100 * time.Millisecond})
+	msgs := subscribe(t, connect(t, b, "sub", nil), "slow", 0)
+	pub := connect(t, b, "pub", nil)
+
+	start := time.Now()
+	publish(t, pub, "slow", 1, false, "x")
+	receive(t, msgs)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("delivered after %v, want at least the 100ms latency", elapsed)
+	}
+}
+
+func TestRejectAndAuth(t *testing.T) {
+	b := startBroker(t, Options{Users: map[string]string{"rtu": "secret"}})
+
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("bad").
+		SetProtocolVersion(4).SetUsername("rtu").SetPassword("wrong"))
+	if tok := c.Connect(); tok.WaitTimeout(5*time.Second) && tok.Error() == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	connect(t, b, "good", func(o *mqtt.ClientOptions) { o.SetUsername("rtu").SetPassword("secret") })
+
+	b2 := startBroker(t, Options{RejectRate: 1})
+	c = mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b2.URL()).SetClientID("rejected").SetProtocolVersion(4))
+	if tok := c.Connect(); tok.WaitTimeout(5*time.Second) && tok.Error() == nil {
+		t.Fatal("connected to a broker rejecting everything")
+	}
+	if s := b2.Stats(); s.Rejected != 1 || s.Connects != 0 {
+		t.Errorf("stats = %+v, want one rejected connect", s)
+	}
+}
+
+func TestDropIsDeterministic(t *testing.T) {
+	run := func() int64 {
+		b := startBroker(t, Options{DropRate: 0.3, Seed: 42})
+		msgs := subscribe(t, connect(t, b, "sub", nil), "drop", 1)
+		pub := connect(t, b, "pub", nil)
+		for i := 0; i < 100; i++ {
+			publish(t, pub, "drop", 1, false, "x")
+		}
+		for i := int64(0); i < 100-b.Stats().Dropped; i++ {
+			receive(t, msgs)
+		}
+		return b.Stats().Dropped
+	}
+
+	first := run()
+	if first == 0 || first == 100 {
+		t.Fatalf("dropped %d of 100 at a 0.3 drop rate", first)
+	}
+	if second := run(); second != first {
+		t.Errorf("dropped %d then %d with the same seed", first, second)
+	}
+}
+
+func TestDisconnectInjection(t *testing.T) {
+	b := startBroker(t, Options{DisconnectRate: 1})
+	lost := make(chan error, 1)
+	pub := connect(t, b, "pub", func(o *mqtt.ClientOptions) {
+		o.SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	})
+	pub.Publish("boom", 1, false, "x")
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not dropped")
+	}
+	if s := b.Stats(); s.Disconnected != 1 {
+		t.Errorf("Disconnected = %d, want 1", s.Disconnected)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	b := startBroker(t, Options{})
+	lost := make(chan error, 1)
+	connect(t, b, "rtu1", func(o *mqtt.ClientOptions) {
+		o.SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	})
+	connect(t, b, "rtu1", nil)
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first connection survived the takeover")
+	}
+	if s := b.Stats(); s.Takeovers != 1 {
+		t.Errorf("Takeovers = %d, want 1", s.Takeovers)
+	}
+}
@@ -0,0 +1,129 @@
+package brokermetrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scraper reads selected counters from a Prometheus text endpoint, such as
+// the one VerneMQ serves on listener.http.metrics
+type Scraper struct {
+	URL    string
+	Names  []string
+	client *http.Client
+}
+
+// NewScraper creates a scraper for the given counters
+func NewScraper(endpoint string, names []string, timeout time.Duration) *Scraper {
+	return &Scraper{
+		URL:    Endpoint(endpoint),
+		Names:  names,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Endpoint completes a metrics address: a bare host:port gets the http
+// scheme and the /metrics path
+func Endpoint(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	if rest := endpoint[strings.Index(endpoint, "://")+3:]; !strings.Contains(rest, "/") {
+		endpoint += "/metrics"
+	}
+	return endpoint
+}
+
+// Scrape fetches the endpoint once and returns the counters it found
+func (s *Scraper) Scrape(ctx context.Context) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", s.URL, resp.Status)
+	}
+	return Parse(resp.Body, s.Names)
+}
+
+// Parse reads the Prometheus text exposition format and returns the named
+// metrics, each summed across its label sets. A name also matches its
+// _total counter. Names that are not exposed are left out.
+func Parse(r io.Reader, names []string) (map[string]float64, error) {
+	wanted := make(map[string]string, len(names)*2)
+	for _, name := range names {
+		wanted[name] = name
+		wanted[name+"_total"] = name
+	}
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		name, rest, err := splitSample(line)
+		if err != nil {
+			return nil, err
+		}
+		metric, ok := wanted[name]
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("metric %s has no value", name)
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", name, err)
+		}
+		values[metric] += v
+	}
+	return values, scanner.Err()
+}
+
+// splitSample splits a sample line into the metric name and what follows
+// its label set
+func splitSample(line string) (string, string, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return "", "", fmt.Errorf("malformed sample %q", line)
+	}
+	name, rest := line[:end], line[end:]
+	if rest[0] != '{' {
+		return name, rest, nil
+	}
+
+	// Skip the label set; quoted values may hold '}' and escaped quotes
+	quoted := false
+	for i := 1; i < len(rest); i++ {
+		switch {
+		case quoted && rest[i] == '\\':
+			i++
+		case rest[i] == '"':
+			quoted = !quoted
+		case !quoted && rest[i] == '}':
+			return name, rest[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated labels in %q", line)
+}
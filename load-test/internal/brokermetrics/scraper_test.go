@@ -0,0 +1,106 @@
+package brokermetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// vernemqMetrics mimics the shape of VerneMQ's /metrics output
+const vernemqMetrics = `# HELP mqtt_publish_received The number of PUBLISH packets received.
+# TYPE mqtt_publish_received counter
+mqtt_publish_received{node="VerneMQ@127.0.0.1",mqtt_version="4"} 120
+mqtt_publish_received{node="VerneMQ@127.0.0.1",mqtt_version="5"} 30
+# HELP queue_message_drop The number of messages dropped due to full queues.
+# TYPE queue_message_drop counter
+queue_message_drop{node="VerneMQ@127.0.0.1"} 7
+# TYPE socket_open_total counter
+socket_open_total{node="VerneMQ@127.0.0.1",listener="a}b \"q\""} 42 1700000000000
+# TYPE router_subscriptions gauge
+router_subscriptions{node="VerneMQ@127.0.0.1"} 3
+`
+
+func TestParse(t *testing.T) {
+	got, err := Parse(strings.NewReader(vernemqMetrics), []string{"mqtt_publish_received", "queue_message_drop", "socket_open", "mqtt_connack_sent"})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := map[string]float64{
+		"mqtt_publish_received": 150,
+		"queue_message_drop":    7,
+		"socket_open":           42,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s = %v, want %v", name, got[name], v)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, body := range []string{
+		"mqtt_publish_received{node=\"a\" 1\n",
+		"mqtt_publish_received one\n",
+		"mqtt_publish_received\n",
+	} {
+		if _, err := Parse(strings.NewReader(body), []string{"mqtt_publish_received"}); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", body)
+		}
+	}
+}
+
+func TestScrapeFakeEndpoint(t *testing.T) {
+	var scrapes int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		n := atomic.AddInt64(&scrapes, 1)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(vernemqMetrics))
+		// The counter grows between scrapes like a live broker's
+		w.Write([]byte("mqtt_publish_sent{node=\"VerneMQ@127.0.0.1\"} " + strings.Repeat("1", int(n)) + "\n"))
+	}))
+	defer srv.Close()
+
+	// A bare host:port gets the scheme and the /metrics path
+	s := NewScraper(strings.TrimPrefix(srv.URL, "http://"), []string{"mqtt_publish_received", "mqtt_publish_sent"}, time.Second)
+	if s.URL != srv.URL+"/metrics" {
+		t.Fatalf("URL = %s, want %s/metrics", s.URL, srv.URL)
+	}
+
+	first, err := s.Scrape(context.Background())
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	second, err := s.Scrape(context.Background())
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if first["mqtt_publish_received"] != 150 || first["mqtt_publish_sent"] != 1 {
+		t.Errorf("first scrape = %v", first)
+	}
+	if second["mqtt_publish_sent"]-first["mqtt_publish_sent"] != 10 {
+		t.Errorf("mqtt_publish_sent went from %v to %v, want a delta of 10", first["mqtt_publish_sent"], second["mqtt_publish_sent"])
+	}
+}
+
+func TestScrapeHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if _, err := NewScraper(srv.URL+"/metrics", []string{"socket_open"}, time.Second).Scrape(context.Background()); err == nil {
+		t.Fatal("Scrape succeeded against a 503, want an error")
+	}
+}
@@ -36,6 +36,7 @@ type Request struct {
 	Body       []byte
 	Timeout    time.Duration
 	Name       string
+	Check      func(*Response) error // checks the response body, nil if the status is enough
 }
 
 // Response represents a load test response
@@ -50,10 +51,11 @@ type Response struct {
 
 // Client is the HTTP client for load testing
 type Client struct {
-	client    *http.Client
-	targetCfg config.TargetConfig
-	authCfg   config.AuthConfig
-	baseURL   string
+	webhookSeq uint64 // webhook calls generated, first for atomic alignment
+	client     *http.Client
+	targetCfg  config.TargetConfig
+	authCfg    config.AuthConfig
+	baseURL    string
 }
 
 // NewClient creates a new HTTP client
@@ -116,8 +118,9 @@ func (c *Client) getAuthHeaders() map[string]string {
 	return headers
 }
 
-// NewRequest creates a new request from config
-func (c *Client) NewRequest(reqCfg config.RequestConfig) *Request {
+// NewRequest creates a new request from config. The request is returned
+// even on error so the failure can be recorded under its name.
+func (c *Client) NewRequest(reqCfg config.RequestConfig) (*Request, error) {
 	url := c.baseURL + reqCfg.Endpoint
 
 	// Read body from file if specified
@@ -136,6 +139,19 @@ func (c *Client) NewRequest(reqCfg config.RequestConfig) *Request {
 		headers[k] = v
 	}
 
+	// Generate a VerneMQ webhook call, as the broker would send it
+	var check func(*Response) error
+	var err error
+	if reqCfg.Webhook.Hook != "" {
+		body, err = c.webhookBody(reqCfg.Webhook)
+		if err != nil {
+			err = fmt.Errorf("webhook %s: %w", reqCfg.Webhook.Hook, err)
+		}
+		headers["Content-Type"] = "application/json"
+		headers["vernemq-hook"] = reqCfg.Webhook.Hook
+		check = webhookCheck(reqCfg.Webhook.Expect)
+	}
+
 	timeout := reqCfg.Timeout
 	if timeout == 0 {
 		timeout = c.targetCfg.Timeout
@@ -148,7 +164,8 @@ func (c *Client) NewRequest(reqCfg config.RequestConfig) *Request {
 		Body:    body,
 		Timeout: timeout,
 		Name:    reqCfg.Name,
-	}
+		Check:   check,
+	}, err
 }
 
 // Execute executes a request and returns the response
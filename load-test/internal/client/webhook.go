@@ -0,0 +1,167 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"loadtest/internal/config"
+)
+
+// Webhook results VerneMQ understands, besides {"result":{"error":...}}
+const (
+	WebhookOK   = "ok"
+	WebhookNext = "next"
+)
+
+// webhookBase holds the fields VerneMQ sends with every hook
+type webhookBase struct {
+	Mountpoint string `json:"mountpoint"`
+	ClientID   string `json:"client_id"`
+	Username   string `json:"username"`
+	PeerAddr   string `json:"peer_addr"`
+	PeerPort   int    `json:"peer_port"`
+}
+
+type authOnRegister struct {
+	webhookBase
+	Password     string `json:"password"`
+	CleanSession bool   `json:"clean_session"`
+}
+
+type authOnPublish struct {
+	webhookBase
+	QoS     int    `json:"qos"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Retain  bool   `json:"retain"`
+}
+
+type authOnSubscribe struct {
+	webhookBase
+	Topics []webhookTopic `json:"topics"`
+}
+
+type webhookTopic struct {
+	Topic string `json:"topic"`
+	QoS   int    `json:"qos"`
+}
+
+// webhookBody renders one call of the configured hook
+func (c *Client) webhookBody(wh config.WebhookConfig) ([]byte, error) {
+	n := strconv.Itoa(mathrand.Intn(wh.Clients) + 1)
+	seq := strconv.FormatUint(atomic.AddUint64(&c.webhookSeq, 1), 10)
+	fill := func(tmpl string) string {
+		s := strings.ReplaceAll(tmpl, "{n}", n)
+		s = strings.ReplaceAll(s, "{seq}", seq)
+		for strings.Contains(s, "{rand}") {
+			s = strings.Replace(s, "{rand}", randomHex(), 1)
+		}
+		return s
+	}
+
+	base := webhookBase{
+		Mountpoint: wh.Mountpoint,
+		ClientID:   fill(wh.ClientID),
+		Username:   fill(wh.Username),
+		PeerAddr:   wh.PeerAddr,
+		PeerPort:   1024 + mathrand.Intn(64511),
+	}
+
+	switch wh.Hook {
+	case config.HookAuthOnRegister:
+		return json.Marshal(authOnRegister{
+			webhookBase:  base,
+			Password:     fill(wh.Password),
+			CleanSession: true,
+		})
+	case config.HookAuthOnPublish:
+		return json.Marshal(authOnPublish{
+			webhookBase: base,
+			QoS:         wh.QoS,
+			Topic:       fill(wh.Topic),
+			Payload:     base64.StdEncoding.EncodeToString([]byte(fill(wh.Payload))),
+			Retain:      wh.Retain,
+		})
+	case config.HookAuthOnSubscribe:
+		var topics []webhookTopic
+		for _, t := range strings.Split(wh.Topic, ",") {
+			topics = append(topics, webhookTopic{Topic: fill(strings.TrimSpace(t)), QoS: wh.QoS})
+		}
+		return json.Marshal(authOnSubscribe{webhookBase: base, Topics: topics})
+	default:
+		return nil, fmt.Errorf("unknown webhook %q", wh.Hook)
+	}
+}
+
+func randomHex() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ParseWebhookResult reads a hook response: {"result":"ok"}, {"result":"next"}
+// or {"result":{"error":"reason"}}. It returns the result, or "error" and
+// the reason.
+func ParseWebhookResult(body []byte) (string, string, error) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", "", fmt.Errorf("malformed webhook response: %w", err)
+	}
+	if len(resp.Result) == 0 {
+		return "", "", fmt.Errorf("webhook response has no result")
+	}
+
+	var result string
+	if err := json.Unmarshal(resp.Result, &result); err == nil {
+		if result != WebhookOK && result != WebhookNext {
+			return "", "", fmt.Errorf("unknown webhook result %q", result)
+		}
+		return result, "", nil
+	}
+
+	var failure struct {
+		Error *string `json:"error"`
+	}
+	if err := json.Unmarshal(resp.Result, &failure); err != nil || failure.Error == nil {
+		return "", "", fmt.Errorf("webhook result is neither a string nor an error: %s", resp.Result)
+	}
+	return "error", *failure.Error, nil
+}
+
+// webhookCheck returns the response check for expect: ok, next, error (any
+// error), a specific error reason, or any well-formed result
+func webhookCheck(expect string) func(*Response) error {
+	return func(resp *Response) error {
+		result, reason, err := ParseWebhookResult(resp.Body)
+		if err != nil {
+			return err
+		}
+		got := result
+		if reason != "" {
+			got = "error " + reason
+		}
+
+		switch expect {
+		case "any":
+			return nil
+		case WebhookOK, WebhookNext, "error":
+			if result != expect {
+				return fmt.Errorf("webhook returned %s, expected %s", got, expect)
+			}
+		default:
+			if reason != expect {
+				return fmt.Errorf("webhook returned %s, expected error %s", got, expect)
+			}
+		}
+		return nil
+	}
+}
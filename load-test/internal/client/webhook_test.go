@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"loadtest/internal/config"
+)
+
+func TestParseWebhookResult(t *testing.T) {
+	for _, tc := range []struct {
+		body           string
+		result, reason string
+		wantErr        bool
+	}{
+		{body: `{"result":"ok"}`, result: "ok"},
+		{body: `{"result":"next"}`, result: "next"},
+		{body: `{"result":{"error":"not_authorized"}}`, result: "error", reason: "not_authorized"},
+		{body: `{"result":{"error":""}}`, result: "error"},
+		{body: `{"result":"maybe"}`, wantErr: true},
+		{body: `{"result":{"modifiers":{}}}`, wantErr: true},
+		{body: `{"result":42}`, wantErr: true},
+		{body: `{}`, wantErr: true},
+		{body: `ok`, wantErr: true},
+		{body: ``, wantErr: true},
+	} {
+		result, reason, err := ParseWebhookResult([]byte(tc.body))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseWebhookResult(%s) error = %v, want error %v", tc.body, err, tc.wantErr)
+			continue
+		}
+		if result != tc.result || reason != tc.reason {
+			t.Errorf("ParseWebhookResult(%s) = %q, %q, want %q, %q", tc.body, result, reason, tc.result, tc.reason)
+		}
+	}
+}
+
+func TestWebhookCheck(t *testing.T) {
+	const (
+		ok        = `{"result":"ok"}`
+		next      = `{"result":"next"}`
+		denied    = `{"result":{"error":"not_authorized"}}`
+		malformed = `{"result":"maybe"}`
+	)
+	for _, tc := range []struct {
+		expect string
+		pass   []string
+		fail   []string
+	}{
+		{expect: "ok", pass: []string{ok}, fail: []string{next, denied, malformed}},
+		{expect: "next", pass: []string{next}, fail: []string{ok, denied, malformed}},
+		{expect: "error", pass: []string{denied}, fail: []string{ok, next, malformed}},
+		{expect: "not_authorized", pass: []string{denied}, fail: []string{ok, next, `{"result":{"error":"invalid_credentials"}}`}},
+		{expect: "any", pass: []string{ok, next, denied}, fail: []string{malformed}},
+	} {
+		check := webhookCheck(tc.expect)
+		for _, body := range tc.pass {
+			if err := check(&Response{Body: []byte(body)}); err != nil {
+				t.Errorf("expect %s: %s failed: %v", tc.expect, body, err)
+			}
+		}
+		for _, body := range tc.fail {
+			if err := check(&Response{Body: []byte(body)}); err == nil {
+				t.Errorf("expect %s: %s passed", tc.expect, body)
+			}
+		}
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	base := config.WebhookConfig{
+		ClientID: "rtu{n}",
+		Username: "user{n}",
+		Password: "secret",
+		Topic:    "thms/rtu{n}/data, thms/broadcast",
+		Payload:  `{"seq":{seq}}`,
+		PeerAddr: "127.0.0.1",
+		QoS:      1,
+		Clients:  1,
+	}
+	for _, tc := range []struct {
+		hook string
+		want map[string]interface{}
+	}{
+		{config.HookAuthOnRegister, map[string]interface{}{
+			"password":      "secret",
+			"clean_session": true,
+		}},
+		{config.HookAuthOnPublish, map[string]interface{}{
+			"qos":     float64(1),
+			"topic":   "thms/rtu1/data, thms/broadcast",
+			"payload": "eyJzZXEiOjJ9", // {"seq":2}
+			"retain":  false,
+		}},
+		{config.HookAuthOnSubscribe, map[string]interface{}{
+			"topics": []interface{}{
+				map[string]interface{}{"topic": "thms/rtu1/data", "qos": float64(1)},
+				map[string]interface{}{"topic": "thms/broadcast", "qos": float64(1)},
+			},
+		}},
+	} {
+		wh := base
+		wh.Hook = tc.hook
+		// Each call counts {seq} from 1, so the publish payload sees 2
+		c := &Client{webhookSeq: 1}
+		data, err := c.webhookBody(wh)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.hook, err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %s isn't JSON: %v", tc.hook, data, err)
+		}
+
+		port, _ := got["peer_port"].(float64)
+		if port < 1024 || port > 65535 {
+			t.Errorf("%s: peer_port = %v", tc.hook, got["peer_port"])
+		}
+		delete(got, "peer_port")
+		want := map[string]interface{}{
+			"mountpoint": "",
+			"client_id":  "rtu1",
+			"username":   "user1",
+			"peer_addr":  "127.0.0.1",
+		}
+		for k, v := range tc.want {
+			want[k] = v
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s body = %s\nwant %v", tc.hook, data, want)
+		}
+	}
+
+	if _, err := (&Client{}).webhookBody(config.WebhookConfig{Hook: "auth_on_deliver", Clients: 1}); err == nil {
+		t.Error("unknown hook rendered a body")
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/spf13/viper"
@@ -46,6 +47,7 @@ type RequestConfig struct {
 	ThinkTime  time.Duration     `mapstructure:"think_time"`
 	Timeout    time.Duration     `mapstructure:"timeout"`
 	Expected   ExpectedConfig    `mapstructure:"expected"`
+	Webhook    WebhookConfig     `mapstructure:"webhook"`
 }
 
 // ExpectedConfig holds response expectations
@@ -55,6 +57,32 @@ type ExpectedConfig struct {
 	ContentType string `mapstructure:"content_type"`
 }
 
+// VerneMQ webhook hooks the request generator can produce
+const (
+	HookAuthOnRegister  = "auth_on_register"
+	HookAuthOnPublish   = "auth_on_publish"
+	HookAuthOnSubscribe = "auth_on_subscribe"
+)
+
+// WebhookConfig generates VerneMQ webhook calls in place of a fixed body.
+// ClientID, Username, Password, Topic and Payload are templates: {n} is a
+// client number drawn from 1..Clients, shared by every field of one call,
+// {seq} counts calls and {rand} is a random hex string.
+type WebhookConfig struct {
+	Hook       string `mapstructure:"hook"`
+	ClientID   string `mapstructure:"client_id"`
+	Username   string `mapstructure:"username"`
+	Password   string `mapstructure:"password"`
+	Topic      string `mapstructure:"topic"`   // comma-separated for several subscriptions
+	Payload    string `mapstructure:"payload"` // sent base64 encoded, as VerneMQ does
+	QoS        int    `mapstructure:"qos"`
+	Retain     bool   `mapstructure:"retain"`
+	Mountpoint string `mapstructure:"mountpoint"`
+	PeerAddr   string `mapstructure:"peer_addr"`
+	Clients    int    `mapstructure:"clients"`
+	Expect     string `mapstructure:"expect"` // ok, next, error, an error such as not_authorized, or any
+}
+
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
 	Type     string `mapstructure:"type"`
@@ -123,6 +151,10 @@ func Load(path string) (*Config, error) {
 	// Set defaults
 	setDefaults(&cfg)
 
+	if err := validateWebhooks(&cfg); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
@@ -155,6 +187,88 @@ func setDefaults(cfg *Config) {
 	if len(cfg.Report.Percentiles) == 0 {
 		cfg.Report.Percentiles = []float64{50, 90, 95, 99, 99.9}
 	}
+	setWebhookDefaults(cfg.Requests)
+	for _, sc := range cfg.Scenarios {
+		setWebhookDefaults(sc.Requests)
+	}
+}
+
+// setWebhookDefaults fills in the endpoint, method and identities of
+// webhook requests and expands environment variables in their fields
+func setWebhookDefaults(requests []RequestConfig) {
+	for i := range requests {
+		req := &requests[i]
+		wh := &req.Webhook
+		if wh.Hook == "" {
+			continue
+		}
+		if req.Name == "" {
+			req.Name = wh.Hook
+		}
+		wh.ClientID = os.ExpandEnv(wh.ClientID)
+		wh.Username = os.ExpandEnv(wh.Username)
+		wh.Password = os.ExpandEnv(wh.Password)
+		wh.Topic = os.ExpandEnv(wh.Topic)
+		wh.Payload = os.ExpandEnv(wh.Payload)
+		if req.Method == "" {
+			req.Method = "POST"
+		}
+		if req.Endpoint == "" {
+			switch wh.Hook {
+			case HookAuthOnRegister:
+				req.Endpoint = "/mqtt/auth"
+			case HookAuthOnPublish:
+				req.Endpoint = "/mqtt/publish"
+			case HookAuthOnSubscribe:
+				req.Endpoint = "/mqtt/subscribe"
+			}
+		}
+		if wh.ClientID == "" {
+			wh.ClientID = "loadtest-{n}"
+		}
+		if wh.Username == "" {
+			wh.Username = "user{n}"
+		}
+		if wh.Topic == "" {
+			wh.Topic = "loadtest/{n}/data"
+		}
+		if wh.PeerAddr == "" {
+			wh.PeerAddr = "127.0.0.1"
+		}
+		if wh.Clients == 0 {
+			wh.Clients = 1000
+		}
+		if wh.Expect == "" {
+			wh.Expect = "ok"
+		}
+	}
+}
+
+// validateWebhooks checks the webhook requests of the test and its scenarios
+func validateWebhooks(cfg *Config) error {
+	requests := cfg.Requests
+	for _, sc := range cfg.Scenarios {
+		requests = append(requests[:len(requests):len(requests)], sc.Requests...)
+	}
+	for _, req := range requests {
+		wh := req.Webhook
+		if wh.Hook == "" {
+			continue
+		}
+		switch wh.Hook {
+		case HookAuthOnRegister, HookAuthOnPublish, HookAuthOnSubscribe:
+		default:
+			return fmt.Errorf("request %s: webhook.hook %q (use %s, %s or %s)", req.Name, wh.Hook,
+				HookAuthOnRegister, HookAuthOnPublish, HookAuthOnSubscribe)
+		}
+		if wh.QoS < 0 || wh.QoS > 2 {
+			return fmt.Errorf("request %s: webhook.qos %d (use 0, 1 or 2)", req.Name, wh.QoS)
+		}
+		if wh.Clients < 1 {
+			return fmt.Errorf("request %s: webhook.clients must be at least 1", req.Name)
+		}
+	}
+	return nil
 }
 
 // LoadCoordinator loads coordinator configuration
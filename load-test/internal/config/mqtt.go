@@ -0,0 +1,698 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Payload generator types for MQTT client groups
+const (
+	PayloadRTU      = "rtu"       // random but realistic RTU telemetry
+	PayloadTestMode = "test-mode" // predictable threshold/peak cycle
+	PayloadRandom   = "random"    // random bytes of a fixed size
+	PayloadTemplate = "template"  // user-supplied Go text/template
+	PayloadJSON     = "json"      // text/template rendering a JSON object
+	PayloadSequence = "sequence"  // scripted per-RTU threshold timelines
+)
+
+// Reconnect backoff policies for churn and thundering-herd reconnects
+const (
+	BackoffImmediate   = "immediate"   // reconnect at once, retry after the initial delay
+	BackoffFixed       = "fixed"       // wait the initial delay before every attempt
+	BackoffExponential = "exponential" // double the delay after every failed attempt
+	BackoffJitter      = "jitter"      // random delay up to the exponential one ("full jitter")
+)
+
+// Publish schedules for MQTT client groups
+const (
+	ScheduleContinuous = "continuous" // every client publishes on its own ticker
+	ScheduleSync       = "sync"       // all clients publish at the same interval mark
+)
+
+// MQTTScenario represents an mqtt-loadtest scenario file
+type MQTTScenario struct {
+	Name            string              `mapstructure:"name"`
+	Description     string              `mapstructure:"description"`
+	Broker          string              `mapstructure:"broker"`
+	CompareBroker   string              `mapstructure:"compare_broker"`
+	ProtocolVersion int                 `mapstructure:"protocol_version"`
+	Duration        time.Duration       `mapstructure:"duration"`
+	Drain           time.Duration       `mapstructure:"drain"`
+	Verbose         bool                `mapstructure:"verbose"`
+	GroundTruth     string              `mapstructure:"ground_truth"` // alarm manifest output for sequence payloads
+	TLS             MQTTTLSConfig       `mapstructure:"tls"`
+	WebSocket       MQTTWebSocketConfig `mapstructure:"websocket"`
+	Subscribers     MQTTSubscriberGroup `mapstructure:"subscribers"`
+	Shared          MQTTSharedGroup     `mapstructure:"shared"`
+	OfflineQueue    MQTTOfflineQueue    `mapstructure:"offline_queue"`
+	Retained        MQTTRetainedStorm   `mapstructure:"retained"`
+	Churn           MQTTChurn           `mapstructure:"churn"`
+	Takeover        MQTTTakeover        `mapstructure:"takeover"`
+	Kill            MQTTKill            `mapstructure:"kill"`
+	OpenLoop        MQTTOpenLoop        `mapstructure:"open_loop"`
+	StepLoad        MQTTStepLoad        `mapstructure:"step_load"`
+	Soak            MQTTSoak            `mapstructure:"soak"`
+	BrokerMetrics   MQTTBrokerMetrics   `mapstructure:"broker_metrics"`
+	Groups          []MQTTClientGroup   `mapstructure:"groups"`
+}
+
+// MQTTTLSConfig holds TLS settings for ssl://, mqtts:// and wss:// brokers
+type MQTTTLSConfig struct {
+	CAFile        string `mapstructure:"ca_file"`
+	CertFile      string `mapstructure:"cert_file"`
+	KeyFile       string `mapstructure:"key_file"`
+	ClientCertDir string `mapstructure:"client_cert_dir"`
+	ServerName    string `mapstructure:"server_name"`
+	Insecure      bool   `mapstructure:"insecure"`
+}
+
+// MQTTWebSocketConfig holds settings for ws:// and wss:// brokers
+type MQTTWebSocketConfig struct {
+	Path        string   `mapstructure:"path"`
+	Subprotocol string   `mapstructure:"subprotocol"`
+	Headers     []string `mapstructure:"headers"` // "Key: Value"
+}
+
+// MQTTSubscriberGroup configures the subscribers measuring end-to-end delivery
+type MQTTSubscriberGroup struct {
+	Count    int        `mapstructure:"count"`
+	Mode     string     `mapstructure:"mode"`    // wildcard or per-rtu
+	Filters  []string   `mapstructure:"filters"` // wildcard mode, cycled across subscribers; placeholders mean exact per-RTU topics
+	Username string     `mapstructure:"username"`
+	Password string     `mapstructure:"password"`
+	Fanout   MQTTFanout `mapstructure:"fanout"`
+}
+
+// MQTTSharedGroup starts consumers sharing a $share subscription alongside
+// the publishers, using the subscriber credentials
+type MQTTSharedGroup struct {
+	Consumers int           `mapstructure:"consumers"` // 0 disables
+	Group     string        `mapstructure:"group"`     // share name, $share/<group>/<filter>
+	Filter    string        `mapstructure:"filter"`    // defaults to the groups' topic wildcards
+	DropAt    time.Duration `mapstructure:"drop_at"`   // kill one consumer at this offset, 0 = never
+}
+
+// MQTTFanout grows the subscriber count in steps during the timed run to
+// show how delivery scales with fan-out
+type MQTTFanout struct {
+	Steps []int         `mapstructure:"steps"` // subscriber counts, ascending; the last one sizes the pool
+	Step  time.Duration `mapstructure:"step"`  // time per step, defaults to duration / len(steps)
+}
+
+// MQTTOfflineQueue replaces the timed publish phase with a persistent-session
+// test: subscribers subscribe with clean session off and disconnect,
+// publishers send Messages each, then subscribers reconnect and drain
+type MQTTOfflineQueue struct {
+	Messages      int           `mapstructure:"messages"`       // per publisher, 0 disables the mode
+	Offline       time.Duration `mapstructure:"offline"`        // extra time away after publishing, e.g. to let messages expire
+	SessionExpiry time.Duration `mapstructure:"session_expiry"` // MQTT 5 subscriber session expiry
+	DrainTimeout  time.Duration `mapstructure:"drain_timeout"`
+}
+
+// MQTTRetainedStorm replaces the timed publish phase with a retained store
+// test: publishers populate Topics retained topics, fresh wildcard
+// subscribers (subscribers.count, at least one) time the retained snapshot,
+// then the topics are cleared with empty retained publishes
+type MQTTRetainedStorm struct {
+	Topics  int           `mapstructure:"topics"`  // 0 disables the mode
+	Topic   string        `mapstructure:"topic"`   // template, {index} is the 1-based topic number
+	Sizes   []int         `mapstructure:"sizes"`   // payload bytes, cycled across topics
+	Timeout time.Duration `mapstructure:"timeout"` // per subscriber snapshot wait
+	Keep    bool          `mapstructure:"keep"`    // leave the topics retained after the run
+}
+
+// MQTTChurn disconnects and reconnects publishers during the timed run
+type MQTTChurn struct {
+	Rate    float64       `mapstructure:"rate"`    // clients cycled per second, 0 disables
+	HerdAt  time.Duration `mapstructure:"herd_at"` // drop every client at once at this offset, 0 disables
+	Backoff MQTTBackoff   `mapstructure:"backoff"`
+}
+
+// MQTTBackoff is the reconnect policy of churned clients
+type MQTTBackoff struct {
+	Policy  string        `mapstructure:"policy"` // immediate, fixed, exponential or jitter
+	Initial time.Duration `mapstructure:"initial"`
+	Max     time.Duration `mapstructure:"max"`
+}
+
+// MQTTTakeover opens a second connection with the same client ID for a
+// fraction of publishers, like an RTU rebooting before its old TCP session
+// dies
+type MQTTTakeover struct {
+	Fraction float64       `mapstructure:"fraction"` // of publishers, 0 disables
+	At       time.Duration `mapstructure:"at"`       // offset into the run, defaults to half the duration
+	InFlight int           `mapstructure:"inflight"` // QoS 1 publishes in flight on the old session
+}
+
+// MQTTKill abruptly closes the TCP connection of a fraction of publishers,
+// without DISCONNECT, so the broker publishes their wills
+type MQTTKill struct {
+	Fraction float64       `mapstructure:"fraction"` // of publishers with a will, 0 disables
+	At       time.Duration `mapstructure:"at"`       // offset into the run, defaults to half the duration
+}
+
+// MQTTOpenLoop replaces the per-client publish intervals with a global
+// message rate: a scheduler hands out send times round robin across the
+// publishers whether or not their earlier publishes have completed, and
+// latency is measured from the scheduled time
+type MQTTOpenLoop struct {
+	Rate   float64       `mapstructure:"rate"`   // messages per second across all publishers, 0 disables
+	Queue  int           `mapstructure:"queue"`  // scheduled sends a publisher may owe before new ones are skipped
+	Behind time.Duration `mapstructure:"behind"` // schedule lag that counts as falling behind
+}
+
+// MQTTStepLoad searches for capacity: the run starts with Clients
+// publishers, adds Clients more every Every and stops at the first step
+// that breaks an SLO. The groups' client counts are the upper bound and the
+// scenario duration is ignored.
+type MQTTStepLoad struct {
+	Clients int           `mapstructure:"clients"` // publishers added per step, 0 disables
+	Every   time.Duration `mapstructure:"every"`   // time each step is held and measured
+	SLO     MQTTStepSLO   `mapstructure:"slo"`
+}
+
+// MQTTStepSLO is what every capacity step must meet
+type MQTTStepSLO struct {
+	SuccessRate     float64       `mapstructure:"success_rate"`     // minimum publish success percent, 0 disables
+	LatencyP95      time.Duration `mapstructure:"latency_p95"`      // maximum publish acknowledgement p95, 0 disables
+	ConnectFailures int           `mapstructure:"connect_failures"` // failed connects allowed per step
+}
+
+// MQTTSoak holds mostly idle connections for the run, timing every
+// keep-alive PINGREQ/PINGRESP and recording connections that drop without
+// the client closing them
+type MQTTSoak struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Window  time.Duration `mapstructure:"window"` // ping latency timeline resolution
+}
+
+// MQTTBrokerMetrics scrapes the broker's Prometheus endpoint during the run
+// so broker counters can be lined up with what the clients saw
+type MQTTBrokerMetrics struct {
+	URL      string        `mapstructure:"url"` // e.g. http://localhost:8888/metrics, empty disables
+	Interval time.Duration `mapstructure:"interval"`
+	Metrics  []string      `mapstructure:"metrics"` // counters, summed across labels
+}
+
+// DefaultBrokerMetrics are the VerneMQ counters scraped unless a scenario
+// lists its own
+var DefaultBrokerMetrics = []string{
+	"mqtt_publish_received",
+	"mqtt_publish_sent",
+	"queue_message_in",
+	"queue_message_out",
+	"queue_message_drop",
+	"socket_open",
+	"socket_close",
+	"client_keepalive_expired",
+}
+
+// MQTTWill is the Last Will and Testament clients register on connect
+type MQTTWill struct {
+	Topic   string        `mapstructure:"topic"`   // supports the group topic placeholders, empty disables
+	Payload string        `mapstructure:"payload"` // supports the group topic placeholders
+	QoS     int           `mapstructure:"qos"`
+	Retain  bool          `mapstructure:"retain"`
+	Delay   time.Duration `mapstructure:"delay"` // MQTT 5 will delay interval
+}
+
+// MQTTClientGroup is a set of publishing clients sharing one configuration
+type MQTTClientGroup struct {
+	Name           string                `mapstructure:"name"`
+	Clients        int                   `mapstructure:"clients"`
+	RTUPrefix      string                `mapstructure:"rtu_prefix"`
+	RTUStart       int                   `mapstructure:"rtu_start"`
+	ClientIDPrefix string                `mapstructure:"client_id_prefix"`
+	Topic          string                `mapstructure:"topic"` // supports {rtuId}, {clientId}, {group} and {index}
+	QoS            int                   `mapstructure:"qos"`
+	Retain         bool                  `mapstructure:"retain"`
+	Clean          *bool                 `mapstructure:"clean"`
+	Interval       time.Duration         `mapstructure:"interval"`
+	Schedule       string                `mapstructure:"schedule"`
+	Jitter         time.Duration         `mapstructure:"jitter"`
+	Payload        MQTTPayloadConfig     `mapstructure:"payload"`
+	Credentials    MQTTCredentialsConfig `mapstructure:"credentials"`
+	SessionExpiry  time.Duration         `mapstructure:"session_expiry"`
+	MessageExpiry  time.Duration         `mapstructure:"message_expiry"`
+	UserProperties []string              `mapstructure:"user_properties"` // "key=value"
+	TopicAliases   bool                  `mapstructure:"topic_aliases"`
+	KeepAlive      time.Duration         `mapstructure:"keep_alive"`
+	Will           MQTTWill              `mapstructure:"will"`
+}
+
+// MQTTPayloadConfig selects the payload generator of a client group
+type MQTTPayloadConfig struct {
+	Type string `mapstructure:"type"`
+	Size int    `mapstructure:"size"` // bytes, for random
+	File string `mapstructure:"file"` // template or sequence file path
+}
+
+// MQTTCredentialsConfig holds the credentials of a client group. Username
+// and password may reference environment variables as ${VAR}.
+type MQTTCredentialsConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	File     string `mapstructure:"file"`
+	Order    string `mapstructure:"order"` // sequential or random
+}
+
+// CleanSession returns the clean session flag, defaulting to true
+func (g MQTTClientGroup) CleanSession() bool {
+	return g.Clean == nil || *g.Clean
+}
+
+// TotalClients returns the number of publishing clients across all groups
+func (s *MQTTScenario) TotalClients() int {
+	total := 0
+	for _, g := range s.Groups {
+		total += g.Clients
+	}
+	return total
+}
+
+// validateShared checks the shared subscription group
+func (s *MQTTScenario) validateShared() error {
+	if s.Shared.Consumers < 0 {
+		return fmt.Errorf("shared.consumers must not be negative")
+	}
+	if s.Shared.Consumers == 0 {
+		return nil
+	}
+	if s.Shared.Group == "" || strings.ContainsAny(s.Shared.Group, "/+#") {
+		return fmt.Errorf("shared.group %q must be a single topic level without wildcards", s.Shared.Group)
+	}
+	if s.OfflineQueue.Messages > 0 || s.Retained.Topics > 0 {
+		return fmt.Errorf("shared consumers need a timed run")
+	}
+	if s.Shared.DropAt > 0 && s.Shared.Consumers < 2 {
+		return fmt.Errorf("shared.drop_at needs at least two consumers to redistribute to")
+	}
+	if s.Shared.DropAt < 0 || (s.Shared.DropAt > 0 && s.Shared.DropAt >= s.Duration) {
+		return fmt.Errorf("shared.drop_at %v must fall within the %v run", s.Shared.DropAt, s.Duration)
+	}
+	return nil
+}
+
+// validateFanout checks the fan-out steps grow and leave room for the run
+func (s *MQTTScenario) validateFanout() error {
+	steps := s.Subscribers.Fanout.Steps
+	if len(steps) == 0 {
+		return nil
+	}
+	if s.Subscribers.Mode != "wildcard" {
+		return fmt.Errorf("subscribers.fanout needs wildcard mode")
+	}
+	if s.OfflineQueue.Messages > 0 || s.Retained.Topics > 0 {
+		return fmt.Errorf("subscribers.fanout needs a timed run")
+	}
+	for i, n := range steps {
+		if n < 1 || (i > 0 && n <= steps[i-1]) {
+			return fmt.Errorf("subscribers.fanout.steps %v must be positive and ascending", steps)
+		}
+	}
+	if s.Subscribers.Fanout.Step < 0 {
+		return fmt.Errorf("subscribers.fanout.step must not be negative")
+	}
+	return nil
+}
+
+// validateOpenLoop checks the global publish rate
+func (s *MQTTScenario) validateOpenLoop() error {
+	if s.OpenLoop.Rate < 0 {
+		return fmt.Errorf("open_loop.rate must not be negative")
+	}
+	if s.OpenLoop.Rate == 0 {
+		return nil
+	}
+	if s.OfflineQueue.Messages > 0 || s.Retained.Topics > 0 {
+		return fmt.Errorf("open_loop needs a timed run")
+	}
+	if s.OpenLoop.Queue < 1 {
+		return fmt.Errorf("open_loop.queue must be at least 1")
+	}
+	if s.OpenLoop.Behind <= 0 {
+		return fmt.Errorf("open_loop.behind must be positive")
+	}
+	for _, g := range s.Groups {
+		if g.Schedule == ScheduleSync {
+			return fmt.Errorf("group %s: open_loop replaces the %s schedule", g.Name, ScheduleSync)
+		}
+	}
+	return nil
+}
+
+// validateStepLoad checks the capacity steps and their SLO
+func (s *MQTTScenario) validateStepLoad() error {
+	st := s.StepLoad
+	if st.Clients < 0 {
+		return fmt.Errorf("step_load.clients must not be negative")
+	}
+	if st.Clients == 0 {
+		return nil
+	}
+	if s.OfflineQueue.Messages > 0 || s.Retained.Topics > 0 {
+		return fmt.Errorf("step_load needs a timed run")
+	}
+	if s.OpenLoop.Rate > 0 || s.Churn.Rate > 0 || s.Churn.HerdAt > 0 || s.Takeover.Fraction > 0 || s.Kill.Fraction > 0 || len(s.Subscribers.Fanout.Steps) > 0 {
+		return fmt.Errorf("step_load can't be combined with open_loop, churn, takeover, kill or subscribers.fanout")
+	}
+	if st.Every <= 0 {
+		return fmt.Errorf("step_load.every must be positive")
+	}
+	if st.SLO.SuccessRate < 0 || st.SLO.SuccessRate > 100 {
+		return fmt.Errorf("step_load.slo.success_rate %v (use 0 to 100)", st.SLO.SuccessRate)
+	}
+	if st.SLO.LatencyP95 < 0 || st.SLO.ConnectFailures < 0 {
+		return fmt.Errorf("step_load.slo latency_p95 and connect_failures must not be negative")
+	}
+	for _, g := range s.Groups {
+		if g.Interval > st.Every {
+			return fmt.Errorf("group %s: interval %v is longer than step_load.every %v, steps would see no publishes", g.Name, g.Interval, st.Every)
+		}
+	}
+	return nil
+}
+
+// validateSoak checks the idle-connection soak
+func (s *MQTTScenario) validateSoak() error {
+	if !s.Soak.Enabled {
+		return nil
+	}
+	if s.OfflineQueue.Messages > 0 || s.Retained.Topics > 0 {
+		return fmt.Errorf("soak needs a timed run")
+	}
+	if s.Churn.Rate > 0 || s.Churn.HerdAt > 0 || s.Takeover.Fraction > 0 || s.Kill.Fraction > 0 || s.StepLoad.Clients > 0 {
+		return fmt.Errorf("soak can't be combined with churn, takeover, kill or step_load, which close connections on purpose")
+	}
+	if s.Soak.Window <= 0 {
+		return fmt.Errorf("soak.window must be positive")
+	}
+	return nil
+}
+
+// hasWills reports whether any group registers a will
+func (s *MQTTScenario) hasWills() bool {
+	for _, g := range s.Groups {
+		if g.Will.Topic != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadMQTTScenario loads an mqtt-loadtest scenario from the specified file path
+func LoadMQTTScenario(path string) (*MQTTScenario, error) {
+	v := viper.New()
+
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %w", err)
+	}
+
+	var sc MQTTScenario
+	if err := v.Unmarshal(&sc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scenario: %w", err)
+	}
+
+	setMQTTDefaults(&sc)
+
+	// 0 disables an SLO check, so only a check left out of the file gets
+	// its default
+	if !v.IsSet("step_load.slo.success_rate") {
+		sc.StepLoad.SLO.SuccessRate = 99
+	}
+	if !v.IsSet("step_load.slo.latency_p95") {
+		sc.StepLoad.SLO.LatencyP95 = 500 * time.Millisecond
+	}
+
+	if err := sc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+
+	return &sc, nil
+}
+
+// setMQTTDefaults sets default scenario values
+func setMQTTDefaults(sc *MQTTScenario) {
+	if sc.Broker == "" {
+		sc.Broker = "tcp://localhost:1883"
+	}
+	if sc.ProtocolVersion == 0 {
+		sc.ProtocolVersion = 4
+	}
+	if sc.Duration == 0 {
+		sc.Duration = 60 * time.Second
+	}
+	if sc.Drain == 0 {
+		sc.Drain = 2 * time.Second
+	}
+	if sc.Subscribers.Mode == "" {
+		sc.Subscribers.Mode = "wildcard"
+	}
+	sc.Subscribers.Username = os.ExpandEnv(sc.Subscribers.Username)
+	sc.Subscribers.Password = os.ExpandEnv(sc.Subscribers.Password)
+	if sc.OfflineQueue.SessionExpiry == 0 {
+		sc.OfflineQueue.SessionExpiry = time.Hour
+	}
+	if sc.OfflineQueue.DrainTimeout == 0 {
+		sc.OfflineQueue.DrainTimeout = 60 * time.Second
+	}
+	if sc.Shared.Group == "" {
+		sc.Shared.Group = "ingest"
+	}
+	if sc.Retained.Topic == "" {
+		sc.Retained.Topic = "loadtest/retained/{index}"
+	}
+	if len(sc.Retained.Sizes) == 0 {
+		sc.Retained.Sizes = []int{256}
+	}
+	if sc.Retained.Timeout == 0 {
+		sc.Retained.Timeout = 60 * time.Second
+	}
+	if sc.Churn.Backoff.Policy == "" {
+		sc.Churn.Backoff.Policy = BackoffExponential
+	}
+	if sc.Churn.Backoff.Initial == 0 {
+		sc.Churn.Backoff.Initial = 500 * time.Millisecond
+	}
+	if sc.Churn.Backoff.Max == 0 {
+		sc.Churn.Backoff.Max = 30 * time.Second
+	}
+	if sc.Takeover.At == 0 {
+		sc.Takeover.At = sc.Duration / 2
+	}
+	if sc.Kill.At == 0 {
+		sc.Kill.At = sc.Duration / 2
+	}
+	if sc.Takeover.InFlight == 0 {
+		sc.Takeover.InFlight = 10
+	}
+	if sc.OpenLoop.Queue == 0 {
+		sc.OpenLoop.Queue = 1000
+	}
+	if sc.OpenLoop.Behind == 0 {
+		sc.OpenLoop.Behind = 100 * time.Millisecond
+	}
+	if sc.StepLoad.Every == 0 {
+		sc.StepLoad.Every = 30 * time.Second
+	}
+	if sc.Soak.Window == 0 {
+		sc.Soak.Window = time.Minute
+	}
+	if sc.BrokerMetrics.Interval == 0 {
+		sc.BrokerMetrics.Interval = 5 * time.Second
+	}
+	if len(sc.BrokerMetrics.Metrics) == 0 {
+		sc.BrokerMetrics.Metrics = DefaultBrokerMetrics
+	}
+	if sc.WebSocket.Path == "" {
+		sc.WebSocket.Path = "/mqtt"
+	}
+	if sc.WebSocket.Subprotocol == "" {
+		sc.WebSocket.Subprotocol = "mqtt"
+	}
+
+	nextRTU := 1
+	for i := range sc.Groups {
+		g := &sc.Groups[i]
+		if g.Name == "" {
+			g.Name = fmt.Sprintf("group%d", i+1)
+		}
+		if g.RTUPrefix == "" {
+			g.RTUPrefix = "25090100"
+		}
+		if g.RTUStart == 0 {
+			g.RTUStart = nextRTU
+		}
+		nextRTU = g.RTUStart + g.Clients
+		if g.ClientIDPrefix == "" {
+			g.ClientIDPrefix = "mqtt_client_"
+		}
+		if g.Topic == "" {
+			g.Topic = "thms/{rtuId}/data"
+		}
+		if g.Interval == 0 {
+			g.Interval = 5 * time.Second
+		}
+		if g.Schedule == "" {
+			g.Schedule = ScheduleContinuous
+		}
+		if g.Jitter == 0 {
+			g.Jitter = 5 * time.Second
+		}
+		if g.KeepAlive == 0 {
+			g.KeepAlive = 60 * time.Second
+		}
+		if g.Payload.Type == "" {
+			g.Payload.Type = PayloadRTU
+		}
+		if g.Payload.Type == PayloadRandom && g.Payload.Size == 0 {
+			g.Payload.Size = 256
+		}
+		if g.Credentials.Order == "" {
+			g.Credentials.Order = "sequential"
+		}
+		if g.Will.Topic != "" && g.Will.Payload == "" {
+			g.Will.Payload = `{"rtuId":"{rtuId}","status":"offline"}`
+		}
+		g.Credentials.Username = os.ExpandEnv(g.Credentials.Username)
+		g.Credentials.Password = os.ExpandEnv(g.Credentials.Password)
+	}
+}
+
+// Validate checks the scenario for values mqtt-loadtest cannot run
+func (s *MQTTScenario) Validate() error {
+	if len(s.Groups) == 0 {
+		return fmt.Errorf("no client groups defined")
+	}
+	if s.ProtocolVersion < 3 || s.ProtocolVersion > 5 {
+		return fmt.Errorf("protocol_version %d (use 3, 4 or 5)", s.ProtocolVersion)
+	}
+	if s.Subscribers.Mode != "wildcard" && s.Subscribers.Mode != "per-rtu" {
+		return fmt.Errorf("subscribers.mode %q (use wildcard or per-rtu)", s.Subscribers.Mode)
+	}
+	if len(s.Subscribers.Filters) > 0 && s.Subscribers.Mode != "wildcard" {
+		return fmt.Errorf("subscribers.filters need wildcard mode")
+	}
+	if err := s.validateShared(); err != nil {
+		return err
+	}
+	if err := s.validateFanout(); err != nil {
+		return err
+	}
+	if s.OfflineQueue.Messages < 0 {
+		return fmt.Errorf("offline_queue.messages must not be negative")
+	}
+	if s.OfflineQueue.Messages > 0 && s.Subscribers.Count == 0 {
+		return fmt.Errorf("offline_queue needs subscribers to queue messages for")
+	}
+	if s.Retained.Topics < 0 {
+		return fmt.Errorf("retained.topics must not be negative")
+	}
+	if s.Retained.Topics > 0 {
+		if s.OfflineQueue.Messages > 0 {
+			return fmt.Errorf("retained and offline_queue can't be combined")
+		}
+		if !strings.Contains(s.Retained.Topic, "{index}") {
+			return fmt.Errorf("retained.topic %q needs {index} to make the topics distinct", s.Retained.Topic)
+		}
+		if strings.ContainsAny(s.Retained.Topic, "+#") {
+			return fmt.Errorf("retained.topic %q must not contain wildcards", s.Retained.Topic)
+		}
+		for _, size := range s.Retained.Sizes {
+			if size < 1 {
+				return fmt.Errorf("retained.sizes must be at least 1 byte; an empty payload clears the topic")
+			}
+		}
+	}
+	if s.Churn.Rate < 0 || s.Churn.HerdAt < 0 {
+		return fmt.Errorf("churn rate and herd_at must not be negative")
+	}
+	if s.Churn.HerdAt > 0 && s.Churn.HerdAt >= s.Duration {
+		return fmt.Errorf("churn.herd_at %v must fall within the %v run", s.Churn.HerdAt, s.Duration)
+	}
+	if s.Takeover.Fraction < 0 || s.Takeover.Fraction > 1 {
+		return fmt.Errorf("takeover.fraction %v (use 0 to 1)", s.Takeover.Fraction)
+	}
+	if s.Takeover.InFlight < 0 {
+		return fmt.Errorf("takeover.inflight must not be negative")
+	}
+	if s.Takeover.Fraction > 0 && (s.Takeover.At < 0 || s.Takeover.At >= s.Duration) {
+		return fmt.Errorf("takeover.at %v must fall within the %v run", s.Takeover.At, s.Duration)
+	}
+	if s.Kill.Fraction < 0 || s.Kill.Fraction > 1 {
+		return fmt.Errorf("kill.fraction %v (use 0 to 1)", s.Kill.Fraction)
+	}
+	if s.Kill.Fraction > 0 && !s.hasWills() {
+		return fmt.Errorf("kill needs at least one group with a will topic")
+	}
+	if s.Kill.Fraction > 0 && (s.Kill.At < 0 || s.Kill.At >= s.Duration) {
+		return fmt.Errorf("kill.at %v must fall within the %v run", s.Kill.At, s.Duration)
+	}
+	if err := s.validateOpenLoop(); err != nil {
+		return err
+	}
+	if err := s.validateStepLoad(); err != nil {
+		return err
+	}
+	if err := s.validateSoak(); err != nil {
+		return err
+	}
+	if s.BrokerMetrics.URL != "" && s.BrokerMetrics.Interval <= 0 {
+		return fmt.Errorf("broker_metrics.interval must be positive")
+	}
+	switch s.Churn.Backoff.Policy {
+	case BackoffImmediate, BackoffFixed, BackoffExponential, BackoffJitter:
+	default:
+		return fmt.Errorf("churn.backoff.policy %q (use %s, %s, %s or %s)", s.Churn.Backoff.Policy,
+			BackoffImmediate, BackoffFixed, BackoffExponential, BackoffJitter)
+	}
+
+	names := make(map[string]bool)
+	for _, g := range s.Groups {
+		if names[g.Name] {
+			return fmt.Errorf("duplicate group name %q", g.Name)
+		}
+		names[g.Name] = true
+
+		if g.Clients <= 0 {
+			return fmt.Errorf("group %s: clients must be positive", g.Name)
+		}
+		if g.QoS < 0 || g.QoS > 2 {
+			return fmt.Errorf("group %s: qos %d (use 0, 1 or 2)", g.Name, g.QoS)
+		}
+		if g.Interval <= 0 {
+			return fmt.Errorf("group %s: interval must be positive", g.Name)
+		}
+		if g.KeepAlive < time.Second || g.KeepAlive > 65535*time.Second {
+			return fmt.Errorf("group %s: keep_alive %v (use 1s to 65535s)", g.Name, g.KeepAlive)
+		}
+		if g.Schedule != ScheduleContinuous && g.Schedule != ScheduleSync {
+			return fmt.Errorf("group %s: schedule %q (use %s or %s)", g.Name, g.Schedule, ScheduleContinuous, ScheduleSync)
+		}
+		if g.Will.QoS < 0 || g.Will.QoS > 2 {
+			return fmt.Errorf("group %s: will qos %d (use 0, 1 or 2)", g.Name, g.Will.QoS)
+		}
+		switch g.Payload.Type {
+		case PayloadRTU, PayloadTestMode:
+		case PayloadRandom:
+			if g.Payload.Size <= 0 {
+				return fmt.Errorf("group %s: random payload size must be positive", g.Name)
+			}
+		case PayloadTemplate, PayloadJSON, PayloadSequence:
+			if g.Payload.File == "" {
+				return fmt.Errorf("group %s: %s payload needs a file", g.Name, g.Payload.Type)
+			}
+		default:
+			return fmt.Errorf("group %s: payload type %q (use %s, %s, %s, %s, %s or %s)", g.Name, g.Payload.Type,
+				PayloadRTU, PayloadTestMode, PayloadRandom, PayloadTemplate, PayloadJSON, PayloadSequence)
+		}
+	}
+	return nil
+}
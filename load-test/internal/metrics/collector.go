@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,31 +13,26 @@ import (
 type Sample struct {
 	Timestamp    time.Duration
 	Latency      time.Duration
-	StatusCode   int
+	StatusCode   int // HTTP status, or the MQTT reason code when the broker sent one
 	Success      bool
 	RequestName  string
 	ErrorMsg     string
 	BytesSent    int64
 	BytesReceived int64
+	Target       string // endpoint the request went to, when a run compares several
 }
 
 // Collector collects and aggregates metrics
 type Collector struct {
-	mu          sync.RWMutex
-	samples     []Sample
-	startTime   time.Time
-	buckets     map[int64][]Sample // time bucket -> samples
-	windowSize  time.Duration
-	bucketSize  time.Duration
+	mu        sync.RWMutex
+	samples   []Sample
+	startTime time.Time
 }
 
 // NewCollector creates a new metrics collector
 func NewCollector() *Collector {
 	return &Collector{
-		samples:    make([]Sample, 0),
-		buckets:    make(map[int64][]Sample),
-		windowSize: 5 * time.Minute,
-		bucketSize: time.Second,
+		samples: make([]Sample, 0),
 	}
 }
 
@@ -57,10 +53,6 @@ func (c *Collector) Record(sample Sample) {
 
 	sample.Timestamp = time.Since(c.startTime)
 	c.samples = append(c.samples, sample)
-
-	// Add to time bucket
-	bucket := int64(sample.Timestamp.Seconds())
-	c.buckets[bucket] = append(c.buckets[bucket], sample)
 }
 
 // RecordResponse records a response
@@ -114,6 +106,8 @@ func (c *Collector) GetStatistics() *Statistics {
 
 		if !s.Success {
 			errors = append(errors, s)
+		} else {
+			stats.SuccessRequests++
 		}
 
 		stats.BytesSent += s.BytesSent
@@ -165,6 +159,29 @@ func (c *Collector) GetSamples() []Sample {
 	return result
 }
 
+// Count returns the number of recorded samples, a mark for GetSamplesSince
+func (c *Collector) Count() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.samples)
+}
+
+// GetSamplesSince returns the samples recorded after the first mark that
+// match selects
+func (c *Collector) GetSamplesSince(mark int, match func(Sample) bool) []Sample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var result []Sample
+	for _, s := range c.samples[min(mark, len(c.samples)):] {
+		if match(s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 // GetTimeWindow returns samples within the time window
 func (c *Collector) GetTimeWindow(window time.Duration) []Sample {
 	c.mu.RLock()
@@ -188,15 +205,12 @@ func (c *Collector) Reset() {
 	defer c.mu.Unlock()
 
 	c.samples = make([]Sample, 0)
-	c.buckets = make(map[int64][]Sample)
 	c.startTime = time.Now()
 }
 
-// calculateRPSHistory calculates requests per second over time
+// calculateRPSHistory calculates requests per second over time. Callers
+// hold c.mu.
 func (c *Collector) calculateRPSHistory() []RPSDataPoint {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
 	var result []RPSDataPoint
 
 	// Group by second
@@ -285,9 +299,7 @@ func percentile(vals []float64, p float64) float64 {
 	// Sort values
 	sorted := make([]float64, len(vals))
 	copy(sorted, vals)
-	for i := 0; i < len(sorted)/2; i++ {
-		sorted[i], sorted[len(sorted)-1-i] = sorted[len(sorted)-1-i], sorted[i]
-	}
+	sort.Float64s(sorted)
 
 	// Calculate percentile
 	index := int(float64(len(sorted)) * p / 100)
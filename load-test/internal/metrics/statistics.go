@@ -130,42 +130,47 @@ func (s *Statistics) CalculateRequestStats(samples []Sample) {
 
 	// Calculate stats for each group
 	for name, group := range groups {
-		stats := &RequestStatistics{
-			Name:        name,
-			Count:       len(group),
-			Percentiles: make(map[float64]float64),
-		}
+		s.RequestStats[name] = SummarizeRequests(name, group)
+	}
+}
 
-		var latencies []float64
-		for _, sample := range group {
-			latencies = append(latencies, float64(sample.Latency.Microseconds()))
-			stats.BytesSent += sample.BytesSent
-			stats.BytesReceived += sample.BytesReceived
-
-			if sample.Success {
-				stats.SuccessCount++
-			} else {
-				stats.ErrorCount++
-			}
-		}
+// SummarizeRequests calculates the statistics of one request's samples
+func SummarizeRequests(name string, samples []Sample) *RequestStatistics {
+	stats := &RequestStatistics{
+		Name:        name,
+		Count:       len(samples),
+		Percentiles: make(map[float64]float64),
+	}
 
-		if len(latencies) > 0 {
-			stats.MinLatency = minFloat(latencies)
-			stats.MaxLatency = maxFloat(latencies)
-			stats.AvgLatency = avgFloat(latencies)
-			stats.StdDev = stdDevFloat(latencies, stats.AvgLatency)
-
-			// Calculate percentiles
-			stats.Percentiles[50] = percentile(latencies, 50)
-			stats.Percentiles[90] = percentile(latencies, 90)
-			stats.Percentiles[95] = percentile(latencies, 95)
-			stats.Percentiles[99] = percentile(latencies, 99)
+	var latencies []float64
+	for _, sample := range samples {
+		latencies = append(latencies, float64(sample.Latency.Microseconds()))
+		stats.BytesSent += sample.BytesSent
+		stats.BytesReceived += sample.BytesReceived
+
+		if sample.Success {
+			stats.SuccessCount++
+		} else {
+			stats.ErrorCount++
 		}
+	}
 
-		if stats.Count > 0 {
-			stats.ErrorRate = float64(stats.ErrorCount) / float64(stats.Count) * 100
-		}
+	if len(latencies) > 0 {
+		stats.MinLatency = minFloat(latencies)
+		stats.MaxLatency = maxFloat(latencies)
+		stats.AvgLatency = avgFloat(latencies)
+		stats.StdDev = stdDevFloat(latencies, stats.AvgLatency)
+
+		// Calculate percentiles
+		stats.Percentiles[50] = percentile(latencies, 50)
+		stats.Percentiles[90] = percentile(latencies, 90)
+		stats.Percentiles[95] = percentile(latencies, 95)
+		stats.Percentiles[99] = percentile(latencies, 99)
+	}
 
-		s.RequestStats[name] = stats
+	if stats.Count > 0 {
+		stats.ErrorRate = float64(stats.ErrorCount) / float64(stats.Count) * 100
 	}
+
+	return stats
 }
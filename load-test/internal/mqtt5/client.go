@@ -0,0 +1,703 @@
+// Package mqtt5 implements a minimal MQTT 5.0 client for load testing.
+//
+// It covers the parts of the protocol the load tester exercises: CONNECT with
+// session expiry and user properties, QoS 0/1/2 publishing with message expiry
+// and topic aliases, subscriptions, keep-alive pings and reason codes on every
+// acknowledgement. The caller supplies the network connection so the same
+// client works over TCP, TLS and WebSockets.
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+	packetAuth        = 15
+)
+
+var packetNames = map[byte]string{
+	packetConnack:    "CONNACK",
+	packetPuback:     "PUBACK",
+	packetPubrec:     "PUBREC",
+	packetPubcomp:    "PUBCOMP",
+	packetSuback:     "SUBACK",
+	packetUnsuback:   "UNSUBACK",
+	packetDisconnect: "DISCONNECT",
+}
+
+// ErrClosed is returned for operations on a closed client
+var ErrClosed = errors.New("mqtt5: connection closed")
+
+// Message is an application message sent or received by the client
+type Message struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Duplicate  bool
+	Properties Properties
+}
+
+// ClientOptions configures a client connection
+type ClientOptions struct {
+	ClientID      string
+	Username      string
+	Password      string
+	CleanStart    bool
+	KeepAlive     time.Duration
+	SessionExpiry uint32
+	UserProps     []UserProperty
+	Will          *Message
+
+	// UseTopicAliases replaces repeated topic names with aliases, up to the
+	// Topic Alias Maximum advertised by the broker in CONNACK
+	UseTopicAliases bool
+
+	// OnMessage is called from the read loop for every inbound PUBLISH
+	OnMessage func(*Message)
+}
+
+// Connack holds the broker's answer to CONNECT
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties
+}
+
+// Subscription is a single topic filter in a SUBSCRIBE request
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+type ack struct {
+	packetType byte
+	reasons    []byte
+	props      Properties
+}
+
+// Client is an MQTT 5.0 client bound to one network connection
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	opts   ClientOptions
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	nextID      uint16
+	pending     map[uint16]chan ack
+	aliases     map[string]uint16
+	aliasMax    uint16
+	awaitRel    map[uint16]bool // inbound QoS 2 packet IDs waiting for PUBREL
+	pingWaiters []chan struct{} // one per PINGREQ sent, answered in order
+	err         error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Connect performs the MQTT 5 handshake over conn. A CONNACK with a failure
+// reason code is returned together with a *ReasonCodeError.
+func Connect(ctx context.Context, conn net.Conn, opts ClientOptions) (*Client, *Connack, error) {
+	c := &Client{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		opts:     opts,
+		pending:  make(map[uint16]chan ack),
+		aliases:  make(map[string]uint16),
+		awaitRel: make(map[uint16]bool),
+		done:     make(chan struct{}),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := c.writePacket(packetConnect<<4, c.encodeConnect()); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	header, body, err := c.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if header>>4 != packetConnack {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+
+	connack, err := decodeConnack(body)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if connack.ReasonCode != ReasonSuccess && connack.ReasonCode < 0x80 {
+		// A 3.1.1 broker refuses MQTT 5 with a legacy return code (0x01)
+		if connack.ReasonCode == 0x01 {
+			connack.ReasonCode = ReasonUnsupportedProtocolVersion
+		}
+		conn.Close()
+		return nil, connack, &ReasonCodeError{Packet: "CONNACK", Code: connack.ReasonCode}
+	}
+	if connack.ReasonCode >= 0x80 {
+		conn.Close()
+		return nil, connack, &ReasonCodeError{Packet: "CONNACK", Code: connack.ReasonCode, Reason: connack.Properties.ReasonString}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if opts.UseTopicAliases && connack.Properties.TopicAliasMaximum != nil {
+		c.aliasMax = *connack.Properties.TopicAliasMaximum
+	}
+	if connack.Properties.ServerKeepAlive != nil {
+		c.opts.KeepAlive = time.Duration(*connack.Properties.ServerKeepAlive) * time.Second
+	}
+
+	go c.readLoop()
+	if c.opts.KeepAlive > 0 {
+		go c.keepAliveLoop()
+	}
+
+	return c, connack, nil
+}
+
+func (c *Client) encodeConnect() []byte {
+	var buf bytes.Buffer
+	writeString(&buf, "MQTT")
+	buf.WriteByte(5)
+
+	var flags byte
+	if c.opts.CleanStart {
+		flags |= 0x02
+	}
+	if c.opts.Will != nil {
+		flags |= 0x04 | c.opts.Will.QoS<<3
+		if c.opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.opts.Password != "" {
+		flags |= 0x40
+	}
+	if c.opts.Username != "" {
+		flags |= 0x80
+	}
+	buf.WriteByte(flags)
+	writeUint16(&buf, uint16(c.opts.KeepAlive/time.Second))
+
+	props := &Properties{User: c.opts.UserProps}
+	if c.opts.SessionExpiry > 0 {
+		props.SessionExpiry = Uint32(c.opts.SessionExpiry)
+	}
+	buf.Write(props.encode())
+
+	writeString(&buf, c.opts.ClientID)
+	if c.opts.Will != nil {
+		buf.Write(c.opts.Will.Properties.encode())
+		writeString(&buf, c.opts.Will.Topic)
+		writeBinary(&buf, c.opts.Will.Payload)
+	}
+	if c.opts.Username != "" {
+		writeString(&buf, c.opts.Username)
+	}
+	if c.opts.Password != "" {
+		writeString(&buf, c.opts.Password)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeConnack(body []byte) (*Connack, error) {
+	r := bytes.NewReader(body)
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("malformed CONNACK: %w", err)
+	}
+	code, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("malformed CONNACK: %w", err)
+	}
+
+	connack := &Connack{SessionPresent: flags&0x01 == 1, ReasonCode: code}
+	if r.Len() > 0 {
+		if connack.Properties, err = decodeProperties(r); err != nil {
+			return nil, fmt.Errorf("malformed CONNACK properties: %w", err)
+		}
+	}
+	return connack, nil
+}
+
+// Publish sends msg and waits for the acknowledgement flow of its QoS level.
+// It returns the broker's reason code, which is ReasonSuccess for QoS 0.
+func (c *Client) Publish(ctx context.Context, msg *Message) (byte, error) {
+	var id uint16
+	var wait chan ack
+	if msg.QoS > 0 {
+		id, wait = c.register()
+		defer c.unregister(id)
+	}
+
+	header := byte(packetPublish<<4) | msg.QoS<<1
+	if msg.Retain {
+		header |= 0x01
+	}
+
+	// The alias is chosen and the packet written under the write lock, so a
+	// concurrent publish can't send an aliased packet with an empty topic
+	// before the one establishing the alias
+	c.writeMu.Lock()
+	err := c.write(header, c.encodePublish(msg, id))
+	c.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if msg.QoS == 0 {
+		return ReasonSuccess, nil
+	}
+
+	a, err := c.await(ctx, wait)
+	if err != nil {
+		return 0, err
+	}
+	if code := a.reasons[0]; code >= 0x80 {
+		return code, &ReasonCodeError{Packet: packetNames[a.packetType], Code: code, Reason: a.props.ReasonString}
+	}
+	if msg.QoS == 1 {
+		return a.reasons[0], nil
+	}
+
+	// QoS 2: PUBREC received, release and wait for PUBCOMP
+	var rel bytes.Buffer
+	writeUint16(&rel, id)
+	if err := c.writePacket(packetPubrel<<4|0x02, rel.Bytes()); err != nil {
+		return 0, err
+	}
+
+	a, err = c.await(ctx, wait)
+	if err != nil {
+		return 0, err
+	}
+	if code := a.reasons[0]; code >= 0x80 {
+		return code, &ReasonCodeError{Packet: packetNames[a.packetType], Code: code, Reason: a.props.ReasonString}
+	}
+	return a.reasons[0], nil
+}
+
+// encodePublish builds the PUBLISH body, replacing a topic that already has
+// an alias by the alias alone. Callers hold writeMu.
+func (c *Client) encodePublish(msg *Message, id uint16) []byte {
+	props := msg.Properties
+	topic := msg.Topic
+
+	if c.aliasMax > 0 {
+		c.mu.Lock()
+		alias, known := c.aliases[topic]
+		if !known && uint16(len(c.aliases)) < c.aliasMax {
+			alias = uint16(len(c.aliases) + 1)
+			c.aliases[topic] = alias
+		}
+		c.mu.Unlock()
+
+		if alias > 0 {
+			props.TopicAlias = Uint16(alias)
+			if known {
+				topic = ""
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	writeString(&buf, topic)
+	if msg.QoS > 0 {
+		writeUint16(&buf, id)
+	}
+	buf.Write(props.encode())
+	buf.Write(msg.Payload)
+	return buf.Bytes()
+}
+
+// Subscribe subscribes to the given filters and returns the SUBACK reason codes.
+// Any failure code is also reported as a *ReasonCodeError.
+func (c *Client) Subscribe(ctx context.Context, subs ...Subscription) ([]byte, error) {
+	id, wait := c.register()
+	defer c.unregister(id)
+
+	var buf bytes.Buffer
+	writeUint16(&buf, id)
+	buf.Write((&Properties{}).encode())
+	for _, s := range subs {
+		writeString(&buf, s.Filter)
+		buf.WriteByte(s.QoS & 0x03)
+	}
+
+	if err := c.writePacket(packetSubscribe<<4|0x02, buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	a, err := c.await(ctx, wait)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range a.reasons {
+		if code >= 0x80 {
+			return a.reasons, &ReasonCodeError{Packet: "SUBACK", Code: code, Reason: a.props.ReasonString}
+		}
+	}
+	return a.reasons, nil
+}
+
+// Unsubscribe removes the given filters
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	id, wait := c.register()
+	defer c.unregister(id)
+
+	var buf bytes.Buffer
+	writeUint16(&buf, id)
+	buf.Write((&Properties{}).encode())
+	for _, f := range filters {
+		writeString(&buf, f)
+	}
+
+	if err := c.writePacket(packetUnsubscribe<<4|0x02, buf.Bytes()); err != nil {
+		return err
+	}
+
+	a, err := c.await(ctx, wait)
+	if err != nil {
+		return err
+	}
+	for _, code := range a.reasons {
+		if code >= 0x80 {
+			return &ReasonCodeError{Packet: "UNSUBACK", Code: code, Reason: a.props.ReasonString}
+		}
+	}
+	return nil
+}
+
+// Ping sends PINGREQ and returns the round-trip time to PINGRESP. The
+// broker answers pings in order, so concurrent callers each get their own.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	waiter := make(chan struct{})
+
+	// Queue the waiter under the write lock so the queue matches the order
+	// the PINGREQs go out in
+	c.writeMu.Lock()
+	c.mu.Lock()
+	c.pingWaiters = append(c.pingWaiters, waiter)
+	c.mu.Unlock()
+	start := time.Now()
+	err := c.write(packetPingreq<<4, nil)
+	c.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-waiter:
+		return time.Since(start), nil
+	case <-c.done:
+		return 0, c.Err()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Disconnect sends DISCONNECT with the given reason code and closes the connection
+func (c *Client) Disconnect(reason byte) {
+	c.writePacket(packetDisconnect<<4, []byte{reason, 0})
+	c.closeWithError(ErrClosed)
+}
+
+// Close drops the network connection without sending DISCONNECT
+func (c *Client) Close() {
+	c.closeWithError(ErrClosed)
+}
+
+// Done is closed when the connection terminates
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection terminated. A broker DISCONNECT is reported
+// as a *ReasonCodeError.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// IsConnected reports whether the connection is still open
+func (c *Client) IsConnected() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Client) register() (uint16, chan ack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, used := c.pending[c.nextID]; !used {
+			break
+		}
+	}
+
+	ch := make(chan ack, 2)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *Client) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) await(ctx context.Context, wait chan ack) (ack, error) {
+	select {
+	case a := <-wait:
+		return a, nil
+	case <-c.done:
+		return ack{}, c.Err()
+	case <-ctx.Done():
+		return ack{}, ctx.Err()
+	}
+}
+
+func (c *Client) keepAliveLoop() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.KeepAlive)
+			_, err := c.Ping(ctx)
+			cancel()
+			if err != nil {
+				c.closeWithError(fmt.Errorf("keep alive: %w", err))
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+
+		switch header >> 4 {
+		case packetPublish:
+			if err := c.handlePublish(header, body); err != nil {
+				c.closeWithError(err)
+				return
+			}
+		case packetPuback, packetPubrec, packetPubcomp, packetSuback, packetUnsuback:
+			c.handleAck(header>>4, body)
+		case packetPubrel:
+			if len(body) >= 2 {
+				id := uint16(body[0])<<8 | uint16(body[1])
+				c.mu.Lock()
+				delete(c.awaitRel, id)
+				c.mu.Unlock()
+				c.writePacket(packetPubcomp<<4, body[:2])
+			}
+		case packetPingresp:
+			c.mu.Lock()
+			if len(c.pingWaiters) > 0 {
+				close(c.pingWaiters[0])
+				c.pingWaiters = c.pingWaiters[1:]
+			}
+			c.mu.Unlock()
+		case packetDisconnect:
+			code := byte(ReasonSuccess)
+			var props Properties
+			if len(body) > 0 {
+				r := bytes.NewReader(body)
+				code, _ = r.ReadByte()
+				if r.Len() > 0 {
+					props, _ = decodeProperties(r)
+				}
+			}
+			c.closeWithError(&ReasonCodeError{Packet: "DISCONNECT", Code: code, Reason: props.ReasonString})
+			return
+		case packetAuth:
+			// Enhanced authentication is not supported
+		}
+	}
+}
+
+func (c *Client) handlePublish(header byte, body []byte) error {
+	r := bytes.NewReader(body)
+	msg := &Message{
+		QoS:       (header >> 1) & 0x03,
+		Retain:    header&0x01 == 1,
+		Duplicate: header&0x08 != 0,
+	}
+
+	topic, err := readString(r)
+	if err != nil {
+		return fmt.Errorf("malformed PUBLISH: %w", err)
+	}
+	msg.Topic = topic
+
+	var id uint16
+	if msg.QoS > 0 {
+		if id, err = readUint16(r); err != nil {
+			return fmt.Errorf("malformed PUBLISH: %w", err)
+		}
+	}
+	if msg.Properties, err = decodeProperties(r); err != nil {
+		return fmt.Errorf("malformed PUBLISH properties: %w", err)
+	}
+	msg.Payload, _ = io.ReadAll(r)
+
+	deliver := true
+	if msg.QoS == 2 {
+		c.mu.Lock()
+		deliver = !c.awaitRel[id]
+		c.awaitRel[id] = true
+		c.mu.Unlock()
+	}
+
+	if deliver && c.opts.OnMessage != nil {
+		c.opts.OnMessage(msg)
+	}
+
+	var idBytes bytes.Buffer
+	writeUint16(&idBytes, id)
+	switch msg.QoS {
+	case 1:
+		return c.writePacket(packetPuback<<4, idBytes.Bytes())
+	case 2:
+		return c.writePacket(packetPubrec<<4, idBytes.Bytes())
+	}
+	return nil
+}
+
+func (c *Client) handleAck(packetType byte, body []byte) {
+	r := bytes.NewReader(body)
+	id, err := readUint16(r)
+	if err != nil {
+		return
+	}
+
+	a := ack{packetType: packetType}
+	switch packetType {
+	case packetSuback, packetUnsuback:
+		if a.props, err = decodeProperties(r); err != nil {
+			return
+		}
+		a.reasons, _ = io.ReadAll(r)
+	default:
+		code := byte(ReasonSuccess)
+		if r.Len() > 0 {
+			code, _ = r.ReadByte()
+		}
+		if r.Len() > 0 {
+			a.props, _ = decodeProperties(r)
+		}
+		a.reasons = []byte{code}
+	}
+
+	c.mu.Lock()
+	ch := c.pending[id]
+	c.mu.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+func (c *Client) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarInt(c.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func (c *Client) writePacket(header byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.write(header, body)
+}
+
+// write sends one packet. Callers hold writeMu.
+func (c *Client) write(header byte, body []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(header)
+	writeVarInt(&buf, len(body))
+	buf.Write(body)
+
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *Client) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
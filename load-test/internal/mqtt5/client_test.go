@@ -0,0 +1,421 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	mqttbroker "loadtest/internal/broker"
+)
+
+// fakeBroker is the server end of a net.Pipe, scripted by each test
+type fakeBroker struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (b *fakeBroker) read() (byte, []byte) {
+	b.t.Helper()
+	header, err := b.reader.ReadByte()
+	if err != nil {
+		b.t.Errorf("fake broker read: %v", err)
+		return 0, nil
+	}
+	length, err := readVarInt(b.reader)
+	if err != nil {
+		b.t.Errorf("fake broker read: %v", err)
+		return 0, nil
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(b.reader, body); err != nil {
+		b.t.Errorf("fake broker read: %v", err)
+	}
+	return header, body
+}
+
+func (b *fakeBroker) write(header byte, body []byte) {
+	var buf bytes.Buffer
+	buf.WriteByte(header)
+	writeVarInt(&buf, len(body))
+	buf.Write(body)
+	b.conn.Write(buf.Bytes())
+}
+
+// script runs the broker's side of a test, which must finish before the
+// client is closed
+func (b *fakeBroker) script(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	b.t.Cleanup(func() {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			b.t.Error("fake broker script didn't finish")
+		}
+	})
+}
+
+// connect accepts the client's CONNECT with a CONNACK carrying props
+func (b *fakeBroker) connect(props Properties) []byte {
+	b.t.Helper()
+	header, body := b.read()
+	if header>>4 != packetConnect {
+		b.t.Fatalf("first packet type %d, want CONNECT", header>>4)
+	}
+	b.write(packetConnack<<4, append([]byte{0x00, ReasonSuccess}, props.encode()...))
+	return body
+}
+
+// dial connects a client to a fresh fake broker
+func dial(t *testing.T, opts ClientOptions, connack Properties) (*Client, *fakeBroker, []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	b := &fakeBroker{t: t, conn: server, reader: bufio.NewReader(server)}
+	connect := make(chan []byte, 1)
+	go func() { connect <- b.connect(connack) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := Connect(ctx, client, opts)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+	})
+	return c, b, <-connect
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestConnectEncoding(t *testing.T) {
+	opts := ClientOptions{
+		ClientID:      "rtu1",
+		Username:      "user",
+		Password:      "pass",
+		CleanStart:    true,
+		KeepAlive:     0,
+		SessionExpiry: 600,
+		UserProps:     []UserProperty{{Key: "k", Value: "v"}},
+		Will: &Message{
+			Topic:      "thms/rtu1/status",
+			Payload:    []byte("offline"),
+			QoS:        1,
+			Retain:     true,
+			Properties: Properties{WillDelay: Uint32(5)},
+		},
+	}
+	_, _, body := dial(t, opts, Properties{})
+
+	r := bytes.NewReader(body)
+	name, _ := readString(r)
+	version, _ := r.ReadByte()
+	flags, _ := r.ReadByte()
+	keepAlive, _ := readUint16(r)
+	props, err := decodeProperties(r)
+	if err != nil {
+		t.Fatalf("CONNECT properties: %v", err)
+	}
+	clientID, _ := readString(r)
+	willProps, err := decodeProperties(r)
+	if err != nil {
+		t.Fatalf("will properties: %v", err)
+	}
+	willTopic, _ := readString(r)
+	willPayload, _ := readBinary(r)
+	username, _ := readString(r)
+	password, _ := readString(r)
+
+	// username, password, will retain, will QoS 1, will, clean start
+	const wantFlags = 0x80 | 0x40 | 0x20 | 0x08 | 0x04 | 0x02
+	if name != "MQTT" || version != 5 || flags != wantFlags || keepAlive != 0 {
+		t.Errorf("header = %s v%d flags %08b keep-alive %d", name, version, flags, keepAlive)
+	}
+	if *props.SessionExpiry != 600 || len(props.User) != 1 || props.User[0] != (UserProperty{"k", "v"}) {
+		t.Errorf("properties = %+v", props)
+	}
+	if clientID != "rtu1" || *willProps.WillDelay != 5 || willTopic != "thms/rtu1/status" ||
+		string(willPayload) != "offline" || username != "user" || password != "pass" {
+		t.Errorf("payload = %q, will %q %q delay %v, credentials %q/%q",
+			clientID, willTopic, willPayload, willProps.WillDelay, username, password)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d trailing bytes", r.Len())
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	b := &fakeBroker{t: t, conn: server, reader: bufio.NewReader(server)}
+	go func() {
+		b.read()
+		b.write(packetConnack<<4, append([]byte{0x00, ReasonBadUsernameOrPassword}, (&Properties{ReasonString: "nope"}).encode()...))
+	}()
+
+	_, connack, err := Connect(testContext(t), client, ClientOptions{ClientID: "rtu1"})
+	var rcErr *ReasonCodeError
+	if !errors.As(err, &rcErr) || rcErr.Code != ReasonBadUsernameOrPassword || rcErr.Reason != "nope" {
+		t.Fatalf("Connect = %v, want bad username or password", err)
+	}
+	if connack == nil || connack.ReasonCode != ReasonBadUsernameOrPassword {
+		t.Errorf("connack = %+v", connack)
+	}
+}
+
+func TestPublishQoS1(t *testing.T) {
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1"}, Properties{})
+
+	b.script(func() {
+		header, body := b.read()
+		r := bytes.NewReader(body)
+		topic, _ := readString(r)
+		id, _ := readUint16(r)
+		props, _ := decodeProperties(r)
+		payload, _ := io.ReadAll(r)
+		if header != packetPublish<<4|0x02|0x01 || topic != "thms/rtu1/data" || *props.MessageExpiry != 60 || string(payload) != "x" {
+			t.Errorf("PUBLISH header %08b topic %q props %+v payload %q", header, topic, props, payload)
+		}
+		var ack bytes.Buffer
+		writeUint16(&ack, id)
+		ack.WriteByte(ReasonNoMatchingSubscribers)
+		b.write(packetPuback<<4, ack.Bytes())
+	})
+
+	code, err := c.Publish(testContext(t), &Message{
+		Topic:      "thms/rtu1/data",
+		Payload:    []byte("x"),
+		QoS:        1,
+		Retain:     true,
+		Properties: Properties{MessageExpiry: Uint32(60)},
+	})
+	if err != nil || code != ReasonNoMatchingSubscribers {
+		t.Errorf("Publish = 0x%02X, %v, want no matching subscribers", code, err)
+	}
+}
+
+func TestPublishQoS2(t *testing.T) {
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1"}, Properties{})
+
+	b.script(func() {
+		_, body := b.read()
+		r := bytes.NewReader(body)
+		readString(r)
+		id, _ := readUint16(r)
+		var idBytes bytes.Buffer
+		writeUint16(&idBytes, id)
+
+		b.write(packetPubrec<<4, idBytes.Bytes())
+		if header, rel := b.read(); header != packetPubrel<<4|0x02 || !bytes.Equal(rel, idBytes.Bytes()) {
+			t.Errorf("got header %08b body % X, want PUBREL for %d", header, rel, id)
+		}
+		b.write(packetPubcomp<<4, idBytes.Bytes())
+	})
+
+	if code, err := c.Publish(testContext(t), &Message{Topic: "t", QoS: 2}); err != nil || code != ReasonSuccess {
+		t.Errorf("Publish = 0x%02X, %v", code, err)
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1"}, Properties{})
+
+	b.script(func() {
+		_, body := b.read()
+		r := bytes.NewReader(body)
+		readString(r)
+		id, _ := readUint16(r)
+		var ack bytes.Buffer
+		writeUint16(&ack, id)
+		ack.WriteByte(ReasonNotAuthorized)
+		ack.Write((&Properties{ReasonString: "acl"}).encode())
+		b.write(packetPuback<<4, ack.Bytes())
+	})
+
+	code, err := c.Publish(testContext(t), &Message{Topic: "t", QoS: 1})
+	var rcErr *ReasonCodeError
+	if code != ReasonNotAuthorized || !errors.As(err, &rcErr) || rcErr.Packet != "PUBACK" || rcErr.Reason != "acl" {
+		t.Errorf("Publish = 0x%02X, %v, want a not authorized PUBACK", code, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	received := make(chan *Message, 1)
+	c, b, _ := dial(t, ClientOptions{ClientID: "sub", OnMessage: func(m *Message) { received <- m }}, Properties{})
+
+	b.script(func() {
+		header, body := b.read()
+		r := bytes.NewReader(body)
+		id, _ := readUint16(r)
+		decodeProperties(r)
+		f1, _ := readString(r)
+		q1, _ := r.ReadByte()
+		f2, _ := readString(r)
+		q2, _ := r.ReadByte()
+		if header != packetSubscribe<<4|0x02 || f1 != "thms/+/data" || q1 != 1 || f2 != "$share/g/thms/#" || q2 != 2 {
+			t.Errorf("SUBSCRIBE header %08b filters %q/%d %q/%d", header, f1, q1, f2, q2)
+		}
+
+		var ack bytes.Buffer
+		writeUint16(&ack, id)
+		ack.Write((&Properties{}).encode())
+		ack.Write([]byte{ReasonGrantedQoS1, ReasonSharedSubNotSupported})
+		b.write(packetSuback<<4, ack.Bytes())
+
+		// Then deliver a QoS 1 message and expect the PUBACK
+		var pub bytes.Buffer
+		writeString(&pub, "thms/rtu1/data")
+		writeUint16(&pub, 7)
+		pub.Write((&Properties{User: []UserProperty{{"k", "v"}}}).encode())
+		pub.WriteString("hello")
+		b.write(packetPublish<<4|0x02, pub.Bytes())
+		if header, body := b.read(); header != packetPuback<<4 || !bytes.Equal(body, []byte{0, 7}) {
+			t.Errorf("got header %08b body % X, want PUBACK 7", header, body)
+		}
+	})
+
+	codes, err := c.Subscribe(testContext(t), Subscription{"thms/+/data", 1}, Subscription{"$share/g/thms/#", 2})
+	var rcErr *ReasonCodeError
+	if !errors.As(err, &rcErr) || rcErr.Code != ReasonSharedSubNotSupported {
+		t.Errorf("Subscribe error = %v, want the refused shared subscription", err)
+	}
+	if !bytes.Equal(codes, []byte{ReasonGrantedQoS1, ReasonSharedSubNotSupported}) {
+		t.Errorf("SUBACK codes = % X", codes)
+	}
+
+	select {
+	case m := <-received:
+		if m.Topic != "thms/rtu1/data" || string(m.Payload) != "hello" || m.QoS != 1 || len(m.Properties.User) != 1 {
+			t.Errorf("received %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+	}
+}
+
+// Every alias must reach the broker on a PUBLISH carrying its topic before
+// any PUBLISH that uses the alias alone, however the publishes interleave
+func TestTopicAliasesOrdered(t *testing.T) {
+	// The publishes only interleave when they run in parallel
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1", UseTopicAliases: true}, Properties{TopicAliasMaximum: Uint16(200)})
+
+	const topics, perTopic = 200, 5
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		established := make(map[uint16]string)
+		for i := 0; i < topics*perTopic; i++ {
+			_, body := b.read()
+			r := bytes.NewReader(body)
+			topic, _ := readString(r)
+			props, _ := decodeProperties(r)
+			if props.TopicAlias == nil {
+				t.Errorf("PUBLISH to %q without an alias", topic)
+				continue
+			}
+			alias := *props.TopicAlias
+			switch {
+			case topic != "":
+				established[alias] = topic
+			case established[alias] == "":
+				t.Errorf("alias %d used before a PUBLISH established it", alias)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < topics*perTopic; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("thms/rtu%d/data", i/perTopic)
+			if _, err := c.Publish(testContext(t), &Message{Topic: topic}); err != nil {
+				t.Errorf("Publish: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	<-checked
+}
+
+func TestConcurrentPings(t *testing.T) {
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1"}, Properties{})
+
+	const pings = 10
+	b.script(func() {
+		for i := 0; i < pings; i++ {
+			if header, _ := b.read(); header != packetPingreq<<4 {
+				t.Errorf("got header %08b, want PINGREQ", header)
+			}
+			b.write(packetPingresp<<4, nil)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < pings; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Ping(testContext(t)); err != nil {
+				t.Errorf("Ping: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBrokerDisconnect(t *testing.T) {
+	c, b, _ := dial(t, ClientOptions{ClientID: "rtu1"}, Properties{})
+	b.write(packetDisconnect<<4, append([]byte{ReasonSessionTakenOver}, (&Properties{}).encode()...))
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client still connected after DISCONNECT")
+	}
+	var rcErr *ReasonCodeError
+	if !errors.As(c.Err(), &rcErr) || rcErr.Code != ReasonSessionTakenOver {
+		t.Errorf("Err = %v, want session taken over", c.Err())
+	}
+}
+
+// The embedded broker speaks MQTT 3.1.1, so it refuses an MQTT 5 CONNECT
+// with the legacy return code the client reports as unsupported version
+func TestConnectToLegacyBroker(t *testing.T) {
+	b := mqttbroker.NewBroker(mqttbroker.Options{})
+	if err := b.Start(); err != nil {
+		t.Fatalf("embedded broker: %v", err)
+	}
+	defer b.Stop()
+
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	_, connack, err := Connect(testContext(t), conn, ClientOptions{ClientID: "rtu1", CleanStart: true})
+	var rcErr *ReasonCodeError
+	if !errors.As(err, &rcErr) || rcErr.Code != ReasonUnsupportedProtocolVersion {
+		t.Fatalf("Connect = %v, want unsupported protocol version", err)
+	}
+	if connack == nil || connack.ReasonCode != ReasonUnsupportedProtocolVersion {
+		t.Errorf("connack = %+v", connack)
+	}
+}
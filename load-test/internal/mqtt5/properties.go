@@ -0,0 +1,335 @@
+package mqtt5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Property identifiers defined by MQTT 5.0 section 2.2.2.2
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiry          = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthMethod             = 0x15
+	propAuthData               = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelay              = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInfo           = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQoS             = 0x24
+	propRetainAvailable        = 0x25
+	propUserProperty           = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardSubAvailable   = 0x28
+	propSubIDAvailable         = 0x29
+	propSharedSubAvailable     = 0x2A
+)
+
+// UserProperty is an application-defined key/value pair
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5 properties used by the load tester.
+// Optional numeric properties are pointers so "absent" and "zero" differ.
+type Properties struct {
+	PayloadFormat     *byte
+	MessageExpiry     *uint32
+	ContentType       string
+	ResponseTopic     string
+	SessionExpiry     *uint32
+	AssignedClientID  string
+	ServerKeepAlive   *uint16
+	WillDelay         *uint32
+	ServerReference   string
+	ReasonString      string
+	ReceiveMaximum    *uint16
+	TopicAliasMaximum *uint16
+	TopicAlias        *uint16
+	MaximumQoS        *byte
+	RetainAvailable   *byte
+	MaximumPacketSize *uint32
+	WildcardSubAvail  *byte
+	SharedSubAvail    *byte
+	User              []UserProperty
+}
+
+// Uint16 returns a pointer to v, for optional properties
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 returns a pointer to v, for optional properties
+func Uint32(v uint32) *uint32 { return &v }
+
+func (p *Properties) encode() []byte {
+	var buf bytes.Buffer
+	if p != nil {
+		if p.PayloadFormat != nil {
+			buf.WriteByte(propPayloadFormat)
+			buf.WriteByte(*p.PayloadFormat)
+		}
+		if p.MessageExpiry != nil {
+			buf.WriteByte(propMessageExpiry)
+			writeUint32(&buf, *p.MessageExpiry)
+		}
+		if p.ContentType != "" {
+			buf.WriteByte(propContentType)
+			writeString(&buf, p.ContentType)
+		}
+		if p.ResponseTopic != "" {
+			buf.WriteByte(propResponseTopic)
+			writeString(&buf, p.ResponseTopic)
+		}
+		if p.SessionExpiry != nil {
+			buf.WriteByte(propSessionExpiry)
+			writeUint32(&buf, *p.SessionExpiry)
+		}
+		if p.WillDelay != nil {
+			buf.WriteByte(propWillDelay)
+			writeUint32(&buf, *p.WillDelay)
+		}
+		if p.ReasonString != "" {
+			buf.WriteByte(propReasonString)
+			writeString(&buf, p.ReasonString)
+		}
+		if p.ReceiveMaximum != nil {
+			buf.WriteByte(propReceiveMaximum)
+			writeUint16(&buf, *p.ReceiveMaximum)
+		}
+		if p.TopicAliasMaximum != nil {
+			buf.WriteByte(propTopicAliasMaximum)
+			writeUint16(&buf, *p.TopicAliasMaximum)
+		}
+		if p.TopicAlias != nil {
+			buf.WriteByte(propTopicAlias)
+			writeUint16(&buf, *p.TopicAlias)
+		}
+		if p.MaximumPacketSize != nil {
+			buf.WriteByte(propMaximumPacketSize)
+			writeUint32(&buf, *p.MaximumPacketSize)
+		}
+		for _, u := range p.User {
+			buf.WriteByte(propUserProperty)
+			writeString(&buf, u.Key)
+			writeString(&buf, u.Value)
+		}
+	}
+
+	var out bytes.Buffer
+	writeVarInt(&out, buf.Len())
+	out.Write(buf.Bytes())
+	return out.Bytes()
+}
+
+func decodeProperties(r *bytes.Reader) (Properties, error) {
+	var p Properties
+
+	length, err := readVarInt(r)
+	if err != nil {
+		return p, err
+	}
+	if length > r.Len() {
+		return p, fmt.Errorf("property length %d exceeds packet", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return p, err
+	}
+	pr := bytes.NewReader(data)
+
+	for pr.Len() > 0 {
+		id, _ := pr.ReadByte()
+		switch id {
+		case propPayloadFormat:
+			v, err := pr.ReadByte()
+			if err != nil {
+				return p, err
+			}
+			p.PayloadFormat = &v
+		case propMessageExpiry, propSessionExpiry, propWillDelay, propMaximumPacketSize:
+			v, err := readUint32(pr)
+			if err != nil {
+				return p, err
+			}
+			switch id {
+			case propMessageExpiry:
+				p.MessageExpiry = &v
+			case propSessionExpiry:
+				p.SessionExpiry = &v
+			case propWillDelay:
+				p.WillDelay = &v
+			case propMaximumPacketSize:
+				p.MaximumPacketSize = &v
+			}
+		case propContentType, propResponseTopic, propAssignedClientID, propAuthMethod,
+			propResponseInfo, propServerReference, propReasonString:
+			v, err := readString(pr)
+			if err != nil {
+				return p, err
+			}
+			switch id {
+			case propContentType:
+				p.ContentType = v
+			case propResponseTopic:
+				p.ResponseTopic = v
+			case propAssignedClientID:
+				p.AssignedClientID = v
+			case propServerReference:
+				p.ServerReference = v
+			case propReasonString:
+				p.ReasonString = v
+			}
+		case propCorrelationData, propAuthData:
+			if _, err := readBinary(pr); err != nil {
+				return p, err
+			}
+		case propSubscriptionIdentifier:
+			if _, err := readVarInt(pr); err != nil {
+				return p, err
+			}
+		case propServerKeepAlive, propReceiveMaximum, propTopicAliasMaximum, propTopicAlias:
+			v, err := readUint16(pr)
+			if err != nil {
+				return p, err
+			}
+			switch id {
+			case propServerKeepAlive:
+				p.ServerKeepAlive = &v
+			case propReceiveMaximum:
+				p.ReceiveMaximum = &v
+			case propTopicAliasMaximum:
+				p.TopicAliasMaximum = &v
+			case propTopicAlias:
+				p.TopicAlias = &v
+			}
+		case propRequestProblemInfo, propRequestResponseInfo, propMaximumQoS, propRetainAvailable,
+			propWildcardSubAvailable, propSubIDAvailable, propSharedSubAvailable:
+			v, err := pr.ReadByte()
+			if err != nil {
+				return p, err
+			}
+			switch id {
+			case propMaximumQoS:
+				p.MaximumQoS = &v
+			case propRetainAvailable:
+				p.RetainAvailable = &v
+			case propWildcardSubAvailable:
+				p.WildcardSubAvail = &v
+			case propSharedSubAvailable:
+				p.SharedSubAvail = &v
+			}
+		case propUserProperty:
+			k, err := readString(pr)
+			if err != nil {
+				return p, err
+			}
+			v, err := readString(pr)
+			if err != nil {
+				return p, err
+			}
+			p.User = append(p.User, UserProperty{Key: k, Value: v})
+		default:
+			return p, fmt.Errorf("unknown property identifier 0x%02X", id)
+		}
+	}
+
+	return p, nil
+}
+
+// Primitive encoders and decoders
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBinary(buf, []byte(s))
+}
+
+func writeBinary(buf *bytes.Buffer, b []byte) {
+	writeUint16(buf, uint16(len(b)))
+	buf.Write(b)
+}
+
+func writeVarInt(buf *bytes.Buffer, v int) {
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		buf.WriteByte(digit)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func readUint16(r io.Reader) (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func readString(r io.Reader) (string, error) {
+	b, err := readBinary(r)
+	return string(b), err
+}
+
+func readBinary(r io.Reader) ([]byte, error) {
+	n, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readVarInt(r io.ByteReader) (int, error) {
+	var value, multiplier int
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= int(digit&0x7F) << multiplier
+		if digit&0x80 == 0 {
+			return value, nil
+		}
+		multiplier += 7
+	}
+	return 0, fmt.Errorf("malformed variable byte integer")
+}
@@ -0,0 +1,128 @@
+package mqtt5
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestVarInt(t *testing.T) {
+	for _, tc := range []struct {
+		value int
+		wire  []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xFF, 0xFF, 0x7F}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	} {
+		var buf bytes.Buffer
+		writeVarInt(&buf, tc.value)
+		if !bytes.Equal(buf.Bytes(), tc.wire) {
+			t.Errorf("writeVarInt(%d) = % X, want % X", tc.value, buf.Bytes(), tc.wire)
+		}
+		got, err := readVarInt(bytes.NewReader(tc.wire))
+		if err != nil || got != tc.value {
+			t.Errorf("readVarInt(% X) = %d, %v, want %d", tc.wire, got, err, tc.value)
+		}
+	}
+}
+
+func TestVarIntMalformed(t *testing.T) {
+	for _, wire := range [][]byte{
+		{0x80, 0x80, 0x80, 0x80, 0x01}, // five bytes
+		{0x80, 0x80},                   // truncated
+		{},
+	} {
+		if v, err := readVarInt(bytes.NewReader(wire)); err == nil {
+			t.Errorf("readVarInt(% X) = %d, want an error", wire, v)
+		}
+	}
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	format := byte(1)
+	for _, p := range []Properties{
+		{},
+		{
+			PayloadFormat:     &format,
+			MessageExpiry:     Uint32(300),
+			ContentType:       "application/json",
+			ResponseTopic:     "thms/rtu1/reply",
+			SessionExpiry:     Uint32(3600),
+			WillDelay:         Uint32(5),
+			ReasonString:      "quota exceeded",
+			ReceiveMaximum:    Uint16(20),
+			TopicAliasMaximum: Uint16(10),
+			TopicAlias:        Uint16(3),
+			MaximumPacketSize: Uint32(1 << 20),
+			User: []UserProperty{
+				{Key: "site", Value: "north"},
+				{Key: "site", Value: "south"}, // keys may repeat
+			},
+		},
+	} {
+		wire := p.encode()
+		got, err := decodeProperties(bytes.NewReader(wire))
+		if err != nil {
+			t.Fatalf("decodeProperties(% X): %v", wire, err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("round trip of %+v gave %+v", p, got)
+		}
+	}
+
+	if wire := (*Properties)(nil).encode(); !bytes.Equal(wire, []byte{0}) {
+		t.Errorf("nil properties encode to % X, want 00", wire)
+	}
+}
+
+func TestDecodeBrokerProperties(t *testing.T) {
+	// Properties only a broker sends, as they appear in a CONNACK
+	var body bytes.Buffer
+	body.Write([]byte{propServerKeepAlive, 0x00, 0x1E})
+	body.Write([]byte{propMaximumQoS, 0x01})
+	body.Write([]byte{propRetainAvailable, 0x00})
+	body.Write([]byte{propWildcardSubAvailable, 0x01})
+	body.Write([]byte{propSharedSubAvailable, 0x00})
+	body.WriteByte(propAssignedClientID)
+	writeString(&body, "auto-1")
+	body.WriteByte(propServerReference)
+	writeString(&body, "other:1883")
+	// Skipped, but must be consumed
+	body.WriteByte(propCorrelationData)
+	writeBinary(&body, []byte{1, 2})
+	body.Write([]byte{propSubscriptionIdentifier, 0x80, 0x01})
+
+	var wire bytes.Buffer
+	writeVarInt(&wire, body.Len())
+	wire.Write(body.Bytes())
+
+	p, err := decodeProperties(bytes.NewReader(wire.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeProperties: %v", err)
+	}
+	if *p.ServerKeepAlive != 30 || *p.MaximumQoS != 1 || *p.RetainAvailable != 0 ||
+		*p.WildcardSubAvail != 1 || *p.SharedSubAvail != 0 ||
+		p.AssignedClientID != "auto-1" || p.ServerReference != "other:1883" {
+		t.Errorf("decoded %+v", p)
+	}
+}
+
+func TestDecodePropertiesMalformed(t *testing.T) {
+	for name, wire := range map[string][]byte{
+		"unknown identifier":   {0x02, 0x7E, 0x00},
+		"length past packet":   {0x05, propPayloadFormat, 0x01},
+		"truncated uint32":     {0x03, propMessageExpiry, 0x00, 0x00},
+		"truncated string":     {0x04, propContentType, 0x00, 0x05, 'a'},
+		"user property no key": {0x01, propUserProperty},
+	} {
+		if _, err := decodeProperties(bytes.NewReader(wire)); err == nil {
+			t.Errorf("%s: decodeProperties(% X) succeeded, want an error", name, wire)
+		}
+	}
+}
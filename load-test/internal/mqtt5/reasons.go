@@ -0,0 +1,109 @@
+package mqtt5
+
+import "fmt"
+
+// Reason codes defined by MQTT 5.0 section 2.4
+const (
+	ReasonSuccess                     = 0x00
+	ReasonGrantedQoS1                 = 0x01
+	ReasonGrantedQoS2                 = 0x02
+	ReasonDisconnectWithWill          = 0x04
+	ReasonNoMatchingSubscribers       = 0x10
+	ReasonUnspecifiedError            = 0x80
+	ReasonMalformedPacket             = 0x81
+	ReasonProtocolError               = 0x82
+	ReasonImplementationSpecific      = 0x83
+	ReasonUnsupportedProtocolVersion  = 0x84
+	ReasonClientIDNotValid            = 0x85
+	ReasonBadUsernameOrPassword       = 0x86
+	ReasonNotAuthorized               = 0x87
+	ReasonServerUnavailable           = 0x88
+	ReasonServerBusy                  = 0x89
+	ReasonBanned                      = 0x8A
+	ReasonServerShuttingDown          = 0x8B
+	ReasonKeepAliveTimeout            = 0x8D
+	ReasonSessionTakenOver            = 0x8E
+	ReasonTopicFilterInvalid          = 0x8F
+	ReasonTopicNameInvalid            = 0x90
+	ReasonPacketIDInUse               = 0x91
+	ReasonReceiveMaximumExceeded      = 0x93
+	ReasonTopicAliasInvalid           = 0x94
+	ReasonPacketTooLarge              = 0x95
+	ReasonMessageRateTooHigh          = 0x96
+	ReasonQuotaExceeded               = 0x97
+	ReasonAdministrativeAction        = 0x98
+	ReasonPayloadFormatInvalid        = 0x99
+	ReasonRetainNotSupported          = 0x9A
+	ReasonQoSNotSupported             = 0x9B
+	ReasonUseAnotherServer            = 0x9C
+	ReasonServerMoved                 = 0x9D
+	ReasonSharedSubNotSupported       = 0x9E
+	ReasonConnectionRateExceeded      = 0x9F
+	ReasonMaximumConnectTime          = 0xA0
+	ReasonSubscriptionIDsNotSupported = 0xA1
+	ReasonWildcardSubNotSupported     = 0xA2
+)
+
+var reasonNames = map[byte]string{
+	ReasonSuccess:                     "success",
+	ReasonGrantedQoS1:                 "granted QoS 1",
+	ReasonGrantedQoS2:                 "granted QoS 2",
+	ReasonDisconnectWithWill:          "disconnect with will message",
+	ReasonNoMatchingSubscribers:       "no matching subscribers",
+	ReasonUnspecifiedError:            "unspecified error",
+	ReasonMalformedPacket:             "malformed packet",
+	ReasonProtocolError:               "protocol error",
+	ReasonImplementationSpecific:      "implementation specific error",
+	ReasonUnsupportedProtocolVersion:  "unsupported protocol version",
+	ReasonClientIDNotValid:            "client identifier not valid",
+	ReasonBadUsernameOrPassword:       "bad user name or password",
+	ReasonNotAuthorized:               "not authorized",
+	ReasonServerUnavailable:           "server unavailable",
+	ReasonServerBusy:                  "server busy",
+	ReasonBanned:                      "banned",
+	ReasonServerShuttingDown:          "server shutting down",
+	ReasonKeepAliveTimeout:            "keep alive timeout",
+	ReasonSessionTakenOver:            "session taken over",
+	ReasonTopicFilterInvalid:          "topic filter invalid",
+	ReasonTopicNameInvalid:            "topic name invalid",
+	ReasonPacketIDInUse:               "packet identifier in use",
+	ReasonReceiveMaximumExceeded:      "receive maximum exceeded",
+	ReasonTopicAliasInvalid:           "topic alias invalid",
+	ReasonPacketTooLarge:              "packet too large",
+	ReasonMessageRateTooHigh:          "message rate too high",
+	ReasonQuotaExceeded:               "quota exceeded",
+	ReasonAdministrativeAction:        "administrative action",
+	ReasonPayloadFormatInvalid:        "payload format invalid",
+	ReasonRetainNotSupported:          "retain not supported",
+	ReasonQoSNotSupported:             "QoS not supported",
+	ReasonUseAnotherServer:            "use another server",
+	ReasonServerMoved:                 "server moved",
+	ReasonSharedSubNotSupported:       "shared subscriptions not supported",
+	ReasonConnectionRateExceeded:      "connection rate exceeded",
+	ReasonMaximumConnectTime:          "maximum connect time",
+	ReasonSubscriptionIDsNotSupported: "subscription identifiers not supported",
+	ReasonWildcardSubNotSupported:     "wildcard subscriptions not supported",
+}
+
+// ReasonName returns the specification name of a reason code
+func ReasonName(code byte) string {
+	if name, ok := reasonNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason 0x%02X", code)
+}
+
+// ReasonCodeError is returned when the broker answers with a failure reason code
+type ReasonCodeError struct {
+	Packet string // packet type carrying the code, e.g. CONNACK
+	Code   byte
+	Reason string // optional reason string property sent by the broker
+}
+
+func (e *ReasonCodeError) Error() string {
+	msg := fmt.Sprintf("%s 0x%02X (%s)", e.Packet, e.Code, ReasonName(e.Code))
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
@@ -3,6 +3,7 @@ package reporter
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"text/tabwriter"
 	"time"
@@ -155,7 +156,8 @@ func (r *JSONReporter) Generate(result *Result) error {
 			P99Ms:     result.Statistics.ToLatencyMs(result.Statistics.P99),
 			P999Ms:    result.Statistics.ToLatencyMs(result.Statistics.P99_9),
 		},
-		StatusCodes: result.Statistics.StatusCodes,
+		StatusCodes:  result.Statistics.StatusCodes,
+		RequestStats: make(map[string]RequestStatData),
 	}
 
 	// Convert samples to JSON-friendly format
@@ -210,6 +212,7 @@ func (r *JSONReporter) PrintSummary(result *Result) {
 // HTMLReporter generates HTML reports with charts
 type HTMLReporter struct {
 	OutputPath string
+	Writer     io.Writer // receives the report when OutputPath is empty; nil means stdout
 }
 
 // NewHTMLReporter creates a new HTML reporter
@@ -304,7 +307,11 @@ func (r *HTMLReporter) Generate(result *Result) error {
 </html>`
 
 	if r.OutputPath == "" || r.OutputPath == "stdout" {
-		fmt.Println(html)
+		w := r.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		fmt.Fprintln(w, html)
 	} else {
 		return os.WriteFile(r.OutputPath, []byte(html), 0644)
 	}
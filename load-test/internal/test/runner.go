@@ -150,7 +150,11 @@ func (r *LocalRunner) runVirtualUser(
 			reqCfg := requestQueue[rand.Intn(len(requestQueue))]
 
 			// Create request
-			req := httpClient.NewRequest(reqCfg)
+			req, err := httpClient.NewRequest(reqCfg)
+			if err != nil {
+				collector.RecordError(req, err)
+				continue
+			}
 
 			// Execute request
 			start := time.Now()
@@ -161,14 +165,22 @@ func (r *LocalRunner) runVirtualUser(
 			if err != nil {
 				collector.RecordError(req, err)
 			} else {
-				collector.Record(metrics.Sample{
+				sample := metrics.Sample{
 					Latency:       latency,
 					StatusCode:    resp.StatusCode,
 					Success:       resp.StatusCode >= 200 && resp.StatusCode < 400,
 					RequestName:   req.Name,
 					BytesSent:     int64(len(req.Body)),
 					BytesReceived: int64(len(resp.Body)),
-				})
+				}
+				// Check the body too, e.g. a webhook answering 200 with an error
+				if sample.Success && req.Check != nil {
+					if err := req.Check(resp); err != nil {
+						sample.Success = false
+						sample.ErrorMsg = err.Error()
+					}
+				}
+				collector.Record(sample)
 			}
 
 			// Think time between requests
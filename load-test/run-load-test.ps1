@@ -99,37 +99,22 @@ if ($Custom) {
 } else {
     Write-Host "[INFO] Running $($Preset.ToUpper()) preset MQTT load test..." -ForegroundColor Cyan
 
+    # Presets are checked-in scenario files, shared with Linux CI
+    $scenario = "configs/mqtt/$Preset.yaml"
     switch ($Preset) {
-        "basic" {
-            Write-Host "       50 clients, 60s duration, 5s interval" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 50 -d 60 -i 5 -t $Topic --rtu-prefix $RtuPrefix"
-        }
-        "stress" {
-            Write-Host "       1000 clients, 300s duration, 1s interval" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 1000 -d 300 -i 1 -t $Topic --rtu-prefix $RtuPrefix"
-        }
-        "endurance" {
-            Write-Host "       100 clients, 3600s duration, 10s interval" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 100 -d 3600 -i 10 -t $Topic --rtu-prefix $RtuPrefix"
-        }
-        "spike" {
-            Write-Host "       2000 clients, 120s duration, 2s interval" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 2000 -d 120 -i 2 -t $Topic --rtu-prefix $RtuPrefix"
-        }
-        "10k" {
-            Write-Host "       10000 clients, 600s duration, 5s interval" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 10000 -d 600 -i 5 -t $Topic --rtu-prefix $RtuPrefix"
-        }
-        "realworld" {
-            Write-Host "       2000 clients, 3600s duration, 900s interval (15-min real-world simulation)" -ForegroundColor White
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 2000 -d 3600 -i 900 -t $Topic --rtu-prefix $RtuPrefix"
-        }
+        "basic"     { Write-Host "       50 clients, 60s duration, 5s interval" -ForegroundColor White }
+        "stress"    { Write-Host "       1000 clients, 300s duration, 1s interval" -ForegroundColor White }
+        "endurance" { Write-Host "       100 clients, 3600s duration, 10s interval" -ForegroundColor White }
+        "spike"     { Write-Host "       2000 clients, 120s duration, 2s interval" -ForegroundColor White }
+        "10k"       { Write-Host "       10000 clients, 600s duration, 5s interval" -ForegroundColor White }
+        "realworld" { Write-Host "       2000 clients, 3600s duration, 900s interval (15-min real-world simulation)" -ForegroundColor White }
         "syncburst" {
             Write-Host "       2000 clients, 3600s duration, 900s SYNC interval (burst at :00, :15, :30, :45)" -ForegroundColor Green
             Write-Host "       Simulates real smart meter behavior with synchronized reporting" -ForegroundColor Gray
-            $cmd = ".\mqtt-loadtest.exe -b $Broker -c 2000 -d 3600 -i 900 --sync --jitter 5 -t $Topic --rtu-prefix $RtuPrefix"
         }
     }
+    Write-Host "       Scenario: $scenario" -ForegroundColor White
+    $cmd = ".\mqtt-loadtest.exe --scenario $scenario -b $Broker"
     Write-Host ""
 
     # Add auth parameters for all presets